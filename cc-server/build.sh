@@ -2,19 +2,29 @@
 
 echo "Building C&C Server components..."
 
+# Build metadata injected into internal/version at link time
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+COMMIT=${COMMIT:-$(git rev-parse --short HEAD 2>/dev/null || echo unknown)}
+BUILD_DATE=${BUILD_DATE:-$(date -u +%Y-%m-%dT%H:%M:%SZ)}
+
+VERSION_PKG=github.com/user/cc-server/internal/version
+LDFLAGS="-X ${VERSION_PKG}.Version=${VERSION} -X ${VERSION_PKG}.Commit=${COMMIT} -X ${VERSION_PKG}.BuildDate=${BUILD_DATE}"
+
+echo "Version: ${VERSION} (commit ${COMMIT}, built ${BUILD_DATE})"
+
 # Build the server
 echo "Building server..."
-go build -o bin/cc-server cmd/server/main.go
+go build -ldflags "${LDFLAGS}" -o bin/cc-server cmd/server/main.go
 
 # Build the client
 echo "Building client..."
-go build -o bin/cc-client cmd/client/main.go
+go build -ldflags "${LDFLAGS}" -o bin/cc-client cmd/client/main.go
 
 # Build the CLI
 echo "Building CLI..."
-go build -o bin/cc-cli cmd/cli/main.go
+go build -ldflags "${LDFLAGS}" -o bin/cc-cli cmd/cli/main.go
 
 echo "Build completed. Binaries are in the bin/ directory."
 echo "To run the server: ./bin/cc-server"
 echo "To run a client: ./bin/cc-client -token YOUR_TOKEN"
-echo "To use the CLI: ./bin/cc-cli list-clients"
\ No newline at end of file
+echo "To use the CLI: ./bin/cc-cli list-clients"
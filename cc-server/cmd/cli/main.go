@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/user/cc-server/internal/cli"
@@ -14,6 +19,23 @@ var (
 	clientID   string
 	command    string
 	token      string
+	selector   string
+	rollout    cli.Rollout
+	task       string
+	reason     string
+	schedule   cli.Schedule
+	watchOpts  cli.EventFilter
+	replayed   bool
+	listOpts   cli.ListOptions
+	allPages   bool
+	exitCode   int
+	exportOpts cli.ExportOptions
+	outputFile string
+	secretRefs []string
+	stdinRef   string
+	secret     cli.Secret
+
+	operatorToken string
 )
 
 var rootCmd = &cobra.Command{
@@ -35,48 +57,432 @@ var registerCmd = &cobra.Command{
 
 var listClientsCmd = &cobra.Command{
 	Use:   "list-clients",
-	Short: "List all registered clients",
-	Long:  `List all clients registered with the C&C server.`,
+	Short: "List registered clients",
+	Long: `List the clients registered with the C&C server, a page at a time.
+Use --all to fetch every page, or --cursor to continue where a page ended.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		listClients()
 	},
 }
 
 var sendCmd = &cobra.Command{
-	Use:   "send [client_id] [command]",
+	Use:   "send [client_id] [command] | send --selector SELECTOR [command]",
 	Short: "Send a command to a client",
-	Long:  `Send a command to a specific client.`,
-	Args:  cobra.ExactArgs(2),
+	Long: `Send a command to a specific client, or with --selector to every client
+whose labels match, e.g. --selector "role=build,env!=prod".`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if selector != "" {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if selector != "" {
+			command = args[0]
+			sendJob()
+			return
+		}
 		clientID = args[0]
 		command = args[1]
 		sendCommand()
 	},
 }
 
+var labelCmd = &cobra.Command{
+	Use:   "label [client_id] [key=value | key-]...",
+	Short: "Set or remove labels of a client",
+	Long:  `Set labels with key=value and remove them with key-.`,
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		clientID = args[0]
+		setLabels(args[1:])
+	},
+}
+
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Inspect and control jobs created by send --selector",
+}
+
+var jobStatusCmd = &cobra.Command{
+	Use:   "status [job_id]",
+	Short: "Show the progress of a job",
+	Long:  `Show the progress of every batch of a job and which clients failed.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jobStatus(args[0])
+	},
+}
+
+// jobActionCmd returns the "job pause|resume|abort" subcommand
+func jobActionCmd(action, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " [job_id]",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobAction(args[0], action)
+		},
+	}
+}
+
+var approvalsCmd = &cobra.Command{
+	Use:   "approvals",
+	Short: "List commands and jobs waiting for approval",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listApprovals()
+	},
+}
+
+// decideCmd returns the "approve" or "reject" command
+func decideCmd(decision, short string) *cobra.Command {
+	c := &cobra.Command{
+		Use:   decision + " [command_or_job_id]",
+		Short: short,
+		Long:  short + `. The operator who sent it cannot decide on it.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			decideApproval(args[0], decision)
+		},
+	}
+	c.Flags().StringVar(&reason, "reason", "", "Reason recorded with the decision")
+	return c
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Work with the server command policy",
+}
+
+var policyTestCmd = &cobra.Command{
+	Use:   "test [command] --target CLIENT_ID | --selector SELECTOR",
+	Short: "Check whether the server policy allows a command",
+	Long:  `Check a command against the server policy as the calling operator, without sending it.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		testPolicy(args[0])
+	},
+}
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Manage commands the server runs on a schedule",
+}
+
+var scheduleCreateCmd = &cobra.Command{
+	Use:   "create [name] [command] --selector SELECTOR --cron EXPR | --every DURATION",
+	Short: "Run a command on every matching client on a schedule",
+	Long: `Run a command on every client matching --selector, either on a cron
+expression ("0 * * * *", "*/15 8-18 * * 1-5", "@daily") evaluated in
+--timezone, or every --every duration. Each run is delayed by a random time
+up to --jitter. With --offline skip, clients that are not connected when a run
+starts are left out instead of getting the command when they reconnect.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		schedule.Name = args[0]
+		schedule.Command = args[1]
+		createSchedule()
+	},
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List schedules",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listSchedules()
+	},
+}
+
+var scheduleShowCmd = &cobra.Command{
+	Use:   "show [schedule_id]",
+	Short: "Show a schedule and its recent runs",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showSchedule(args[0])
+	},
+}
+
+var scheduleDeleteCmd = &cobra.Command{
+	Use:   "delete [schedule_id]",
+	Short: "Delete a schedule and its run history",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteSchedule(args[0])
+	},
+}
+
+// scheduleActionCmd returns the "schedule enable|disable" subcommand
+func scheduleActionCmd(action, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " [schedule_id]",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			scheduleAction(args[0], action)
+		},
+	}
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Show a live feed of agent, command and job events",
+	Long: `Show agent connects and disconnects, status changes, command state
+changes and command output as they happen. The feed reconnects by itself
+and resumes where it left off.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		watch()
+	},
+}
+
+var rawOutputCmd = &cobra.Command{
+	Use:   "raw-output [client_id] [command_id]",
+	Short: "Show the output of a command before secrets were redacted (admins only)",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		showRawOutput(args[0], args[1])
+	},
+}
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [client_id] [command_id]",
+	Short: "Cancel a command that was not sent yet or is running on its agent",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cancelCommand(args[0], args[1])
+	},
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell [client_id]",
+	Short: "Run commands on a client interactively",
+	Long: `Open an interactive shell on a client. Every line is sent as a command,
+checked by policy and audited like any other, with the task name "shell".
+The working directory carries over from one line to the next, output is
+streamed as it comes and Ctrl-C cancels the running line.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runShell(args[0])
+	},
+}
+
+var dashboardCmd = &cobra.Command{
+	Use:   "dashboard",
+	Short: "Show a full-screen, live view of agents and commands",
+	Long: `Show the agents with their status and last seen time, and the running
+and recent commands, updated live from the event stream. Open an agent to
+browse its history and a command to read its output; cancel a command with c
+or run it again on other agents with R.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runDashboard()
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export command history as JSON Lines or CSV",
+	Long: `Export the commands created in a time range, oldest first. Commands
+whose output was pruned by the retention policy are included without it; the
+archive column names the archive file holding it.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		exportCommands()
+	},
+}
+
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage secrets commands can use by name",
+	Long: `Manage the secrets kept by the server. Commands use them with
+--secret NAME=ENV_VAR or --secret-stdin NAME; the agent gets the values in
+memory only and they are never stored with the command.`,
+}
+
+var secretsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List secrets, without their values",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listSecrets()
+	},
+}
+
+var secretsSetCmd = &cobra.Command{
+	Use:   "set [name] < value",
+	Short: "Create or replace a secret, reading its value from stdin (admins only)",
+	Long: `Create or replace a secret. The value is read from stdin so it never
+appears on the command line or in shell history, e.g.
+
+  cc-cli secrets set db_password --roles operator --selector env=prod < password.txt`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		secret.Name = args[0]
+		setSecret()
+	},
+}
+
+var secretsDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a secret (admins only)",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteSecret(args[0])
+	},
+}
+
+var webhooksCmd = &cobra.Command{
+	Use:   "webhooks",
+	Short: "Inspect webhook endpoints and failed deliveries",
+}
+
+var webhooksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the webhook endpoints configured on the server",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listWebhooks()
+	},
+}
+
+var deadLettersCmd = &cobra.Command{
+	Use:   "dead-letters",
+	Short: "List webhook deliveries that failed every attempt",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listDeadLetters()
+	},
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [dead_letter_id]",
+	Short: "Send a failed webhook delivery again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		replayDeadLetter(args[0])
+	},
+}
+
 var getCommandsCmd = &cobra.Command{
 	Use:   "get-commands [client_id]",
 	Short: "Get command history for a client",
-	Long:  `Get the command execution history for a specific client.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Get the command execution history for a specific client, newest
+first and a page at a time. Use --all to fetch every page, or --cursor to
+continue where a page ended.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		clientID = args[0]
+		if cmd.Flags().Changed("exit-code") {
+			listOpts.ExitCode = &exitCode
+		}
 		getCommands()
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&serverAddr, "server", "s", "http://localhost:8080", "Server address")
+	rootCmd.PersistentFlags().StringVar(&operatorToken, "token", os.Getenv("CC_TOKEN"), "Operator token (defaults to $CC_TOKEN)")
 	
 	registerCmd.Flags().StringVarP(&serverAddr, "server", "s", "http://localhost:8080", "Server address")
 	listClientsCmd.Flags().StringVarP(&serverAddr, "server", "s", "http://localhost:8080", "Server address")
 	sendCmd.Flags().StringVarP(&serverAddr, "server", "s", "http://localhost:8080", "Server address")
 	getCommandsCmd.Flags().StringVarP(&serverAddr, "server", "s", "http://localhost:8080", "Server address")
+	sendCmd.Flags().StringVarP(&selector, "selector", "l", "", "Send to every client whose labels match this selector")
+	sendCmd.Flags().StringVar(&task, "task", "", "Task name of the command, matched by policy rules")
+	sendCmd.Flags().IntVar(&rollout.Canary, "canary", 0, "Run on this many clients first (with --selector)")
+	sendCmd.Flags().IntVar(&rollout.BatchSize, "batch-size", 0, "Release the remaining clients in batches of this many")
+	sendCmd.Flags().IntVar(&rollout.BatchPercent, "batch-percent", 0, "Release the remaining clients in batches of this percentage of all targets")
+	sendCmd.Flags().IntVar(&rollout.FailureThreshold, "max-failures", 0, "Stop the job once this many commands failed")
+	sendCmd.Flags().IntVar(&rollout.FailurePercent, "max-failure-percent", 0, "Stop the job once this percentage of finished commands failed")
+	sendCmd.Flags().StringVar(&rollout.BatchTimeout, "batch-timeout", "", "Fail the commands of a batch still unfinished this long after its release, e.g. 30m")
+	sendCmd.Flags().StringArrayVar(&secretRefs, "secret", nil, "Pass a server secret as an environment variable, NAME=ENV_VAR (repeatable)")
+	sendCmd.Flags().StringVar(&stdinRef, "secret-stdin", "", "Pass a server secret on the command's stdin")
+
+	for _, cmd := range []*cobra.Command{listClientsCmd, getCommandsCmd} {
+		cmd.Flags().IntVar(&listOpts.Limit, "limit", 0, "Results per page (server default 100)")
+		cmd.Flags().StringVar(&listOpts.Since, "since", "", "Only results since this RFC 3339 time or duration ago, e.g. 24h")
+		cmd.Flags().StringVar(&listOpts.Until, "until", "", "Only results before this RFC 3339 time or duration ago")
+		cmd.Flags().StringSliceVar(&listOpts.Status, "status", nil, "Only results with these statuses")
+		cmd.Flags().StringVar(&listOpts.Sort, "sort", "", "Sort field, prefixed with - for descending")
+		cmd.Flags().StringVar(&listOpts.Cursor, "cursor", "", "Continue after the page that printed this cursor")
+		cmd.Flags().BoolVar(&allPages, "all", false, "Follow the cursors and fetch every page")
+	}
+	listClientsCmd.Flags().StringVarP(&listOpts.Selector, "selector", "l", "", "Only clients whose labels match this selector")
+	getCommandsCmd.Flags().StringVar(&listOpts.Command, "grep", "", "Only commands containing this text")
+	getCommandsCmd.Flags().StringVar(&listOpts.JobID, "job", "", "Only commands of this job")
+	getCommandsCmd.Flags().IntVar(&exitCode, "exit-code", 0, "Only commands that exited with this code")
 
 	rootCmd.AddCommand(registerCmd)
 	rootCmd.AddCommand(listClientsCmd)
 	rootCmd.AddCommand(sendCmd)
 	rootCmd.AddCommand(getCommandsCmd)
+	rootCmd.AddCommand(labelCmd)
+	jobCmd.AddCommand(jobStatusCmd)
+	jobCmd.AddCommand(jobActionCmd("pause", "Stop releasing further batches of a job"))
+	jobCmd.AddCommand(jobActionCmd("resume", "Continue a paused job"))
+	jobCmd.AddCommand(jobActionCmd("abort", "Stop a job and cancel its commands not sent yet"))
+	rootCmd.AddCommand(jobCmd)
+	rootCmd.AddCommand(approvalsCmd)
+	policyTestCmd.Flags().StringVar(&clientID, "target", "", "Client the command would be sent to")
+	policyTestCmd.Flags().StringVarP(&selector, "selector", "l", "", "Selector the command would be sent to")
+	policyTestCmd.Flags().StringVar(&task, "task", "", "Task name of the command")
+	policyCmd.AddCommand(policyTestCmd)
+	rootCmd.AddCommand(policyCmd)
+	scheduleCreateCmd.Flags().StringVarP(&schedule.Selector, "selector", "l", "", "Run on every client whose labels match this selector")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Cron, "cron", "", "Cron expression: minute hour day-of-month month day-of-week")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Interval, "every", "", "Run at this interval instead, e.g. 1h")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Timezone, "timezone", "", "IANA timezone of the cron expression (default UTC)")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Jitter, "jitter", "", "Delay each run by a random time up to this long, e.g. 5m")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Offline, "offline", "queue", "What to do with clients that are not connected: queue or skip")
+	scheduleCreateCmd.Flags().StringVar(&schedule.Task, "task", "", "Task name of the command, matched by policy rules")
+	scheduleCreateCmd.Flags().IntVar(&rollout.Canary, "canary", 0, "Run on this many clients first")
+	scheduleCreateCmd.Flags().IntVar(&rollout.BatchSize, "batch-size", 0, "Release the remaining clients in batches of this many")
+	scheduleCreateCmd.Flags().IntVar(&rollout.BatchPercent, "batch-percent", 0, "Release the remaining clients in batches of this percentage of all targets")
+	scheduleCreateCmd.Flags().IntVar(&rollout.FailureThreshold, "max-failures", 0, "Stop a run once this many commands failed")
+	scheduleCreateCmd.Flags().IntVar(&rollout.FailurePercent, "max-failure-percent", 0, "Stop a run once this percentage of finished commands failed")
+	scheduleCreateCmd.Flags().StringVar(&rollout.BatchTimeout, "batch-timeout", "", "Fail the commands of a batch still unfinished this long after its release, e.g. 30m")
+	scheduleCreateCmd.Flags().StringArrayVar(&secretRefs, "secret", nil, "Pass a server secret as an environment variable, NAME=ENV_VAR (repeatable)")
+	scheduleCreateCmd.Flags().StringVar(&stdinRef, "secret-stdin", "", "Pass a server secret on the command's stdin")
+	scheduleCreateCmd.MarkFlagRequired("selector")
+	scheduleCmd.AddCommand(scheduleCreateCmd)
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleShowCmd)
+	scheduleCmd.AddCommand(scheduleActionCmd("enable", "Resume a disabled schedule from now"))
+	scheduleCmd.AddCommand(scheduleActionCmd("disable", "Stop a schedule without deleting it"))
+	scheduleCmd.AddCommand(scheduleDeleteCmd)
+	rootCmd.AddCommand(scheduleCmd)
+	watchCmd.Flags().StringSliceVar(&watchOpts.Clients, "client", nil, "Only events of these clients")
+	watchCmd.Flags().StringVarP(&watchOpts.Selector, "selector", "l", "", "Only events of clients whose labels match this selector")
+	watchCmd.Flags().StringVar(&watchOpts.JobID, "job", "", "Only events of this job and its commands")
+	watchCmd.Flags().StringSliceVar(&watchOpts.Types, "type", nil, "Only these event types, e.g. command_status,command_output")
+	rootCmd.AddCommand(watchCmd)
+	deadLettersCmd.Flags().BoolVar(&replayed, "replayed", false, "List deliveries already replayed instead")
+	webhooksCmd.AddCommand(webhooksListCmd)
+	webhooksCmd.AddCommand(deadLettersCmd)
+	webhooksCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(webhooksCmd)
+	secretsSetCmd.Flags().StringSliceVar(&secret.Roles, "roles", nil, "Operator roles that may use the secret besides admins")
+	secretsSetCmd.Flags().StringVarP(&secret.Selector, "selector", "l", "", "Only send the secret to clients whose labels match this selector")
+	secretsSetCmd.Flags().StringVar(&secret.Description, "description", "", "What the secret is for")
+	secretsCmd.AddCommand(secretsListCmd)
+	secretsCmd.AddCommand(secretsSetCmd)
+	secretsCmd.AddCommand(secretsDeleteCmd)
+	rootCmd.AddCommand(secretsCmd)
+	exportCmd.Flags().StringVar(&exportOpts.Since, "since", "", "Only commands since this RFC 3339 time or duration ago, e.g. 720h")
+	exportCmd.Flags().StringVar(&exportOpts.Until, "until", "", "Only commands before this RFC 3339 time or duration ago")
+	exportCmd.Flags().StringVar(&exportOpts.ClientID, "client", "", "Only commands of this client")
+	exportCmd.Flags().StringSliceVar(&exportOpts.Status, "status", nil, "Only commands with these statuses")
+	exportCmd.Flags().StringVar(&exportOpts.Format, "format", "jsonl", "Output format: jsonl or csv")
+	exportCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write to this file instead of stdout")
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(rawOutputCmd)
+	rootCmd.AddCommand(cancelCmd)
+	rootCmd.AddCommand(shellCmd)
+	rootCmd.AddCommand(dashboardCmd)
+	rootCmd.AddCommand(decideCmd("approve", "Approve a command or job waiting for approval"))
+	rootCmd.AddCommand(decideCmd("reject", "Reject a command or job waiting for approval"))
 }
 
 func registerClient() {
@@ -87,28 +493,85 @@ func registerClient() {
 }
 
 func listClients() {
-	apiClient := cli.NewAPIClient(serverAddr)
-	clients, err := apiClient.ListClients()
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	found := 0
+	next, err := forEachPage(func(opts cli.ListOptions) (string, error) {
+		clients, next, err := apiClient.ListClientsPage(opts)
+		for _, client := range clients {
+			fmt.Printf("- ID: %s, Hostname: %s, IP: %s, Status: %s, Last Seen: %s\n",
+				client.ID, client.Hostname, client.IP, client.Status, client.LastSeen)
+			if client.NodeID != "" {
+				fmt.Printf("  Node: %s\n", client.NodeID)
+			}
+			if len(client.Labels) > 0 {
+				fmt.Printf("  Labels: %s\n", formatLabels(client.Labels))
+			}
+		}
+		found += len(clients)
+		return next, err
+	})
 	if err != nil {
 		fmt.Printf("Error fetching clients: %v\n", err)
 		os.Exit(1)
 	}
 
-	if len(clients) == 0 {
-		fmt.Println("No clients registered")
+	if found == 0 {
+		fmt.Println("No clients found")
 		return
 	}
+	printMore(next)
+}
+
+// forEachPage fetches the page listOpts asks for, and with --all every page
+// after it. It returns the cursor of the page after the last one fetched.
+func forEachPage(fetch func(cli.ListOptions) (string, error)) (string, error) {
+	opts := listOpts
+	for {
+		next, err := fetch(opts)
+		if err != nil || next == "" || !allPages {
+			return next, err
+		}
+		opts.Cursor = next
+	}
+}
+
+// printMore tells how to fetch the page after the one printed
+func printMore(next string) {
+	if next != "" {
+		fmt.Printf("More results: --cursor %s (or --all)\n", next)
+	}
+}
+
+// formatLabels renders labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-	fmt.Printf("Found %d client(s):\n", len(clients))
-	for _, client := range clients {
-		fmt.Printf("- ID: %s, Hostname: %s, IP: %s, Status: %s, Last Seen: %s\n",
-			client.ID, client.Hostname, client.IP, client.Status, client.LastSeen)
+// parseSecretRefs reads the --secret and --secret-stdin flags
+func parseSecretRefs() []cli.SecretRef {
+	var refs []cli.SecretRef
+	for _, arg := range secretRefs {
+		name, env, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || env == "" {
+			fmt.Printf("Invalid --secret %q, use NAME=ENV_VAR\n", arg)
+			os.Exit(1)
+		}
+		refs = append(refs, cli.SecretRef{Name: name, Env: env})
+	}
+	if stdinRef != "" {
+		refs = append(refs, cli.SecretRef{Name: stdinRef, Stdin: true})
 	}
+	return refs
 }
 
 func sendCommand() {
-	apiClient := cli.NewAPIClient(serverAddr)
-	cmd, err := apiClient.SendCommand(clientID, command)
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	cmd, err := apiClient.SendCommand(cli.Command{ClientID: clientID, Command: command, Task: task, Secrets: parseSecretRefs()})
 	if err != nil {
 		fmt.Printf("Error sending command: %v\n", err)
 		os.Exit(1)
@@ -118,31 +581,577 @@ func sendCommand() {
 	fmt.Printf("ID: %s\n", cmd.ID)
 	fmt.Printf("Command: %s\n", cmd.Command)
 	fmt.Printf("Status: %s\n", cmd.Status)
+	if cmd.Status == "awaiting_approval" {
+		fmt.Printf("Another operator must run: cc-cli approve %s\n", cmd.ID)
+	}
+}
+
+func sendJob() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	var r *cli.Rollout
+	if rollout != (cli.Rollout{}) {
+		r = &rollout
+	}
+	job, err := apiClient.SendJob(cli.Command{Selector: selector, Command: command, Task: task, Secrets: parseSecretRefs()}, r)
+	if err != nil {
+		fmt.Printf("Error sending command: %v\n", err)
+		os.Exit(1)
+	}
+	if job.Status == "awaiting_approval" {
+		fmt.Printf("Job %s needs approval. Another operator must run: cc-cli approve %s\n", job.ID, job.ID)
+	}
+
+	fmt.Printf("Job %s created for %d client(s) matching %s in %d batch(es):\n", job.ID, job.Targets, job.Selector, job.Batches)
+	for _, cmd := range job.Commands {
+		fmt.Printf("- Client: %s, ID: %s, Batch: %d, Status: %s\n", cmd.ClientID, cmd.ID, cmd.Batch, cmd.Status)
+	}
+}
+
+func jobStatus(jobID string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	job, err := apiClient.GetJob(jobID)
+	if err != nil {
+		fmt.Printf("Error fetching job: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Job:      %s\n", job.ID)
+	fmt.Printf("Command:  %s\n", job.Command)
+	fmt.Printf("Selector: %s\n", job.Selector)
+	fmt.Printf("Operator: %s\n", job.Operator)
+	fmt.Printf("Targets:  %d\n", job.Targets)
+	fmt.Printf("Status:   %s", job.Status)
+	if job.StopReason != "" {
+		fmt.Printf(" (%s)", job.StopReason)
+	}
+	fmt.Println()
+
+	fmt.Printf("Batches (%d of %d released):\n", job.CurrentBatch, job.Batches)
+	for _, b := range job.Progress {
+		name := fmt.Sprintf("batch %d", b.Batch)
+		if b.Canary {
+			name += " (canary)"
+		}
+		fmt.Printf("- %-18s %d total, %d completed, %d failed, %d running, %d held, %d cancelled\n",
+			name, b.Total, b.Completed, b.Failed, b.Active, b.Held, b.Cancelled)
+	}
+
+	var failed []cli.Command
+	for _, cmd := range job.Commands {
+		switch cmd.Status {
+		case "failed", "limit_exceeded", "undelivered":
+			failed = append(failed, cmd)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	fmt.Printf("Failed clients:\n")
+	for _, cmd := range failed {
+		exit := "-"
+		if cmd.ExitCode != nil {
+			exit = fmt.Sprint(*cmd.ExitCode)
+		}
+		fmt.Printf("- Client: %s, Batch: %d, Status: %s, Exit: %s", cmd.ClientID, cmd.Batch, cmd.Status, exit)
+		if cmd.Error != "" {
+			fmt.Printf(", Error: %s", cmd.Error)
+		}
+		fmt.Println()
+	}
+}
+
+func jobAction(jobID, action string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	job, err := apiClient.JobAction(jobID, action)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Job %s is now %s\n", job.ID, job.Status)
+}
+
+func testPolicy(command string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	res, err := apiClient.TestPolicy(cli.Command{ClientID: clientID, Selector: selector, Command: command, Task: task})
+	if err != nil {
+		fmt.Printf("Error testing policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Targets: %d (%s)\n", len(res.Targets), strings.Join(res.Targets, ", "))
+	switch {
+	case !res.Allowed:
+		fmt.Printf("Denied by rule %q\n", res.DeniedBy)
+		os.Exit(1)
+	case res.ApprovalRule != "":
+		fmt.Printf("Allowed after approval (rule %q)\n", res.ApprovalRule)
+	default:
+		fmt.Println("Allowed")
+	}
+}
+
+func listApprovals() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	approvals, err := apiClient.ListApprovals()
+	if err != nil {
+		fmt.Printf("Error fetching approvals: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(approvals) == 0 {
+		fmt.Println("Nothing is waiting for approval")
+		return
+	}
+	for _, a := range approvals {
+		fmt.Printf("- %s %s, Targets: %d, Rule: %s, Requested by: %s, Expires: %s\n",
+			a.Kind, a.ID, a.Targets, a.Rule, a.RequestedBy, a.ExpiresAt)
+		fmt.Printf("  Command: %s\n", a.Command)
+	}
+}
+
+func decideApproval(id, decision string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	a, err := apiClient.DecideApproval(id, decision, reason)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s %s %s by %s\n", a.Kind, a.ID, a.Status, a.DecidedBy)
+}
+
+func createSchedule() {
+	if rollout != (cli.Rollout{}) {
+		schedule.Rollout = &rollout
+	}
+	schedule.Secrets = parseSecretRefs()
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	sch, err := apiClient.CreateSchedule(schedule)
+	if err != nil {
+		fmt.Printf("Error creating schedule: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Schedule %s created, next run at %s\n", sch.ID, sch.NextRunAt)
+}
+
+// describeSchedule renders when a schedule repeats
+func describeSchedule(sch cli.Schedule) string {
+	when := "every " + sch.Interval
+	if sch.Cron != "" {
+		when = "cron " + sch.Cron
+		if sch.Timezone != "" {
+			when += " " + sch.Timezone
+		}
+	}
+	if sch.Jitter != "" {
+		when += ", jitter " + sch.Jitter
+	}
+	return when
+}
+
+func listSchedules() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	schedules, err := apiClient.ListSchedules()
+	if err != nil {
+		fmt.Printf("Error fetching schedules: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(schedules) == 0 {
+		fmt.Println("No schedules")
+		return
+	}
+	for _, sch := range schedules {
+		state := "enabled"
+		if !sch.Enabled {
+			state = "disabled"
+		}
+		fmt.Printf("- %s %s (%s), %s, Selector: %s, Next run: %s\n",
+			sch.ID, sch.Name, state, describeSchedule(sch), sch.Selector, sch.NextRunAt)
+		fmt.Printf("  Command: %s\n", sch.Command)
+	}
+}
+
+func showSchedule(id string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	sch, err := apiClient.GetSchedule(id)
+	if err != nil {
+		fmt.Printf("Error fetching schedule: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Schedule: %s (%s)\n", sch.ID, sch.Name)
+	fmt.Printf("When:     %s\n", describeSchedule(*sch))
+	fmt.Printf("Selector: %s\n", sch.Selector)
+	fmt.Printf("Command:  %s\n", sch.Command)
+	fmt.Printf("Offline:  %s\n", sch.Offline)
+	fmt.Printf("Enabled:  %t\n", sch.Enabled)
+	fmt.Printf("Operator: %s\n", sch.Operator)
+	if sch.Enabled {
+		fmt.Printf("Next run: %s\n", sch.NextRunAt)
+	}
+
+	if len(sch.Runs) == 0 {
+		fmt.Println("No runs yet")
+		return
+	}
+	fmt.Println("Recent runs:")
+	for _, run := range sch.Runs {
+		fmt.Printf("- Due: %s, Status: %s, Targets: %d, Offline: %d", run.DueAt, run.Status, run.Targets, run.Offline)
+		if run.JobID != "" {
+			fmt.Printf(", Job: %s", run.JobID)
+		}
+		if run.Detail != "" {
+			fmt.Printf(", %s", run.Detail)
+		}
+		fmt.Println()
+	}
+}
+
+func scheduleAction(id, action string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	sch, err := apiClient.ScheduleAction(id, action)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Schedule %s %sd\n", sch.ID, action)
+}
+
+func deleteSchedule(id string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	if err := apiClient.DeleteSchedule(id); err != nil {
+		fmt.Printf("Error deleting schedule: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Schedule %s deleted\n", id)
+}
+
+// watchReconnectDelay is how long watch waits before resuming a lost stream
+const watchReconnectDelay = 2 * time.Second
+
+func watch() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	var lastID string
+	connected := false
+	lineStart := make(map[string]bool) // commands whose output ended with a newline
+
+	for {
+		// A stream that opened once is retried, even if no event came
+		id, err := apiClient.WatchContext(context.Background(), watchOpts, lastID, func() { connected = true }, func(ev cli.Event) {
+			printEvent(ev, lineStart)
+		})
+		if err != nil && !connected {
+			fmt.Printf("Error opening event stream: %v\n", err)
+			os.Exit(1)
+		}
+		lastID = id
+		fmt.Fprintf(os.Stderr, "Event stream lost, reconnecting...\n")
+		time.Sleep(watchReconnectDelay)
+	}
+}
+
+// printEvent prints one event of the live feed. Command output is printed as
+// it comes, each line prefixed with the client.
+func printEvent(ev cli.Event, lineStart map[string]bool) {
+	if ev.Type == "command_output" {
+		var out struct {
+			Data string `json:"data"`
+		}
+		json.Unmarshal(ev.Data, &out)
+		start, seen := lineStart[ev.CommandID]
+		for _, line := range strings.SplitAfter(out.Data, "\n") {
+			if line == "" {
+				continue
+			}
+			if start || !seen {
+				fmt.Printf("[%s] ", ev.ClientID)
+			}
+			fmt.Print(line)
+			start, seen = strings.HasSuffix(line, "\n"), true
+		}
+		lineStart[ev.CommandID] = start
+		return
+	}
+
+	if ev.Type == "events_lost" {
+		fmt.Println("Some events were missed while reconnecting")
+		return
+	}
+
+	var data map[string]interface{}
+	json.Unmarshal(ev.Data, &data)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{ev.Timestamp.Local().Format("15:04:05"), ev.Type}
+	for _, f := range []struct{ name, value string }{
+		{"client", ev.ClientID}, {"job", ev.JobID}, {"command", ev.CommandID},
+	} {
+		if f.value != "" {
+			parts = append(parts, f.name+"="+f.value)
+		}
+	}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, data[k]))
+	}
+	fmt.Println(strings.Join(parts, " "))
+}
+
+func setLabels(args []string) {
+	changes := make(map[string]*string)
+	for _, arg := range args {
+		if k, v, ok := strings.Cut(arg, "="); ok {
+			changes[k] = &v
+			continue
+		}
+		if k, ok := strings.CutSuffix(arg, "-"); ok {
+			changes[k] = nil
+			continue
+		}
+		fmt.Printf("Invalid label %q: use key=value to set or key- to remove\n", arg)
+		os.Exit(1)
+	}
+
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	labels, err := apiClient.SetLabels(clientID, changes)
+	if err != nil {
+		fmt.Printf("Error setting labels: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Labels of %s: %s\n", clientID, formatLabels(labels))
 }
 
 func getCommands() {
-	apiClient := cli.NewAPIClient(serverAddr)
-	commands, err := apiClient.GetCommands(clientID)
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	found := 0
+	next, err := forEachPage(func(opts cli.ListOptions) (string, error) {
+		commands, next, err := apiClient.GetCommandsPage(clientID, opts)
+		for _, cmd := range commands {
+			fmt.Printf("- ID: %s, Command: %s, Status: %s, Operator: %s\n",
+				cmd.ID, cmd.Command, cmd.Status, cmd.Operator)
+			if cmd.ExitCode != nil {
+				fmt.Printf("  Exit code: %d\n", *cmd.ExitCode)
+			}
+			if cmd.Result != "" {
+				fmt.Printf("  Result: %s\n", cmd.Result)
+			}
+			if len(cmd.Secrets) > 0 {
+				names := make([]string, len(cmd.Secrets))
+				for i, ref := range cmd.Secrets {
+					names[i] = ref.Name
+				}
+				fmt.Printf("  Secrets: %s\n", strings.Join(names, ", "))
+			}
+			if len(cmd.Redactions) > 0 {
+				fmt.Printf("  Redacted: %s\n", strings.Join(cmd.Redactions, ", "))
+			}
+			if cmd.PrunedAt != "" {
+				fmt.Printf("  Output pruned %s, archived in %s\n", cmd.PrunedAt, cmd.Archive)
+			}
+		}
+		found += len(commands)
+		return next, err
+	})
 	if err != nil {
 		fmt.Printf("Error fetching commands: %v\n", err)
 		os.Exit(1)
 	}
 
-	if len(commands) == 0 {
+	if found == 0 {
 		fmt.Printf("No commands found for client %s\n", clientID)
 		return
 	}
+	printMore(next)
+}
+
+func showRawOutput(clientID, commandID string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	raw, err := apiClient.GetRawOutput(clientID, commandID)
+	if err != nil {
+		fmt.Printf("Error fetching raw output: %v\n", err)
+		os.Exit(1)
+	}
+	if raw.Error != "" {
+		fmt.Printf("Error: %s\n", raw.Error)
+	}
+	fmt.Print(raw.Result)
+}
+
+func cancelCommand(clientID, commandID string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	cmd, err := apiClient.CancelCommand(clientID, commandID)
+	if err != nil {
+		fmt.Printf("Error cancelling command: %v\n", err)
+		os.Exit(1)
+	}
+	if cmd.Status == "cancelled" {
+		fmt.Printf("Command %s cancelled\n", commandID)
+		return
+	}
+	fmt.Printf("Cancel sent to the agent running command %s\n", commandID)
+}
+
+func runShell(clientID string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	if err := cli.RunShell(apiClient, clientID); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runDashboard() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	if err := cli.RunDashboard(apiClient); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func listSecrets() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	secrets, err := apiClient.ListSecrets()
+	if err != nil {
+		fmt.Printf("Error listing secrets: %v\n", err)
+		os.Exit(1)
+	}
+	if len(secrets) == 0 {
+		fmt.Println("No secrets")
+		return
+	}
+	for _, sec := range secrets {
+		roles := "admin"
+		if len(sec.Roles) > 0 {
+			roles += "," + strings.Join(sec.Roles, ",")
+		}
+		fmt.Printf("%s (roles: %s", sec.Name, roles)
+		if sec.Selector != "" {
+			fmt.Printf(", clients: %s", sec.Selector)
+		}
+		fmt.Printf(", updated %s by %s)\n", sec.UpdatedAt, sec.UpdatedBy)
+		if sec.Description != "" {
+			fmt.Printf("  %s\n", sec.Description)
+		}
+	}
+}
+
+func setSecret() {
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Printf("Error reading secret value: %v\n", err)
+		os.Exit(1)
+	}
+	secret.Value = strings.TrimSuffix(strings.TrimSuffix(string(value), "\n"), "\r")
+	if secret.Value == "" {
+		fmt.Println("Error: pipe the secret value to stdin")
+		os.Exit(1)
+	}
+
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	sec, err := apiClient.PutSecret(secret)
+	if err != nil {
+		fmt.Printf("Error storing secret: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Secret %s stored\n", sec.Name)
+}
+
+func deleteSecret(name string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	if err := apiClient.DeleteSecret(name); err != nil {
+		fmt.Printf("Error deleting secret: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Secret %s deleted\n", name)
+}
+
+func exportCommands() {
+	if exportOpts.Format != "jsonl" && exportOpts.Format != "csv" {
+		fmt.Println("Error: --format must be jsonl or csv")
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	if err := apiClient.Export(exportOpts, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting commands: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func listWebhooks() {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	webhooks, err := apiClient.ListWebhooks()
+	if err != nil {
+		fmt.Printf("Error fetching webhooks: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(webhooks) == 0 {
+		fmt.Println("No webhooks configured")
+		return
+	}
+	for _, wh := range webhooks {
+		events := "all events"
+		if len(wh.Events) > 0 {
+			events = strings.Join(wh.Events, ", ")
+		}
+		fmt.Printf("- %s: %s (%s)\n", wh.Name, wh.URL, events)
+		if len(wh.CommandStatuses) > 0 {
+			fmt.Printf("  Command statuses: %s\n", strings.Join(wh.CommandStatuses, ", "))
+		}
+	}
+}
 
-	fmt.Printf("Found %d command(s) for client %s:\n", len(commands), clientID)
-	for _, cmd := range commands {
-		fmt.Printf("- ID: %s, Command: %s, Status: %s\n",
-			cmd.ID, cmd.Command, cmd.Status)
-		if cmd.Result != "" {
-			fmt.Printf("  Result: %s\n", cmd.Result)
+func listDeadLetters() {
+	status := "failed"
+	if replayed {
+		status = "replayed"
+	}
+
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	letters, err := apiClient.ListDeadLetters(status)
+	if err != nil {
+		fmt.Printf("Error fetching dead letters: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(letters) == 0 {
+		fmt.Printf("No %s deliveries\n", status)
+		return
+	}
+	for _, dl := range letters {
+		fmt.Printf("- %s %s to %s, %d attempt(s), Created: %s\n",
+			dl.ID, dl.EventType, dl.Endpoint, dl.Attempts, dl.CreatedAt)
+		fmt.Printf("  Error: %s\n", dl.LastError)
+		if dl.ReplayedAt != "" {
+			fmt.Printf("  Replayed by %s at %s\n", dl.ReplayedBy, dl.ReplayedAt)
 		}
 	}
 }
 
+func replayDeadLetter(id string) {
+	apiClient := cli.NewAPIClient(serverAddr, operatorToken)
+	dl, err := apiClient.ReplayDeadLetter(id)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Delivery %s queued for %s again\n", dl.ID, dl.Endpoint)
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -2,30 +2,90 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/user/cc-server/internal/client"
+	"github.com/user/cc-server/internal/version"
 )
 
 var (
-	serverAddr string
-	regToken   string
+	regToken    string
+	policyPath  string
+	showVersion bool
 )
 
 func main() {
-	flag.StringVar(&serverAddr, "server", "http://localhost:8080", "Server address to connect to")
+	// The agent re-executes itself to set up sandboxed commands
+	if len(os.Args) > 1 && os.Args[1] == client.SandboxArg {
+		client.RunSandbox(os.Args[2:])
+		return
+	}
+
+	// Local control commands for the host owner
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pause", "resume", "status", "jobs", "logs":
+			runControl(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	cfg := client.DefaultConfig()
+
+	flag.StringVar(&cfg.ServerURL, "server", cfg.ServerURL, "Server address to connect to")
+	flag.Func("label", "Label sent at registration as key=value (repeatable)", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("label must be key=value")
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		cfg.Labels[k] = v
+		return nil
+	})
+	flag.StringVar(&cfg.JournalPath, "journal", cfg.JournalPath, "File recording commands already run")
+	flag.IntVar(&cfg.JournalSize, "journal-size", cfg.JournalSize, "Number of recent commands kept in the journal")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of commands run in parallel")
+	flag.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize, "Commands waiting for a worker before new ones are refused")
+	flag.IntVar(&cfg.Limits.CPUSeconds, "limit-cpu", 0, "CPU seconds a command may use (Linux, 0 for no limit)")
+	flag.Int64Var(&cfg.Limits.AddressSpace, "limit-memory", 0, "Address space in bytes a command may use (Linux, 0 for no limit)")
+	flag.IntVar(&cfg.Limits.OpenFiles, "limit-files", 0, "Open files a command may have (Linux, 0 for no limit)")
+	flag.Int64Var(&cfg.Limits.OutputBytes, "limit-output", 0, "Output bytes a command may write before it is killed (0 for no limit)")
 	flag.StringVar(&regToken, "token", "", "Registration token")
+	flag.StringVar(&cfg.TransparencyLog, "transparency-log", cfg.TransparencyLog, "Log of every command received, readable only by the agent's user")
+	flag.StringVar(&cfg.PauseFile, "pause-file", cfg.PauseFile, "The agent refuses new work while this file exists")
+	flag.StringVar(&cfg.ControlSocket, "control-socket", cfg.ControlSocket, "Unix socket for local status and control (empty to disable)")
+	flag.StringVar(&policyPath, "policy", "", "Agent policy file choosing the user, environment and directory of commands")
+	flag.BoolVar(&showVersion, "version", false, "Print version information and exit")
 	flag.Parse()
 
+	if showVersion {
+		log.SetFlags(0)
+		log.Println(version.Get())
+		return
+	}
+
 	if regToken == "" {
 		log.Fatal("Registration token is required (-token flag)")
 	}
 
+	if policyPath != "" {
+		policy, err := client.LoadPolicy(policyPath)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		cfg.Policy = policy
+	}
+
 	// Initialize client
-	c, err := client.NewClient(serverAddr)
+	c, err := client.NewClient(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
@@ -48,4 +108,97 @@ func main() {
 	// Clean shutdown
 	c.Close()
 	log.Println("Client shutdown gracefully")
-}
\ No newline at end of file
+}
+// runControl implements "cc-client pause|resume|status|jobs|logs"
+func runControl(action string, args []string) {
+	log.SetFlags(0)
+	defaults := client.DefaultConfig()
+
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	pauseFile := fs.String("pause-file", defaults.PauseFile, "Pause file of the agent")
+	transparencyLog := fs.String("transparency-log", defaults.TransparencyLog, "Transparency log of the agent")
+	socket := fs.String("control-socket", defaults.ControlSocket, "Control socket of the running agent")
+	lines := fs.Int("n", 10, "Number of recent entries shown by status and logs")
+	kill := fs.String("kill", "", "Kill the queued or running command with this ID (jobs)")
+	fs.Parse(args)
+
+	switch action {
+	case "pause":
+		if err := client.Pause(*pauseFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Agent paused: new commands will be refused. Running commands are not interrupted.")
+	case "resume":
+		if err := client.Resume(*pauseFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Agent resumed")
+	case "status":
+		resp, err := client.QueryControl(*socket, client.ControlRequest{Action: client.ControlStatus})
+		if err != nil {
+			log.Printf("Agent: %v", err)
+		} else {
+			st := resp.Status
+			connection := "disconnected"
+			if st.Connected {
+				connection = "connected"
+			}
+			log.Printf("Agent:      %s (version %s)", st.AgentID, st.Version)
+			log.Printf("Server:     %s (%s)", st.Server, connection)
+			log.Printf("Uptime:     %s", time.Since(st.StartedAt).Round(time.Second))
+			log.Printf("Reconnects: %d", st.Reconnects)
+			log.Printf("Jobs:       %d (%d workers)", st.Jobs, st.Workers)
+		}
+
+		if paused, since := client.IsPaused(*pauseFile); paused {
+			log.Printf("State: paused since %s", since.Format(time.RFC3339))
+		} else {
+			log.Println("State: running")
+		}
+
+		entries, err := client.TailLog(*transparencyLog, *lines)
+		if err != nil {
+			log.Fatalf("Failed to read transparency log: %v", err)
+		}
+		log.Printf("Recent commands (%s):", *transparencyLog)
+		for _, e := range entries {
+			log.Println("  " + e)
+		}
+	case "jobs":
+		if *kill != "" {
+			if _, err := client.QueryControl(*socket, client.ControlRequest{Action: client.ControlKill, ID: *kill}); err != nil {
+				log.Fatalf("Failed to kill command: %v", err)
+			}
+			log.Printf("Command %s killed", *kill)
+			return
+		}
+
+		resp, err := client.QueryControl(*socket, client.ControlRequest{Action: client.ControlJobs})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(resp.Jobs) == 0 {
+			log.Println("No queued or running commands")
+			return
+		}
+		for _, j := range resp.Jobs {
+			since := j.QueuedAt
+			if j.State == "running" {
+				since = j.Started
+			}
+			state := j.State
+			if j.Killed {
+				state += " (killed)"
+			}
+			log.Printf("%s  %-16s %-8s %s  %s", j.ID, state, time.Since(since).Round(time.Second), j.Operator, j.Command)
+		}
+	case "logs":
+		resp, err := client.QueryControl(*socket, client.ControlRequest{Action: client.ControlLogs, Lines: *lines})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range resp.Events {
+			log.Printf("%s %s", e.Time.Format(time.RFC3339), e.Message)
+		}
+	}
+}
@@ -3,4 +3,11 @@
 
 INSERT INTO registration_tokens (token, created_by) VALUES 
 ('INITIAL_TOKEN_12345', 'admin'),
-('TEST_TOKEN_67890', 'test');
\ No newline at end of file
+('TEST_TOKEN_67890', 'test');
+
+-- Sample operators for testing. The tokens are DEV_ADMIN_TOKEN_CHANGE_ME and
+-- DEV_OPERATOR_TOKEN_CHANGE_ME; only their SHA-256 is stored.
+-- Generate a hash with: printf '%s' "$TOKEN" | sha256sum
+INSERT INTO operators (name, role, token_hash) VALUES
+('admin', 'admin', '7a704b1623768084799864a99ef824e9bb9280ab9e6a5d69b913bc3e4f5972d7'),
+('alice', 'operator', 'bdba457a54e199a7621362c602102ebf860a043820533df195d2f2ae38b72ff0');
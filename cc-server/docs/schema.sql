@@ -7,9 +7,26 @@ CREATE TABLE IF NOT EXISTS clients (
     ip TEXT NOT NULL,
     last_seen TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     status TEXT DEFAULT 'connected',
+    agent_version TEXT,
+    agent_protocol INTEGER,
+    os TEXT,
+    arch TEXT,
+    outdated BOOLEAN DEFAULT FALSE,
+    labels JSONB DEFAULT '{}', -- key/value labels used by command selectors
+    assigned_labels JSONB DEFAULT '{}', -- the labels set by operators, which secret selectors match
+    node_id TEXT, -- server node the agent is connected to
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Server nodes sharing this store. A node that stops updating last_seen is
+-- considered gone.
+CREATE TABLE IF NOT EXISTS nodes (
+    id TEXT PRIMARY KEY,
+    url TEXT NOT NULL, -- where other nodes reach it
+    started_at TIMESTAMP WITH TIME ZONE,
+    last_seen TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Registration tokens table for initial client registration
 CREATE TABLE IF NOT EXISTS registration_tokens (
     id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
@@ -20,29 +37,181 @@ CREATE TABLE IF NOT EXISTS registration_tokens (
     is_used BOOLEAN DEFAULT FALSE
 );
 
+-- Jobs group the commands created for every client matching a selector
+CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY,
+    command TEXT NOT NULL, -- starts with enc1: when encrypted, like commands.command
+    selector TEXT NOT NULL,
+    operator TEXT,
+    targets INTEGER NOT NULL DEFAULT 0,
+    status TEXT DEFAULT 'running', -- awaiting_approval, running, paused, completed, failed, aborted, rejected, expired
+    stop_reason TEXT,
+    rollout JSONB, -- canary, batch size and failure thresholds
+    batches INTEGER NOT NULL DEFAULT 1,
+    current_batch INTEGER NOT NULL DEFAULT 1,
+    batch_started_at TIMESTAMP WITH TIME ZONE, -- when the current batch was released
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
 -- Commands table to store commands sent to clients
 CREATE TABLE IF NOT EXISTS commands (
     id TEXT PRIMARY KEY,
     client_id TEXT REFERENCES clients(id),
-    command TEXT NOT NULL,
-    status TEXT DEFAULT 'pending', -- pending, executing, completed, failed
+    job_id TEXT REFERENCES jobs(id), -- parent job of commands sent to a selector
+    batch INTEGER, -- rollout batch within the job
+    command TEXT NOT NULL, -- command, result and error start with enc1: when encrypted (-master-key-file)
+    task TEXT, -- optional task name matched by policy rules
+    cwd TEXT, -- directory a shell line runs in
+    operator TEXT, -- operator who sent the command
+    concurrency TEXT DEFAULT 'parallel', -- parallel, serial
+    serial_key TEXT,
+    status TEXT DEFAULT 'pending', -- awaiting_approval, held, pending, delivered, queued, received, completed, failed, limit_exceeded, undelivered, cancelled
     result TEXT,
     error TEXT,
+    limits JSONB, -- optional per-command resource limits
+    limit_exceeded TEXT, -- name of the limit that stopped the command
+    exit_code INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+    pruned_at TIMESTAMP WITH TIME ZONE, -- result moved to the archive file by retention
+    archive TEXT,
+    redactions JSONB, -- names of the rules that removed secrets from the result
+    raw_output TEXT, -- encrypted result before redaction, readable by admins
+    secrets JSONB -- names of the secrets passed to the command; never their values
+);
+
+-- Operators allowed to use the management API. Only the SHA-256 of each
+-- token is stored.
+CREATE TABLE IF NOT EXISTS operators (
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    role TEXT NOT NULL DEFAULT 'operator', -- admin, operator, viewer
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Approvals of commands and jobs matching an approval rule. The id is the
+-- id of the command or job waiting for the decision.
+CREATE TABLE IF NOT EXISTS approvals (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL, -- command, job
+    command TEXT NOT NULL, -- starts with enc1: when encrypted
+    targets INTEGER NOT NULL DEFAULT 1,
+    rule TEXT NOT NULL, -- approval rule that matched
+    requested_by TEXT NOT NULL,
+    status TEXT DEFAULT 'pending', -- pending, approved, rejected, expired
+    decided_by TEXT,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    decided_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Recurring commands sent to the clients matching a selector
+CREATE TABLE IF NOT EXISTS schedules (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    cron TEXT, -- five-field cron expression, or
+    interval TEXT, -- a duration such as 1h
+    timezone TEXT,
+    jitter TEXT, -- each run is delayed by up to this long
+    selector TEXT NOT NULL,
+    command TEXT NOT NULL, -- starts with enc1: when encrypted
+    task TEXT,
+    concurrency TEXT,
+    rollout JSONB,
+    secrets JSONB, -- names of the secrets passed to every run
+    offline TEXT DEFAULT 'queue', -- queue, skip
+    enabled BOOLEAN DEFAULT TRUE,
+    operator TEXT, -- operator who created the schedule
+    role TEXT, -- their role, checked against deny rules on every run
+    next_due_at TIMESTAMP WITH TIME ZONE,
+    next_run_at TIMESTAMP WITH TIME ZONE, -- next_due_at plus jitter
+    last_run_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Every time a schedule was due and what came of it
+CREATE TABLE IF NOT EXISTS schedule_runs (
+    id TEXT PRIMARY KEY,
+    schedule_id TEXT REFERENCES schedules(id) ON DELETE CASCADE,
+    due_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    status TEXT NOT NULL, -- started, skipped, denied, failed
+    job_id TEXT REFERENCES jobs(id),
+    targets INTEGER NOT NULL DEFAULT 0,
+    offline INTEGER NOT NULL DEFAULT 0, -- clients left out because they were not connected
+    detail TEXT
+);
+
+-- Webhook deliveries that failed every attempt; can be replayed
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id TEXT PRIMARY KEY,
+    endpoint TEXT NOT NULL, -- name of the endpoint in the webhook config
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL, -- the event, or a JSON string starting with enc1: when encrypted
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    status TEXT NOT NULL DEFAULT 'failed', -- failed, replayed
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    completed_at TIMESTAMP WITH TIME ZONE
+    replayed_at TIMESTAMP WITH TIME ZONE,
+    replayed_by TEXT
+);
+
+-- Secrets commands can use by name. Values are encrypted with the master
+-- key (-master-key-file) and only sent to agents.
+CREATE TABLE IF NOT EXISTS secrets (
+    name TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    description TEXT,
+    roles JSONB DEFAULT '[]', -- operator roles that may use it besides admins
+    selector TEXT, -- label selector of the clients it may be sent to
+    updated_by TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Audit trail of security relevant events
+CREATE TABLE IF NOT EXISTS audit_events (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    actor TEXT,
+    client_id TEXT,
+    ip TEXT,
+    detail TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
 -- Indexes for better performance
 CREATE INDEX IF NOT EXISTS idx_clients_status ON clients(status);
 CREATE INDEX IF NOT EXISTS idx_clients_last_seen ON clients(last_seen);
+CREATE INDEX IF NOT EXISTS idx_clients_node_id ON clients(node_id);
 CREATE INDEX IF NOT EXISTS idx_commands_client_id ON commands(client_id);
+CREATE INDEX IF NOT EXISTS idx_commands_job_id ON commands(job_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
 CREATE INDEX IF NOT EXISTS idx_commands_status ON commands(status);
 CREATE INDEX IF NOT EXISTS idx_commands_created_at ON commands(created_at);
+CREATE INDEX IF NOT EXISTS idx_commands_unpruned ON commands(client_id, created_at) WHERE pruned_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_approvals_status ON approvals(status);
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run_at ON schedules(next_run_at) WHERE enabled;
+CREATE INDEX IF NOT EXISTS idx_schedule_runs_schedule_id ON schedule_runs(schedule_id, due_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_status ON webhook_dead_letters(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_type ON audit_events(type);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
 
 -- RLS (Row Level Security) policies - adjust as needed for your security model
 ALTER TABLE clients ENABLE ROW LEVEL SECURITY;
 ALTER TABLE commands ENABLE ROW LEVEL SECURITY;
 ALTER TABLE registration_tokens ENABLE ROW LEVEL SECURITY;
+ALTER TABLE audit_events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE operators ENABLE ROW LEVEL SECURITY;
+ALTER TABLE jobs ENABLE ROW LEVEL SECURITY;
+ALTER TABLE approvals ENABLE ROW LEVEL SECURITY;
+ALTER TABLE schedules ENABLE ROW LEVEL SECURITY;
+ALTER TABLE schedule_runs ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_dead_letters ENABLE ROW LEVEL SECURITY;
+ALTER TABLE nodes ENABLE ROW LEVEL SECURITY;
+ALTER TABLE secrets ENABLE ROW LEVEL SECURITY;
 
 -- Example policies (you may need to adjust based on your auth model)
 -- For now, we're setting permissive policies for testing
@@ -53,4 +222,31 @@ CREATE POLICY "Allow all operations for authenticated users" ON commands
     FOR ALL USING (true);
 
 CREATE POLICY "Allow all operations for authenticated users" ON registration_tokens
-    FOR ALL USING (true);
\ No newline at end of file
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON audit_events
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON operators
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON jobs
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON approvals
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON schedules
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON schedule_runs
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON webhook_dead_letters
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON nodes
+    FOR ALL USING (true);
+
+CREATE POLICY "Allow all operations for authenticated users" ON secrets
+    FOR ALL USING (true);
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 type APIClient struct {
 	BaseURL string
+	Token   string
 	Client  *http.Client
 }
 
@@ -19,100 +23,853 @@ type ClientInfo struct {
 	IP       string `json:"ip"`
 	LastSeen string `json:"last_seen"`
 	Status   string `json:"status"`
+	NodeID   string `json:"node_id,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Command struct {
-	ID      string `json:"id"`
-	Command string `json:"command"`
-	Status  string `json:"status"`
-	Result  string `json:"result,omitempty"`
+	ID       string `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+	Batch    int    `json:"batch,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	Command  string `json:"command"`
+	Task     string `json:"task,omitempty"`
+	Cwd      string `json:"cwd,omitempty"` // directory a shell line runs in
+	Operator string `json:"operator,omitempty"`
+	Status   string `json:"status"`
+
+	Concurrency string `json:"concurrency,omitempty"` // parallel (default) or serial
+	SerialKey   string `json:"serial_key,omitempty"`  // serial commands sharing a key never overlap
+
+	// Resources the command may use on the agent
+	Limits *ResourceLimits `json:"limits,omitempty"`
+
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+
+	CreatedAt   string `json:"created_at,omitempty"`
+	CompletedAt string `json:"completed_at,omitempty"`
+
+	// Set once retention moved the result to an archive file
+	PrunedAt string `json:"pruned_at,omitempty"`
+	Archive  string `json:"archive,omitempty"`
+
+	// Rules that removed secrets from the result
+	Redactions []string `json:"redactions,omitempty"`
+
+	// Server-managed secrets the agent passes to the command
+	Secrets []SecretRef `json:"secrets,omitempty"`
 }
 
-func NewAPIClient(baseURL string) *APIClient {
+// ResourceLimits bound what a single command may use. Zero means no limit.
+type ResourceLimits struct {
+	CPUSeconds   int   `json:"cpu_seconds,omitempty"`
+	AddressSpace int64 `json:"address_space_bytes,omitempty"`
+	OpenFiles    int   `json:"open_files,omitempty"`
+	OutputBytes  int64 `json:"output_bytes,omitempty"`
+}
+
+// SecretRef passes a server-managed secret to a command as the environment
+// variable Env, or on its standard input
+type SecretRef struct {
+	Name  string `json:"name"`
+	Env   string `json:"env,omitempty"`
+	Stdin bool   `json:"stdin,omitempty"`
+}
+
+// Rollout releases the commands of a job in batches
+type Rollout struct {
+	Canary           int    `json:"canary,omitempty"`
+	BatchSize        int    `json:"batch_size,omitempty"`
+	BatchPercent     int    `json:"batch_percent,omitempty"`
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+	FailurePercent   int    `json:"failure_percent,omitempty"`
+	BatchTimeout     string `json:"batch_timeout,omitempty"`
+}
+
+// BatchProgress counts the commands of one batch of a job by state
+type BatchProgress struct {
+	Batch     int  `json:"batch"`
+	Canary    bool `json:"canary,omitempty"`
+	Total     int  `json:"total"`
+	Held      int  `json:"held"`
+	Active    int  `json:"active"`
+	Completed int  `json:"completed"`
+	Failed    int  `json:"failed"`
+	Cancelled int  `json:"cancelled"`
+}
+
+// Job groups the commands sent to every client matching a selector
+type Job struct {
+	ID           string          `json:"id"`
+	Command      string          `json:"command"`
+	Selector     string          `json:"selector"`
+	Operator     string          `json:"operator,omitempty"`
+	Targets      int             `json:"targets"`
+	Status       string          `json:"status"`
+	StopReason   string          `json:"stop_reason,omitempty"`
+	CreatedAt    string          `json:"created_at"`
+	Rollout      *Rollout        `json:"rollout,omitempty"`
+	Batches      int             `json:"batches"`
+	CurrentBatch int             `json:"current_batch"`
+	Commands     []Command       `json:"commands,omitempty"`
+	Progress     []BatchProgress `json:"progress,omitempty"`
+}
+
+func NewAPIClient(baseURL, token string) *APIClient {
 	return &APIClient{
 		BaseURL: baseURL,
+		Token:   token,
 		Client:  &http.Client{},
 	}
 }
 
-func (c *APIClient) ListClients() ([]ClientInfo, error) {
-	resp, err := c.Client.Get(c.BaseURL + "/clients")
+// do sends an authenticated request to the server
+func (c *APIClient) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
 	if err != nil {
 		return nil, err
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.Client.Do(req)
+}
+
+// maxPageSize is the largest page the server hands out
+const maxPageSize = 1000
+
+// ListOptions pages, filters and sorts list requests. Zero fields are left
+// out. Times are RFC 3339 or a duration before now, such as 24h.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string // a field name, "-" prefixed for descending
+	Fields []string
+	Since  string
+	Until  string
+	Status []string
+
+	// Clients only
+	Selector string
+
+	// Commands only
+	Command  string // case-insensitive substring
+	JobID    string
+	ExitCode *int
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	set("cursor", o.Cursor)
+	set("sort", o.Sort)
+	set("fields", strings.Join(o.Fields, ","))
+	set("since", o.Since)
+	set("until", o.Until)
+	set("status", strings.Join(o.Status, ","))
+	set("selector", o.Selector)
+	set("command", o.Command)
+	set("job", o.JobID)
+	if o.ExitCode != nil {
+		q.Set("exit_code", strconv.Itoa(*o.ExitCode))
+	}
+	return q
+}
+
+// getPage fetches one page of a list endpoint into out and returns the
+// cursor of the next page
+func (c *APIClient) getPage(path string, opts ListOptions, out interface{}) (string, error) {
+	if q := opts.query().Encode(); q != "" {
+		path += "?" + q
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error: %d", resp.StatusCode)
+		return "", apiError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// apiError turns an unsuccessful response into an error, including the
+// server's error message when there is one
+func apiError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
 	}
+	data, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return fmt.Errorf("API error: %d: %s", resp.StatusCode, body.Error)
+	}
+	return fmt.Errorf("API error: %d", resp.StatusCode)
+}
+
+// ListClients returns every registered client, following the page cursors
+func (c *APIClient) ListClients() ([]ClientInfo, error) {
+	var all []ClientInfo
+	opts := ListOptions{Limit: maxPageSize}
+	for {
+		clients, next, err := c.ListClientsPage(opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, clients...)
+		if next == "" {
+			return all, nil
+		}
+		opts.Cursor = next
+	}
+}
 
+// ListClientsPage returns one page of clients and the cursor of the next
+// page, which is empty on the last one
+func (c *APIClient) ListClientsPage(opts ListOptions) ([]ClientInfo, string, error) {
 	var clients []ClientInfo
+	next, err := c.getPage("/clients", opts, &clients)
+	return clients, next, err
+}
+
+// SendCommand sends a command to the client named in cmd. Commands that
+// need approval come back with status awaiting_approval.
+func (c *APIClient) SendCommand(cmd Command) (*Command, error) {
+	jsonData, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("POST", "/command", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, apiError(resp)
+	}
+
+	var sentCmd Command
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(body, &clients); err != nil {
+	if err := json.Unmarshal(body, &sentCmd); err != nil {
 		return nil, err
 	}
 
-	return clients, nil
+	return &sentCmd, nil
 }
 
-func (c *APIClient) SendCommand(clientID, command string) (*Command, error) {
-	cmd := Command{
-		ClientID: clientID,
-		Command:  command,
+// SendJob sends a command to every client matching the selector of cmd. A
+// non-nil rollout releases the commands in batches.
+func (c *APIClient) SendJob(cmd Command, rollout *Rollout) (*Job, error) {
+	jsonData, err := json.Marshal(struct {
+		Command
+		Rollout *Rollout `json:"rollout,omitempty"`
+	}{cmd, rollout})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("POST", "/command", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, apiError(resp)
 	}
 
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJob returns a job and the state of its child commands
+func (c *APIClient) GetJob(jobID string) (*Job, error) {
+	resp, err := c.do("GET", "/jobs/"+jobID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// JobAction pauses, resumes or aborts a job
+func (c *APIClient) JobAction(jobID, action string) (*Job, error) {
+	resp, err := c.do("POST", "/jobs/"+jobID+"/"+action, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Approval is a request for a second operator to allow a command or job
+type Approval struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Command     string `json:"command"`
+	Targets     int    `json:"targets"`
+	Rule        string `json:"rule"`
+	RequestedBy string `json:"requested_by"`
+	Status      string `json:"status"`
+	DecidedBy   string `json:"decided_by,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+// ListApprovals returns the commands and jobs waiting for approval
+func (c *APIClient) ListApprovals() ([]Approval, error) {
+	resp, err := c.do("GET", "/approvals", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var approvals []Approval
+	if err := json.NewDecoder(resp.Body).Decode(&approvals); err != nil {
+		return nil, err
+	}
+	return approvals, nil
+}
+
+// DecideApproval approves or rejects the command or job with the given ID
+func (c *APIClient) DecideApproval(id, decision, reason string) (*Approval, error) {
+	jsonData, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("POST", "/approvals/"+id+"/"+decision, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var a Approval
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// PolicyTestResult reports what the server policy would do with a command
+type PolicyTestResult struct {
+	Targets      []string `json:"targets"`
+	Allowed      bool     `json:"allowed"`
+	DeniedBy     string   `json:"denied_by,omitempty"`
+	ApprovalRule string   `json:"approval_rule,omitempty"`
+}
+
+// TestPolicy checks cmd against the server policy without sending it
+func (c *APIClient) TestPolicy(cmd Command) (*PolicyTestResult, error) {
 	jsonData, err := json.Marshal(cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.Client.Post(c.BaseURL+"/command", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := c.do("POST", "/policy/test", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error: %d", resp.StatusCode)
+		return nil, apiError(resp)
 	}
 
-	var sentCmd Command
-	body, err := io.ReadAll(resp.Body)
+	var res PolicyTestResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SetLabels changes the labels of a client. A nil value removes the label.
+func (c *APIClient) SetLabels(clientID string, changes map[string]*string) (map[string]string, error) {
+	jsonData, err := json.Marshal(changes)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(body, &sentCmd); err != nil {
+	resp, err := c.do("PATCH", "/clients/"+clientID+"/labels", bytes.NewBuffer(jsonData))
+	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return &sentCmd, nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var body struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Labels, nil
 }
 
-func (c *APIClient) GetCommands(clientID string) ([]Command, error) {
-	resp, err := c.Client.Get(c.BaseURL + "/commands/" + clientID)
+// Schedule sends a command to the clients matching a selector on a cron
+// expression or interval
+type Schedule struct {
+	ID          string        `json:"id,omitempty"`
+	Name        string        `json:"name"`
+	Cron        string        `json:"cron,omitempty"`
+	Interval    string        `json:"interval,omitempty"`
+	Timezone    string        `json:"timezone,omitempty"`
+	Jitter      string        `json:"jitter,omitempty"`
+	Selector    string        `json:"selector"`
+	Command     string        `json:"command"`
+	Task        string        `json:"task,omitempty"`
+	Concurrency string        `json:"concurrency,omitempty"`
+	Rollout     *Rollout      `json:"rollout,omitempty"`
+	Secrets     []SecretRef   `json:"secrets,omitempty"`
+	Offline     string        `json:"offline,omitempty"`
+	Enabled     bool          `json:"enabled"`
+	Operator    string        `json:"operator,omitempty"`
+	NextRunAt   string        `json:"next_run_at,omitempty"`
+	LastRunAt   string        `json:"last_run_at,omitempty"`
+	Runs        []ScheduleRun `json:"runs,omitempty"`
+}
+
+// ScheduleRun records one time a schedule was due
+type ScheduleRun struct {
+	ID        string `json:"id"`
+	DueAt     string `json:"due_at"`
+	StartedAt string `json:"started_at"`
+	Status    string `json:"status"`
+	JobID     string `json:"job_id,omitempty"`
+	Targets   int    `json:"targets"`
+	Offline   int    `json:"offline"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// CreateSchedule stores a new schedule on the server
+func (c *APIClient) CreateSchedule(sch Schedule) (*Schedule, error) {
+	jsonData, err := json.Marshal(sch)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("POST", "/schedules", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, apiError(resp)
+	}
+
+	var created Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListSchedules returns every schedule
+func (c *APIClient) ListSchedules() ([]Schedule, error) {
+	resp, err := c.do("GET", "/schedules", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var schedules []Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// GetSchedule returns a schedule with its most recent runs
+func (c *APIClient) GetSchedule(id string) (*Schedule, error) {
+	resp, err := c.do("GET", "/schedules/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var sch Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&sch); err != nil {
+		return nil, err
+	}
+	return &sch, nil
+}
+
+// ScheduleAction enables or disables a schedule
+func (c *APIClient) ScheduleAction(id, action string) (*Schedule, error) {
+	resp, err := c.do("POST", "/schedules/"+id+"/"+action, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error: %d", resp.StatusCode)
+		return nil, apiError(resp)
 	}
 
+	var sch Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&sch); err != nil {
+		return nil, err
+	}
+	return &sch, nil
+}
+
+// DeleteSchedule removes a schedule and its run history
+func (c *APIClient) DeleteSchedule(id string) error {
+	resp, err := c.do("DELETE", "/schedules/"+id, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return nil
+}
+
+// GetCommands returns the whole command history of a client
+func (c *APIClient) GetCommands(clientID string) ([]Command, error) {
+	var all []Command
+	opts := ListOptions{Limit: maxPageSize}
+	for {
+		commands, next, err := c.GetCommandsPage(clientID, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, commands...)
+		if next == "" {
+			return all, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// GetCommandsPage returns one page of a client's commands, newest first
+// unless opts.Sort says otherwise, and the cursor of the next page
+func (c *APIClient) GetCommandsPage(clientID string, opts ListOptions) ([]Command, string, error) {
 	var commands []Command
-	body, err := io.ReadAll(resp.Body)
+	next, err := c.getPage("/commands/"+clientID, opts, &commands)
+	return commands, next, err
+}
+
+// GetCommand returns one command of a client with the given fields (all
+// when empty)
+func (c *APIClient) GetCommand(clientID, commandID string, fields []string) (*Command, error) {
+	path := "/commands/" + clientID + "/" + commandID
+	if len(fields) > 0 {
+		path += "?" + url.Values{"fields": {strings.Join(fields, ",")}}.Encode()
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var cmd Command
+	if err := json.NewDecoder(resp.Body).Decode(&cmd); err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// Webhook is an endpoint the server posts live events to
+type Webhook struct {
+	Name            string   `json:"name"`
+	URL             string   `json:"url"`
+	Events          []string `json:"events,omitempty"`
+	CommandStatuses []string `json:"command_statuses,omitempty"`
+}
+
+// DeadLetter is a webhook delivery that failed every attempt
+type DeadLetter struct {
+	ID         string          `json:"id"`
+	Endpoint   string          `json:"endpoint"`
+	EventType  string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	Status     string          `json:"status"`
+	CreatedAt  string          `json:"created_at"`
+	ReplayedAt string          `json:"replayed_at,omitempty"`
+	ReplayedBy string          `json:"replayed_by,omitempty"`
+}
+
+// ListWebhooks returns the webhook endpoints configured on the server
+func (c *APIClient) ListWebhooks() ([]Webhook, error) {
+	resp, err := c.do("GET", "/webhooks", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var webhooks []Webhook
+	if err := json.NewDecoder(resp.Body).Decode(&webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// ListDeadLetters returns the failed webhook deliveries with the given
+// status, "failed" or "replayed"
+func (c *APIClient) ListDeadLetters(status string) ([]DeadLetter, error) {
+	resp, err := c.do("GET", "/webhooks/dead-letters?status="+url.QueryEscape(status), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var letters []DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetter sends a failed webhook delivery again
+func (c *APIClient) ReplayDeadLetter(id string) (*DeadLetter, error) {
+	resp, err := c.do("POST", "/webhooks/dead-letters/"+id+"/replay", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var dl DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// ExportOptions selects the commands to export. Times are RFC 3339 or a
+// duration before now, such as 24h.
+type ExportOptions struct {
+	Since    string
+	Until    string
+	ClientID string
+	Status   []string
+	Format   string // jsonl or csv
+}
+
+// Export streams the selected commands, oldest first, to w
+func (c *APIClient) Export(opts ExportOptions, w io.Writer) error {
+	q := url.Values{}
+	for key, value := range map[string]string{
+		"since":  opts.Since,
+		"until":  opts.Until,
+		"client": opts.ClientID,
+		"status": strings.Join(opts.Status, ","),
+		"format": opts.Format,
+	} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+
+	resp, err := c.do("GET", "/export/commands?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// RawOutput is the output of a command before redaction
+type RawOutput struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// GetRawOutput returns the output of a command before secrets were
+// redacted. Only admins may read it.
+func (c *APIClient) GetRawOutput(clientID, commandID string) (*RawOutput, error) {
+	resp, err := c.do("GET", "/commands/"+clientID+"/"+commandID+"/raw", nil)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if err := json.Unmarshal(body, &commands); err != nil {
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var raw RawOutput
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+// CancelCommand stops a command. One not sent yet comes back cancelled; for
+// one already on its agent the status is unchanged until the agent reports.
+func (c *APIClient) CancelCommand(clientID, commandID string) (*Command, error) {
+	resp, err := c.do("POST", "/commands/"+clientID+"/"+commandID+"/cancel", nil)
+	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, apiError(resp)
+	}
 
-	return commands, nil
-}
\ No newline at end of file
+	var cmd Command
+	if err := json.NewDecoder(resp.Body).Decode(&cmd); err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// Secret is a value kept by the server for commands to use. Value is only
+// sent, never returned.
+type Secret struct {
+	Name        string   `json:"name"`
+	Value       string   `json:"value,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Selector    string   `json:"selector,omitempty"`
+	UpdatedBy   string   `json:"updated_by,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+}
+
+// ListSecrets returns the secrets on the server, without their values
+func (c *APIClient) ListSecrets() ([]Secret, error) {
+	resp, err := c.do("GET", "/secrets", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var secrets []Secret
+	if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// PutSecret creates or replaces a secret
+func (c *APIClient) PutSecret(sec Secret) (*Secret, error) {
+	jsonData, err := json.Marshal(sec)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("PUT", "/secrets/"+url.PathEscape(sec.Name), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var stored Secret
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// DeleteSecret removes a secret
+func (c *APIClient) DeleteSecret(name string) error {
+	resp, err := c.do("DELETE", "/secrets/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,1102 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Dashboard refresh intervals
+const (
+	dashTick           = time.Second      // redraw for ages, fetch missing details
+	dashAgentsInterval = 10 * time.Second // reload the agent list
+)
+
+// Dashboard limits
+const (
+	dashMaxCommands  = 500       // commands kept in the recent list
+	dashMaxOutput    = 256 << 10 // live output kept per command
+	dashSeedPerAgent = 10        // recent commands fetched per connected agent on start
+)
+
+// dashListFields are the command fields shown in lists; results are only
+// fetched for the command being looked at
+var dashListFields = []string{"id", "client_id", "job_id", "command", "task", "operator", "status", "error",
+	"exit_code", "created_at", "completed_at", "secrets", "limits", "concurrency", "serial_key"}
+
+// Dashboard views
+const (
+	viewFleet = iota
+	viewAgent
+	viewOutput
+)
+
+// dashCommand is a command known to the dashboard
+type dashCommand struct {
+	Command
+	created time.Time
+	loaded  bool // Result holds the stored output
+}
+
+// dashPrompt asks for a line, or a single key when single is set, at the
+// bottom of the screen
+type dashPrompt struct {
+	label  string
+	text   []rune
+	single bool
+	done   func(string)
+}
+
+// dashboard is a full-screen view of the fleet. It only uses the REST and
+// event stream APIs, with the operator's token. All state is owned by the
+// goroutine running loop; background requests hand their results back as
+// functions on updates.
+type dashboard struct {
+	api *APIClient
+	out io.Writer
+	fd  int
+
+	width, height int
+
+	agents   []ClientInfo
+	commands map[string]*dashCommand
+	recent   []string          // command IDs, newest first
+	output   map[string]string // output streamed by running commands
+	missing  map[string]string // command ID to client ID of commands seen only in events
+	history  []string          // command IDs of the agent view, newest first
+
+	view        int
+	focus       int // fleet view: 0 agents, 1 commands
+	agentSel    int
+	cmdSel      int
+	histSel     int
+	scroll      int
+	agentID     string // agent view
+	cmdID       string // output view
+	back        int    // view the output view returns to
+	runningOnly bool
+
+	message string
+	prompt  *dashPrompt
+	live    bool // the event stream is open
+
+	updates chan func()
+	events  chan Event
+}
+
+// RunDashboard shows the dashboard until the operator quits
+func RunDashboard(api *APIClient) error {
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return errors.New("the dashboard needs a terminal")
+	}
+	defer restore()
+
+	d := &dashboard{
+		api:      api,
+		out:      os.Stdout,
+		fd:       int(os.Stdout.Fd()),
+		commands: make(map[string]*dashCommand),
+		output:   make(map[string]string),
+		missing:  make(map[string]string),
+		updates:  make(chan func(), 64),
+		events:   make(chan Event, 1024),
+	}
+
+	// Alternate screen, hidden cursor
+	fmt.Fprint(d.out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go d.stream(ctx)
+
+	keys := make(chan string)
+	go readKeys(bufio.NewReader(os.Stdin), keys)
+
+	d.loadAgents(true)
+	return d.loop(keys)
+}
+
+// loop handles keys, events and background results until the operator quits
+func (d *dashboard) loop(keys chan string) error {
+	tick := time.NewTicker(dashTick)
+	defer tick.Stop()
+	lastAgents := time.Now()
+
+	for {
+		d.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok || d.key(key) {
+				return nil
+			}
+		case ev := <-d.events:
+			d.apply(ev)
+			// Catch up on a burst before drawing again
+			for i := 0; i < 100 && len(d.events) > 0; i++ {
+				d.apply(<-d.events)
+			}
+		case f := <-d.updates:
+			f()
+		case <-tick.C:
+			if time.Since(lastAgents) >= dashAgentsInterval {
+				d.loadAgents(false)
+				lastAgents = time.Now()
+			}
+			d.fetchMissing()
+		}
+	}
+}
+
+// readKeys turns terminal input into key names until it ends
+func readKeys(r *bufio.Reader, keys chan<- string) {
+	defer close(keys)
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return
+		}
+		key := string(c)
+		switch c {
+		case '\r', '\n':
+			key = "enter"
+		case '\t':
+			key = "tab"
+		case 127, 8:
+			key = "backspace"
+		case 3:
+			key = "ctrl-c"
+		case 27:
+			key = map[string]string{
+				"": "esc", "[A": "up", "OA": "up", "[B": "down", "OB": "down",
+				"[C": "right", "OC": "right", "[D": "left", "OD": "left",
+				"[H": "home", "OH": "home", "[1~": "home", "[7~": "home",
+				"[F": "end", "OF": "end", "[4~": "end", "[8~": "end",
+				"[5~": "pgup", "[6~": "pgdn",
+			}[readEscape(r)]
+		}
+		if key != "" {
+			keys <- key
+		}
+	}
+}
+
+// stream follows the event stream, reconnecting when it is lost
+func (d *dashboard) stream(ctx context.Context) {
+	filter := EventFilter{Types: []string{"agent_connected", "agent_disconnected", "agent_status",
+		"command_status", "command_output"}}
+	var lastID string
+	for ctx.Err() == nil {
+		var err error
+		lastID, err = d.api.WatchContext(ctx, filter, lastID, func() { d.setLive(true, "") }, func(ev Event) {
+			select {
+			case d.events <- ev:
+			case <-ctx.Done():
+			}
+		})
+		msg := "Event stream lost, reconnecting..."
+		if err != nil {
+			msg = fmt.Sprintf("Event stream: %v", err)
+		}
+		d.setLive(false, msg)
+		select {
+		case <-ctx.Done():
+		case <-time.After(shellReconnectDelay):
+		}
+	}
+}
+
+// setLive records from a background goroutine whether the stream is open
+func (d *dashboard) setLive(live bool, msg string) {
+	d.updates <- func() {
+		d.live = live
+		if msg != "" {
+			d.message = msg
+		}
+	}
+}
+
+// loadAgents reloads the agent list in the background. The first load also
+// fetches the recent commands of the connected agents.
+func (d *dashboard) loadAgents(seed bool) {
+	go func() {
+		agents, err := d.api.ListClients()
+		d.updates <- func() {
+			if err != nil {
+				d.message = fmt.Sprintf("Failed to list agents: %v", err)
+				return
+			}
+			sort.Slice(agents, func(i, j int) bool { return agents[i].Hostname < agents[j].Hostname })
+			d.agents = agents
+		}
+		if err != nil || !seed {
+			return
+		}
+		for _, a := range agents {
+			if a.Status == "disconnected" {
+				continue
+			}
+			commands, _, err := d.api.GetCommandsPage(a.ID, ListOptions{Limit: dashSeedPerAgent, Fields: dashListFields})
+			if err != nil {
+				continue
+			}
+			d.updates <- func() {
+				for _, cmd := range commands {
+					d.merge(cmd, false)
+				}
+			}
+		}
+	}()
+}
+
+// fetchMissing fetches the details of commands only seen in events
+func (d *dashboard) fetchMissing() {
+	byClient := make(map[string]bool)
+	for _, clientID := range d.missing {
+		byClient[clientID] = true
+	}
+	d.missing = make(map[string]string)
+	for clientID := range byClient {
+		clientID := clientID
+		go func() {
+			commands, _, err := d.api.GetCommandsPage(clientID, ListOptions{Limit: 50, Fields: dashListFields})
+			if err != nil {
+				return
+			}
+			d.updates <- func() {
+				for _, cmd := range commands {
+					if _, ok := d.commands[cmd.ID]; ok {
+						d.merge(cmd, false)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// loadCommand fetches the stored output of a command in the background
+func (d *dashboard) loadCommand(clientID, commandID string) {
+	go func() {
+		cmd, err := d.api.GetCommand(clientID, commandID, nil)
+		d.updates <- func() {
+			if err != nil {
+				d.message = fmt.Sprintf("Failed to load command %s: %v", commandID, err)
+				return
+			}
+			d.merge(*cmd, true)
+		}
+	}()
+}
+
+// loadHistory fetches the commands of the agent shown in the agent view
+func (d *dashboard) loadHistory(clientID string) {
+	go func() {
+		commands, _, err := d.api.GetCommandsPage(clientID, ListOptions{Limit: 100, Fields: dashListFields})
+		d.updates <- func() {
+			if err != nil {
+				d.message = fmt.Sprintf("Failed to load history: %v", err)
+				return
+			}
+			if d.agentID != clientID {
+				return
+			}
+			d.history = d.history[:0]
+			for _, cmd := range commands {
+				d.merge(cmd, false)
+				d.history = append(d.history, cmd.ID)
+			}
+		}
+	}()
+}
+
+// merge records what the API returned about a command. A status already
+// known to be final is kept, as events may be newer than the fetch.
+func (d *dashboard) merge(cmd Command, withResult bool) {
+	dc, ok := d.commands[cmd.ID]
+	if !ok {
+		dc = &dashCommand{}
+		d.commands[cmd.ID] = dc
+		d.remember(cmd.ID)
+	}
+	status := dc.Status
+	result, loaded := dc.Result, dc.loaded
+	dc.Command = cmd
+	if finishedStatuses[status] && !finishedStatuses[cmd.Status] {
+		dc.Status = status
+	}
+	if !withResult {
+		dc.Result, dc.loaded = result, loaded
+	} else {
+		dc.loaded = true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, cmd.CreatedAt); err == nil {
+		dc.created = t
+	} else if dc.created.IsZero() {
+		dc.created = time.Now()
+	}
+	d.sortRecent()
+}
+
+// remember adds a command to the recent list, dropping the oldest beyond
+// dashMaxCommands
+func (d *dashboard) remember(id string) {
+	d.recent = append(d.recent, id)
+	if len(d.recent) <= dashMaxCommands {
+		return
+	}
+	d.sortRecent()
+	for _, old := range d.recent[dashMaxCommands:] {
+		delete(d.commands, old)
+		delete(d.output, old)
+	}
+	d.recent = d.recent[:dashMaxCommands]
+}
+
+func (d *dashboard) sortRecent() {
+	sort.SliceStable(d.recent, func(i, j int) bool {
+		a, b := d.commands[d.recent[i]], d.commands[d.recent[j]]
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.created.After(b.created)
+	})
+}
+
+// apply updates the state from a live event
+func (d *dashboard) apply(ev Event) {
+	switch ev.Type {
+	case "events_lost":
+		d.message = "Some events were missed; press r to reload"
+	case "agent_connected", "agent_disconnected", "agent_status":
+		status := "connected"
+		switch ev.Type {
+		case "agent_disconnected":
+			status = "disconnected"
+		case "agent_status":
+			var data struct {
+				Status string `json:"status"`
+			}
+			json.Unmarshal(ev.Data, &data)
+			status = data.Status
+		}
+		for i := range d.agents {
+			if d.agents[i].ID == ev.ClientID {
+				d.agents[i].Status = status
+				d.agents[i].LastSeen = ev.Timestamp.Format(time.RFC3339)
+				return
+			}
+		}
+		// A new agent
+		d.loadAgents(false)
+	case "command_status":
+		var data struct {
+			Status   string `json:"status"`
+			ExitCode *int   `json:"exit_code"`
+			Error    string `json:"error"`
+		}
+		json.Unmarshal(ev.Data, &data)
+		dc := d.seen(ev)
+		dc.Status = data.Status
+		if data.ExitCode != nil {
+			dc.ExitCode = data.ExitCode
+		}
+		if data.Error != "" {
+			dc.Error = data.Error
+		}
+		if finishedStatuses[data.Status] && d.view == viewOutput && d.cmdID == dc.ID {
+			d.loadCommand(dc.ClientID, dc.ID)
+		}
+	case "command_output":
+		var chunk struct {
+			Data string `json:"data"`
+		}
+		json.Unmarshal(ev.Data, &chunk)
+		d.seen(ev)
+		out := d.output[ev.CommandID] + chunk.Data
+		if len(out) > dashMaxOutput {
+			out = out[len(out)-dashMaxOutput:]
+		}
+		d.output[ev.CommandID] = out
+	}
+}
+
+// seen returns the command an event is about, recording it if it is new
+func (d *dashboard) seen(ev Event) *dashCommand {
+	dc, ok := d.commands[ev.CommandID]
+	if ok {
+		return dc
+	}
+	dc = &dashCommand{Command: Command{ID: ev.CommandID, ClientID: ev.ClientID, JobID: ev.JobID}, created: ev.Timestamp}
+	if dc.created.IsZero() {
+		dc.created = time.Now()
+	}
+	d.commands[ev.CommandID] = dc
+	d.missing[ev.CommandID] = ev.ClientID
+	d.remember(ev.CommandID)
+	d.sortRecent()
+	if d.view == viewAgent && ev.ClientID == d.agentID {
+		d.history = append([]string{ev.CommandID}, d.history...)
+		if d.histSel > 0 {
+			d.histSel++
+		}
+	}
+	return dc
+}
+
+// fleetCommands are the commands listed in the fleet view
+func (d *dashboard) fleetCommands() []*dashCommand {
+	var list []*dashCommand
+	for _, id := range d.recent {
+		dc := d.commands[id]
+		if dc == nil || (d.runningOnly && finishedStatuses[dc.Status]) {
+			continue
+		}
+		list = append(list, dc)
+	}
+	return list
+}
+
+// historyCommands are the commands listed in the agent view
+func (d *dashboard) historyCommands() []*dashCommand {
+	var list []*dashCommand
+	for _, id := range d.history {
+		if dc := d.commands[id]; dc != nil {
+			list = append(list, dc)
+		}
+	}
+	return list
+}
+
+// selected is the command the command keys act on
+func (d *dashboard) selected() *dashCommand {
+	var list []*dashCommand
+	sel := 0
+	switch {
+	case d.view == viewOutput:
+		return d.commands[d.cmdID]
+	case d.view == viewAgent:
+		list, sel = d.historyCommands(), d.histSel
+	case d.focus == 1:
+		list, sel = d.fleetCommands(), d.cmdSel
+	}
+	if sel < 0 || sel >= len(list) {
+		return nil
+	}
+	return list[sel]
+}
+
+// agentName returns the hostname of an agent, or its ID if unknown
+func (d *dashboard) agentName(clientID string) string {
+	for _, a := range d.agents {
+		if a.ID == clientID {
+			return a.Hostname
+		}
+	}
+	return clientID
+}
+
+// key handles a key press and reports whether to quit
+func (d *dashboard) key(key string) bool {
+	if d.prompt != nil {
+		d.promptKey(key)
+		return false
+	}
+	d.message = ""
+
+	switch key {
+	case "q", "ctrl-c":
+		return true
+	case "c":
+		if dc := d.selected(); dc != nil {
+			d.confirmCancel(dc)
+		}
+		return false
+	case "R":
+		if dc := d.selected(); dc != nil {
+			d.askRerun(dc)
+		}
+		return false
+	}
+
+	switch d.view {
+	case viewFleet:
+		d.fleetKey(key)
+	case viewAgent:
+		d.agentKey(key)
+	case viewOutput:
+		d.outputKey(key)
+	}
+	return false
+}
+
+func (d *dashboard) fleetKey(key string) {
+	sel, n := &d.agentSel, len(d.agents)
+	if d.focus == 1 {
+		sel, n = &d.cmdSel, len(d.fleetCommands())
+	}
+	switch key {
+	case "up", "k":
+		*sel--
+	case "down", "j":
+		*sel++
+	case "pgup":
+		*sel -= d.height / 2
+	case "pgdn":
+		*sel += d.height / 2
+	case "home":
+		*sel = 0
+	case "end":
+		*sel = n - 1
+	case "tab":
+		d.focus = 1 - d.focus
+	case "f":
+		d.runningOnly = !d.runningOnly
+		d.cmdSel = 0
+	case "r":
+		d.loadAgents(false)
+	case "enter", "right":
+		if d.focus == 0 && d.agentSel < len(d.agents) {
+			d.agentID = d.agents[d.agentSel].ID
+			d.history, d.histSel = nil, 0
+			d.view = viewAgent
+			d.loadHistory(d.agentID)
+		} else if dc := d.selected(); dc != nil {
+			d.openOutput(dc, viewFleet)
+		}
+	}
+	*sel = clamp(*sel, n)
+}
+
+func (d *dashboard) agentKey(key string) {
+	n := len(d.history)
+	switch key {
+	case "up", "k":
+		d.histSel--
+	case "down", "j":
+		d.histSel++
+	case "pgup":
+		d.histSel -= d.height / 2
+	case "pgdn":
+		d.histSel += d.height / 2
+	case "home":
+		d.histSel = 0
+	case "end":
+		d.histSel = n - 1
+	case "r":
+		d.loadHistory(d.agentID)
+	case "esc", "left", "backspace":
+		d.view = viewFleet
+	case "enter", "right":
+		if dc := d.selected(); dc != nil {
+			d.openOutput(dc, viewAgent)
+		}
+	}
+	d.histSel = clamp(d.histSel, n)
+}
+
+func (d *dashboard) outputKey(key string) {
+	page := d.height - 8
+	switch key {
+	case "up", "k":
+		d.scroll--
+	case "down", "j":
+		d.scroll++
+	case "pgup":
+		d.scroll -= page
+	case "pgdn", " ":
+		d.scroll += page
+	case "home":
+		d.scroll = 0
+	case "end":
+		d.scroll = len(d.outputLines(d.commands[d.cmdID]))
+	case "r":
+		if dc := d.commands[d.cmdID]; dc != nil {
+			d.loadCommand(dc.ClientID, dc.ID)
+		}
+	case "esc", "left", "backspace":
+		d.view = d.back
+	}
+	if d.scroll < 0 {
+		d.scroll = 0
+	}
+}
+
+// openOutput shows the output of a command
+func (d *dashboard) openOutput(dc *dashCommand, back int) {
+	d.cmdID, d.back, d.scroll = dc.ID, back, 0
+	d.view = viewOutput
+	if !dc.loaded {
+		d.loadCommand(dc.ClientID, dc.ID)
+	}
+}
+
+// confirmCancel asks before cancelling a command
+func (d *dashboard) confirmCancel(dc *dashCommand) {
+	if finishedStatuses[dc.Status] {
+		d.message = fmt.Sprintf("Command %s already finished (%s)", dc.ID, dc.Status)
+		return
+	}
+	d.prompt = &dashPrompt{
+		label:  fmt.Sprintf("Cancel command %s on %s? (y/n) ", dc.ID, d.agentName(dc.ClientID)),
+		single: true,
+		done: func(answer string) {
+			if answer != "y" && answer != "Y" {
+				return
+			}
+			clientID, commandID := dc.ClientID, dc.ID
+			d.message = "Cancelling..."
+			go func() {
+				cmd, err := d.api.CancelCommand(clientID, commandID)
+				d.updates <- func() {
+					switch {
+					case err != nil:
+						d.message = fmt.Sprintf("Cancel failed: %v", err)
+					case cmd.Status == "cancelled":
+						d.message = fmt.Sprintf("Command %s cancelled", commandID)
+					default:
+						d.message = fmt.Sprintf("Cancel sent to the agent running %s", commandID)
+					}
+				}
+			}()
+		},
+	}
+}
+
+// askRerun asks where to run a command again and sends it there. The answer
+// is a label selector if a term compares a label or starts with "!", and a
+// list of agent IDs or hostnames otherwise.
+func (d *dashboard) askRerun(dc *dashCommand) {
+	if dc.Command.Command == "" {
+		d.message = "Command details not loaded yet"
+		return
+	}
+	cmd := Command{Command: dc.Command.Command, Task: dc.Task, Secrets: dc.Secrets,
+		Limits: dc.Limits, Concurrency: dc.Concurrency, SerialKey: dc.SerialKey}
+	d.prompt = &dashPrompt{
+		label: "Re-run on (agent IDs or hostnames, or a label selector such as env=prod): ",
+		done: func(answer string) {
+			answer = strings.TrimSpace(answer)
+			if answer == "" {
+				return
+			}
+			var targets []string
+			if !isSelector(answer) {
+				var err error
+				if targets, err = d.resolveAgents(answer); err != nil {
+					d.message = err.Error()
+					return
+				}
+			}
+			d.message = "Sending..."
+			go func() {
+				msg := ""
+				if targets == nil {
+					c := cmd
+					c.Selector = answer
+					job, err := d.api.SendJob(c, nil)
+					if err != nil {
+						msg = fmt.Sprintf("Re-run failed: %v", err)
+					} else {
+						msg = fmt.Sprintf("Job %s created for %d agent(s), status %s", job.ID, job.Targets, job.Status)
+					}
+				} else {
+					sent := 0
+					for _, id := range targets {
+						c := cmd
+						c.ClientID = id
+						if _, err := d.api.SendCommand(c); err != nil {
+							msg = fmt.Sprintf("Re-run on %s failed: %v", id, err)
+							break
+						}
+						sent++
+					}
+					if msg == "" {
+						msg = fmt.Sprintf("Sent to %d agent(s)", sent)
+					}
+				}
+				d.updates <- func() { d.message = msg }
+			}()
+		},
+	}
+}
+
+// isSelector reports whether a re-run answer is a label selector rather
+// than a list of agents
+func isSelector(answer string) bool {
+	for _, term := range strings.Split(answer, ",") {
+		if term = strings.TrimSpace(term); strings.Contains(term, "=") || strings.HasPrefix(term, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAgents returns the IDs of the agents a comma-separated list names
+// by ID or hostname. A name that matches no agent, or a hostname several
+// agents share, is an error.
+func (d *dashboard) resolveAgents(list string) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id := ""
+		var byHost []string
+		for _, a := range d.agents {
+			if a.ID == item {
+				id = a.ID
+			} else if a.Hostname == item {
+				byHost = append(byHost, a.ID)
+			}
+		}
+		switch {
+		case id != "":
+		case len(byHost) == 1:
+			id = byHost[0]
+		case len(byHost) > 1:
+			return nil, fmt.Errorf("Hostname %s is shared by agents %s; use an ID", item, strings.Join(byHost, ", "))
+		default:
+			return nil, fmt.Errorf("Unknown agent %s", item)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No agents given")
+	}
+	return ids, nil
+}
+
+// promptKey edits the prompt line
+func (d *dashboard) promptKey(key string) {
+	p := d.prompt
+	if p.single {
+		d.prompt = nil
+		p.done(key)
+		return
+	}
+	switch key {
+	case "enter":
+		d.prompt = nil
+		p.done(string(p.text))
+	case "esc", "ctrl-c":
+		d.prompt = nil
+	case "backspace":
+		if len(p.text) > 0 {
+			p.text = p.text[:len(p.text)-1]
+		}
+	case "tab":
+	default:
+		if r := []rune(key); len(r) == 1 && unicode.IsPrint(r[0]) {
+			p.text = append(p.text, r[0])
+		}
+	}
+}
+
+// clamp keeps a selection within a list of n items
+func clamp(sel, n int) int {
+	if sel >= n {
+		sel = n - 1
+	}
+	if sel < 0 {
+		sel = 0
+	}
+	return sel
+}
+
+// draw renders the current view
+func (d *dashboard) draw() {
+	d.width, d.height = 80, 24
+	if w, h, err := termSize(d.fd); err == nil && w > 0 && h > 0 {
+		d.width, d.height = w, h
+	}
+
+	var lines []string
+	switch d.view {
+	case viewFleet:
+		lines = d.drawFleet()
+	case viewAgent:
+		lines = d.drawAgent()
+	case viewOutput:
+		lines = d.drawOutput()
+	}
+
+	stream := "live"
+	if !d.live {
+		stream = "reconnecting"
+	}
+	title := fmt.Sprintf(" cc-cli dashboard  %s  agents: %d  events: %s", d.api.BaseURL, len(d.agents), stream)
+
+	footer := d.message
+	if d.prompt != nil {
+		footer = d.prompt.label + string(d.prompt.text)
+		if !d.prompt.single {
+			footer += "_"
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	b.WriteString("\x1b[7m" + fit(title, d.width) + "\x1b[0m\r\n")
+	body := d.height - 3
+	for i := 0; i < body; i++ {
+		line := ""
+		if i < len(lines) {
+			line = lines[i]
+		}
+		b.WriteString(line + "\x1b[K\r\n")
+	}
+	b.WriteString(fit(footer, d.width) + "\x1b[K\r\n")
+	b.WriteString("\x1b[7m" + fit(d.help(), d.width) + "\x1b[0m\x1b[K")
+	io.WriteString(d.out, b.String())
+}
+
+// help lists the keys of the current view
+func (d *dashboard) help() string {
+	switch d.view {
+	case viewAgent:
+		return " ↑/↓ select  Enter output  c cancel  R re-run  r reload  Esc back  q quit"
+	case viewOutput:
+		return " ↑/↓/PgUp/PgDn scroll  c cancel  R re-run  r reload  Esc back  q quit"
+	}
+	return " ↑/↓ select  Tab switch pane  Enter open  c cancel  R re-run  f running only  r reload  q quit"
+}
+
+func (d *dashboard) drawFleet() []string {
+	body := d.height - 3
+	agentRows := (body - 2) / 2
+	cmdRows := body - 2 - agentRows
+
+	running := make(map[string]int)
+	for _, dc := range d.commands {
+		if !finishedStatuses[dc.Status] {
+			running[dc.ClientID]++
+		}
+	}
+
+	lines := []string{d.header(0, fmt.Sprintf("%-24s %-10s %-13s %-10s %s", "AGENT", "ID", "STATUS", "LAST SEEN", "RUNNING"))}
+	start := scrollStart(d.agentSel, agentRows)
+	for i := start; i < start+agentRows; i++ {
+		if i >= len(d.agents) {
+			lines = append(lines, "")
+			continue
+		}
+		a := d.agents[i]
+		row := fmt.Sprintf("%-24s %-10s %-13s %-10s %d", trim(a.Hostname, 24), trim(a.ID, 10), a.Status, ago(a.LastSeen), running[a.ID])
+		lines = append(lines, d.row(row, d.focus == 0 && i == d.agentSel))
+	}
+
+	label := "COMMANDS"
+	if d.runningOnly {
+		label = "RUNNING"
+	}
+	lines = append(lines, d.header(1, fmt.Sprintf("%-8s %-20s %-17s %4s  %s", "TIME", "AGENT", "STATUS", "EXIT", label)))
+	list := d.fleetCommands()
+	start = scrollStart(d.cmdSel, cmdRows)
+	for i := start; i < start+cmdRows && i < len(list); i++ {
+		lines = append(lines, d.row(d.commandRow(list[i], true), d.focus == 1 && i == d.cmdSel))
+	}
+	return lines
+}
+
+func (d *dashboard) drawAgent() []string {
+	var a ClientInfo
+	for _, c := range d.agents {
+		if c.ID == d.agentID {
+			a = c
+		}
+	}
+	lines := []string{
+		fmt.Sprintf(" %s (%s)  %s  last seen %s  %s", a.Hostname, a.ID, a.Status, ago(a.LastSeen), formatLabelList(a.Labels)),
+		"",
+		"\x1b[1m" + fit(fmt.Sprintf(" %-8s %-17s %4s  %s", "TIME", "STATUS", "EXIT", "COMMAND"), d.width) + "\x1b[0m",
+	}
+	rows := d.height - 3 - len(lines)
+	list := d.historyCommands()
+	start := scrollStart(d.histSel, rows)
+	for i := start; i < start+rows && i < len(list); i++ {
+		lines = append(lines, d.row(d.commandRow(list[i], false), i == d.histSel))
+	}
+	if len(list) == 0 {
+		lines = append(lines, " Loading...")
+	}
+	return lines
+}
+
+func (d *dashboard) drawOutput() []string {
+	dc := d.commands[d.cmdID]
+	if dc == nil {
+		return []string{" Command no longer in view"}
+	}
+	exit := "-"
+	if dc.ExitCode != nil {
+		exit = fmt.Sprint(*dc.ExitCode)
+	}
+	lines := []string{
+		fmt.Sprintf(" %s on %s  %s  exit %s  by %s  at %s", dc.ID, d.agentName(dc.ClientID), dc.Status, exit,
+			dc.Operator, dc.created.Local().Format("2006-01-02 15:04:05")),
+	}
+	for i, l := range strings.Split(clean(dc.Command.Command), "\n") {
+		if i == 3 {
+			lines = append(lines, " ...")
+			break
+		}
+		lines = append(lines, " $ "+l)
+	}
+	if dc.Error != "" {
+		lines = append(lines, " Error: "+clean(dc.Error))
+	}
+	lines = append(lines, strings.Repeat("─", d.width))
+
+	out := d.outputLines(dc)
+	rows := d.height - 3 - len(lines)
+	if d.scroll > len(out)-rows {
+		d.scroll = len(out) - rows
+	}
+	if d.scroll < 0 {
+		d.scroll = 0
+	}
+	for i := d.scroll; i < d.scroll+rows && i < len(out); i++ {
+		lines = append(lines, fit(out[i], d.width))
+	}
+	return lines
+}
+
+// outputLines is the output shown for a command: the stored result once it
+// is loaded, the streamed output while it runs
+func (d *dashboard) outputLines(dc *dashCommand) []string {
+	if dc == nil {
+		return nil
+	}
+	text := d.output[dc.ID]
+	switch {
+	case dc.loaded && dc.Result != "":
+		text = dc.Result
+	case text == "" && !finishedStatuses[dc.Status]:
+		text = "[waiting for output]"
+	case text == "" && !dc.loaded:
+		text = "[loading]"
+	}
+	return strings.Split(strings.TrimSuffix(clean(text), "\n"), "\n")
+}
+
+// commandRow formats a command for a list
+func (d *dashboard) commandRow(dc *dashCommand, withAgent bool) string {
+	exit := ""
+	if dc.ExitCode != nil {
+		exit = fmt.Sprint(*dc.ExitCode)
+	}
+	text := strings.SplitN(clean(dc.Command.Command), "\n", 2)[0]
+	if text == "" {
+		text = dc.ID
+	}
+	if withAgent {
+		return fmt.Sprintf("%-8s %-20s %-17s %4s  %s", dc.created.Local().Format("15:04:05"),
+			trim(d.agentName(dc.ClientID), 20), dc.Status, exit, text)
+	}
+	return fmt.Sprintf("%-8s %-17s %4s  %s", dc.created.Local().Format("15:04:05"), dc.Status, exit, text)
+}
+
+// header formats the heading of a fleet view pane, highlighted when focused
+func (d *dashboard) header(pane int, text string) string {
+	if d.focus == pane {
+		return "\x1b[1;4m" + fit(" "+text, d.width) + "\x1b[0m"
+	}
+	return "\x1b[1m" + fit(" "+text, d.width) + "\x1b[0m"
+}
+
+// row formats a list row, in reverse video when selected
+func (d *dashboard) row(text string, selected bool) string {
+	text = fit(" "+text, d.width)
+	if selected {
+		return "\x1b[7m" + text + strings.Repeat(" ", d.width-len([]rune(text))) + "\x1b[0m"
+	}
+	return text
+}
+
+// scrollStart is the first row shown so that sel is visible
+func scrollStart(sel, rows int) int {
+	if rows <= 0 || sel < rows {
+		return 0
+	}
+	return sel - rows + 1
+}
+
+// fit cuts s to width characters
+func fit(s string, width int) string {
+	r := []rune(s)
+	if width < 0 {
+		width = 0
+	}
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// trim cuts s to n characters, marking the cut
+func trim(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// clean makes output safe to draw: tabs become spaces and other control
+// characters are dropped, so escape sequences cannot move the cursor
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return r
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// ago formats how long ago an RFC 3339 time was
+func ago(ts string) string {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "-"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+// formatLabelList shows labels as sorted key=value pairs
+func formatLabelList(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSelector(t *testing.T) {
+	for answer, want := range map[string]bool{
+		"web-1":              false,
+		"web-1, client_2":    false,
+		"env=prod":           true,
+		"web-1,tier!=db":     true,
+		"gpu,!legacy":        true,
+		"role==build":        true,
+		"client_1,client_2,": false,
+	} {
+		if got := isSelector(answer); got != want {
+			t.Errorf("isSelector(%q) = %v, want %v", answer, got, want)
+		}
+	}
+}
+
+func TestResolveAgents(t *testing.T) {
+	d := &dashboard{agents: []ClientInfo{
+		{ID: "client_1", Hostname: "web-1"},
+		{ID: "client_2", Hostname: "db"},
+		{ID: "client_3", Hostname: "db"},
+		// An ID wins over another agent's hostname
+		{ID: "client_4", Hostname: "client_1"},
+	}}
+	for _, tc := range []struct {
+		list string
+		ids  string
+		err  string
+	}{
+		{"web-1", "client_1", ""},
+		{"client_2, web-1", "client_2,client_1", ""},
+		{"client_1", "client_1", ""},
+		{"web-1,client_1", "client_1", ""},
+		{"web-1,wbe-2", "", "Unknown agent wbe-2"},
+		{"db", "", "Hostname db is shared by agents client_2, client_3"},
+		{" , ", "", "No agents given"},
+	} {
+		ids, err := d.resolveAgents(tc.list)
+		if strings.Join(ids, ",") != tc.ids || (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("resolveAgents(%q) = %v, %v, want %s %q", tc.list, ids, err, tc.ids, tc.err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event is one entry of the server's live event stream
+type Event struct {
+	ID        string          `json:"id,omitempty"`
+	Type      string          `json:"type"`
+	ClientID  string          `json:"client_id,omitempty"`
+	JobID     string          `json:"job_id,omitempty"`
+	CommandID string          `json:"command_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// EventFilter narrows the event stream. Empty fields match every event;
+// without Types the raw agent_message events are left out.
+type EventFilter struct {
+	Clients  []string
+	Selector string
+	JobID    string
+	Types    []string
+}
+
+// Watch reads the event stream and calls handle for every event until the
+// stream ends. A non-empty lastEventID resumes after that event. It returns
+// the ID of the last event seen, to resume from, and an error only if the
+// stream could not be opened.
+func (c *APIClient) Watch(filter EventFilter, lastEventID string, handle func(Event)) (string, error) {
+	return c.WatchContext(context.Background(), filter, lastEventID, nil, handle)
+}
+
+// WatchContext is Watch until ctx is done. If opened is not nil it is called
+// once the stream is open, before any event.
+func (c *APIClient) WatchContext(ctx context.Context, filter EventFilter, lastEventID string, opened func(), handle func(Event)) (string, error) {
+	q := url.Values{}
+	if len(filter.Clients) > 0 {
+		q.Set("client", strings.Join(filter.Clients, ","))
+	}
+	if filter.Selector != "" {
+		q.Set("selector", filter.Selector)
+	}
+	if filter.JobID != "" {
+		q.Set("job", filter.JobID)
+	}
+	if len(filter.Types) > 0 {
+		q.Set("type", strings.Join(filter.Types, ","))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/v1/events?"+q.Encode(), nil)
+	if err != nil {
+		return lastEventID, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return lastEventID, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return lastEventID, apiError(resp)
+	}
+	if opened != nil {
+		opened()
+	}
+
+	// Server-sent events: "field: value" lines, a blank line ends an event
+	r := bufio.NewReader(resp.Body)
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// The stream ended; the caller may resume from lastEventID
+			return lastEventID, nil
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var ev Event
+			if json.Unmarshal([]byte(data.String()), &ev) == nil {
+				if ev.ID != "" {
+					lastEventID = ev.ID
+				}
+				handle(ev)
+			}
+			data.Reset()
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// id and event repeat what the JSON data carries; comments keep
+		// the connection alive
+	}
+}
@@ -0,0 +1,255 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// maxHistory is how many lines the history file keeps
+const maxHistory = 1000
+
+// errInterrupted is returned by readLine when Ctrl-C abandons the line
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal with cursor movement, the usual
+// Emacs keys and a history kept in a file. When the input is not a
+// terminal it reads plain lines.
+type lineEditor struct {
+	in       *os.File
+	r        *bufio.Reader
+	out      io.Writer
+	history  []string
+	histFile string
+}
+
+// newLineEditor returns an editor reading in and echoing to out. An empty
+// histFile keeps the history in memory only.
+func newLineEditor(in *os.File, out io.Writer, histFile string) *lineEditor {
+	e := &lineEditor{in: in, r: bufio.NewReader(in), out: out, histFile: histFile}
+	if histFile != "" {
+		if data, err := os.ReadFile(histFile); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					e.history = append(e.history, line)
+				}
+			}
+		}
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+			e.saveHistory()
+		}
+	}
+	return e
+}
+
+// addHistory records a line, skipping repeats of the previous one
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+		e.saveHistory()
+		return
+	}
+	if e.histFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.histFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// saveHistory rewrites the history file with the lines kept
+func (e *lineEditor) saveHistory() {
+	if e.histFile == "" {
+		return
+	}
+	os.WriteFile(e.histFile, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+}
+
+// readLine shows prompt and returns the line typed. It returns io.EOF on
+// Ctrl-D at an empty line or the end of input, and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(int(e.in.Fd()))
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+// edit reads keys from a terminal in raw mode and returns the line they
+// typed, as readLine does
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var (
+		line   []rune
+		pos    int
+		hist   = len(e.history)
+		edited string // the new line while browsing the history
+	)
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if hist == len(e.history) {
+			edited = string(line)
+		}
+		hist = i
+		if i == len(e.history) {
+			line = []rune(edited)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+		redraw()
+	}
+	redraw()
+
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			return "", io.EOF
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(line) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = append([]rune{}, line[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && unicode.IsSpace(line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(line[start-1]) {
+				start--
+			}
+			line = append(line[:start], line[pos:]...)
+			pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			recall(hist - 1)
+			continue
+		case 14: // Ctrl-N
+			recall(hist + 1)
+			continue
+		case 27: // Escape sequences of the arrow and editing keys
+			switch readEscape(e.r) {
+			case "[A", "OA":
+				recall(hist - 1)
+				continue
+			case "[B", "OB":
+				recall(hist + 1)
+				continue
+			case "[C", "OC":
+				if pos < len(line) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if !unicode.IsPrint(r) && r != '\t' {
+				continue
+			}
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+// readEscape reads the rest of an escape sequence after ESC, such as "[A"
+// for the up arrow. A lone Escape key press returns "": the bytes of a
+// sequence arrive together, so nothing buffered means nothing follows.
+func readEscape(r *bufio.Reader) string {
+	if r.Buffered() == 0 {
+		return ""
+	}
+	b, err := r.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return ""
+	}
+	seq := []byte{b}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, b)
+		// Parameters are digits and semicolons; any other byte ends it
+		if (b < '0' || b > '9') && b != ';' {
+			return string(seq)
+		}
+	}
+}
+
+// readPlain reads a line without editing, for input that is not a terminal
+func (e *lineEditor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", io.EOF
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
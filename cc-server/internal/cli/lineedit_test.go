@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEditor returns an editor reading keys from input
+func testEditor(input string, history ...string) (*lineEditor, *strings.Builder) {
+	out := &strings.Builder{}
+	return &lineEditor{r: bufio.NewReader(strings.NewReader(input)), out: out, history: history}, out
+}
+
+func TestEditKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name, keys, want string
+	}{
+		{"enter", "ls -la\r", "ls -la"},
+		{"newline", "ls\n", "ls"},
+		{"left arrow and insert", "lx\x1b[Ds\r", "lsx"},
+		{"right arrow", "ac\x1b[D\x1b[Cb\r", "acb"},
+		{"home and end keys", "bc\x1b[Ha\x1b[Fd\r", "abcd"},
+		{"delete key", "abxc\x1b[D\x1b[D\x1b[3~\r", "abc"},
+		{"ctrl-a and ctrl-e", "cd\x01x\x05y\r", "xcdy"},
+		{"ctrl-b and ctrl-f", "ac\x02\x02\x06b\r", "abc"},
+		{"backspace", "abd\x7fc\r", "abc"},
+		{"ctrl-k", "abc\x01\x06\x0b\r", "a"},
+		{"ctrl-u", "abc\x02\x15\r", "c"},
+		{"ctrl-w", "echo foo bar  \x17baz\r", "echo foo baz"},
+		{"ctrl-d deletes under the cursor", "ab\x01\x04\r", "b"},
+		{"control keys are not inserted", "a\x07b\r", "ab"},
+		{"tab", "a\tb\r", "a\tb"},
+		{"unicode", "héllo\x7f\x7f\x7f\x7fi\r", "hi"},
+	} {
+		e, _ := testEditor(tc.keys)
+		if got, err := e.edit("$ "); err != nil || got != tc.want {
+			t.Errorf("%s: edit = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestEditHistory(t *testing.T) {
+	for _, tc := range []struct {
+		name, keys, want string
+	}{
+		{"up recalls the last line", "\x1b[A\r", "second"},
+		{"up twice", "\x1b[A\x1bOA\r", "first"},
+		{"up stops at the oldest", "\x10\x10\x10\r", "first"},
+		{"down returns to the line being typed", "new\x1b[A\x1b[B\r", "new"},
+		{"down past the newest does nothing", "new\x0e\r", "new"},
+		{"a recalled line can be edited", "\x1b[A\x7f\x7f\x7f\r", "sec"},
+	} {
+		e, _ := testEditor(tc.keys, "first", "second")
+		if got, err := e.edit("$ "); err != nil || got != tc.want {
+			t.Errorf("%s: edit = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestEditEnds(t *testing.T) {
+	e, out := testEditor("abc\x03")
+	if _, err := e.edit("$ "); err != errInterrupted || !strings.HasSuffix(out.String(), "^C\r\n") {
+		t.Fatalf("ctrl-c: %v, output %q", err, out.String())
+	}
+	e, _ = testEditor("\x04")
+	if _, err := e.edit("$ "); err != io.EOF {
+		t.Fatalf("ctrl-d at an empty line: %v", err)
+	}
+	e, _ = testEditor("unfinished")
+	if _, err := e.edit("$ "); err != io.EOF {
+		t.Fatalf("end of input: %v", err)
+	}
+
+	// The line is redrawn after the prompt with the cursor where it was
+	e, out = testEditor("ab\x1b[D\r")
+	e.edit("$ ")
+	if !strings.Contains(out.String(), "\r$ ab\x1b[K\x1b[1D") {
+		t.Fatalf("output %q", out.String())
+	}
+}
+
+func TestReadLineWithoutTerminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WriteString("uptime\r\nlast line")
+	w.Close()
+
+	var out strings.Builder
+	e := newLineEditor(r, &out, "")
+	for _, want := range []string{"uptime", "last line"} {
+		if got, err := e.readLine("$ "); err != nil || got != want {
+			t.Fatalf("readLine = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := e.readLine("$ "); err != io.EOF {
+		t.Fatalf("readLine at the end = %v", err)
+	}
+	if out.String() != "$ $ $ " {
+		t.Fatalf("output %q", out.String())
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	e := newLineEditor(os.Stdin, io.Discard, file)
+	for _, line := range []string{"ls", "ls", "  ", "uptime", "ls"} {
+		e.addHistory(line)
+	}
+	if got := strings.Join(e.history, ","); got != "ls,uptime,ls" {
+		t.Fatalf("history = %s", got)
+	}
+	if again := newLineEditor(os.Stdin, io.Discard, file); strings.Join(again.history, ",") != "ls,uptime,ls" {
+		t.Fatalf("history read back = %v", again.history)
+	}
+}
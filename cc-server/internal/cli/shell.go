@@ -0,0 +1,345 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shellTask is the task name of commands sent by the shell, for policy
+// rules to match
+const shellTask = "shell"
+
+// cwdMarker starts the line on which a shell line prints its final working
+// directory. It is taken out of the output shown.
+const cwdMarker = "__CC_CWD__"
+
+// shellReconnectDelay is how long the shell waits before resuming a lost
+// event stream
+const shellReconnectDelay = 2 * time.Second
+
+// shellPollInterval is how long the shell waits for events of a running line
+// before it checks the stored command instead, in case the stream missed the
+// end of it.
+const shellPollInterval = 5 * time.Second
+
+// finishedStatuses are the command statuses that end a shell line
+var finishedStatuses = map[string]bool{
+	"completed": true, "failed": true, "limit_exceeded": true, "cancelled": true,
+	"rejected": true, "expired": true,
+}
+
+// Shell runs the lines an operator types on one agent. Every line is sent
+// as typed through the API, so it is checked by policy and audited like any
+// other. The working directory is sent along with it and carried from one
+// line to the next.
+type Shell struct {
+	api    *APIClient
+	client ClientInfo
+	cwd    string
+	editor *lineEditor
+	out    io.Writer
+
+	// events receives the agent's command events while a line runs
+	events chan Event
+	mu     sync.Mutex
+	active bool
+}
+
+// RunShell starts an interactive shell on an agent and returns when the
+// operator leaves it
+func RunShell(api *APIClient, clientID string) error {
+	clients, err := api.ListClients()
+	if err != nil {
+		return err
+	}
+	sh := &Shell{api: api, out: os.Stdout, events: make(chan Event, 256)}
+	for _, c := range clients {
+		if c.ID == clientID {
+			sh.client = c
+		}
+	}
+	if sh.client.ID == "" {
+		return fmt.Errorf("client %s not found", clientID)
+	}
+
+	histFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		histFile = filepath.Join(home, ".cc_cli_history")
+	}
+	sh.editor = newLineEditor(os.Stdin, os.Stdout, histFile)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	opened := make(chan struct{})
+	go sh.stream(ctx, opened)
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		return errors.New("timed out opening the event stream")
+	}
+
+	fmt.Fprintf(sh.out, "Connected to %s (%s). Lines run on the agent; type exit or press Ctrl-D to leave.\n",
+		sh.client.Hostname, sh.client.ID)
+	if sh.client.Status == "disconnected" {
+		fmt.Fprintln(sh.out, "The agent is disconnected; lines are queued until it reconnects.")
+	}
+
+	for {
+		line, err := sh.editor.readLine(sh.prompt())
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sh.editor.addHistory(line)
+
+		switch strings.TrimSpace(line) {
+		case "":
+			continue
+		case "exit", "logout":
+			return nil
+		}
+		sh.run(line)
+	}
+}
+
+// prompt shows the agent and the working directory
+func (sh *Shell) prompt() string {
+	if sh.cwd == "" {
+		return sh.client.Hostname + "$ "
+	}
+	return sh.client.Hostname + ":" + sh.cwd + "$ "
+}
+
+// stream follows the event stream of the agent until ctx is done. Events
+// are only passed on while a line runs.
+func (sh *Shell) stream(ctx context.Context, opened chan struct{}) {
+	var once sync.Once
+	filter := EventFilter{Clients: []string{sh.client.ID}, Types: []string{"command_status", "command_output"}}
+	var lastID string
+	for ctx.Err() == nil {
+		lastID, _ = sh.api.WatchContext(ctx, filter, lastID, func() { once.Do(func() { close(opened) }) }, func(ev Event) {
+			sh.mu.Lock()
+			active := sh.active
+			sh.mu.Unlock()
+			if active {
+				select {
+				case sh.events <- ev:
+				case <-ctx.Done():
+				}
+			}
+		})
+		select {
+		case <-ctx.Done():
+		case <-time.After(shellReconnectDelay):
+		}
+	}
+}
+
+// setActive starts or stops passing events on, dropping any left over
+func (sh *Shell) setActive(active bool) {
+	sh.mu.Lock()
+	sh.active = active
+	sh.mu.Unlock()
+	for {
+		select {
+		case <-sh.events:
+		default:
+			return
+		}
+	}
+}
+
+// run sends one line and shows its output as it streams in. Ctrl-C cancels
+// the command; a second Ctrl-C stops waiting for it.
+func (sh *Shell) run(line string) {
+	sh.setActive(true)
+	defer sh.setActive(false)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	cmd, err := sh.api.SendCommand(Command{ClientID: sh.client.ID, Command: line, Task: shellTask, Cwd: sh.cwd})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	if cmd.Status == "awaiting_approval" {
+		fmt.Fprintf(sh.out, "Command %s needs approval. Another operator must run: cc-cli approve %s\n", cmd.ID, cmd.ID)
+	}
+
+	poll := time.NewTicker(shellPollInterval)
+	defer poll.Stop()
+	lastEvent := time.Now()
+
+	out := &shellOutput{w: sh.out}
+	seq, gap, cancelled := 0, false, false
+	status, exitCode := "", -1
+	for status == "" {
+		select {
+		case <-poll.C:
+			if time.Since(lastEvent) < shellPollInterval {
+				continue
+			}
+			if c, err := sh.result(cmd.ID); err == nil && finishedStatuses[c.Status] {
+				status = c.Status
+				if c.ExitCode != nil {
+					exitCode = *c.ExitCode
+				}
+			}
+		case <-interrupt:
+			if cancelled {
+				fmt.Fprintf(sh.out, "\nStopped waiting for command %s\n", cmd.ID)
+				return
+			}
+			cancelled = true
+			if _, err := sh.api.CancelCommand(sh.client.ID, cmd.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "\nFailed to cancel command %s: %v\n", cmd.ID, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "\nCancelling command %s...\n", cmd.ID)
+			}
+		case ev := <-sh.events:
+			switch {
+			case ev.Type == "events_lost":
+				gap = true
+			case ev.CommandID != cmd.ID:
+			case ev.Type == "command_output":
+				lastEvent = time.Now()
+				var chunk struct {
+					Seq  int    `json:"seq"`
+					Data string `json:"data"`
+				}
+				json.Unmarshal(ev.Data, &chunk)
+				if chunk.Seq != seq+1 {
+					gap = true
+				}
+				seq = chunk.Seq
+				if !gap {
+					out.write(chunk.Data)
+				}
+			case ev.Type == "command_status":
+				var data struct {
+					Status   string `json:"status"`
+					ExitCode *int   `json:"exit_code"`
+				}
+				json.Unmarshal(ev.Data, &data)
+				lastEvent = time.Now()
+				if !finishedStatuses[data.Status] {
+					continue
+				}
+				status = data.Status
+				if data.ExitCode != nil {
+					exitCode = *data.ExitCode
+				}
+			}
+		}
+	}
+
+	// Output is only streamed by agents that support it; otherwise, or if
+	// chunks were lost, the stored result is shown
+	final, err := sh.result(cmd.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch the result of command %s: %v\n", cmd.ID, err)
+	}
+	if final != nil && (seq == 0 || gap) {
+		if gap && seq > 0 {
+			out.reset()
+			fmt.Fprintln(sh.out, "\n[some output was missed; the full output follows]")
+		}
+		out.write(final.Result)
+	}
+	out.close()
+	if out.cwd != "" {
+		sh.cwd = out.cwd
+	}
+
+	switch {
+	case status == "cancelled":
+		fmt.Fprintln(os.Stderr, "[cancelled]")
+	case final != nil && final.Error != "":
+		fmt.Fprintf(os.Stderr, "[%s: %s]\n", status, final.Error)
+	case exitCode > 0:
+		fmt.Fprintf(os.Stderr, "[exit %d]\n", exitCode)
+	case status != "completed":
+		fmt.Fprintf(os.Stderr, "[%s]\n", status)
+	}
+}
+
+// result fetches the stored outcome of a command sent by the shell
+func (sh *Shell) result(commandID string) (*Command, error) {
+	return sh.api.GetCommand(sh.client.ID, commandID, []string{"id", "status", "result", "error", "exit_code"})
+}
+
+// shellOutput prints the output of a line as it arrives and takes the
+// working directory marker out of it. The last line break is held back, as
+// it may belong to the marker.
+type shellOutput struct {
+	w       io.Writer
+	pending string
+	cwd     string
+	done    bool
+	midLine bool // the last output shown did not end a line
+}
+
+func (o *shellOutput) write(data string) {
+	if o.done {
+		return
+	}
+	o.pending += data
+	if i := strings.Index(o.pending, "\n"+cwdMarker); i >= 0 {
+		rest := o.pending[i+1+len(cwdMarker):]
+		if j := strings.Index(rest, "\n"); j >= 0 {
+			o.print(o.pending[:i])
+			o.cwd = rest[:j]
+			o.pending = ""
+			o.done = true
+		}
+		return
+	}
+	// Hold back from the last line break if what follows may be the marker
+	if i := strings.LastIndex(o.pending, "\n"); i >= 0 && strings.HasPrefix(cwdMarker, o.pending[i+1:]) {
+		o.print(o.pending[:i])
+		o.pending = o.pending[i:]
+		return
+	}
+	o.print(o.pending)
+	o.pending = ""
+}
+
+func (o *shellOutput) print(s string) {
+	if s == "" {
+		return
+	}
+	fmt.Fprint(o.w, s)
+	o.midLine = !strings.HasSuffix(s, "\n")
+}
+
+// reset forgets output held back, for when the whole output is written again
+func (o *shellOutput) reset() {
+	o.pending, o.done = "", false
+}
+
+// close prints what was held back and ends the last line
+func (o *shellOutput) close() {
+	if !o.done {
+		o.print(o.pending)
+		o.pending = ""
+	}
+	if o.midLine {
+		fmt.Fprintln(o.w)
+	}
+}
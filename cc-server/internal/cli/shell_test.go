@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShellOutputTakesOutCwdMarker(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		want   string
+		cwd    string
+	}{
+		{"one chunk", []string{"hello\nworld\n\n" + cwdMarker + "/tmp\n"}, "hello\nworld\n", "/tmp"},
+		{"marker split across chunks", []string{"out\n", "\n__CC", "_CWD__/var/log\n"}, "out\n", "/var/log"},
+		{"directory split across chunks", []string{"x\n\n" + cwdMarker + "/a", "b\n"}, "x\n", "/ab"},
+		// The script starts the marker on a line of its own
+		{"output without a final line break", []string{"partial", "\n" + cwdMarker + "/x\n"}, "partial\n", "/x"},
+		{"nothing after the marker counts", []string{"\n" + cwdMarker + "/x\n", "late\n"}, "", "/x"},
+		{"no marker", []string{"a\n", "b"}, "a\nb\n", ""},
+		{"text that only starts like the marker", []string{"a\n__CC", "x\n"}, "a\n__CCx\n", ""},
+	} {
+		var w strings.Builder
+		out := &shellOutput{w: &w}
+		for _, chunk := range tc.chunks {
+			out.write(chunk)
+		}
+		out.close()
+		if w.String() != tc.want || out.cwd != tc.cwd {
+			t.Errorf("%s: printed %q with cwd %q, want %q with %q", tc.name, w.String(), out.cwd, tc.want, tc.cwd)
+		}
+	}
+}
+
+func TestShellOutputHoldsBackLastLineBreak(t *testing.T) {
+	var w strings.Builder
+	out := &shellOutput{w: &w}
+	out.write("line\n")
+	if w.String() != "line" {
+		t.Fatalf("printed %q before the next chunk", w.String())
+	}
+
+	// After a reset the stored result is written whole
+	out.reset()
+	out.write("line\nmore\n\n" + cwdMarker + "/srv\n")
+	out.close()
+	if w.String() != "lineline\nmore\n" || out.cwd != "/srv" {
+		t.Fatalf("printed %q with cwd %q", w.String(), out.cwd)
+	}
+}
@@ -0,0 +1,9 @@
+package cli
+
+import "syscall"
+
+// Requests that get and set terminal attributes
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package cli
+
+import "errors"
+
+// makeRaw is only implemented on Linux, macOS and the BSDs. Elsewhere lines are read as the
+// terminal delivers them, without editing keys or history navigation.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+// termSize is only implemented on Linux, macOS and the BSDs
+func termSize(fd int) (int, int, error) {
+	return 0, 0, errors.New("terminal size is not available on this platform")
+}
@@ -5,16 +5,37 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/user/cc-server/internal/protocol"
+	"github.com/user/cc-server/internal/version"
 )
 
+// agentFeatures lists the optional protocol features this agent implements
+var agentFeatures = []string{protocol.FeatureAck, protocol.FeatureQueue, protocol.FeaturePause, protocol.FeatureStreaming, protocol.FeatureSecrets, protocol.FeatureCancel, protocol.FeatureShell}
+
+// welcomeTimeout bounds how long the agent waits for the server's welcome.
+// A server that sends none by then predates the handshake, and the agent
+// carries on with the base feature set.
+const welcomeTimeout = 10 * time.Second
+
+// serverMessage is a message read from the socket, or the error reading it
+type serverMessage struct {
+	data []byte
+	err  error
+}
+
 type Client struct {
+	cfg          Config
 	serverURL    string
 	clientID     string
 	authToken    string
@@ -23,6 +44,29 @@ type Client struct {
 	ip           string
 	ctx          context.Context
 	cancel       context.CancelFunc
+	session      atomic.Pointer[protocol.Welcome] // replaced on every connect
+	journal      *journal
+	pool         *workerPool
+	transparency *transparencyLog
+
+	// paused is set while the host owner has paused the agent
+	paused atomic.Bool
+
+	// gorilla/websocket allows a single concurrent writer
+	writeMu sync.Mutex
+
+	// running holds the commands queued or running on the pool
+	runningMu sync.Mutex
+	running   map[string]*job
+	// cancelled holds cancels for commands not received yet, by when they came
+	cancelled map[string]time.Time
+
+	// events keeps recent activity for the control socket
+	events     *eventLog
+	startedAt  time.Time
+	connected  atomic.Bool
+	reconnects atomic.Int64
+	control    net.Listener
 }
 
 type RegistrationResponse struct {
@@ -31,31 +75,63 @@ type RegistrationResponse struct {
 }
 
 type ServerCommand struct {
-	ID      string `json:"id"`
-	Command string `json:"command"`
+	ID          string `json:"id"`
+	Command     string `json:"command"`
+	Task        string `json:"task,omitempty"`
+	Cwd         string `json:"cwd,omitempty"` // directory a shell line runs in
+	Operator    string `json:"operator,omitempty"`
+	Concurrency string `json:"concurrency,omitempty"` // parallel (default) or serial
+	SerialKey   string `json:"serial_key,omitempty"`
+
+	Limits *protocol.ResourceLimits `json:"limits,omitempty"`
+
+	// Values of server-managed secrets, kept in memory only. They are
+	// masked in everything sent back.
+	SecretEnv   map[string]string `json:"secret_env,omitempty"`
+	SecretStdin string            `json:"secret_stdin,omitempty"`
 }
 
-type CommandResult struct {
-	CommandID string `json:"command_id"`
-	Result    string `json:"result"`
-	Status    string `json:"status"` // success, error
-	Error     string `json:"error,omitempty"`
-}
+// CommandResult is sent back to the server once a command has run
+type CommandResult = protocol.Result
 
 // NewClient creates a new C&C client
-func NewClient(serverURL string) (*Client, error) {
+func NewClient(cfg Config) (*Client, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hostname: %v", err)
 	}
 
+	j, err := openJournal(cfg.JournalPath, cfg.JournalSize)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	c := &Client{
-		serverURL: serverURL,
+		cfg:       cfg,
+		serverURL: cfg.ServerURL,
 		hostname:  hostname,
 		ctx:       ctx,
 		cancel:    cancel,
+		journal:   j,
+		running:   make(map[string]*job),
+		cancelled: make(map[string]time.Time),
+		events:    newEventLog(eventLogSize),
+		startedAt: time.Now(),
+
+		transparency: newTransparencyLog(cfg.TransparencyLog),
+	}
+	paused, _ := IsPaused(cfg.PauseFile)
+	c.paused.Store(paused)
+	go c.watchPause()
+	c.pool = newWorkerPool(ctx, cfg.Workers, cfg.QueueSize, c.executeCommand)
+
+	if cfg.ControlSocket != "" {
+		if err := c.listenControl(cfg.ControlSocket); err != nil {
+			cancel()
+			return nil, err
+		}
 	}
 	
 	return c, nil
@@ -71,10 +147,15 @@ func (c *Client) Register(registrationToken string) error {
 	c.ip = ip
 
 	// Prepare registration request
-	registrationData := map[string]string{
+	registrationData := map[string]interface{}{
 		"token":    registrationToken,
 		"hostname": c.hostname,
 		"ip":       c.ip,
+		"version":  version.Version,
+		"protocol": version.Protocol,
+	}
+	if len(c.cfg.Labels) > 0 {
+		registrationData["labels"] = c.cfg.Labels
 	}
 
 	jsonData, err := json.Marshal(registrationData)
@@ -96,6 +177,16 @@ func (c *Client) Register(registrationToken string) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return fmt.Errorf("server refused agent %s: protocol %d is too old, please upgrade", version.Version, version.Protocol)
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("server rejected registration: %s", body.Error)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("registration failed with status: %d", resp.StatusCode)
 	}
@@ -108,7 +199,7 @@ func (c *Client) Register(registrationToken string) error {
 	c.clientID = regResp.ClientID
 	c.authToken = regResp.Token
 
-	log.Printf("Client registered successfully with ID: %s", c.clientID)
+	c.logf("Client registered successfully with ID: %s", c.clientID)
 	return nil
 }
 
@@ -123,30 +214,131 @@ func (c *Client) getClientIP() (string, error) {
 // Connect connects the client to the server via WebSocket
 func (c *Client) Connect() error {
 	// Build WebSocket URL with authentication
-	wsURL := fmt.Sprintf("%s/ws?client_id=%s", c.serverURL, c.clientID)
+	wsURL := fmt.Sprintf("%s/ws/agent?client_id=%s", c.serverURL, c.clientID)
 	header := http.Header{}
 	header.Set("Authorization", c.authToken)
+	header.Set("X-Agent-Version", version.Version)
+	header.Set("X-Agent-Protocol", strconv.Itoa(version.Protocol))
 
 	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %v", err)
 	}
 
+	session, first, err := c.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	c.writeMu.Lock()
 	c.conn = conn
-	log.Printf("Connected to server as client %s", c.clientID)
+	c.writeMu.Unlock()
+	c.session.Store(&session)
+	c.connected.Store(true)
+	c.logf("Connected to server %s as client %s (protocol %d, features %v)",
+		session.ServerVersion, c.clientID, session.Protocol, session.Features)
+
+	// Let the server know straight away if the owner paused us
+	if c.paused.Load() {
+		c.sendStatus()
+	}
 
 	// Start heartbeat routine
 	go c.sendHeartbeats()
 	
 	// Start message handler
-	go c.handleServerMessages()
+	go c.handleServerMessages(first)
 
 	return nil
 }
 
+// handshake announces the agent and waits for the negotiated session. The
+// first message is read in the background so that a server too old to send
+// a welcome neither blocks the agent nor loses the message it sends instead:
+// that message is left on the returned channel for handleServerMessages.
+func (c *Client) handshake(conn *websocket.Conn) (protocol.Welcome, <-chan serverMessage, error) {
+	hello := protocol.Hello{
+		Type:         protocol.TypeHello,
+		Protocol:     version.Protocol,
+		AgentVersion: version.Version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Features:     agentFeatures,
+	}
+	if err := conn.WriteJSON(hello); err != nil {
+		return protocol.Welcome{}, nil, fmt.Errorf("failed to send hello: %v", err)
+	}
+
+	first := make(chan serverMessage, 1)
+	go func() {
+		_, data, err := conn.ReadMessage()
+		first <- serverMessage{data: data, err: err}
+	}()
+
+	timer := time.NewTimer(welcomeTimeout)
+	defer timer.Stop()
+
+	var msg serverMessage
+	select {
+	case msg = <-first:
+	case <-timer.C:
+		c.logf("No welcome from the server within %v, using the base feature set", welcomeTimeout)
+		return baseSession(), first, nil
+	}
+	if msg.err != nil {
+		return protocol.Welcome{}, nil, fmt.Errorf("failed to read welcome: %v", msg.err)
+	}
+
+	var welcome protocol.Welcome
+	if err := json.Unmarshal(msg.data, &welcome); err != nil || welcome.Type != protocol.TypeWelcome {
+		// An old server sends commands straight away; keep this one for
+		// the message loop
+		c.logf("Server sent no welcome, using the base feature set")
+		pending := make(chan serverMessage, 1)
+		pending <- msg
+		return baseSession(), pending, nil
+	}
+
+	// Only rely on what the agent itself offered, whatever the server says
+	welcome.Features = protocol.Intersect(welcome.Features, agentFeatures)
+	if welcome.Limits.MaxMessageBytes > 0 {
+		conn.SetReadLimit(welcome.Limits.MaxMessageBytes)
+	}
+	return welcome, nil, nil
+}
+
+// baseSession is the session with a server that predates the handshake:
+// the protocol before it and no optional features
+func baseSession() protocol.Welcome {
+	return protocol.Welcome{
+		Type:          protocol.TypeWelcome,
+		Protocol:      protocol.HandshakeProtocol - 1,
+		ServerVersion: "unknown",
+	}
+}
+
+// currentSession returns the session negotiated on the latest connect, or the
+// base session before the first one
+func (c *Client) currentSession() *protocol.Welcome {
+	if session := c.session.Load(); session != nil {
+		return session
+	}
+	base := baseSession()
+	return &base
+}
+
+// heartbeatInterval returns the interval requested by the server
+func (c *Client) heartbeatInterval() time.Duration {
+	if secs := c.currentSession().Limits.HeartbeatInterval; secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 30 * time.Second
+}
+
 // sendHeartbeats sends periodic heartbeats to the server
 func (c *Client) sendHeartbeats() {
-	ticker := time.NewTicker(30 * time.Second) // Send heartbeat every 30 seconds
+	ticker := time.NewTicker(c.heartbeatInterval())
 	defer ticker.Stop()
 
 	for {
@@ -155,13 +347,13 @@ func (c *Client) sendHeartbeats() {
 			return
 		case <-ticker.C:
 			heartbeat := map[string]interface{}{
-				"type":      "heartbeat",
+				"type":      protocol.TypeHeartbeat,
 				"client_id": c.clientID,
 				"timestamp": time.Now().Unix(),
 			}
 			
-			if err := c.conn.WriteJSON(heartbeat); err != nil {
-				log.Printf("Failed to send heartbeat: %v", err)
+			if err := c.send(heartbeat); err != nil {
+				c.logf("Failed to send heartbeat: %v", err)
 				// Attempt to reconnect
 				c.reconnect()
 				return
@@ -170,73 +362,304 @@ func (c *Client) sendHeartbeats() {
 	}
 }
 
-// handleServerMessages handles incoming messages from the server
-func (c *Client) handleServerMessages() {
+// handleServerMessages handles incoming messages from the server. first,
+// when not nil, carries the message the handshake read but did not use.
+func (c *Client) handleServerMessages(first <-chan serverMessage) {
 	for {
-		_, message, err := c.conn.ReadMessage()
+		var message []byte
+		var err error
+		if first != nil {
+			msg := <-first
+			message, err, first = msg.data, msg.err, nil
+		} else {
+			_, message, err = c.conn.ReadMessage()
+		}
 		if err != nil {
-			log.Printf("Failed to read message from server: %v", err)
+			c.logf("Failed to read message from server: %v", err)
 			// Attempt to reconnect
 			c.reconnect()
 			return
 		}
+		c.handleMessage(message)
+	}
+}
 
-		var cmd ServerCommand
-		if err := json.Unmarshal(message, &cmd); err != nil {
-			log.Printf("Failed to unmarshal command: %v", err)
-			continue
+// handleMessage acts on one message from the server
+func (c *Client) handleMessage(message []byte) {
+	var env protocol.Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		c.logf("Failed to unmarshal message: %v", err)
+		return
+	}
+
+	if env.Type == protocol.TypeCancel {
+		var cancel protocol.Cancel
+		if err := json.Unmarshal(message, &cancel); err != nil {
+			c.logf("Failed to unmarshal cancel: %v", err)
+			return
 		}
+		c.cancelJob(cancel.CommandID)
+		return
+	}
+
+	// Commands predate typed messages and may arrive without a type
+	if env.Type != "" && env.Type != protocol.TypeCommand {
+		c.logf("Ignoring unsupported %q message", env.Type)
+		return
+	}
 
-		go c.executeCommand(cmd)
+	var cmd ServerCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		c.logf("Failed to unmarshal command: %v", err)
+		return
 	}
+
+	c.dispatch(cmd)
 }
 
-// executeCommand executes a command received from the server
+// dispatch hands a command received from the server to the worker pool
+func (c *Client) dispatch(cmd ServerCommand) {
+	if c.paused.Load() {
+		c.logf("Command %s refused, agent is paused", cmd.ID)
+		c.transparency.record(cmd, decisionPaused, nil, "")
+		c.sendResult(CommandResult{
+			CommandID: cmd.ID,
+			Status:    protocol.StatusPaused,
+			Error:     "agent paused by host owner",
+		})
+		return
+	}
+
+	// A re-delivery of a command still queued or running here only needs the ack
+	if !c.markRunning(cmd) {
+		c.ack(cmd.ID, protocol.AckReceived)
+		return
+	}
+
+	if entry, ok := c.journal.lookup(cmd.ID); ok {
+		c.clearRunning(cmd.ID)
+		c.ack(cmd.ID, protocol.AckReceived)
+		if entry.State == journalStarted {
+			c.transparency.record(cmd, decisionInterrupted, nil, "")
+		} else {
+			c.transparency.record(cmd, decisionDuplicate, nil, "")
+		}
+		c.reportDuplicate(cmd, entry)
+		return
+	}
+
+	// Servers that cannot handle busy replies get back-pressure instead
+	block := !c.currentSession().Has(protocol.FeatureQueue)
+	switch c.pool.submit(cmd, block) {
+	case submitStarted:
+		c.transparency.record(cmd, decisionAccepted, nil, "")
+		c.ack(cmd.ID, protocol.AckReceived)
+	case submitQueued:
+		c.logf("Command %s queued, all workers busy", cmd.ID)
+		c.transparency.record(cmd, decisionQueued, nil, "")
+		c.ack(cmd.ID, protocol.AckQueued)
+	case submitBusy:
+		c.logf("Command %s refused, queue full", cmd.ID)
+		c.transparency.record(cmd, decisionBusy, nil, "")
+		c.clearRunning(cmd.ID)
+		c.sendResult(CommandResult{
+			CommandID: cmd.ID,
+			Status:    protocol.StatusBusy,
+			Error:     "agent queue is full",
+		})
+	}
+}
+
+// ack acknowledges a command if the session uses acks
+func (c *Client) ack(commandID, stage string) {
+	if !c.currentSession().Has(protocol.FeatureAck) {
+		return
+	}
+	if stage == protocol.AckQueued && !c.currentSession().Has(protocol.FeatureQueue) {
+		stage = protocol.AckReceived
+	}
+	ack := protocol.Ack{Type: protocol.TypeAck, CommandID: commandID, Stage: stage}
+	if err := c.send(ack); err != nil {
+		c.logf("Failed to acknowledge command %s: %v", commandID, err)
+	}
+}
+
+// executeCommand executes a command on a pool worker
 func (c *Client) executeCommand(cmd ServerCommand) {
-	log.Printf("Executing command: %s", cmd.Command)
+	defer c.clearRunning(cmd.ID)
+
+	if by := c.jobKilled(cmd.ID); by != "" {
+		reason := killReason(by) + " before it started"
+		c.transparency.record(cmd, decisionFailed, nil, reason)
+		c.sendResult(CommandResult{
+			CommandID: cmd.ID,
+			Status:    killStatus(by),
+			Error:     reason,
+		})
+		return
+	}
+
+	if err := c.journal.begin(cmd.ID); err != nil {
+		// Without a journal entry a crash could run the command twice
+		c.logf("Refusing command %s: %v", cmd.ID, err)
+		c.transparency.record(cmd, decisionFailed, nil, "agent journal unavailable")
+		c.sendResult(CommandResult{
+			CommandID: cmd.ID,
+			Status:    protocol.StatusError,
+			Error:     fmt.Sprintf("agent journal unavailable: %v", err),
+		})
+		return
+	}
+
+	c.logf("Executing command: %s", cmd.Command)
 	
 	// Execute the command
-	result, err := c.runCommand(cmd.Command)
+	out := c.runCommand(cmd)
+	// Secret values never leave the agent, so mask them before truncating
+	secrets := newSecretMasker(cmd)
+	result := secrets.mask(out.output)
 	
+	// Stay within the output size the server accepts
+	if max := c.currentSession().Limits.MaxOutputBytes; max > 0 && len(result) > max {
+		result = result[:max] + "\n[output truncated]"
+	}
+
 	// Send the result back to the server
 	resultMsg := CommandResult{
 		CommandID: cmd.ID,
-		Status:    "success",
+		Status:    protocol.StatusSuccess,
 		Result:    result,
 	}
+	if out.exitCode >= 0 {
+		resultMsg.ExitCode = &out.exitCode
+	}
 	
-	if err != nil {
-		resultMsg.Status = "error"
-		resultMsg.Error = err.Error()
+	if out.err != nil {
+		resultMsg.Status = protocol.StatusError
+		resultMsg.Error = out.err.Error()
 		resultMsg.Result = ""
 	}
+	if out.limit != "" {
+		c.logf("Command %s stopped by %s limit", cmd.ID, out.limit)
+		resultMsg.Status = protocol.StatusLimitExceeded
+		resultMsg.LimitExceeded = out.limit
+		resultMsg.Result = result
+	}
+	if by := c.jobKilled(cmd.ID); by != "" {
+		resultMsg.Status = killStatus(by)
+		resultMsg.Error = killReason(by)
+		resultMsg.LimitExceeded = ""
+		resultMsg.Result = result
+	}
+	resultMsg.Error = secrets.mask(resultMsg.Error)
+	c.transparency.record(cmd, decisionFinished, &out.exitCode, resultMsg.Status)
 
-	if err := c.conn.WriteJSON(resultMsg); err != nil {
-		log.Printf("Failed to send command result: %v", err)
+	if err := c.journal.finish(cmd.ID, resultMsg.Status, resultMsg.Error); err != nil {
+		c.logf("Failed to journal command %s: %v", cmd.ID, err)
 	}
+	c.sendResult(resultMsg)
 }
 
-// runCommand runs a shell command and returns the output
-func (c *Client) runCommand(command string) (string, error) {
-	cmd := exec.Command("/bin/sh", "-c", command)
-	output, err := cmd.CombinedOutput()
-	
-	return string(output), err
+// killReason describes why a killed command stopped
+func killReason(by string) string {
+	if by == killedByOperator {
+		return "cancelled by operator"
+	}
+	return "killed by " + by
+}
+
+// killStatus returns the result status of a killed command
+func killStatus(by string) string {
+	if by == killedByOperator {
+		return protocol.StatusCancelled
+	}
+	return protocol.StatusError
+}
+
+// reportDuplicate answers a re-delivered command from the journal instead
+// of running it again
+func (c *Client) reportDuplicate(cmd ServerCommand, entry journalEntry) {
+	res := CommandResult{
+		CommandID: cmd.ID,
+		Status:    protocol.StatusDuplicate,
+		Original:  entry.Status,
+		Error:     entry.Error,
+	}
+	if entry.State == journalStarted {
+		c.logf("Command %s was interrupted by an agent restart, not running it again", cmd.ID)
+		res.Status = protocol.StatusInterrupted
+		res.Original = ""
+	} else {
+		c.logf("Command %s already ran at %s, not running it again", cmd.ID, entry.Time.Format(time.RFC3339))
+		res.Result = fmt.Sprintf("[already executed at %s]", entry.Time.Format(time.RFC3339))
+	}
+	c.sendResult(res)
+}
+
+func (c *Client) sendResult(res CommandResult) {
+	res.Type = protocol.TypeResult
+	if err := c.send(res); err != nil {
+		c.logf("Failed to send command result: %v", err)
+	}
+}
+
+// send writes a JSON message to the server
+func (c *Client) send(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.conn.WriteJSON(v)
+}
+
+// runCommand runs a shell command under the agent's and the command's
+// resource limits, whichever are stricter, as the user the agent policy
+// picks for it
+func (c *Client) runCommand(cmd ServerCommand) runOutcome {
+	limits := c.cfg.Limits
+	if cmd.Limits != nil {
+		limits = limits.Tighten(*cmd.Limits)
+	}
+
+	var run *resolvedRunAs
+	if c.cfg.Policy != nil {
+		var err error
+		if run, err = resolveRunAs(c.cfg.Policy.runAsFor(cmd.Command, cmd.Task)); err != nil {
+			return runOutcome{exitCode: -1, err: fmt.Errorf("agent policy: %v", err)}
+		}
+	}
+	// A shell line is wrapped only now, after the policy matched it as
+	// typed. Servers without the feature send it wrapped already.
+	script := cmd.Command
+	if cmd.Task == protocol.ShellTask && c.currentSession().Has(protocol.FeatureShell) {
+		script = protocol.WrapShellLine(cmd.Command, cmd.Cwd)
+	}
+
+	// Chunks still buffered are sent before the result
+	stream := c.newOutputStream(cmd.ID, newSecretMasker(cmd))
+	defer stream.close()
+
+	return runLimited(script, limits, run, secretEnv(cmd), cmd.SecretStdin, func(p *exec.Cmd) {
+		c.startJob(cmd.ID, func() { killCommand(p) })
+	}, stream.write)
 }
 
 // reconnect attempts to reconnect to the server
 func (c *Client) reconnect() {
-	log.Printf("Attempting to reconnect...")
+	c.connected.Store(false)
+	c.logf("Attempting to reconnect...")
 	
 	// Wait before reconnecting
 	time.Sleep(5 * time.Second)
 	
 	if err := c.Connect(); err != nil {
-		log.Printf("Reconnection failed: %v", err)
+		c.logf("Reconnection failed: %v", err)
 		// Schedule another reconnection attempt
 		go c.reconnect()
 	} else {
-		log.Printf("Reconnected successfully")
+		c.reconnects.Add(1)
+		c.logf("Reconnected successfully")
 	}
 }
 
@@ -249,4 +672,8 @@ func (c *Client) Close() {
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	if c.control != nil {
+		c.control.Close()
+		os.Remove(c.cfg.ControlSocket)
+	}
 }
\ No newline at end of file
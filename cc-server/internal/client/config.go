@@ -0,0 +1,69 @@
+package client
+
+import (
+	"path/filepath"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// Config holds the settings of an agent
+type Config struct {
+	// ServerURL is the base URL of the C&C server
+	ServerURL string
+
+	// Labels are sent at registration so operators can target this agent
+	// with a selector, e.g. role=build
+	Labels map[string]string
+
+	// JournalPath is the file recording commands already run, so that
+	// re-delivered commands are not run twice
+	JournalPath string
+
+	// JournalSize is how many recent commands the journal remembers
+	JournalSize int
+
+	// Workers is how many commands may run at once. Serial commands count
+	// against it too, and also wait for the lane of their serial key.
+	Workers int
+
+	// QueueSize is how many commands may wait for a worker (or per serial
+	// lane) before new ones are refused as busy
+	QueueSize int
+
+	// Limits apply to every command. Limits sent with a command can only
+	// tighten them.
+	Limits protocol.ResourceLimits
+
+	// Policy picks the user, environment and working directory of each
+	// command. Without a policy commands inherit the agent's.
+	Policy *Policy
+
+	// TransparencyLog is a file only the agent's user can read, recording
+	// every command received, who sent it, what the agent decided and how
+	// it exited
+	TransparencyLog string
+
+	// PauseFile makes the agent refuse new work while it exists. It is
+	// managed with "cc-client pause" and "cc-client resume".
+	PauseFile string
+
+	// ControlSocket is the Unix socket "cc-client status", "jobs" and
+	// "logs" talk to. Its directory must be private to the agent's user.
+	// Empty disables it; it is only supported on Linux.
+	ControlSocket string
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		ServerURL:   "http://localhost:8080",
+		JournalPath: filepath.Join(defaultStateDir, "journal"),
+		JournalSize: 1000,
+		Workers:     4,
+		QueueSize:   16,
+
+		TransparencyLog: filepath.Join(defaultLogDir, "transparency.log"),
+		PauseFile:       filepath.Join(defaultStateDir, "paused"),
+		ControlSocket:   defaultControlSocket,
+	}
+}
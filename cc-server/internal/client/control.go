@@ -0,0 +1,180 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/user/cc-server/internal/version"
+)
+
+// Actions understood by the control socket
+const (
+	ControlStatus = "status"
+	ControlJobs   = "jobs"
+	ControlKill   = "kill"
+	ControlLogs   = "logs"
+)
+
+// controlTimeout bounds a single exchange on the control socket
+const controlTimeout = 5 * time.Second
+
+// ControlRequest is sent by "cc-client" to a running agent
+type ControlRequest struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`    // command to kill
+	Lines  int    `json:"lines,omitempty"` // number of events for logs
+}
+
+// ControlResponse is the agent's answer to a ControlRequest
+type ControlResponse struct {
+	Error  string      `json:"error,omitempty"`
+	Status *AgentState `json:"status,omitempty"`
+	Jobs   []JobInfo   `json:"jobs,omitempty"`
+	Events []Event     `json:"events,omitempty"`
+}
+
+// AgentState describes a running agent
+type AgentState struct {
+	Connected  bool      `json:"connected"`
+	Paused     bool      `json:"paused"`
+	Server     string    `json:"server"`
+	AgentID    string    `json:"agent_id"`
+	Version    string    `json:"version"`
+	StartedAt  time.Time `json:"started_at"`
+	Reconnects int64     `json:"reconnects"`
+	Workers    int       `json:"workers"`
+	Jobs       int       `json:"jobs"`
+}
+
+// listenControl opens the control socket. Only the agent's user and root
+// may use it: the socket is created inside a directory private to the
+// agent's user, so nobody else can reach it even before its own permissions
+// are set, and the credentials of every peer are checked.
+func (c *Client) listenControl(path string) error {
+	if err := controlSupported(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create control socket directory: %v", err)
+	}
+	if err := checkPrivateDir(dir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use by another agent", path)
+		}
+		// Left behind by an agent that did not shut down cleanly
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to open control socket: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to restrict control socket: %v", err)
+	}
+
+	c.control = l
+	go c.serveControl(l)
+	return nil
+}
+
+func (c *Client) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.logf("Control socket stopped: %v", err)
+			}
+			return
+		}
+		go c.handleControl(conn)
+	}
+}
+
+func (c *Client) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	enc := json.NewEncoder(conn)
+	if !controlPeerAllowed(conn) {
+		enc.Encode(ControlResponse{Error: "permission denied"})
+		return
+	}
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		enc.Encode(ControlResponse{Error: "invalid request"})
+		return
+	}
+
+	var resp ControlResponse
+	switch req.Action {
+	case ControlStatus:
+		resp.Status = c.state()
+	case ControlJobs:
+		resp.Jobs = c.jobs()
+	case ControlKill:
+		if err := c.killJob(req.ID, killedByOwner); err != nil {
+			resp.Error = err.Error()
+		}
+	case ControlLogs:
+		resp.Events = c.events.tail(req.Lines)
+	default:
+		resp.Error = fmt.Sprintf("unknown action %q", req.Action)
+	}
+	enc.Encode(resp)
+}
+
+// state reports what the agent is doing
+func (c *Client) state() *AgentState {
+	c.runningMu.Lock()
+	jobs := len(c.running)
+	c.runningMu.Unlock()
+
+	return &AgentState{
+		Connected:  c.connected.Load(),
+		Paused:     c.paused.Load(),
+		Server:     c.serverURL,
+		AgentID:    c.clientID,
+		Version:    version.Version,
+		StartedAt:  c.startedAt.UTC(),
+		Reconnects: c.reconnects.Load(),
+		Workers:    c.cfg.Workers,
+		Jobs:       jobs,
+	}
+}
+
+// QueryControl sends a request to the agent listening on the control
+// socket at path
+func QueryControl(path string, req ControlRequest) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("agent is not running or control socket %s is not reachable: %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return &resp, nil
+}
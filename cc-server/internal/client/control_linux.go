@@ -0,0 +1,62 @@
+//go:build linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultControlSocket is where the agent listens unless told otherwise
+var defaultControlSocket = filepath.Join(defaultRunDir, "control.sock")
+
+// controlSupported reports whether the control socket can be opened here
+func controlSupported() error {
+	return nil
+}
+
+// checkPrivateDir makes sure only the agent's user can enter dir, so the
+// control socket inside it is never reachable by anyone else
+func checkPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check control socket directory: %v", err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok {
+		return fmt.Errorf("control socket directory %s is not a directory", dir)
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("control socket directory %s is not owned by the agent's user", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("control socket directory %s must not be accessible to other users (mode %04o, want 0700)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// controlPeerAllowed lets root and the agent's own user use the control
+// socket, whatever its file permissions end up being
+func controlPeerAllowed(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return false
+	}
+	return cred.Uid == 0 || cred.Uid == uint32(os.Getuid())
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+// defaultControlSocket is empty: the control socket is off by default where
+// it is not supported
+const defaultControlSocket = ""
+
+// controlSupported refuses the control socket: without peer credentials
+// the agent cannot tell who is asking it to list or kill commands
+func controlSupported() error {
+	return errors.New("the control socket is only supported on Linux; run with -control-socket \"\"")
+}
+
+func checkPrivateDir(dir string) error {
+	return controlSupported()
+}
+
+func controlPeerAllowed(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newControlTestClient starts an agent with all its files in a temporary
+// directory and its control socket at socket
+func newControlTestClient(t *testing.T, socket string) *Client {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.JournalPath = filepath.Join(dir, "journal")
+	cfg.TransparencyLog = filepath.Join(dir, "transparency.log")
+	cfg.PauseFile = filepath.Join(dir, "paused")
+	cfg.ControlSocket = socket
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestControlSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "run", "control.sock")
+	c := newControlTestClient(t, socket)
+	c.clientID = "client_1"
+
+	info, err := os.Stat(filepath.Dir(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("socket directory mode = %04o, want 0700", perm)
+	}
+	info, err = os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode = %04o, want 0600", perm)
+	}
+
+	resp, err := QueryControl(socket, ControlRequest{Action: ControlStatus})
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if resp.Status == nil || resp.Status.AgentID != "client_1" || resp.Status.Workers != c.cfg.Workers {
+		t.Fatalf("status = %+v", resp.Status)
+	}
+
+	// A queued command shows up in jobs and can be killed
+	if !c.markRunning(ServerCommand{ID: "cmd_1", Command: "sleep 60", Operator: "alice"}) {
+		t.Fatal("markRunning refused a new command")
+	}
+	resp, err = QueryControl(socket, ControlRequest{Action: ControlJobs})
+	if err != nil {
+		t.Fatalf("jobs: %v", err)
+	}
+	if len(resp.Jobs) != 1 || resp.Jobs[0].ID != "cmd_1" || resp.Jobs[0].State != jobQueued || resp.Jobs[0].Operator != "alice" {
+		t.Fatalf("jobs = %+v", resp.Jobs)
+	}
+	if _, err := QueryControl(socket, ControlRequest{Action: ControlKill, ID: "cmd_1"}); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	if by := c.jobKilled("cmd_1"); by != killedByOwner {
+		t.Fatalf("command killed by %q, want %q", by, killedByOwner)
+	}
+	if _, err := QueryControl(socket, ControlRequest{Action: ControlKill, ID: "cmd_2"}); err == nil {
+		t.Fatal("killing an unknown command succeeded")
+	}
+
+	resp, err = QueryControl(socket, ControlRequest{Action: ControlLogs, Lines: 10})
+	if err != nil {
+		t.Fatalf("logs: %v", err)
+	}
+	found := false
+	for _, e := range resp.Events {
+		found = found || strings.Contains(e.Message, "cmd_1 killed by host owner")
+	}
+	if !found {
+		t.Fatalf("logs do not record the kill: %+v", resp.Events)
+	}
+
+	if _, err := QueryControl(socket, ControlRequest{Action: "reboot"}); err == nil || !strings.Contains(err.Error(), "unknown action") {
+		t.Fatalf("unknown action: err = %v", err)
+	}
+}
+
+func TestControlSocketInUse(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "run", "control.sock")
+	newControlTestClient(t, socket)
+
+	c := &Client{}
+	if err := c.listenControl(socket); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second agent on the socket: err = %v", err)
+	}
+}
+
+func TestControlSocketStale(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "control.sock")
+	if err := os.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newControlTestClient(t, socket)
+	if _, err := QueryControl(socket, ControlRequest{Action: ControlStatus}); err != nil {
+		t.Fatalf("status after replacing a stale socket: %v", err)
+	}
+}
+
+func TestControlSocketSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{}
+	err := c.listenControl(filepath.Join(dir, "control.sock"))
+	if err == nil || !strings.Contains(err.Error(), "must not be accessible") {
+		t.Fatalf("socket in a shared directory: err = %v", err)
+	}
+}
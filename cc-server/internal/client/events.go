@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// eventLogSize is how many recent events the agent keeps for "cc-client logs"
+const eventLogSize = 200
+
+// Event is one line of the agent's recent activity
+type Event struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// eventLog keeps the most recent events in a ring
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]Event, size)}
+}
+
+func (l *eventLog) add(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = Event{Time: time.Now().UTC(), Message: msg}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// tail returns up to n events, oldest first
+func (l *eventLog) tail(n int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []Event
+	if l.full {
+		out = append(out, l.events[l.next:]...)
+	}
+	out = append(out, l.events[:l.next]...)
+	if n > 0 && len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// logf logs a message and keeps it among the agent's recent events
+func (c *Client) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	c.events.add(msg)
+}
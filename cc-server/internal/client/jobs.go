@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Job states shown by "cc-client jobs"
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+)
+
+// Who killed a command
+const (
+	killedByOwner    = "host owner"
+	killedByOperator = "operator"
+)
+
+// cancelMemory is how long a cancel for a command the agent has not received
+// yet is kept, in case the command arrives after it
+const cancelMemory = time.Hour
+
+// job is a command accepted by the agent that has not finished yet
+type job struct {
+	cmd      ServerCommand
+	state    string
+	queuedAt time.Time
+	started  time.Time
+	kill     func()
+	killed   bool
+	killedBy string
+}
+
+// JobInfo describes a queued or running command
+type JobInfo struct {
+	ID       string    `json:"id"`
+	Command  string    `json:"command"`
+	Operator string    `json:"operator,omitempty"`
+	State    string    `json:"state"`
+	QueuedAt time.Time `json:"queued_at"`
+	Started  time.Time `json:"started,omitempty"`
+	Killed   bool      `json:"killed,omitempty"`
+}
+
+// markRunning records a command as accepted and reports false if it
+// already was
+func (c *Client) markRunning(cmd ServerCommand) bool {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if _, ok := c.running[cmd.ID]; ok {
+		return false
+	}
+	j := &job{cmd: cmd, state: jobQueued, queuedAt: time.Now().UTC()}
+	if _, ok := c.cancelled[cmd.ID]; ok {
+		// Cancelled before it got here; it never starts
+		delete(c.cancelled, cmd.ID)
+		j.killed, j.killedBy = true, killedByOperator
+	}
+	c.running[cmd.ID] = j
+	return true
+}
+
+func (c *Client) clearRunning(commandID string) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	delete(c.running, commandID)
+}
+
+// startJob records that a command's process started and how to kill it.
+// A command killed while it was starting is killed straight away.
+func (c *Client) startJob(commandID string, kill func()) {
+	c.runningMu.Lock()
+	j, ok := c.running[commandID]
+	if ok {
+		j.state = jobRunning
+		j.started = time.Now().UTC()
+		j.kill = kill
+	}
+	c.runningMu.Unlock()
+
+	if ok && j.killed {
+		kill()
+	}
+}
+
+// jobKilled reports who killed a command, or "" if nobody did
+func (c *Client) jobKilled(commandID string) string {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	j, ok := c.running[commandID]
+	if !ok || !j.killed {
+		return ""
+	}
+	return j.killedBy
+}
+
+// killJob kills a running command, or makes sure a queued one never starts
+func (c *Client) killJob(commandID, by string) error {
+	c.runningMu.Lock()
+	j, ok := c.running[commandID]
+	if !ok {
+		c.runningMu.Unlock()
+		return fmt.Errorf("no queued or running command %s", commandID)
+	}
+	if j.killed {
+		c.runningMu.Unlock()
+		return nil
+	}
+	j.killed, j.killedBy = true, by
+	kill := j.kill
+	c.runningMu.Unlock()
+
+	c.logf("Command %s killed by %s", commandID, by)
+	if kill != nil {
+		kill()
+	}
+	return nil
+}
+
+// cancelJob kills a command on the server's request. A command not seen yet
+// is remembered, as the cancel may overtake a re-delivery of it.
+func (c *Client) cancelJob(commandID string) {
+	if c.killJob(commandID, killedByOperator) == nil {
+		return
+	}
+	if _, ok := c.journal.lookup(commandID); ok {
+		// It already ran; the server has or will get its result
+		return
+	}
+
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	now := time.Now()
+	for id, at := range c.cancelled {
+		if now.Sub(at) > cancelMemory {
+			delete(c.cancelled, id)
+		}
+	}
+	c.cancelled[commandID] = now
+	c.logf("Command %s cancelled before it arrived", commandID)
+}
+
+// jobs lists the queued and running commands, oldest first
+func (c *Client) jobs() []JobInfo {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+
+	list := make([]JobInfo, 0, len(c.running))
+	for id, j := range c.running {
+		list = append(list, JobInfo{
+			ID:       id,
+			Command:  j.cmd.Command,
+			Operator: j.cmd.Operator,
+			State:    j.state,
+			QueuedAt: j.queuedAt,
+			Started:  j.started,
+			Killed:   j.killed,
+		})
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].QueuedAt.Before(list[b].QueuedAt) })
+	return list
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal entry states
+const (
+	journalStarted  = "started"
+	journalFinished = "finished"
+)
+
+// journalEntry records what the agent did with one command
+type journalEntry struct {
+	CommandID string    `json:"command_id"`
+	State     string    `json:"state"`
+	Status    string    `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// journal is a small append-only log of command IDs the agent has run. It
+// survives restarts, so a command re-delivered by the server is reported
+// instead of being run a second time.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	max     int
+	entries map[string]journalEntry
+	order   []string
+	lines   int
+}
+
+// openJournal loads the journal at path, creating it and its directory if
+// needed. Only the most recent max commands are remembered.
+func openJournal(path string, max int) (*journal, error) {
+	j := &journal{
+		path:    path,
+		max:     max,
+		entries: make(map[string]journalEntry),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A torn last line from a crash is expected; skip it
+			continue
+		}
+		j.remember(e)
+		j.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %v", err)
+	}
+	return j, nil
+}
+
+// lookup returns what is known about a command
+func (j *journal) lookup(commandID string) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.entries[commandID]
+	return e, ok
+}
+
+// begin records that a command is about to run. It is synced to disk before
+// the command starts, so a crash cannot lead to a second run.
+func (j *journal) begin(commandID string) error {
+	return j.append(journalEntry{CommandID: commandID, State: journalStarted})
+}
+
+// finish records the outcome of a command
+func (j *journal) finish(commandID, status, errMsg string) error {
+	return j.append(journalEntry{CommandID: commandID, State: journalFinished, Status: status, Error: errMsg})
+}
+
+func (j *journal) append(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.Time = time.Now()
+	j.remember(e)
+
+	// Rewrite the file once it holds far more lines than entries we keep
+	if j.lines >= 2*j.max {
+		return j.compact()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	j.lines++
+	return f.Sync()
+}
+
+func (j *journal) remember(e journalEntry) {
+	if _, ok := j.entries[e.CommandID]; !ok {
+		j.order = append(j.order, e.CommandID)
+	}
+	j.entries[e.CommandID] = e
+
+	for len(j.order) > j.max {
+		delete(j.entries, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+// compact rewrites the journal with one line per remembered command
+func (j *journal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, id := range j.order {
+		data, err := json.Marshal(j.entries[id])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to compact journal: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to compact journal: %v", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to compact journal: %v", err)
+	}
+	j.lines = len(j.order)
+	return nil
+}
@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// newTestAgent starts an agent with its files in a temporary directory,
+// connected to a fake server, and returns it with the results it sends
+func newTestAgent(t *testing.T, cfg Config) (*Client, <-chan protocol.Result) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg.JournalPath = filepath.Join(dir, "journal")
+	cfg.TransparencyLog = filepath.Join(dir, "transparency.log")
+	cfg.PauseFile = filepath.Join(dir, "paused")
+	cfg.ControlSocket = ""
+
+	results := make(chan protocol.Result, 64)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var res protocol.Result
+			if json.Unmarshal(data, &res) == nil && res.Type == protocol.TypeResult {
+				results <- res
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn = conn
+	return c, results
+}
+
+// nextResult waits for the next result the agent sends
+func nextResult(t *testing.T, results <-chan protocol.Result) protocol.Result {
+	t.Helper()
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(10 * time.Second):
+		t.Fatal("no result from the agent")
+		return protocol.Result{}
+	}
+}
+
+// journalLines counts the lines of the journal file
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestJournalDefaultPathIsAbsolute(t *testing.T) {
+	if path := DefaultConfig().JournalPath; !filepath.IsAbs(path) {
+		t.Fatalf("default journal %q depends on the working directory", path)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "journal")
+	j, err := openJournal(path, 10)
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	if _, ok := j.lookup("cmd_1"); ok {
+		t.Fatal("empty journal knows a command")
+	}
+	if err := j.begin("cmd_1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.finish("cmd_1", protocol.StatusError, "exit status 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.begin("cmd_2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while writing leaves a torn last line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"command_id":"cmd_3","sta`)
+	f.Close()
+
+	j, err = openJournal(path, 10)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if e, ok := j.lookup("cmd_1"); !ok || e.State != journalFinished || e.Status != protocol.StatusError || e.Error != "exit status 2" {
+		t.Fatalf("finished command replayed as %+v, %v", e, ok)
+	}
+	if e, ok := j.lookup("cmd_2"); !ok || e.State != journalStarted {
+		t.Fatalf("interrupted command replayed as %+v, %v", e, ok)
+	}
+	if _, ok := j.lookup("cmd_3"); ok {
+		t.Fatal("torn line was replayed")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("journal mode %o, want 600", perm)
+	}
+}
+
+func TestJournalForgetsOldest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := openJournal(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"cmd_1", "cmd_2", "cmd_3", "cmd_4"} {
+		if err := j.begin(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Finishing a remembered command does not make it newer
+	if err := j.finish("cmd_2", protocol.StatusSuccess, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, j := range []*journal{j, reopenJournal(t, path, 3)} {
+		if _, ok := j.lookup("cmd_1"); ok {
+			t.Fatal("journal remembers more than its size")
+		}
+		for _, id := range []string{"cmd_2", "cmd_3", "cmd_4"} {
+			if _, ok := j.lookup(id); !ok {
+				t.Fatalf("%s forgotten", id)
+			}
+		}
+	}
+}
+
+func TestJournalCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := openJournal(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Four lines, then the fifth rewrites the file
+	j.begin("cmd_1")
+	j.finish("cmd_1", protocol.StatusSuccess, "")
+	j.begin("cmd_2")
+	j.finish("cmd_2", protocol.StatusSuccess, "")
+	if n := journalLines(t, path); n != 4 {
+		t.Fatalf("%d lines before compaction, want 4", n)
+	}
+	if err := j.begin("cmd_3"); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if n := journalLines(t, path); n != 2 {
+		t.Fatalf("%d lines after compaction, want one per remembered command", n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+
+	// Appends carry on after a compaction, and the result replays
+	if err := j.finish("cmd_3", protocol.StatusSuccess, ""); err != nil {
+		t.Fatal(err)
+	}
+	j = reopenJournal(t, path, 2)
+	if _, ok := j.lookup("cmd_1"); ok {
+		t.Fatal("forgotten command came back after compaction")
+	}
+	if e, ok := j.lookup("cmd_2"); !ok || e.State != journalFinished {
+		t.Fatalf("cmd_2 after compaction: %+v, %v", e, ok)
+	}
+	if e, ok := j.lookup("cmd_3"); !ok || e.State != journalFinished {
+		t.Fatalf("cmd_3 after compaction: %+v, %v", e, ok)
+	}
+}
+
+func TestDispatchReportsJournaledCommands(t *testing.T) {
+	c, results := newTestAgent(t, DefaultConfig())
+	c.journal.begin("cmd_done")
+	c.journal.finish("cmd_done", protocol.StatusError, "exit status 3")
+	c.journal.begin("cmd_crashed")
+
+	marker := filepath.Join(t.TempDir(), "ran")
+	c.dispatch(ServerCommand{ID: "cmd_done", Command: "echo > " + marker})
+	res := nextResult(t, results)
+	if res.CommandID != "cmd_done" || res.Status != protocol.StatusDuplicate || res.Original != protocol.StatusError ||
+		res.Error != "exit status 3" || !strings.HasPrefix(res.Result, "[already executed at ") {
+		t.Fatalf("finished command re-delivered: %+v", res)
+	}
+
+	c.dispatch(ServerCommand{ID: "cmd_crashed", Command: "echo > " + marker})
+	res = nextResult(t, results)
+	if res.CommandID != "cmd_crashed" || res.Status != protocol.StatusInterrupted || res.Original != "" {
+		t.Fatalf("interrupted command re-delivered: %+v", res)
+	}
+
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatal("a journaled command ran again")
+	}
+	if _, ok := c.journal.lookup("cmd_done"); !ok || len(c.jobs()) != 0 {
+		t.Fatal("duplicate left behind as running")
+	}
+}
+
+func reopenJournal(t *testing.T, path string, max int) *journal {
+	t.Helper()
+	j, err := openJournal(path, max)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	return j
+}
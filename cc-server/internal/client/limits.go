@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// errOutputLimit is returned by cappedBuffer once a command wrote too much
+var errOutputLimit = errors.New("output limit exceeded")
+
+// cappedBuffer collects command output up to max bytes and calls onLimit
+// the first time more is written. onWrite, if set, sees every byte kept.
+type cappedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	max     int64
+	hit     bool
+	onLimit func()
+	onWrite func([]byte)
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hit {
+		return 0, errOutputLimit
+	}
+	if b.max > 0 && int64(b.buf.Len()+len(p)) > b.max {
+		kept := p[:b.max-int64(b.buf.Len())]
+		b.buf.Write(kept)
+		if b.onWrite != nil {
+			b.onWrite(kept)
+		}
+		b.hit = true
+		if b.onLimit != nil {
+			go b.onLimit()
+		}
+		return 0, errOutputLimit
+	}
+	if b.onWrite != nil {
+		b.onWrite(p)
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *cappedBuffer) exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hit
+}
+
+// runOutcome is what happened to a command
+type runOutcome struct {
+	output   string
+	limit    string // the limit that stopped the command, if any
+	exitCode int    // -1 if the shell did not exit normally
+	err      error
+}
+
+// runLimited runs a shell command under limits, as run says when it is set.
+// env is added to its environment and stdin, if set, is its standard input.
+// onStart is called with the started process so it can be killed, and
+// onOutput, if set, with the output as it is written.
+func runLimited(command string, limits protocol.ResourceLimits, run *resolvedRunAs, env []string, stdin string, onStart func(*exec.Cmd), onOutput func([]byte)) runOutcome {
+	cmd := limitedCommand(command, limits)
+	if run != nil {
+		if err := applyRunAs(cmd, run); err != nil {
+			return runOutcome{exitCode: -1, err: err}
+		}
+	}
+	if len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+
+	var out cappedBuffer
+	out.max = limits.OutputBytes
+	out.onLimit = func() { killCommand(cmd) }
+	out.onWrite = onOutput
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Start()
+	if err == nil {
+		if onStart != nil {
+			onStart(cmd)
+		}
+		err = cmd.Wait()
+	}
+	res := runOutcome{output: out.String(), exitCode: -1, err: err}
+	if cmd.ProcessState != nil {
+		res.exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if out.exceeded() {
+		res.limit = protocol.LimitOutputBytes
+		res.err = fmt.Errorf("output exceeded %d bytes", limits.OutputBytes)
+	} else if err != nil {
+		if limit := detectLimit(cmd, res.output, limits); limit != "" {
+			res.limit = limit
+			res.err = fmt.Errorf("%s limit exceeded: %v", limit, err)
+		}
+	}
+	return res
+}
+
+// detectLimit works out whether a failed command was stopped by one of its
+// rlimits. CPU time is read from the process accounting; memory and file
+// limits surface as allocation and open errors in the output.
+func detectLimit(cmd *exec.Cmd, output string, limits protocol.ResourceLimits) string {
+	if limits.CPUSeconds > 0 && cmd.ProcessState != nil {
+		used := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		if used >= time.Duration(limits.CPUSeconds)*time.Second-100*time.Millisecond {
+			return protocol.LimitCPUTime
+		}
+		if cpuLimitSignalled(cmd.ProcessState) {
+			return protocol.LimitCPUTime
+		}
+	}
+
+	lower := strings.ToLower(output)
+	if limits.AddressSpace > 0 {
+		for _, msg := range []string{"cannot allocate memory", "out of memory", "memoryerror", "bad_alloc", "virtual memory exhausted"} {
+			if strings.Contains(lower, msg) {
+				return protocol.LimitAddressSpace
+			}
+		}
+	}
+	if limits.OpenFiles > 0 && strings.Contains(lower, "too many open files") {
+		return protocol.LimitOpenFiles
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package client
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// limitedCommand builds the shell invocation for a command. Rlimits are set
+// with ulimit in the shell that then evaluates the command, so they are in
+// place before any of its processes start and are inherited by all of them.
+func limitedCommand(command string, limits protocol.ResourceLimits) *exec.Cmd {
+	var setup []string
+	if limits.CPUSeconds > 0 {
+		setup = append(setup, fmt.Sprintf("ulimit -t %d", limits.CPUSeconds))
+	}
+	if limits.AddressSpace > 0 {
+		kib := limits.AddressSpace / 1024
+		if kib < 1 {
+			kib = 1
+		}
+		setup = append(setup, fmt.Sprintf("ulimit -v %d", kib))
+	}
+	if limits.OpenFiles > 0 {
+		setup = append(setup, fmt.Sprintf("ulimit -n %d", limits.OpenFiles))
+	}
+
+	var cmd *exec.Cmd
+	if len(setup) == 0 {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	} else {
+		script := strings.Join(setup, " && ") + ` && eval "$1"`
+		cmd = exec.Command("/bin/sh", "-c", script, "sh", command)
+	}
+
+	// Own process group, so the whole command tree can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// killCommand kills the process group of a running command
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func init() {
+	agentFeatures = append(agentFeatures, protocol.FeatureLimits)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package client
+
+import (
+	"os/exec"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// limitedCommand builds the shell invocation for a command. Rlimits are only
+// applied on Linux; elsewhere just the output limit is enforced.
+func limitedCommand(command string, limits protocol.ResourceLimits) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// killCommand kills a running command
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
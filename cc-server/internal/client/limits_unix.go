@@ -0,0 +1,19 @@
+//go:build !windows
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// cpuLimitSignalled reports whether a process was killed by SIGXCPU, the
+// signal of the CPU time rlimit, or its shell exited with that signal's
+// status
+func cpuLimitSignalled(ps *os.ProcessState) bool {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	return ws.Signaled() && ws.Signal() == syscall.SIGXCPU || ws.ExitStatus() == 128+int(syscall.SIGXCPU)
+}
@@ -0,0 +1,9 @@
+package client
+
+import "os"
+
+// cpuLimitSignalled always reports false: Windows has no SIGXCPU and no
+// CPU time rlimit to raise it
+func cpuLimitSignalled(ps *os.ProcessState) bool {
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package client
+
+// Default directories of the agent's files
+const (
+	defaultStateDir = "/var/lib/cc-client"
+	defaultLogDir   = "/var/log/cc-client"
+	defaultRunDir   = "/run/cc-client"
+)
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Default directories of the agent's files, under %ProgramData%
+var (
+	defaultStateDir = filepath.Join(programData(), "cc-client")
+	defaultLogDir   = filepath.Join(programData(), "cc-client", "logs")
+)
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// pausePollInterval is how often the agent checks its pause file
+const pausePollInterval = 2 * time.Second
+
+// Pause creates the pause file, so the agent refuses new work. Commands
+// already running are not interrupted.
+func Pause(path string) error {
+	content := fmt.Sprintf("paused at %s\n", time.Now().UTC().Format(time.RFC3339))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to pause agent: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to pause agent: %v", err)
+	}
+	return nil
+}
+
+// Resume removes the pause file
+func Resume(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to resume agent: %v", err)
+	}
+	return nil
+}
+
+// IsPaused reports whether the pause file exists and since when
+func IsPaused(path string) (bool, time.Time) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, time.Time{}
+	}
+	return true, info.ModTime()
+}
+
+// TailLog returns the last n lines of the transparency log at path
+func TailLog(path string, n int) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// watchPause follows the pause file and tells the server when it changes
+func (c *Client) watchPause() {
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+
+	for {
+		paused, _ := IsPaused(c.cfg.PauseFile)
+		if c.paused.Swap(paused) != paused {
+			if paused {
+				c.logf("Agent paused by host owner, refusing new commands")
+			} else {
+				c.logf("Agent resumed by host owner")
+			}
+			c.sendStatus()
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendStatus tells the server about the agent's local state
+func (c *Client) sendStatus() {
+	if !c.currentSession().Has(protocol.FeaturePause) {
+		return
+	}
+	st := protocol.AgentStatus{Type: protocol.TypeStatus, Paused: c.paused.Load()}
+	if err := c.send(st); err != nil {
+		c.logf("Failed to send status: %v", err)
+	}
+}
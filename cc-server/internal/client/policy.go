@@ -0,0 +1,161 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+)
+
+// defaultPath is the PATH given to commands run with a clean environment
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// RunAs says how a command is run on the host
+type RunAs struct {
+	// User is a user name; UID and GID override what is looked up for it
+	User string `json:"user,omitempty"`
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+
+	// Dir is the fixed working directory; it defaults to "/"
+	Dir string `json:"dir,omitempty"`
+
+	// Env is added to the minimal environment (PATH, HOME, USER, LOGNAME, LANG)
+	Env map[string]string `json:"env,omitempty"`
+
+	// Sandbox runs the command in fresh namespaces with a read-only view of
+	// the host, no_new_privs set and no capabilities (Linux only, agent must
+	// run as root). It needs a non-root User or UID to run as.
+	Sandbox bool `json:"sandbox,omitempty"`
+}
+
+// PolicyRule applies RunAs to commands matching a regular expression and,
+// when Task is set, sent with a task name matching it
+type PolicyRule struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+	// Task is a glob matched against the task name of the command
+	Task  string `json:"task,omitempty"`
+	RunAs RunAs  `json:"run_as"`
+
+	re *regexp.Regexp
+}
+
+// Policy decides which user, environment and directory commands run with.
+// The first matching rule wins; commands matching none use Default.
+type Policy struct {
+	Default RunAs        `json:"default"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// LoadPolicy reads an agent policy from a JSON file
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %v", err)
+	}
+	for i := range p.Rules {
+		re, err := regexp.Compile(p.Rules[i].Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in policy rule %q: %v", p.Rules[i].Name, err)
+		}
+		p.Rules[i].re = re
+		if _, err := path.Match(p.Rules[i].Task, ""); err != nil {
+			return nil, fmt.Errorf("invalid task pattern in policy rule %q: %v", p.Rules[i].Name, err)
+		}
+	}
+
+	// Resolve everything once, so a typo fails at startup, not per command
+	if _, err := resolveRunAs(p.Default); err != nil {
+		return nil, fmt.Errorf("invalid default run_as: %v", err)
+	}
+	for _, r := range p.Rules {
+		if _, err := resolveRunAs(r.RunAs); err != nil {
+			return nil, fmt.Errorf("invalid run_as in policy rule %q: %v", r.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+// runAsFor returns the RunAs of the first rule matching command and task
+func (p *Policy) runAsFor(command, task string) RunAs {
+	for _, r := range p.Rules {
+		if !r.re.MatchString(command) {
+			continue
+		}
+		if r.Task != "" {
+			if ok, _ := path.Match(r.Task, task); !ok {
+				continue
+			}
+		}
+		return r.RunAs
+	}
+	return p.Default
+}
+
+// resolvedRunAs is a RunAs with the user looked up
+type resolvedRunAs struct {
+	credential bool
+	uid, gid   uint32
+	dir        string
+	env        []string
+	sandbox    bool
+}
+
+func resolveRunAs(r RunAs) (*resolvedRunAs, error) {
+	res := &resolvedRunAs{dir: r.Dir, sandbox: r.Sandbox}
+	if res.dir == "" {
+		res.dir = "/"
+	}
+
+	home, name := "/", r.User
+	if r.User != "" {
+		u, err := user.Lookup(r.User)
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q: %v", r.User, err)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		res.credential = true
+		res.uid, res.gid = uint32(uid), uint32(gid)
+		home = u.HomeDir
+	}
+	if r.UID != nil {
+		res.credential = true
+		res.uid = uint32(*r.UID)
+		if name == "" {
+			name = strconv.Itoa(*r.UID)
+		}
+	}
+	if r.GID != nil {
+		res.credential = true
+		res.gid = uint32(*r.GID)
+	}
+	if res.credential && r.User == "" && r.UID != nil && r.GID == nil {
+		return nil, fmt.Errorf("gid is required with uid")
+	}
+	if res.sandbox && (!res.credential || res.uid == 0) {
+		return nil, fmt.Errorf("sandbox requires a non-root user or uid")
+	}
+
+	res.env = []string{
+		"PATH=" + defaultPath,
+		"HOME=" + home,
+		"LANG=C",
+	}
+	if name != "" {
+		res.env = append(res.env, "USER="+name, "LOGNAME="+name)
+	}
+	for k, v := range r.Env {
+		res.env = append(res.env, k+"="+v)
+	}
+	return res, nil
+}
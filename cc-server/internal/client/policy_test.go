@@ -0,0 +1,59 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPolicyRunAsFor(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, `{
+		"default": {"dir": "/default"},
+		"rules": [
+			{"name": "inventory", "task": "inventory-*", "run_as": {"dir": "/inventory"}},
+			{"name": "curl in a task", "match": "^curl ", "task": "fetch", "run_as": {"dir": "/fetch"}},
+			{"name": "curl", "match": "^curl ", "run_as": {"dir": "/curl"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+
+	for _, tc := range []struct {
+		command, task, dir string
+	}{
+		{"uptime", "inventory-disks", "/inventory"},
+		{"curl https://example.com", "inventory-net", "/inventory"},
+		{"curl https://example.com", "fetch", "/fetch"},
+		{"curl https://example.com", "", "/curl"},
+		{"curl https://example.com", "deploy", "/curl"},
+		{"uptime", "", "/default"},
+		{"uptime", "inventory", "/default"},
+		{"echo curl x", "fetch", "/default"},
+	} {
+		if got := p.runAsFor(tc.command, tc.task).Dir; got != tc.dir {
+			t.Errorf("runAsFor(%q, %q) ran in %s, want %s", tc.command, tc.task, got, tc.dir)
+		}
+	}
+}
+
+func TestPolicyRejectsBadPatterns(t *testing.T) {
+	for name, policy := range map[string]string{
+		"command": `{"rules": [{"name": "bad", "match": "(", "run_as": {}}]}`,
+		"task":    `{"rules": [{"name": "bad", "task": "[", "run_as": {}}]}`,
+		"sandbox": `{"rules": [{"name": "bad", "match": "^ps", "run_as": {"sandbox": true}}]}`,
+	} {
+		if _, err := LoadPolicy(writePolicy(t, policy)); err == nil {
+			t.Errorf("policy with a bad %s loaded", name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// Outcomes of submitting a command to the pool
+const (
+	submitStarted = iota // a worker picked it up right away
+	submitQueued         // it waits for a free worker
+	submitBusy           // the queue is full, the command was refused
+)
+
+// defaultSerialKey groups serial commands that did not name a key
+const defaultSerialKey = "default"
+
+// workerPool runs commands on a fixed number of workers fed by a bounded
+// queue. Serial commands go to a lane per serial key instead, so commands
+// sharing a key never overlap. Every running command, parallel or serial,
+// holds one of the pool's slots, so no more than workers commands run at
+// once. Serial commands waiting for a slot, in all lanes together, are
+// bounded like the queue, and so is the number of lanes.
+type workerPool struct {
+	ctx       context.Context
+	run       func(ServerCommand)
+	queue     chan ServerCommand
+	queueSize int
+	idle      int32
+	slots     chan struct{}
+
+	lanesMu sync.Mutex
+	lanes   map[string]*lane
+	// serialWaiting counts the commands of all lanes not holding a slot yet
+	serialWaiting int
+	maxLanes      int
+	// laneRoom is signalled when a lane takes a command off its queue
+	laneRoom *sync.Cond
+}
+
+// lane runs the serial commands of one key in order. It only exists while
+// it has commands; the last one to finish removes it. A command stays in
+// waiting until it holds a slot.
+type lane struct {
+	waiting []ServerCommand
+}
+
+func newWorkerPool(ctx context.Context, workers, queueSize int, run func(ServerCommand)) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &workerPool{
+		ctx:       ctx,
+		run:       run,
+		queue:     make(chan ServerCommand, queueSize),
+		queueSize: queueSize,
+		slots:     make(chan struct{}, workers),
+		lanes:     make(map[string]*lane),
+		// Every lane has a command waiting or one running
+		maxLanes: queueSize + workers,
+	}
+	p.laneRoom = sync.NewCond(&p.lanesMu)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	go func() {
+		// Wake submitters waiting for room in a lane
+		<-ctx.Done()
+		p.lanesMu.Lock()
+		p.laneRoom.Broadcast()
+		p.lanesMu.Unlock()
+	}()
+	return p
+}
+
+func (p *workerPool) worker() {
+	for {
+		atomic.AddInt32(&p.idle, 1)
+		select {
+		case <-p.ctx.Done():
+			return
+		case cmd := <-p.queue:
+			atomic.AddInt32(&p.idle, -1)
+			if !p.acquire() {
+				return
+			}
+			p.run(cmd)
+			p.release()
+		}
+	}
+}
+
+// acquire takes a slot to run a command in, waiting for one to be free. It
+// fails once the pool is shut down.
+func (p *workerPool) acquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.slots
+}
+
+// freeSlot reports whether a command could start right now
+func (p *workerPool) freeSlot() bool {
+	return len(p.slots) < cap(p.slots)
+}
+
+// submit hands a command to the pool. With block set it waits for room in
+// the queue instead of refusing the command.
+func (p *workerPool) submit(cmd ServerCommand, block bool) int {
+	if cmd.Concurrency == protocol.ConcurrencySerial {
+		return p.submitSerial(cmd, block)
+	}
+
+	started := atomic.LoadInt32(&p.idle) > 0 && len(p.queue) == 0 && p.freeSlot()
+	if block {
+		select {
+		case p.queue <- cmd:
+		case <-p.ctx.Done():
+			return submitBusy
+		}
+	} else {
+		select {
+		case p.queue <- cmd:
+		default:
+			return submitBusy
+		}
+	}
+	if started {
+		return submitStarted
+	}
+	return submitQueued
+}
+
+// submitSerial adds a command to the lane of its serial key, starting the
+// lane if the key has none. At most queueSize commands wait in all lanes
+// together, not counting one that starts right away, and at most maxLanes
+// lanes exist at once.
+func (p *workerPool) submitSerial(cmd ServerCommand, block bool) int {
+	key := cmd.SerialKey
+	if key == "" {
+		key = defaultSerialKey
+	}
+
+	p.lanesMu.Lock()
+	defer p.lanesMu.Unlock()
+	for {
+		if p.ctx.Err() != nil {
+			return submitBusy
+		}
+		l, ok := p.lanes[key]
+		// Commands of lanes started just before may not hold their slot
+		// yet; as many as there are free slots are about to start
+		free := cap(p.slots) - len(p.slots)
+		started := p.serialWaiting < free
+		room := p.serialWaiting < p.queueSize+free
+		if !ok && room && len(p.lanes) < p.maxLanes {
+			l = &lane{waiting: []ServerCommand{cmd}}
+			p.lanes[key] = l
+			p.serialWaiting++
+			go p.runLane(key, l)
+			if started {
+				return submitStarted
+			}
+			return submitQueued
+		}
+		if ok && room {
+			l.waiting = append(l.waiting, cmd)
+			p.serialWaiting++
+			return submitQueued
+		}
+		if !block {
+			return submitBusy
+		}
+		p.laneRoom.Wait()
+	}
+}
+
+// runLane runs the commands of a lane one at a time, each in a slot of the
+// pool, and removes the lane once it has run out of commands
+func (p *workerPool) runLane(key string, l *lane) {
+	for {
+		p.lanesMu.Lock()
+		if len(l.waiting) == 0 || p.ctx.Err() != nil {
+			p.serialWaiting -= len(l.waiting)
+			delete(p.lanes, key)
+			p.laneRoom.Broadcast()
+			p.lanesMu.Unlock()
+			return
+		}
+		p.lanesMu.Unlock()
+
+		if !p.acquire() {
+			continue
+		}
+		// Only this lane takes commands off it, so the next one is still there
+		p.lanesMu.Lock()
+		cmd := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		p.serialWaiting--
+		p.laneRoom.Broadcast()
+		p.lanesMu.Unlock()
+
+		p.run(cmd)
+		p.release()
+	}
+}
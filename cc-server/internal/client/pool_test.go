@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// poolRecorder runs commands until they are let go, and records how many
+// ran at once and in which order they started
+type poolRecorder struct {
+	mu       sync.Mutex
+	running  map[string]int // by serial key, "" for parallel commands
+	total    int
+	maxTotal int
+	overlap  bool // two commands of one serial key ran at once
+	started  []string
+	done     chan string
+
+	entered chan string
+	release chan struct{}
+}
+
+func newPoolRecorder() *poolRecorder {
+	return &poolRecorder{
+		running: make(map[string]int),
+		done:    make(chan string, 100),
+		entered: make(chan string, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (r *poolRecorder) run(cmd ServerCommand) {
+	r.mu.Lock()
+	r.total++
+	if r.total > r.maxTotal {
+		r.maxTotal = r.total
+	}
+	if cmd.Concurrency == protocol.ConcurrencySerial {
+		r.running[cmd.SerialKey]++
+		if r.running[cmd.SerialKey] > 1 {
+			r.overlap = true
+		}
+	}
+	r.started = append(r.started, cmd.ID)
+	r.mu.Unlock()
+
+	r.entered <- cmd.ID
+	<-r.release
+
+	r.mu.Lock()
+	r.total--
+	if cmd.Concurrency == protocol.ConcurrencySerial {
+		r.running[cmd.SerialKey]--
+	}
+	r.mu.Unlock()
+	r.done <- cmd.ID
+}
+
+// waitEntered waits until n more commands started
+func (r *poolRecorder) waitEntered(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d commands started", i, n)
+		}
+	}
+}
+
+// finish lets every command run to the end and waits for n of them
+func (r *poolRecorder) finish(t *testing.T, n int) {
+	t.Helper()
+	close(r.release)
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d commands finished", i, n)
+		}
+	}
+}
+
+func newTestPool(t *testing.T, workers, queueSize int, r *poolRecorder) *workerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newWorkerPool(ctx, workers, queueSize, r.run)
+}
+
+func serialCommand(id, key string) ServerCommand {
+	return ServerCommand{ID: id, Concurrency: protocol.ConcurrencySerial, SerialKey: key}
+}
+
+func TestPoolBoundsWorkersAndQueue(t *testing.T) {
+	r := newPoolRecorder()
+	p := newTestPool(t, 2, 3, r)
+	time.Sleep(10 * time.Millisecond) // let the workers start
+
+	for i := 0; i < 2; i++ {
+		if got := p.submit(ServerCommand{ID: fmt.Sprintf("cmd_%d", i)}, false); got != submitStarted {
+			t.Fatalf("command %d with a free worker: %d, want started", i, got)
+		}
+	}
+	r.waitEntered(t, 2)
+	for i := 2; i < 5; i++ {
+		if got := p.submit(ServerCommand{ID: fmt.Sprintf("cmd_%d", i)}, false); got != submitQueued {
+			t.Fatalf("command %d with busy workers: %d, want queued", i, got)
+		}
+	}
+	if got := p.submit(ServerCommand{ID: "cmd_5"}, false); got != submitBusy {
+		t.Fatalf("command beyond the queue: %d, want busy", got)
+	}
+
+	r.finish(t, 5)
+	if r.maxTotal != 2 {
+		t.Fatalf("%d commands ran at once, want 2", r.maxTotal)
+	}
+}
+
+func TestPoolRunsSerialKeysInOrder(t *testing.T) {
+	r := newPoolRecorder()
+	close(r.release)
+	p := newTestPool(t, 4, 10, r)
+
+	var want []string
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("pkg_%d", i)
+		want = append(want, id)
+		p.submit(serialCommand(id, "pkg"), true)
+		p.submit(serialCommand(fmt.Sprintf("other_%d", i), "other"), true)
+	}
+	for i := 0; i < 12; i++ {
+		select {
+		case <-r.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of 12 commands finished", i)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.overlap {
+		t.Fatal("commands sharing a serial key overlapped")
+	}
+	var got []string
+	for _, id := range r.started {
+		if len(id) > 3 && id[:4] == "pkg_" {
+			got = append(got, id)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("serial commands ran as %v, want %v", got, want)
+	}
+}
+
+func TestPoolSerialCommandsShareWorkers(t *testing.T) {
+	r := newPoolRecorder()
+	p := newTestPool(t, 1, 4, r)
+	time.Sleep(10 * time.Millisecond)
+
+	if got := p.submit(serialCommand("serial_1", "a"), false); got != submitStarted {
+		t.Fatalf("serial command with a free slot: %d, want started", got)
+	}
+	r.waitEntered(t, 1)
+	if got := p.submit(ServerCommand{ID: "parallel_1"}, false); got != submitQueued {
+		t.Fatalf("parallel command while the only slot is taken: %d, want queued", got)
+	}
+	if got := p.submit(serialCommand("serial_2", "b"), false); got != submitQueued {
+		t.Fatalf("serial command of another key: %d, want queued", got)
+	}
+
+	r.finish(t, 3)
+	if r.maxTotal != 1 {
+		t.Fatalf("%d commands ran at once on one worker", r.maxTotal)
+	}
+}
+
+func TestPoolBoundsSerialLanes(t *testing.T) {
+	r := newPoolRecorder()
+	p := newTestPool(t, 1, 2, r)
+
+	// One key per command, as a misbehaving server might send
+	results := map[int]int{}
+	for i := 0; i < 20; i++ {
+		results[p.submit(serialCommand(fmt.Sprintf("cmd_%d", i), fmt.Sprintf("key_%d", i)), false)]++
+	}
+	if results[submitStarted] != 1 || results[submitQueued] != 2 || results[submitBusy] != 17 {
+		t.Fatalf("submitted 20 keys: %d started, %d queued, %d busy", results[submitStarted], results[submitQueued], results[submitBusy])
+	}
+	p.lanesMu.Lock()
+	lanes := len(p.lanes)
+	p.lanesMu.Unlock()
+	if lanes != 3 {
+		t.Fatalf("%d lanes for 3 accepted commands", lanes)
+	}
+
+	// Lanes go away once their commands are done
+	r.finish(t, 3)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.lanesMu.Lock()
+		lanes, waiting := len(p.lanes), p.serialWaiting
+		p.lanesMu.Unlock()
+		if lanes == 0 && waiting == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d lanes and %d waiting commands left after all finished", lanes, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := p.submit(serialCommand("cmd_again", "key_0"), false); got != submitStarted {
+		t.Fatalf("serial command once the lanes are gone: %d, want started", got)
+	}
+	<-r.done
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// applyRunAs sets the user, environment and working directory of cmd. In
+// sandbox mode the command is wrapped in the agent's sandbox helper, which
+// drops to the user itself after building the sandbox.
+func applyRunAs(cmd *exec.Cmd, run *resolvedRunAs) error {
+	cmd.Env = run.env
+
+	if !run.sandbox {
+		cmd.Dir = run.dir
+		if run.credential {
+			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: run.uid, Gid: run.gid, Groups: []uint32{}}
+		}
+		return nil
+	}
+
+	if !run.credential || run.uid == 0 {
+		return fmt.Errorf("sandbox mode requires a non-root user")
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("sandbox mode requires the agent to run as root")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate agent binary for sandbox: %v", err)
+	}
+	spec, err := json.Marshal(sandboxSpec{
+		Credential: run.credential,
+		UID:        run.uid,
+		GID:        run.gid,
+		Dir:        run.dir,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append([]string{self, SandboxArg, string(spec)}, cmd.Args...)
+	cmd.Path = self
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET |
+		syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows
+
+package client
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// applyRunAs sets the user, environment and working directory of cmd.
+// Sandbox mode is only available on Linux.
+func applyRunAs(cmd *exec.Cmd, run *resolvedRunAs) error {
+	if run.sandbox {
+		return fmt.Errorf("sandbox mode is not supported on this platform")
+	}
+
+	cmd.Env = run.env
+	cmd.Dir = run.dir
+	if run.credential {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: run.uid, Gid: run.gid, Groups: []uint32{}},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// applyRunAs sets the environment and working directory of cmd. Running as
+// another user and sandbox mode are not available on Windows.
+func applyRunAs(cmd *exec.Cmd, run *resolvedRunAs) error {
+	if run.sandbox {
+		return fmt.Errorf("sandbox mode is not supported on this platform")
+	}
+	if run.credential {
+		return fmt.Errorf("running commands as another user is not supported on this platform")
+	}
+
+	cmd.Env = run.env
+	cmd.Dir = run.dir
+	return nil
+}
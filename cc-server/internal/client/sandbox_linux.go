@@ -0,0 +1,157 @@
+//go:build linux
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// SandboxArg is the first argument of the agent binary when it is started
+// as the sandbox helper
+const SandboxArg = "__sandbox"
+
+// prctl options from <linux/prctl.h>
+const (
+	prCapBSetDrop        = 24
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// sandboxSpec is passed from the agent to the sandbox helper
+type sandboxSpec struct {
+	Credential bool   `json:"credential"`
+	UID        uint32 `json:"uid"`
+	GID        uint32 `json:"gid"`
+	Dir        string `json:"dir"`
+}
+
+// RunSandbox is the sandbox helper. It runs as root in the fresh namespaces
+// created by the agent, makes every mount read-only except a private /tmp,
+// sets no_new_privs, empties the capability bounding set, drops to the
+// configured non-root user and execs the command in args. It only returns by
+// exiting.
+func RunSandbox(args []string) {
+	// no_new_privs and the bounding set belong to the thread, so the one
+	// setting them must be the one calling exec
+	runtime.LockOSThread()
+	if err := enterSandbox(args); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+func enterSandbox(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: %s SPEC COMMAND...", SandboxArg)
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		return fmt.Errorf("invalid spec: %v", err)
+	}
+	argv := args[1:]
+	if !spec.Credential || spec.UID == 0 {
+		return fmt.Errorf("refusing to run as root")
+	}
+
+	// Keep our mount changes from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=64m,mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %v", err)
+	}
+	if err := remountReadOnly(); err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+
+	if err := dropCapabilities(); err != nil {
+		return err
+	}
+
+	// Leaving root clears the permitted and effective capabilities
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("failed to clear groups: %v", err)
+	}
+	if err := syscall.Setresgid(int(spec.GID), int(spec.GID), int(spec.GID)); err != nil {
+		return fmt.Errorf("failed to set gid: %v", err)
+	}
+	if err := syscall.Setresuid(int(spec.UID), int(spec.UID), int(spec.UID)); err != nil {
+		return fmt.Errorf("failed to set uid: %v", err)
+	}
+
+	if err := os.Chdir(spec.Dir); err != nil {
+		return fmt.Errorf("failed to enter %s: %v", spec.Dir, err)
+	}
+	return syscall.Exec(argv[0], argv, os.Environ())
+}
+
+// dropCapabilities empties the capability bounding set and the ambient set,
+// so nothing the command runs can gain a capability back
+func dropCapabilities() error {
+	for c := uintptr(0); ; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, c, 0)
+		if errno == syscall.EINVAL {
+			// Past the last capability the kernel knows
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("failed to drop capability %d: %v", c, errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("failed to clear ambient capabilities: %v", errno)
+	}
+	return nil
+}
+
+// remountReadOnly remounts every mount point except /tmp read-only
+func remountReadOnly() error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %v", err)
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			mounts = append(mounts, unescapeMountPath(fields[4]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to list mounts: %v", err)
+	}
+
+	for _, mp := range mounts {
+		if mp == "/tmp" {
+			continue
+		}
+		err := syscall.Mount(mp, mp, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil && mp == "/" {
+			return fmt.Errorf("failed to make / read-only: %v", err)
+		}
+	}
+	return nil
+}
+
+// unescapeMountPath decodes the octal escapes used in /proc/self/mountinfo
+func unescapeMountPath(p string) string {
+	r := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return r.Replace(p)
+}
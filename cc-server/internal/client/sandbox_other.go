@@ -0,0 +1,18 @@
+//go:build !linux
+
+package client
+
+import (
+	"fmt"
+	"os"
+)
+
+// SandboxArg is the first argument of the agent binary when it is started
+// as the sandbox helper
+const SandboxArg = "__sandbox"
+
+// RunSandbox is only available on Linux
+func RunSandbox(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox: not supported on this platform")
+	os.Exit(126)
+}
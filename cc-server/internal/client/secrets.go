@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// minMaskLength is the shortest secret value masked in output; shorter
+// values would mask ordinary text
+const minMaskLength = 4
+
+// secretEnv returns the secret environment variables of a command as
+// KEY=value pairs
+func secretEnv(cmd ServerCommand) []string {
+	env := make([]string, 0, len(cmd.SecretEnv))
+	for k, v := range cmd.SecretEnv {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// secretMasker replaces the values of a command's secrets in its output. A
+// nil masker leaves output as it is.
+type secretMasker struct {
+	values  []string // longest first
+	longest int
+}
+
+// newSecretMasker returns a masker for the secrets of cmd, or nil if it has
+// none
+func newSecretMasker(cmd ServerCommand) *secretMasker {
+	var values []string
+	for _, v := range cmd.SecretEnv {
+		if len(v) >= minMaskLength {
+			values = append(values, v)
+		}
+	}
+	if len(cmd.SecretStdin) >= minMaskLength {
+		values = append(values, cmd.SecretStdin)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return &secretMasker{values: values, longest: len(values[0])}
+}
+
+// mask replaces every secret value in s
+func (m *secretMasker) mask(s string) string {
+	if m == nil {
+		return s
+	}
+	for _, v := range m.values {
+		s = strings.ReplaceAll(s, v, protocol.SecretMask)
+	}
+	return s
+}
+
+// hold is how many trailing bytes of streamed output wait for more, so a
+// value split across writes is still masked
+func (m *secretMasker) hold() int {
+	if m == nil {
+		return 0
+	}
+	return m.longest - 1
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+func TestSecretEnv(t *testing.T) {
+	cmd := ServerCommand{SecretEnv: map[string]string{"DB_PASS": "hunter2", "API_KEY": "k"}}
+	if got := strings.Join(secretEnv(cmd), " "); got != "API_KEY=k DB_PASS=hunter2" {
+		t.Fatalf("secretEnv = %q", got)
+	}
+}
+
+func TestSecretMasker(t *testing.T) {
+	if newSecretMasker(ServerCommand{}) != nil {
+		t.Fatal("masker for a command without secrets")
+	}
+	// Values too short to mask safely are left alone
+	if newSecretMasker(ServerCommand{SecretEnv: map[string]string{"PIN": "123"}}) != nil {
+		t.Fatal("masker for a value shorter than minMaskLength")
+	}
+
+	m := newSecretMasker(ServerCommand{
+		SecretEnv:   map[string]string{"A": "pass", "B": "password1", "C": "abc"},
+		SecretStdin: "s3cr3t-token",
+	})
+	for in, want := range map[string]string{
+		"login with password1 ok":    "login with " + protocol.SecretMask + " ok",
+		"pass and pass":              protocol.SecretMask + " and " + protocol.SecretMask,
+		"token=s3cr3t-token\n":       "token=" + protocol.SecretMask + "\n",
+		"abc is too short to mask":   "abc is too short to mask",
+		"nothing secret in here":     "nothing secret in here",
+		"password1password1passpass": strings.Repeat(protocol.SecretMask, 4),
+	} {
+		if got := m.mask(in); got != want {
+			t.Errorf("mask(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if m.hold() != len("s3cr3t-token")-1 {
+		t.Fatalf("hold = %d", m.hold())
+	}
+
+	var none *secretMasker
+	if none.mask("pass") != "pass" || none.hold() != 0 {
+		t.Fatal("a nil masker changed output")
+	}
+}
+
+// streamTestClient returns a client connected to a test server and the
+// output messages the server receives
+func streamTestClient(t *testing.T) (*Client, <-chan protocol.Output) {
+	t.Helper()
+	received := make(chan protocol.Output, 16)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var out protocol.Output
+			if err := conn.ReadJSON(&out); err != nil {
+				return
+			}
+			received <- out
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &Client{conn: conn}, received
+}
+
+// readStreamed collects the data of the output messages received within a
+// short while
+func readStreamed(received <-chan protocol.Output) string {
+	var data strings.Builder
+	for {
+		select {
+		case out := <-received:
+			data.WriteString(out.Data)
+		case <-time.After(100 * time.Millisecond):
+			return data.String()
+		}
+	}
+}
+
+func TestStreamMasksSecretSplitAcrossWrites(t *testing.T) {
+	c, received := streamTestClient(t)
+	m := newSecretMasker(ServerCommand{SecretEnv: map[string]string{"DB_PASS": "hunter2-long"}})
+	o := &outputStream{c: c, commandID: "cmd_1", secrets: m}
+
+	o.write([]byte("connecting with hunt"))
+	o.flush()
+	// The start of the value is held back, not sent
+	first := readStreamed(received)
+	if strings.Contains(first, "hunt") || !strings.HasPrefix("connecting with hunt", first) {
+		t.Fatalf("first flush sent %q", first)
+	}
+
+	o.write([]byte("er2-long done"))
+	o.close()
+	all := first + readStreamed(received)
+	if all != "connecting with "+protocol.SecretMask+" done" {
+		t.Fatalf("streamed %q", all)
+	}
+
+	// Nothing is sent after close
+	o.write([]byte("late"))
+	if late := readStreamed(received); late != "" {
+		t.Fatalf("sent %q after close", late)
+	}
+}
+
+func TestStreamHoldsBackWholeRunes(t *testing.T) {
+	c, received := streamTestClient(t)
+	m := newSecretMasker(ServerCommand{SecretStdin: "zzzz"})
+	o := &outputStream{c: c, commandID: "cmd_1", secrets: m}
+
+	// The held tail would start inside the two bytes of "é"
+	o.write([]byte("aéxy"))
+	o.flush()
+	if first := readStreamed(received); first != "a" {
+		t.Fatalf("first flush sent %q", first)
+	}
+	o.close()
+	if rest := readStreamed(received); rest != "éxy" {
+		t.Fatalf("close sent %q", rest)
+	}
+}
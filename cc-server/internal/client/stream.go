@@ -0,0 +1,147 @@
+package client
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// Output is sent in chunks of at most streamChunkBytes, at the latest
+// streamFlushInterval after it was written
+const (
+	streamChunkBytes    = 4096
+	streamFlushInterval = 250 * time.Millisecond
+)
+
+// outputStream forwards the output of a running command to the server while
+// the command runs. A nil stream discards everything, so callers need not
+// check whether streaming was negotiated.
+type outputStream struct {
+	c         *Client
+	commandID string
+
+	mu     sync.Mutex
+	buf    []byte
+	seq    int
+	sent   int
+	max    int // the session's output limit; nothing beyond it is streamed
+	timer  *time.Timer
+	closed bool
+
+	// secrets are masked before output leaves the agent
+	secrets *secretMasker
+}
+
+// newOutputStream returns a stream for a command, or nil if the server did
+// not ask for streaming
+func (c *Client) newOutputStream(commandID string, secrets *secretMasker) *outputStream {
+	if !c.currentSession().Has(protocol.FeatureStreaming) {
+		return nil
+	}
+	return &outputStream{c: c, commandID: commandID, max: c.currentSession().Limits.MaxOutputBytes, secrets: secrets}
+}
+
+// write queues output for sending. It does not wait for the network unless a
+// full chunk is ready.
+func (o *outputStream) write(p []byte) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+
+	if o.max > 0 {
+		room := o.max - o.sent - len(o.buf)
+		if room <= 0 {
+			return
+		}
+		if len(p) > room {
+			p = p[:room]
+		}
+	}
+	o.buf = append(o.buf, p...)
+
+	if len(o.buf) >= streamChunkBytes+o.secrets.hold() {
+		o.flushLocked(false)
+		return
+	}
+	if o.timer == nil {
+		o.timer = time.AfterFunc(streamFlushInterval, o.flush)
+	}
+}
+
+func (o *outputStream) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushLocked(false)
+}
+
+// flushLocked sends the buffered output. Unless final, the tail a secret
+// could start in stays buffered. The caller holds o.mu.
+func (o *outputStream) flushLocked(final bool) {
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+
+	var tail []byte
+	if o.secrets != nil {
+		o.buf = []byte(o.secrets.mask(string(o.buf)))
+		if hold := o.secrets.hold(); !final && len(o.buf) > 0 {
+			keep := len(o.buf) - hold
+			if keep < 0 {
+				keep = 0
+			}
+			for keep > 0 && keep < len(o.buf) && !utf8.RuneStart(o.buf[keep]) {
+				keep--
+			}
+			tail = append([]byte(nil), o.buf[keep:]...)
+			o.buf = o.buf[:keep]
+		}
+	}
+
+	for len(o.buf) > 0 {
+		n := len(o.buf)
+		if n > streamChunkBytes {
+			n = streamChunkBytes
+			// Do not split a UTF-8 sequence across chunks
+			for i := 0; i < utf8.UTFMax-1 && !utf8.RuneStart(o.buf[n]); i++ {
+				n--
+			}
+		}
+
+		o.seq++
+		msg := protocol.Output{
+			Type:      protocol.TypeOutput,
+			CommandID: o.commandID,
+			Seq:       o.seq,
+			Data:      string(o.buf[:n]),
+		}
+		o.sent += n
+		o.buf = o.buf[n:]
+		if err := o.c.send(msg); err != nil {
+			// Live output is best effort; the result carries all of it
+			o.c.logf("Failed to stream output of command %s: %v", o.commandID, err)
+			o.buf = nil
+			return
+		}
+	}
+	// A held tail goes out with the next output or when the stream closes
+	o.buf = tail
+}
+
+// close sends the output still buffered; nothing is sent after it
+func (o *outputStream) close() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushLocked(true)
+	o.closed = true
+}
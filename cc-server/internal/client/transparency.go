@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decisions recorded in the transparency log
+const (
+	decisionAccepted    = "accepted"
+	decisionQueued      = "queued"
+	decisionBusy        = "refused_busy"
+	decisionPaused      = "refused_paused"
+	decisionDuplicate   = "duplicate_not_run"
+	decisionInterrupted = "interrupted_not_run"
+	decisionFinished    = "finished"
+	decisionFailed      = "failed"
+)
+
+// transparencyLog is a plain-text record of everything the agent was asked
+// to do, so the owner of the host can see what ran on it. Commands may carry
+// sensitive arguments, so only the agent's user can read it.
+type transparencyLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newTransparencyLog(path string) *transparencyLog {
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create transparency log directory: %v\n", err)
+		}
+		// Logs written by older agents were world-readable
+		if err := os.Chmod(path, 0600); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Failed to restrict transparency log: %v\n", err)
+		}
+	}
+	return &transparencyLog{path: path}
+}
+
+// record appends one line about a command. exitCode is only written for
+// commands that ran.
+func (t *transparencyLog) record(cmd ServerCommand, decision string, exitCode *int, detail string) {
+	if t == nil || t.path == "" {
+		return
+	}
+
+	operator := cmd.Operator
+	if operator == "" {
+		operator = "unknown"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s id=%s operator=%q decision=%s", time.Now().UTC().Format(time.RFC3339), cmd.ID, operator, decision)
+	if exitCode != nil {
+		fmt.Fprintf(&b, " exit=%d", *exitCode)
+	}
+	if detail != "" {
+		fmt.Fprintf(&b, " detail=%q", detail)
+	}
+	fmt.Fprintf(&b, " command=%q\n", cmd.Command)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		// The log is for the host owner; failing to write it must be loud
+		fmt.Fprintf(os.Stderr, "Failed to open transparency log: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(b.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write transparency log: %v\n", err)
+	}
+}
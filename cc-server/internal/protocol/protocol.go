@@ -0,0 +1,236 @@
+package protocol
+
+import "github.com/user/cc-server/internal/version"
+
+// Message types exchanged over the agent socket
+const (
+	TypeHello     = "hello"
+	TypeWelcome   = "welcome"
+	TypeCommand   = "command"
+	TypeResult    = "result"
+	TypeHeartbeat = "heartbeat"
+	TypeAck       = "ack"
+	TypeStatus    = "status"
+	TypeOutput    = "output"
+	TypeCancel    = "cancel"
+)
+
+// Optional features negotiated during the handshake. A side may only rely on
+// a feature when both the agent and the server announced it.
+const (
+	FeatureStreaming = "streaming"
+	FeatureCancel    = "cancel"
+	FeatureAck       = "ack"
+	FeatureQueue     = "queue"
+	FeatureLimits    = "limits"
+	FeaturePause     = "pause"
+	// FeatureSecrets lets commands carry secret values that the agent hands
+	// to the process in memory and masks in the output
+	FeatureSecrets = "secrets"
+	// FeatureShell has the agent wrap shell lines itself, after its policy
+	// matched them as typed. Other agents get the wrapped script.
+	FeatureShell = "shell"
+)
+
+// Command concurrency modes. Serial commands sharing a serial key never
+// overlap on an agent; parallel commands share the agent's worker pool.
+const (
+	ConcurrencyParallel = "parallel"
+	ConcurrencySerial   = "serial"
+)
+
+// HandshakeProtocol is the first protocol version that opens the socket with
+// a hello/welcome exchange. Older agents start reading commands right away.
+const HandshakeProtocol = 2
+
+// Envelope is used to peek at the type of an incoming message
+type Envelope struct {
+	Type string `json:"type"`
+}
+
+// Hello is the first message an agent sends once the socket is open
+type Hello struct {
+	Type         string   `json:"type"`
+	Protocol     int      `json:"protocol"`
+	AgentVersion string   `json:"agent_version"`
+	OS           string   `json:"os"`
+	Arch         string   `json:"arch"`
+	Features     []string `json:"features"`
+}
+
+// SecretMask replaces the value of a secret in command output
+const SecretMask = "[REDACTED:secret]"
+
+// Ack stages
+const (
+	// AckReceived is sent by the agent as soon as it has a command
+	AckReceived = "received"
+	// AckQueued is sent instead when the command waits for a free worker
+	AckQueued = "queued"
+)
+
+// Ack acknowledges a command. The result message acknowledges completion.
+type Ack struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+	Stage     string `json:"stage"`
+}
+
+// Result statuses reported by agents
+const (
+	StatusSuccess = "success"
+	StatusError   = "error"
+	// StatusDuplicate reports a re-delivered command the agent had already
+	// run; Result and Error repeat the journaled outcome
+	StatusDuplicate = "duplicate"
+	// StatusInterrupted reports a re-delivered command whose earlier run was
+	// cut short by an agent restart; it is not run again
+	StatusInterrupted = "interrupted"
+	// StatusBusy reports a command refused because the agent's queue is
+	// full; the server should send it again later
+	StatusBusy = "busy"
+	// StatusLimitExceeded reports a command stopped by a resource limit;
+	// LimitExceeded names the limit
+	StatusLimitExceeded = "limit_exceeded"
+	// StatusPaused reports a command refused because the host owner paused
+	// the agent; the server should hold it until the agent resumes
+	StatusPaused = "paused"
+	// StatusCancelled reports a command killed, or never started, because
+	// the server cancelled it
+	StatusCancelled = "cancelled"
+)
+
+// Resource limit names reported in Result.LimitExceeded
+const (
+	LimitCPUTime      = "cpu_time"
+	LimitAddressSpace = "address_space"
+	LimitOpenFiles    = "open_files"
+	LimitOutputBytes  = "output_bytes"
+)
+
+// ResourceLimits bound what a single command may use. Zero means no limit.
+type ResourceLimits struct {
+	CPUSeconds   int   `json:"cpu_seconds,omitempty"`
+	AddressSpace int64 `json:"address_space_bytes,omitempty"`
+	OpenFiles    int   `json:"open_files,omitempty"`
+	OutputBytes  int64 `json:"output_bytes,omitempty"`
+}
+
+// IsZero reports whether no limit is set
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// Tighten returns the stricter of each limit in l and o
+func (l ResourceLimits) Tighten(o ResourceLimits) ResourceLimits {
+	return ResourceLimits{
+		CPUSeconds:   int(minLimit(int64(l.CPUSeconds), int64(o.CPUSeconds))),
+		AddressSpace: minLimit(l.AddressSpace, o.AddressSpace),
+		OpenFiles:    int(minLimit(int64(l.OpenFiles), int64(o.OpenFiles))),
+		OutputBytes:  minLimit(l.OutputBytes, o.OutputBytes),
+	}
+}
+
+// minLimit returns the smaller non-zero value
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Result carries the outcome of a command back to the server
+type Result struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+	Result    string `json:"result"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	// Original is the journaled status of a duplicate
+	Original string `json:"original_status,omitempty"`
+	// LimitExceeded names the resource limit that stopped the command
+	LimitExceeded string `json:"limit_exceeded,omitempty"`
+	// ExitCode of the command's shell, -1 if it did not exit normally
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+// Output carries a chunk of a running command's output when streaming was
+// negotiated. Seq starts at 1 for every command. The result still carries the
+// whole output, so a lost chunk only affects live views.
+type Output struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+	Seq       int    `json:"seq"`
+	Data      string `json:"data"`
+}
+
+// Cancel asks the agent to kill a queued or running command when cancel was
+// negotiated. The agent answers with the command's result.
+type Cancel struct {
+	Type      string `json:"type"`
+	CommandID string `json:"command_id"`
+}
+
+// AgentStatus is sent by the agent when its local state changes
+type AgentStatus struct {
+	Type   string `json:"type"`
+	Paused bool   `json:"paused"`
+}
+
+// Limits are imposed by the server on an agent session
+type Limits struct {
+	MaxMessageBytes   int64 `json:"max_message_bytes"`
+	MaxOutputBytes    int   `json:"max_output_bytes"`
+	HeartbeatInterval int   `json:"heartbeat_interval"` // seconds
+}
+
+// Welcome is the server's answer to Hello. Protocol and Features are the
+// negotiated values both sides use for the rest of the session.
+type Welcome struct {
+	Type          string   `json:"type"`
+	Protocol      int      `json:"protocol"`
+	ServerVersion string   `json:"server_version"`
+	Features      []string `json:"features"`
+	Limits        Limits   `json:"limits"`
+}
+
+// Has reports whether the negotiated session includes feature
+func (w *Welcome) Has(feature string) bool {
+	return w != nil && contains(w.Features, feature)
+}
+
+// Negotiate answers hello with the protocol and features both sides support
+func Negotiate(hello Hello, serverFeatures []string, limits Limits) Welcome {
+	proto := hello.Protocol
+	if proto > version.Protocol {
+		proto = version.Protocol
+	}
+
+	return Welcome{
+		Type:          TypeWelcome,
+		Protocol:      proto,
+		ServerVersion: version.Version,
+		Features:      Intersect(hello.Features, serverFeatures),
+		Limits:        limits,
+	}
+}
+
+// Intersect returns the features present in both lists, in the order of a
+func Intersect(a, b []string) []string {
+	common := []string{}
+	for _, f := range a {
+		if contains(b, f) && !contains(common, f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
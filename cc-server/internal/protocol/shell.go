@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShellTask is the task of lines typed in cc-cli shell. Policy, approvals
+// and the audit trail see the line as typed; it is only wrapped into the
+// script that runs it at the last moment.
+const ShellTask = "shell"
+
+// ShellCwdMarker starts the output line on which a shell line reports its
+// final working directory. cc-cli takes it out of the output it shows.
+const ShellCwdMarker = "__CC_CWD__"
+
+// WrapShellLine returns the script that runs a shell line: it starts in cwd,
+// the directory the previous line ended in, and ends by printing its own
+// working directory, keeping the line's exit status
+func WrapShellLine(line, cwd string) string {
+	var b strings.Builder
+	if cwd != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(cwd))
+	}
+	b.WriteString(line)
+	b.WriteString("\n__cc_status=$?\n")
+	fmt.Fprintf(&b, "printf '\\n%s%%s\\n' \"$PWD\"\n", ShellCwdMarker)
+	b.WriteString("exit $__cc_status")
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
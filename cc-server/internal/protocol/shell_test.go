@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWrapShellLine(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run the script")
+	}
+	dir := filepath.Join(t.TempDir(), "it's a dir")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(sh, "-c", WrapShellLine("cd sub && echo hi; false", dir)).Output()
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		t.Fatalf("exit = %v, want the line's status 1", err)
+	}
+	want := "hi\n\n" + ShellCwdMarker + filepath.Join(dir, "sub") + "\n"
+	if string(out) != want {
+		t.Fatalf("output = %q, want %q", out, want)
+	}
+
+	// The line runs only in the directory it was typed in
+	out, err = exec.Command(sh, "-c", WrapShellLine("echo ran", filepath.Join(dir, "gone"))).Output()
+	if err == nil || strings.Contains(string(out), "ran") {
+		t.Fatalf("line ran outside its directory: %q, %v", out, err)
+	}
+}
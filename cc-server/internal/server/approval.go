@@ -0,0 +1,336 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Approval statuses
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+// What an approval is for
+const (
+	approvalKindCommand = "command"
+	approvalKindJob     = "job"
+)
+
+// approvalTickInterval is how often pending approvals are checked for expiry
+const approvalTickInterval = 30 * time.Second
+
+// Approval is a request for a second operator to allow a command or job. Its
+// ID is the ID of the command or job waiting for it.
+type Approval struct {
+	ID          string     `json:"id"`
+	Kind        string     `json:"kind"` // command or job
+	Command     string     `json:"command"`
+	Targets     int        `json:"targets"`
+	Rule        string     `json:"rule"` // approval rule that matched
+	RequestedBy string     `json:"requested_by"`
+	Status      string     `json:"status"` // pending, approved, rejected, expired
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+}
+
+// requestApproval records that a command or job must wait for approval
+func (s *Server) requestApproval(kind, id, command string, targets int, rule *ApprovalRule, operator string) (Approval, error) {
+	now := time.Now()
+	a := Approval{
+		ID:          id,
+		Kind:        kind,
+		Command:     command,
+		Targets:     targets,
+		Rule:        rule.Name,
+		RequestedBy: operator,
+		Status:      approvalPending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.cfg.CommandPolicy.approvalExpiry),
+	}
+	stored := a
+	var err error
+	if stored.Command, err = sealValue(s.cfg.Encryption, fieldContext("approvals", "command", id), command); err != nil {
+		return a, err
+	}
+	resp, err := s.db.From("approvals").Insert(stored, false, "", "", "").Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	if err != nil {
+		return a, err
+	}
+
+	log.Printf("%s %s needs approval (rule %q, requested by %s)", kind, id, rule.Name, operator)
+	s.audit(AuditEvent{
+		Type:   auditApprovalRequested,
+		Actor:  operator,
+		Detail: fmt.Sprintf("%s %s rule=%q", kind, id, rule.Name),
+	})
+	return a, nil
+}
+
+// loadApproval returns an approval, or nil if there is none
+func (s *Server) loadApproval(id string) (*Approval, error) {
+	var approvals []Approval
+	resp, err := s.db.From("approvals").Select("*", false, "", "", "").Eq("id", id).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &approvals); err != nil {
+		return nil, err
+	}
+	if len(approvals) == 0 {
+		return nil, nil
+	}
+	approvals[0].Command = s.openStored("approvals", id, approvals[0].Command)
+	return &approvals[0], nil
+}
+
+// List approvals waiting for a decision
+func (s *Server) handleListApprovals(c *gin.Context) {
+	var approvals []Approval
+	resp, err := s.db.From("approvals").Select("*", false, "", "", "").
+		Eq("status", approvalPending).
+		Order("created_at", true).
+		Execute()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if err := s.db.ParseJSON(resp.Body, &approvals); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+		return
+	}
+	for i := range approvals {
+		approvals[i].Command = s.openStored("approvals", approvals[i].ID, approvals[i].Command)
+	}
+
+	c.JSON(http.StatusOK, approvals)
+}
+
+// handleDecideApproval approves or rejects a waiting command or job. It takes
+// an operator or admin other than the one who sent it.
+func (s *Server) handleDecideApproval(c *gin.Context) {
+	id := c.Param("id")
+	decision := c.Param("decision")
+	if decision != "approve" && decision != "reject" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown approval decision"})
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	operator := operatorName(c)
+	if role := operatorRole(c); role != roleOperator && role != roleAdmin {
+		s.audit(AuditEvent{Type: auditApprovalDenied, Actor: operator, IP: c.ClientIP(), Detail: fmt.Sprintf("%s: role %q", id, role)})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only operators and admins may decide on approvals"})
+		return
+	}
+
+	s.approvalMu.Lock()
+	defer s.approvalMu.Unlock()
+
+	a, err := s.loadApproval(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Approval not found"})
+		return
+	}
+	if a.Status != approvalPending {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Approval is already %s", a.Status)})
+		return
+	}
+	if time.Now().After(a.ExpiresAt) {
+		s.expireApproval(*a)
+		c.JSON(http.StatusConflict, gin.H{"error": "Approval has expired"})
+		return
+	}
+	if operator == a.RequestedBy {
+		s.audit(AuditEvent{Type: auditApprovalDenied, Actor: operator, IP: c.ClientIP(), Detail: fmt.Sprintf("%s %s: own request", a.Kind, a.ID)})
+		c.JSON(http.StatusForbidden, gin.H{"error": "A different operator must decide on this command"})
+		return
+	}
+
+	now := time.Now()
+	a.DecidedBy = operator
+	a.DecidedAt = &now
+	a.Reason = body.Reason
+	auditType := auditApprovalGranted
+	a.Status = approvalApproved
+	if decision == "reject" {
+		auditType = auditApprovalRejected
+		a.Status = approvalRejected
+	}
+
+	resp, err := s.db.From("approvals").Update(map[string]interface{}{
+		"status":     a.Status,
+		"decided_by": a.DecidedBy,
+		"decided_at": now,
+		"reason":     a.Reason,
+	}, "representation", "").Eq("id", a.ID).Eq("status", approvalPending).Execute()
+	if err != nil {
+		log.Printf("Failed to store decision on %s %s: %v", a.Kind, a.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store decision"})
+		return
+	}
+	// approvalMu only guards this node; another one may have been first
+	var decided []Approval
+	if err := s.db.ParseJSON(resp.Body, &decided); err != nil || len(decided) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Approval was decided meanwhile"})
+		return
+	}
+
+	if a.Status == approvalApproved {
+		s.releaseApproved(*a)
+	} else {
+		s.dropUnapproved(*a, "rejected by "+operator)
+	}
+
+	log.Printf("%s %s %s by %s", a.Kind, a.ID, a.Status, operator)
+	s.audit(AuditEvent{Type: auditType, Actor: operator, Detail: fmt.Sprintf("%s %s %s", a.Kind, a.ID, a.Reason)})
+	c.JSON(http.StatusOK, a)
+}
+
+// releaseApproved lets an approved command or job go ahead
+func (s *Server) releaseApproved(a Approval) {
+	if a.Kind == approvalKindJob {
+		s.jobMu.Lock()
+		defer s.jobMu.Unlock()
+
+		s.updateJob(a.ID, map[string]interface{}{"status": jobRunning, "batch_started_at": time.Now()})
+		commands, err := s.jobCommands(a.ID)
+		if err != nil {
+			log.Printf("Failed to load commands of job %s: %v", a.ID, err)
+			return
+		}
+		s.releaseBatch(a.ID, 1, commands)
+		return
+	}
+
+	var commands []Command
+	resp, err := s.db.From("commands").Select("*", false, "", "", "").Eq("id", a.ID).Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &commands)
+	}
+	if err == nil && len(commands) > 0 {
+		err = s.openCommand(&commands[0])
+	}
+	if err != nil || len(commands) == 0 {
+		log.Printf("Failed to load approved command %s: %v", a.ID, err)
+		return
+	}
+	s.updateCommandStatus(a.ID, statusPending, statusAwaitingApproval)
+	cmd := commands[0]
+	cmd.Status = statusPending
+	s.deliver(cmd)
+}
+
+// dropUnapproved ends a command or job whose approval was rejected or expired
+func (s *Server) dropUnapproved(a Approval, reason string) {
+	if a.Kind == approvalKindJob {
+		status := jobRejected
+		if a.Status == approvalExpired {
+			status = jobExpired
+		}
+		s.jobMu.Lock()
+		defer s.jobMu.Unlock()
+		s.stopJob(a.ID, status, reason)
+		return
+	}
+
+	status := statusRejected
+	if a.Status == approvalExpired {
+		status = statusExpired
+	}
+	update := map[string]interface{}{
+		"status":       status,
+		"error":        reason,
+		"completed_at": time.Now(),
+	}
+	if err := s.sealUpdate(a.ID, update); err != nil {
+		log.Printf("Failed to encrypt error of command %s: %v", a.ID, err)
+		return
+	}
+	resp, err := s.db.From("commands").Update(update, "representation", "").
+		Eq("id", a.ID).
+		Eq("status", statusAwaitingApproval).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to update unapproved command %s: %v", a.ID, err)
+		return
+	}
+	s.publishUpdatedCommands(resp.Body)
+}
+
+// expireApproval marks an approval nobody acted on in time as expired. The
+// caller holds approvalMu. Nothing is done if the approval was decided or
+// expired by another node in the meantime.
+func (s *Server) expireApproval(a Approval) {
+	resp, err := s.db.From("approvals").Update(map[string]interface{}{"status": approvalExpired}, "representation", "").
+		Eq("id", a.ID).
+		Eq("status", approvalPending).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to expire approval of %s %s: %v", a.Kind, a.ID, err)
+		return
+	}
+	var expired []Approval
+	if err := s.db.ParseJSON(resp.Body, &expired); err != nil || len(expired) == 0 {
+		return
+	}
+	a.Status = approvalExpired
+	s.dropUnapproved(a, "approval expired")
+
+	log.Printf("Approval of %s %s expired", a.Kind, a.ID)
+	s.audit(AuditEvent{Type: auditApprovalExpired, Detail: fmt.Sprintf("%s %s", a.Kind, a.ID)})
+}
+
+// expireApprovals expires pending approvals until the server stops
+func (s *Server) expireApprovals() {
+	ticker := time.NewTicker(approvalTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.leads() {
+			continue
+		}
+		var approvals []Approval
+		resp, err := s.db.From("approvals").Select("*", false, "", "", "").
+			Eq("status", approvalPending).
+			Lt("expires_at", time.Now().Format(time.RFC3339)).
+			Execute()
+		if err != nil {
+			log.Printf("Failed to load expired approvals: %v", err)
+			continue
+		}
+		if err := s.db.ParseJSON(resp.Body, &approvals); err != nil {
+			log.Printf("Failed to parse expired approvals: %v", err)
+			continue
+		}
+
+		s.approvalMu.Lock()
+		for _, a := range approvals {
+			s.expireApproval(a)
+		}
+		s.approvalMu.Unlock()
+	}
+}
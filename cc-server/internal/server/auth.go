@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Operator roles
+const (
+	roleAdmin    = "admin"
+	roleOperator = "operator"
+	roleViewer   = "viewer"
+)
+
+// anonymousOperator is the identity used when AllowAnonymous is set
+const anonymousOperator = "anonymous"
+
+// operatorCacheTTL is how long a validated operator token is trusted before
+// it is looked up again
+const operatorCacheTTL = time.Minute
+
+// Operator is a person or system allowed to use the management API
+type Operator struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	TokenHash string `json:"token_hash"`
+}
+
+type cachedOperator struct {
+	op      Operator
+	expires time.Time
+}
+
+// operatorCache remembers recently validated tokens by hash
+type operatorCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedOperator
+}
+
+func newOperatorCache() *operatorCache {
+	return &operatorCache{entries: make(map[string]cachedOperator)}
+}
+
+func (oc *operatorCache) get(hash string) (Operator, bool) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	e, ok := oc.entries[hash]
+	if !ok || time.Now().After(e.expires) {
+		delete(oc.entries, hash)
+		return Operator{}, false
+	}
+	return e.op, true
+}
+
+func (oc *operatorCache) put(hash string, op Operator) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.entries[hash] = cachedOperator{op: op, expires: time.Now().Add(operatorCacheTTL)}
+}
+
+// hashToken returns the hex SHA-256 of an operator token, as stored in the
+// operators table
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Middleware to authenticate CLI requests with an operator bearer token
+func (s *Server) authMiddleware(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" && (websocket.IsWebSocketUpgrade(c.Request) || isEventStream(c.Request)) {
+		// Browsers cannot set headers on websocket upgrades or EventSource
+		token = c.Query("access_token")
+	}
+	if token == "" {
+		if s.cfg.Auth.AllowAnonymous {
+			c.Set("operator", anonymousOperator)
+			c.Set("role", roleAdmin)
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Operator token required"})
+		return
+	}
+
+	op, err := s.lookupOperator(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to validate operator token"})
+		return
+	}
+	if op == nil {
+		s.audit(AuditEvent{Type: auditAuthFailed, IP: c.ClientIP(), Detail: c.Request.URL.Path})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid operator token"})
+		return
+	}
+
+	c.Set("operator", op.Name)
+	c.Set("role", op.Role)
+	c.Next()
+}
+
+// lookupOperator returns the operator owning token, or nil if there is none
+func (s *Server) lookupOperator(token string) (*Operator, error) {
+	hash := hashToken(token)
+	if op, ok := s.operators.get(hash); ok {
+		return &op, nil
+	}
+
+	var ops []Operator
+	resp, err := s.db.From("operators").Select("*", false, "", "", "").Eq("token_hash", hash).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &ops); err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	s.operators.put(hash, ops[0])
+	return &ops[0], nil
+}
+
+// isEventStream reports whether a request asks for server-sent events
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// operatorName returns the authenticated operator of a request
+func operatorName(c *gin.Context) string {
+	return c.GetString("operator")
+}
+
+// operatorRole returns the role of the authenticated operator of a request
+func operatorRole(c *gin.Context) string {
+	return c.GetString("role")
+}
+
+// requireRole rejects requests from operators whose role is not one of roles
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !contains(roles, operatorRole(c)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Your role may not do this"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// unsentStatuses are the statuses of commands no agent has been sent yet,
+// which a cancel simply marks cancelled
+var unsentStatuses = []string{statusHeld, statusPending, statusUndelivered}
+
+// sentStatuses are the statuses of commands an agent may be running, which
+// a cancel asks the agent to kill
+var sentStatuses = []string{statusDelivered, statusQueued, statusReceived}
+
+// handleCancelCommand stops a command. One that was not sent yet is marked
+// cancelled; one already on its agent is killed there, and the agent's
+// result records the cancellation.
+func (s *Server) handleCancelCommand(c *gin.Context) {
+	clientID := c.Param("client_id")
+	commandID := c.Param("command_id")
+
+	var commands []Command
+	resp, err := s.db.From("commands").Select("id,client_id,status", false, "", "", "").
+		Eq("id", commandID).
+		Eq("client_id", clientID).
+		Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &commands)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if len(commands) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	}
+
+	operator := operatorName(c)
+	status := commands[0].Status
+	switch {
+	case contains(unsentStatuses, status):
+		if !s.cancelUnsent(commandID, "cancelled by "+operator) {
+			// It was sent or finished in the meantime
+			c.JSON(http.StatusConflict, gin.H{"error": "Command changed state, try again"})
+			return
+		}
+		status = statusCancelled
+	case contains(sentStatuses, status):
+		delivered, reason := s.sendCancel(clientID, commandID)
+		if !delivered {
+			c.JSON(http.StatusConflict, gin.H{"error": reason})
+			return
+		}
+	case status == statusAwaitingApproval:
+		c.JSON(http.StatusConflict, gin.H{"error": "Command is awaiting approval; reject the approval instead"})
+		return
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Command already finished (%s)", status)})
+		return
+	}
+
+	log.Printf("Command %s cancelled by %s", commandID, operator)
+	s.audit(AuditEvent{Type: auditCommandCancelled, Actor: operator, ClientID: clientID, IP: c.ClientIP(),
+		Detail: fmt.Sprintf("%s status=%s", commandID, status)})
+	if status == statusCancelled {
+		c.JSON(http.StatusOK, gin.H{"id": commandID, "status": statusCancelled})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"id": commandID, "status": status, "message": "Cancel sent to agent"})
+}
+
+// cancelUnsent marks a command that was not sent yet cancelled and reports
+// whether it still was unsent
+func (s *Server) cancelUnsent(commandID, reason string) bool {
+	update := map[string]interface{}{
+		"status":       statusCancelled,
+		"error":        reason,
+		"completed_at": time.Now(),
+	}
+	if err := s.sealUpdate(commandID, update); err != nil {
+		log.Printf("Failed to encrypt cancellation of command %s: %v", commandID, err)
+		return false
+	}
+	resp, err := s.db.From("commands").Update(update, "representation", "").
+		Eq("id", commandID).
+		In("status", unsentStatuses).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to cancel command %s: %v", commandID, err)
+		return false
+	}
+	var updated []Command
+	if err := s.db.ParseJSON(resp.Body, &updated); err != nil || len(updated) == 0 {
+		return false
+	}
+	s.deliveries.ack(commandID)
+	s.publishUpdatedCommands(resp.Body)
+	return true
+}
+
+// sendCancel asks the agent running a command to kill it, through the node
+// it is connected to. If that fails it also returns why.
+func (s *Server) sendCancel(clientID, commandID string) (bool, string) {
+	if _, ok := s.hub.get(clientID); !ok && s.cluster != nil {
+		return s.cluster.cancel(clientID, commandID)
+	}
+	return s.cancelLocal(clientID, commandID)
+}
+
+// cancelLocal sends a cancel to an agent connected to this node
+func (s *Server) cancelLocal(clientID, commandID string) (bool, string) {
+	ac, ok := s.hub.get(clientID)
+	if !ok {
+		return false, "Client is not connected"
+	}
+	if !ac.session.Has(protocol.FeatureCancel) {
+		return false, "Agent does not support cancelling commands"
+	}
+	if err := ac.send(protocol.Cancel{Type: protocol.TypeCancel, CommandID: commandID}); err != nil {
+		log.Printf("Failed to send cancel of command %s to client %s: %v", commandID, clientID, err)
+		return false, "Failed to reach the agent"
+	}
+	return true, ""
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cluster bus message types
+const (
+	busDeliver = "deliver" // send a command to an agent connected to the receiving node
+	busRelease = "release" // the agent reconnected elsewhere; drop its old socket
+	busCancel  = "cancel"  // ask an agent connected to the receiving node to kill a command
+	busEvents  = "events"  // live events published on the sending node
+)
+
+// clusterSecretHeader carries the shared secret on node-to-node requests
+const clusterSecretHeader = "X-CC-Cluster-Secret"
+
+// clusterPath is the internal endpoint nodes post bus messages to
+const clusterPath = "/internal/cluster"
+
+// Node is a server instance sharing the store with other instances
+type Node struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	StartedAt time.Time `json:"started_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// busMessage is sent from one node to another
+type busMessage struct {
+	Type     string   `json:"type"`
+	ClientID string   `json:"client_id"`
+	Command  *Command `json:"command,omitempty"`
+
+	// CommandID names the command to cancel
+	CommandID string `json:"command_id,omitempty"`
+
+	// Events are relayed to the receiving node's operators, oldest first
+	Events []liveEvent `json:"events,omitempty"`
+}
+
+// cluster lets several servers share the agents. Every node records in the
+// store which agents are connected to it; a command for an agent connected
+// elsewhere is forwarded to that node. Live events are relayed to every
+// node, and the oldest live node runs the background work.
+type cluster struct {
+	s      *Server
+	cfg    ClusterConfig
+	client *http.Client
+
+	mu    sync.RWMutex
+	peers map[string]Node // live nodes by ID, this one included
+
+	// owner and setOwner read and record the node an agent is connected
+	// to; they are the database unless a test says otherwise
+	owner    func(clientID string) (string, error)
+	setOwner func(clientID string) error
+
+	// events holds the events published here not yet relayed to the peers
+	eventsMu sync.Mutex
+	events   []liveEvent
+	wake     chan struct{}
+}
+
+// newCluster registers this node and starts its heartbeat. It returns nil
+// when clustering is not configured.
+func newCluster(s *Server, cfg ClusterConfig) *cluster {
+	if !cfg.Enabled() {
+		return nil
+	}
+	cl := &cluster{
+		s:      s,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.ForwardTimeout},
+		peers:  make(map[string]Node),
+		wake:   make(chan struct{}, 1),
+	}
+	cl.owner = cl.loadOwner
+	cl.setOwner = cl.storeOwner
+
+	// Agents recorded as ours belong to an earlier run of this node
+	cl.releaseOwned()
+	cl.heartbeat(time.Now())
+	go cl.run()
+
+	s.live.setNode(cfg.NodeID)
+	s.live.addSink(cl.push)
+	go cl.relay()
+	return cl
+}
+
+// run refreshes this node's record and the list of peers until the server
+// stops
+func (cl *cluster) run() {
+	ticker := time.NewTicker(cl.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		cl.heartbeat(now)
+		cl.releaseOrphans()
+	}
+}
+
+// heartbeat stores this node's record and reloads the live peers
+func (cl *cluster) heartbeat(now time.Time) {
+	// The store keeps microseconds; leads compares this node's start with
+	// the stored starts of the others
+	started := cl.s.started.Truncate(time.Microsecond)
+	self := Node{ID: cl.cfg.NodeID, URL: cl.cfg.AdvertiseURL, StartedAt: started, LastSeen: now}
+	resp, err := cl.s.db.From("nodes").Insert(self, true, "id", "", "").Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	if err != nil {
+		log.Printf("Failed to record node %s: %v", cl.cfg.NodeID, err)
+	}
+
+	var nodes []Node
+	resp, err = cl.s.db.From("nodes").Select("*", false, "", "", "").
+		Gt("last_seen", now.Add(-cl.cfg.NodeTTL).Format(time.RFC3339)).
+		Execute()
+	if err == nil {
+		err = cl.s.db.ParseJSON(resp.Body, &nodes)
+	}
+	if err != nil {
+		log.Printf("Failed to load cluster nodes: %v", err)
+		return
+	}
+
+	peers := make(map[string]Node, len(nodes)+1)
+	for _, n := range nodes {
+		peers[n.ID] = n
+	}
+	peers[self.ID] = self
+
+	cl.mu.Lock()
+	cl.peers = peers
+	cl.mu.Unlock()
+}
+
+// peer returns a live node by ID
+func (cl *cluster) peer(id string) (Node, bool) {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	n, ok := cl.peers[id]
+	return n, ok
+}
+
+// leads reports whether this node is the oldest live one. Only that node
+// runs schedules, jobs, approval expiry and retention, so they are not done
+// once per node. When it stops, the next oldest takes over with its next
+// heartbeat.
+func (cl *cluster) leads() bool {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	self := cl.peers[cl.cfg.NodeID]
+	for _, n := range cl.peers {
+		if n.StartedAt.Before(self.StartedAt) || n.StartedAt.Equal(self.StartedAt) && n.ID < self.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// push takes an event published on this node. It is called by the live
+// view for every event, in order, and must not block.
+func (cl *cluster) push(ev liveEvent) {
+	cl.eventsMu.Lock()
+	cl.events = append(cl.events, ev)
+	cl.eventsMu.Unlock()
+	select {
+	case cl.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relay sends the events published here to the other live nodes, so
+// operators see every agent whichever node they are connected to. A node
+// that cannot be reached misses those events.
+func (cl *cluster) relay() {
+	for range cl.wake {
+		cl.eventsMu.Lock()
+		events := cl.events
+		cl.events = nil
+		cl.eventsMu.Unlock()
+
+		cl.mu.RLock()
+		var peers []Node
+		for id, n := range cl.peers {
+			if id != cl.cfg.NodeID {
+				peers = append(peers, n)
+			}
+		}
+		cl.mu.RUnlock()
+
+		// Each batch reaches every peer before the next is sent, which
+		// keeps the events in order
+		msg := busMessage{Type: busEvents, Events: events}
+		var wg sync.WaitGroup
+		for _, n := range peers {
+			wg.Add(1)
+			go func(n Node) {
+				defer wg.Done()
+				if _, err := cl.send(n, msg); err != nil {
+					log.Printf("Failed to relay %d event(s) to node %s: %v", len(events), n.ID, err)
+				}
+			}(n)
+		}
+		wg.Wait()
+	}
+}
+
+// claim records that an agent is now connected to this node. If it was
+// connected to another live node, that node is told to drop the old socket.
+func (cl *cluster) claim(clientID string) {
+	prev, err := cl.owner(clientID)
+	if err != nil {
+		log.Printf("Failed to look up owner of client %s: %v", clientID, err)
+	}
+
+	if err := cl.setOwner(clientID); err != nil {
+		log.Printf("Failed to record node of client %s: %v", clientID, err)
+	}
+
+	// The old node must not mark the agent disconnected, so it is told only
+	// once the record points here
+	if prev != "" && prev != cl.cfg.NodeID {
+		if n, ok := cl.peer(prev); ok {
+			log.Printf("Client %s moved from node %s to this node", clientID, prev)
+			go cl.send(n, busMessage{Type: busRelease, ClientID: clientID})
+		}
+	}
+}
+
+// disconnected records that an agent left this node. Nothing is changed if
+// the agent has since connected to another node.
+func (cl *cluster) disconnected(clientID string) {
+	_, err := cl.s.db.From("clients").Update(map[string]interface{}{
+		"status":    "disconnected",
+		"node_id":   nil,
+		"last_seen": time.Now(),
+	}, "", "").Eq("id", clientID).Eq("node_id", cl.cfg.NodeID).Execute()
+	if err != nil {
+		log.Printf("Failed to update client status: %v", err)
+	}
+}
+
+// releaseOwned marks the agents recorded as connected to this node as
+// disconnected. Called at startup, when this node has no sockets yet.
+func (cl *cluster) releaseOwned() {
+	_, err := cl.s.db.From("clients").Update(map[string]interface{}{
+		"status":  "disconnected",
+		"node_id": nil,
+	}, "", "").Eq("node_id", cl.cfg.NodeID).Execute()
+	if err != nil {
+		log.Printf("Failed to release clients of node %s: %v", cl.cfg.NodeID, err)
+	}
+}
+
+// releaseOrphans marks agents of nodes that stopped sending heartbeats as
+// disconnected, so they are not reported as reachable until they reconnect
+func (cl *cluster) releaseOrphans() {
+	var clients []ClientInfo
+	resp, err := cl.s.db.From("clients").Select("id,node_id", false, "", "", "").
+		Neq("status", "disconnected").
+		Execute()
+	if err == nil {
+		err = cl.s.db.ParseJSON(resp.Body, &clients)
+	}
+	if err != nil {
+		log.Printf("Failed to load client nodes: %v", err)
+		return
+	}
+
+	var orphans []string
+	for _, c := range clients {
+		if c.NodeID == "" {
+			continue
+		}
+		if _, ok := cl.peer(c.NodeID); !ok {
+			orphans = append(orphans, c.ID)
+		}
+	}
+	if len(orphans) == 0 {
+		return
+	}
+
+	log.Printf("Releasing %d client(s) of nodes that stopped", len(orphans))
+	_, err = cl.s.db.From("clients").Update(map[string]interface{}{
+		"status":  "disconnected",
+		"node_id": nil,
+	}, "", "").In("id", orphans).Execute()
+	if err != nil {
+		log.Printf("Failed to release orphaned clients: %v", err)
+	}
+}
+
+// storeOwner records in the store that an agent is connected to this node
+func (cl *cluster) storeOwner(clientID string) error {
+	_, err := cl.s.db.From("clients").Update(map[string]interface{}{"node_id": cl.cfg.NodeID}, "", "").
+		Eq("id", clientID).Execute()
+	return err
+}
+
+// loadOwner returns the node an agent is connected to, or "" if none
+func (cl *cluster) loadOwner(clientID string) (string, error) {
+	var clients []ClientInfo
+	resp, err := cl.s.db.From("clients").Select("id,node_id", false, "", "", "").Eq("id", clientID).Execute()
+	if err != nil {
+		return "", err
+	}
+	if err := cl.s.db.ParseJSON(resp.Body, &clients); err != nil {
+		return "", err
+	}
+	if len(clients) == 0 {
+		return "", nil
+	}
+	return clients[0].NodeID, nil
+}
+
+// connected reports whether an agent is connected to a live node
+func (cl *cluster) connected(c ClientInfo) bool {
+	if c.NodeID == "" || c.Status == "disconnected" {
+		return false
+	}
+	_, ok := cl.peer(c.NodeID)
+	return ok
+}
+
+// forward sends a command to the node the agent is connected to. It reports
+// whether that node delivered it; if not, the command stays pending and is
+// delivered when the agent reconnects.
+func (cl *cluster) forward(cmd Command) bool {
+	id, err := cl.owner(cmd.ClientID)
+	if err != nil {
+		log.Printf("Failed to look up owner of client %s: %v", cmd.ClientID, err)
+		return false
+	}
+	n, ok := cl.peer(id)
+	if id == "" || id == cl.cfg.NodeID || !ok {
+		log.Printf("Client %s is not connected, command %s queued", cmd.ClientID, cmd.ID)
+		return false
+	}
+
+	delivered, err := cl.send(n, busMessage{Type: busDeliver, ClientID: cmd.ClientID, Command: &cmd})
+	if err != nil {
+		log.Printf("Failed to forward command %s to node %s: %v", cmd.ID, n.ID, err)
+		return false
+	}
+	return delivered
+}
+
+// cancel asks the node the agent is connected to to kill a command there. If
+// that fails it also returns why.
+func (cl *cluster) cancel(clientID, commandID string) (bool, string) {
+	id, err := cl.owner(clientID)
+	if err != nil {
+		log.Printf("Failed to look up owner of client %s: %v", clientID, err)
+		return false, "Failed to find the agent's node"
+	}
+	n, ok := cl.peer(id)
+	if id == "" || id == cl.cfg.NodeID || !ok {
+		return false, "Client is not connected"
+	}
+
+	cancelled, err := cl.send(n, busMessage{Type: busCancel, ClientID: clientID, CommandID: commandID})
+	if err != nil {
+		log.Printf("Failed to forward cancel of command %s to node %s: %v", commandID, n.ID, err)
+		return false, "Failed to reach the agent's node"
+	}
+	if !cancelled {
+		return false, "The agent's node could not cancel the command"
+	}
+	return true, ""
+}
+
+// send posts a bus message to a node and returns whether it was acted on
+func (cl *cluster) send(n Node, msg busMessage) (bool, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", n.URL+clusterPath, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSecretHeader, cl.cfg.Secret)
+
+	resp, err := cl.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return false, fmt.Errorf("node answered %d", resp.StatusCode)
+	}
+	var result struct {
+		OK bool `json:"ok"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.OK, nil
+}
+
+// Middleware to authenticate requests from other nodes
+func (s *Server) clusterAuth(c *gin.Context) {
+	secret := c.GetHeader(clusterSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.cfg.Cluster.Secret)) != 1 {
+		s.audit(AuditEvent{Type: auditAuthFailed, IP: c.ClientIP(), Detail: c.Request.URL.Path})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid cluster secret"})
+		return
+	}
+	c.Next()
+}
+
+// handleBusMessage acts on a message from another node. Commands are only
+// delivered to agents connected here, never forwarded again.
+func (s *Server) handleBusMessage(c *gin.Context) {
+	var msg busMessage
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	switch msg.Type {
+	case busDeliver:
+		if msg.Command == nil || msg.Command.ClientID != msg.ClientID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": s.deliverLocal(*msg.Command)})
+	case busRelease:
+		ac, ok := s.hub.get(msg.ClientID)
+		if ok {
+			log.Printf("Client %s connected to another node, closing its socket here", msg.ClientID)
+			s.hub.remove(ac)
+			ac.conn.Close()
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": ok})
+	case busCancel:
+		ok, reason := s.cancelLocal(msg.ClientID, msg.CommandID)
+		if !ok {
+			log.Printf("Cancel of command %s from another node failed: %s", msg.CommandID, reason)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": ok})
+	case busEvents:
+		for _, ev := range msg.Events {
+			s.live.relay(ev)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown message type %q", msg.Type)})
+	}
+}
+
+// leads reports whether this server runs the background work: always,
+// unless it is a node of a cluster with an older live node
+func (s *Server) leads() bool {
+	return s.cluster == nil || s.cluster.leads()
+}
+
+// isConnected reports whether an agent is connected to this or, in a
+// cluster, any live node
+func (s *Server) isConnected(c ClientInfo) bool {
+	if _, ok := s.hub.get(c.ID); ok {
+		return true
+	}
+	return s.cluster != nil && s.cluster.connected(c)
+}
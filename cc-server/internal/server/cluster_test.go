@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/supabase/postgrest-go"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+const testClusterSecret = "cluster-secret"
+
+// unreachableDB is a store that fails every query, for code that only
+// records what it did
+func unreachableDB(t *testing.T) *postgrest.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return newDBClient(srv.URL, "")
+}
+
+// newBusNode starts a node that answers bus messages
+func newBusNode(t *testing.T, id string) (*Server, Node) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := &Server{
+		live: newLiveView(),
+		hub:  newHub(),
+		db:   unreachableDB(t),
+		cfg:  Config{Cluster: ClusterConfig{NodeID: id, Secret: testClusterSecret}},
+	}
+	router := gin.New()
+	router.POST(clusterPath, s.clusterAuth, s.handleBusMessage)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return s, Node{ID: id, URL: srv.URL}
+}
+
+// newTestCluster is the cluster of node id, which knows peers and finds
+// agents in owners
+func newTestCluster(s *Server, id string, owners map[string]string, peers ...Node) *cluster {
+	var mu sync.Mutex
+	cl := &cluster{
+		s:      s,
+		cfg:    ClusterConfig{NodeID: id, Secret: testClusterSecret},
+		client: &http.Client{Timeout: time.Second},
+		peers:  map[string]Node{id: {ID: id}},
+		wake:   make(chan struct{}, 1),
+		owner: func(clientID string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return owners[clientID], nil
+		},
+		setOwner: func(clientID string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			owners[clientID] = id
+			return nil
+		},
+	}
+	for _, n := range peers {
+		cl.peers[n.ID] = n
+	}
+	return cl
+}
+
+// testAgent is the far end of an agent socket held by a node
+type testAgent struct {
+	messages chan map[string]interface{}
+	closed   chan struct{}
+}
+
+// connectAgent registers an agent with the given features in the hub of s
+func connectAgent(t *testing.T, s *Server, clientID string, features ...string) *testAgent {
+	t.Helper()
+	a := &testAgent{messages: make(chan map[string]interface{}, 16), closed: make(chan struct{})}
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(a.closed)
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			a.messages <- msg
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.hub.add(&agentConn{clientID: clientID, conn: conn, session: protocol.Welcome{Features: features}})
+	return a
+}
+
+// next returns the next message the agent got
+func (a *testAgent) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case msg := <-a.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent got nothing")
+		return nil
+	}
+}
+
+func TestClusterLeads(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cl := &cluster{
+		cfg: ClusterConfig{NodeID: "b"},
+		peers: map[string]Node{
+			"a": {ID: "a", StartedAt: start.Add(time.Minute)},
+			"b": {ID: "b", StartedAt: start},
+			"c": {ID: "c", StartedAt: start},
+		},
+	}
+	if !cl.leads() {
+		t.Fatal("oldest node does not lead")
+	}
+
+	cl.cfg.NodeID = "c"
+	if cl.leads() {
+		t.Fatal("node started with b but named after it leads too")
+	}
+
+	// The oldest node stopped sending heartbeats
+	delete(cl.peers, "b")
+	if !cl.leads() {
+		t.Fatal("next oldest node did not take over")
+	}
+}
+
+func TestClusterRelaysEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = testClusterSecret
+
+	// Node b receives the events of node a
+	b := &Server{live: newLiveView(), cfg: Config{Cluster: ClusterConfig{NodeID: "b", Secret: secret}}}
+	b.live.setNode("b")
+	var sunk []liveEvent
+	b.live.addSink(func(ev liveEvent) { sunk = append(sunk, ev) })
+	router := gin.New()
+	router.POST(clusterPath, b.clusterAuth, b.handleBusMessage)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	a := &Server{live: newLiveView()}
+	cl := &cluster{
+		s:      a,
+		cfg:    ClusterConfig{NodeID: "a", Secret: secret},
+		client: &http.Client{Timeout: time.Second},
+		peers: map[string]Node{
+			"a": {ID: "a"},
+			"b": {ID: "b", URL: srv.URL},
+		},
+		wake: make(chan struct{}, 1),
+	}
+	a.live.setNode("a")
+	a.live.addSink(cl.push)
+	go cl.relay()
+
+	events := b.live.subscribe()
+	defer b.live.unsubscribe(events)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		a.live.publish(liveEvent{Type: eventCommandOutput, ClientID: "client_1", CommandID: "cmd_1", Data: eventData(map[string]interface{}{"seq": i})})
+	}
+	var ids []string
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-events:
+			if ev.Type != eventCommandOutput || ev.CommandID != "cmd_1" || string(ev.Data) != string(eventData(map[string]interface{}{"seq": i})) {
+				t.Fatalf("event %d relayed as %+v", i, ev)
+			}
+			ids = append(ids, ev.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d relayed events", i, n)
+		}
+	}
+
+	// Node a already ran its sinks, webhooks included
+	if len(sunk) != 0 {
+		t.Fatalf("relayed events reached %d sink(s) on the receiving node", len(sunk))
+	}
+
+	// Relayed events keep the IDs node a gave them, so a stream of node a
+	// resumes on node b
+	a.live.mu.Lock()
+	published := a.live.history
+	a.live.mu.Unlock()
+	for i, ev := range published {
+		if ids[i] != ev.ID || !strings.HasPrefix(ev.ID, "a:") {
+			t.Fatalf("event %d published as %s, relayed as %s", i, ev.ID, ids[i])
+		}
+	}
+	b.live.publish(liveEvent{Type: eventAgentConnected, ClientID: "client_2"})
+	_, backlog, complete := b.live.subscribeSince(ids[n-3])
+	if !complete || len(backlog) != 3 || backlog[0].ID != ids[n-2] || !strings.HasPrefix(backlog[2].ID, "b:") {
+		t.Fatalf("resume on node b after %s: %+v, complete %v", ids[n-3], backlog, complete)
+	}
+}
+
+func TestClusterForwardsCommands(t *testing.T) {
+	b, nodeB := newBusNode(t, "b")
+	agent := connectAgent(t, b, "client_1")
+	a := &Server{live: newLiveView(), hub: newHub()}
+	cl := newTestCluster(a, "a", map[string]string{"client_1": "b", "client_2": "b", "client_3": "c", "client_4": "a"}, nodeB)
+
+	if !cl.forward(Command{ID: "cmd_1", ClientID: "client_1", Command: "uptime"}) {
+		t.Fatal("command for an agent on node b not delivered")
+	}
+	if msg := agent.next(t); msg["id"] != "cmd_1" || msg["command"] != "uptime" {
+		t.Fatalf("agent got %v", msg)
+	}
+
+	for _, cmd := range []Command{
+		{ID: "cmd_2", ClientID: "client_2"}, // recorded on b, but gone from there
+		{ID: "cmd_3", ClientID: "client_3"}, // on a node that stopped
+		{ID: "cmd_4", ClientID: "client_4"}, // on this node, so not connected
+		{ID: "cmd_5", ClientID: "client_5"}, // not connected anywhere
+	} {
+		if cl.forward(cmd) {
+			t.Fatalf("%s forwarded", cmd.ID)
+		}
+	}
+	select {
+	case msg := <-agent.messages:
+		t.Fatalf("agent got %v", msg)
+	default:
+	}
+
+	// A node only delivers commands for the agent the message names
+	body := `{"type":"deliver","client_id":"client_2","command":{"id":"cmd_6","client_id":"client_1"}}`
+	req, _ := http.NewRequest("POST", nodeB.URL+clusterPath, strings.NewReader(body))
+	req.Header.Set(clusterSecretHeader, testClusterSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("mismatched command: status %d", resp.StatusCode)
+	}
+}
+
+func TestClusterForwardsCancel(t *testing.T) {
+	b, nodeB := newBusNode(t, "b")
+	agent := connectAgent(t, b, "client_1", protocol.FeatureCancel)
+	connectAgent(t, b, "client_2")
+	cl := newTestCluster(&Server{}, "a", map[string]string{"client_1": "b", "client_2": "b"}, nodeB)
+
+	if ok, reason := cl.cancel("client_1", "cmd_1"); !ok {
+		t.Fatalf("cancel on node b failed: %s", reason)
+	}
+	if msg := agent.next(t); msg["type"] != protocol.TypeCancel || msg["command_id"] != "cmd_1" {
+		t.Fatalf("agent got %v", msg)
+	}
+
+	for _, tc := range []struct{ client, reason string }{
+		{"client_2", "could not cancel"}, // too old to cancel
+		{"client_3", "not connected"},
+	} {
+		if ok, reason := cl.cancel(tc.client, "cmd_1"); ok || !strings.Contains(reason, tc.reason) {
+			t.Errorf("cancel on %s: %v, %q", tc.client, ok, reason)
+		}
+	}
+
+	// A node that cannot be reached
+	cl.peers["b"] = Node{ID: "b", URL: "http://127.0.0.1:1"}
+	if ok, reason := cl.cancel("client_1", "cmd_1"); ok || !strings.Contains(reason, "reach") {
+		t.Fatalf("cancel through an unreachable node: %v, %q", ok, reason)
+	}
+}
+
+func TestClusterClaimReleasesOldSocket(t *testing.T) {
+	b, nodeB := newBusNode(t, "b")
+	agent := connectAgent(t, b, "client_1")
+	owners := map[string]string{"client_1": "b"}
+	cl := newTestCluster(&Server{}, "a", owners, nodeB)
+
+	// The agent reconnected to node a
+	cl.claim("client_1")
+	if owner, _ := cl.owner("client_1"); owner != "a" {
+		t.Fatalf("agent recorded on %q", owner)
+	}
+	select {
+	case <-agent.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node b kept the old socket")
+	}
+	if _, ok := b.hub.get("client_1"); ok {
+		t.Fatal("node b still lists the agent")
+	}
+
+	// Node b, told late, has nothing left to release
+	var result struct {
+		OK bool `json:"ok"`
+	}
+	msg, _ := json.Marshal(busMessage{Type: busRelease, ClientID: "client_1"})
+	req, _ := http.NewRequest("POST", nodeB.URL+clusterPath, strings.NewReader(string(msg)))
+	req.Header.Set(clusterSecretHeader, testClusterSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if result.OK {
+		t.Fatal("release of an agent that left reported done")
+	}
+
+	// A reconnect to the same node releases nothing
+	other := connectAgent(t, b, "client_2")
+	owners["client_2"] = "a"
+	cl.claim("client_2")
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-other.closed:
+		t.Fatal("socket of an agent not moving away was closed")
+	default:
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import "time"
+
+// Config holds the tunable behaviour of the server
+type Config struct {
+	Registration RegistrationLimits
+	WebSocket    WebSocketConfig
+	Agent        AgentLimits
+	Delivery     DeliveryConfig
+	Auth         AuthConfig
+
+	// TrustedProxies lists the addresses or CIDRs of reverse proxies whose
+	// X-Forwarded-For header is believed when deciding a request's client
+	// IP. Nil uses the address of the connection, so clients cannot pick
+	// the IP they are rate limited and locked out as.
+	TrustedProxies []string
+
+	// CommandPolicy holds the rules commands are checked against before
+	// they are stored. Nil means every command runs right away.
+	CommandPolicy *CommandPolicy
+
+	// Webhooks lists the endpoints live events are posted to. Nil means
+	// no webhooks are sent.
+	Webhooks *WebhookConfig
+
+	Cluster ClusterConfig
+
+	Retention RetentionConfig
+
+	// Redaction removes secrets from command output before it is stored or
+	// sent to operators. Nil stores output verbatim.
+	Redaction *RedactionConfig
+
+	// Encryption wraps the data keys that encrypt the command, result and
+	// error of commands in the store. Nil stores them in plaintext.
+	Encryption KeyWrapper
+}
+
+// RetentionConfig bounds how long command output is kept in the store.
+// Output past the policy is moved to archive files; the rest of the command
+// record stays.
+type RetentionConfig struct {
+	// MaxAge prunes finished commands older than this. Zero keeps them.
+	MaxAge time.Duration
+
+	// KeepPerClient prunes finished commands beyond the newest this many of
+	// each client. Zero keeps them.
+	KeepPerClient int
+
+	// ArchiveDir receives the gzip-compressed JSON Lines archive files
+	ArchiveDir string
+
+	// Interval is how often the policy is applied
+	Interval time.Duration
+}
+
+// Enabled reports whether any output is ever pruned
+func (r RetentionConfig) Enabled() bool {
+	return r.MaxAge > 0 || r.KeepPerClient > 0
+}
+
+// ClusterConfig lets several servers share the store and the agents
+type ClusterConfig struct {
+	// NodeID names this server in the nodes table and in clients.node_id
+	NodeID string
+
+	// AdvertiseURL is where other nodes reach this one, e.g.
+	// http://10.0.0.5:8080. Empty runs the server on its own.
+	AdvertiseURL string
+
+	// Secret authenticates requests between nodes
+	Secret string
+
+	// A node that has not sent a heartbeat for NodeTTL is considered gone,
+	// together with the agents connected to it
+	HeartbeatInterval time.Duration
+	NodeTTL           time.Duration
+
+	// ForwardTimeout bounds a request to another node
+	ForwardTimeout time.Duration
+}
+
+// Enabled reports whether the server runs as part of a cluster
+func (c ClusterConfig) Enabled() bool {
+	return c.AdvertiseURL != ""
+}
+
+// AuthConfig controls operator authentication of the management API
+type AuthConfig struct {
+	// AllowAnonymous lets requests without a token through as the
+	// "anonymous" admin. Only meant for local development.
+	AllowAnonymous bool
+}
+
+// RegistrationLimits bounds how hard the public /register endpoint can be hit
+type RegistrationLimits struct {
+	// Token buckets: Rate is requests per second, Burst the bucket size
+	PerIPRate   float64
+	PerIPBurst  int
+	GlobalRate  float64
+	GlobalBurst int
+
+	// An IP presenting MaxFailures invalid tokens within FailureWindow is
+	// locked out for LockoutDuration
+	MaxFailures     int
+	FailureWindow   time.Duration
+	LockoutDuration time.Duration
+
+	// MaxBodyBytes caps the size of a registration request body
+	MaxBodyBytes int64
+}
+
+// WebSocketConfig controls who may open sockets and how many at once
+type WebSocketConfig struct {
+	// AllowedOrigins lists the browser origins (scheme://host[:port]) allowed
+	// to open operator live views. Empty means same-origin only.
+	AllowedOrigins []string
+
+	// MaxConcurrentUpgrades bounds the number of websocket handshakes being
+	// processed at the same time. Zero disables the limit.
+	MaxConcurrentUpgrades int
+
+	// HandshakeTimeout bounds how long a single upgrade may take
+	HandshakeTimeout time.Duration
+}
+
+// AgentLimits are announced to agents in the handshake
+type AgentLimits struct {
+	// MaxMessageBytes caps a single message read from an agent socket
+	MaxMessageBytes int64
+
+	// MaxOutputBytes caps the command output an agent sends back
+	MaxOutputBytes int
+
+	// HeartbeatInterval is how often agents report in
+	HeartbeatInterval time.Duration
+}
+
+// DeliveryConfig controls how commands are re-sent to agents that have not
+// acknowledged them
+type DeliveryConfig struct {
+	// AckTimeout is how long to wait for the first ack; it doubles with
+	// every retry up to MaxBackoff
+	AckTimeout time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is how often a command is sent to a connected agent
+	// before it is marked undelivered
+	MaxAttempts int
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		Registration: RegistrationLimits{
+			PerIPRate:       0.2, // one request every 5 seconds
+			PerIPBurst:      5,
+			GlobalRate:      20,
+			GlobalBurst:     50,
+			MaxFailures:     5,
+			FailureWindow:   10 * time.Minute,
+			LockoutDuration: 15 * time.Minute,
+			MaxBodyBytes:    4 << 10,
+		},
+		WebSocket: WebSocketConfig{
+			MaxConcurrentUpgrades: 64,
+			HandshakeTimeout:      10 * time.Second,
+		},
+		Agent: AgentLimits{
+			MaxMessageBytes:   1 << 20,
+			MaxOutputBytes:    512 << 10,
+			HeartbeatInterval: 30 * time.Second,
+		},
+		Delivery: DeliveryConfig{
+			AckTimeout:  10 * time.Second,
+			MaxBackoff:  2 * time.Minute,
+			MaxAttempts: 8,
+		},
+		Cluster: ClusterConfig{
+			HeartbeatInterval: 10 * time.Second,
+			NodeTTL:           30 * time.Second,
+			ForwardTimeout:    5 * time.Second,
+		},
+		Retention: RetentionConfig{
+			ArchiveDir: "archive",
+			Interval:   time.Hour,
+		},
+		Redaction: DefaultRedactionConfig(),
+	}
+}
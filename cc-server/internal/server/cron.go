@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands accepted in place of five fields
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week (0 or 7 is Sunday)
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// Like cron, a restricted day of month and day of week match either
+	domAny, dowAny bool
+
+	// wildcardTime is set when the minute or hour starts with "*". Like in
+	// cron, such runs follow the clock through daylight saving changes,
+	// while runs at a fixed time of day happen once that day.
+	wildcardTime bool
+}
+
+// parseCron parses expressions such as "*/15 8-18 * * 1-5" or "@daily"
+func parseCron(expr string) (*cronSchedule, error) {
+	if m, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var cs cronSchedule
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if cs.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	cs.domAny = fields[2] == "*"
+	cs.dowAny = fields[4] == "*"
+	cs.wildcardTime = strings.HasPrefix(fields[0], "*") || strings.HasPrefix(fields[1], "*")
+	return &cs, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "n", "a-b", each
+// optionally followed by "/step"
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid value %q", b)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matchesDay reports whether the cron runs on the day of t
+func (cs *cronSchedule) matchesDay(t time.Time) bool {
+	if !cs.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := cs.dom[t.Day()], cs.dow[int(t.Weekday())]
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dow
+	case cs.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the cron fires, in t's location. It
+// gives up after five years, which only happens for dates like "0 0 30 2 *".
+//
+// Fields are matched against the wall clock. A fixed-time run whose time is
+// skipped when clocks go forward runs as the gap ends, and one whose time
+// repeats when clocks go back runs the first time only. Wildcard runs skip
+// the gap and run in both passes of a repeated hour.
+func (cs *cronSchedule) next(t time.Time) (time.Time, bool) {
+	// Start a little early: the hour before t may repeat after it
+	w := wallClock(t).Add(-3 * time.Hour)
+	limit := w.AddDate(5, 0, 0)
+
+	for w.Before(limit) {
+		if !cs.matchesDay(w) {
+			y, m, d := w.Date()
+			w = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cs.hour[w.Hour()] {
+			w = w.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !cs.minute[w.Minute()] {
+			w = w.Add(time.Minute)
+			continue
+		}
+		for _, at := range cs.instants(w, t.Location()) {
+			if at.After(t) {
+				return at, true
+			}
+		}
+		w = w.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// wallClock returns the wall-clock minute of t as a time in UTC, which has
+// no gaps or repeats to walk through
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// instants returns when the wall-clock time w happens in loc, in order:
+// once, twice in a repeated hour or never in a gap, as cs runs then
+func (cs *cronSchedule) instants(w time.Time, loc *time.Location) []time.Time {
+	// Any offset change near w is between the offsets a day before and after
+	var at []time.Time
+	for _, probe := range []time.Time{w.Add(-24 * time.Hour), w.Add(24 * time.Hour)} {
+		_, offset := probe.In(loc).Zone()
+		c := w.Add(-time.Duration(offset) * time.Second).In(loc)
+		if wallClock(c).Equal(w) && (len(at) == 0 || !at[0].Equal(c)) {
+			at = append(at, c)
+		}
+	}
+	if len(at) == 2 && at[1].Before(at[0]) {
+		at[0], at[1] = at[1], at[0]
+	}
+
+	switch {
+	case len(at) == 0 && cs.wildcardTime:
+		return nil
+	case len(at) == 0:
+		// Read with the offset before the gap, w is past it
+		_, offset := w.Add(-24 * time.Hour).In(loc).Zone()
+		gapEnd, _ := w.Add(-time.Duration(offset) * time.Second).In(loc).ZoneBounds()
+		return []time.Time{gapEnd}
+	case len(at) == 2 && !cs.wildcardTime:
+		return at[:1]
+	}
+	return at
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronField(t *testing.T) {
+	for _, tc := range []struct {
+		field    string
+		min, max int
+		want     string // sorted values, or "error"
+	}{
+		{"*", 0, 5, "[0 1 2 3 4 5]"},
+		{"3", 0, 59, "[3]"},
+		{"1,3,5", 0, 59, "[1 3 5]"},
+		{"8-11", 0, 23, "[8 9 10 11]"},
+		{"*/15", 0, 59, "[0 15 30 45]"},
+		{"10-20/5", 0, 59, "[10 15 20]"},
+		{"50/4", 0, 59, "[50 54 58]"},
+		{"1-3,*/10", 0, 30, "[0 1 2 3 10 20 30]"},
+		{"60", 0, 59, "error"},
+		{"0", 1, 31, "error"},
+		{"5-3", 0, 59, "error"},
+		{"*/0", 0, 59, "error"},
+		{"a", 0, 59, "error"},
+		{"1-", 0, 59, "error"},
+		{"", 0, 59, "error"},
+	} {
+		values, err := parseCronField(tc.field, tc.min, tc.max)
+		got := "error"
+		if err == nil {
+			var list []int
+			for v := range values {
+				list = append(list, v)
+			}
+			sort.Ints(list)
+			got = fmt.Sprint(list)
+		}
+		if got != tc.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %s, want %s", tc.field, tc.min, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * *", "* * * * * *", "61 * * * *", "* 24 * * *", "* * * 13 *", "* * * * 8", "@yearly"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+	cs, err := parseCron(" @daily ")
+	if err != nil || !cs.minute[0] || len(cs.minute) != 1 || !cs.hour[0] || len(cs.hour) != 1 || !cs.domAny || !cs.dowAny {
+		t.Fatalf("@daily parsed as %+v, %v", cs, err)
+	}
+	cs, _ = parseCron("0 0 * * 7")
+	if !cs.dow[0] {
+		t.Fatal("7 is not Sunday")
+	}
+}
+
+// cronTimes lists the first n times cron fires after start
+func cronTimes(t *testing.T, expr string, start time.Time, n int) []string {
+	t.Helper()
+	cs, err := parseCron(expr)
+	if err != nil {
+		t.Fatalf("parseCron(%q): %v", expr, err)
+	}
+	var times []string
+	for at := start; len(times) < n; {
+		next, ok := cs.next(at)
+		if !ok {
+			t.Fatalf("%q never fires after %v", expr, at)
+		}
+		times = append(times, next.Format("2006-01-02 15:04 MST"))
+		at = next
+	}
+	return times
+}
+
+func TestCronNext(t *testing.T) {
+	// A Monday
+	start := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want []string
+	}{
+		{"*/15 * * * *", []string{"2024-01-01 10:15 UTC", "2024-01-01 10:30 UTC", "2024-01-01 10:45 UTC"}},
+		{"7 10 * * *", []string{"2024-01-02 10:07 UTC", "2024-01-03 10:07 UTC"}},
+		{"0 9-17/4 * * *", []string{"2024-01-01 13:00 UTC", "2024-01-01 17:00 UTC", "2024-01-02 09:00 UTC"}},
+		{"@hourly", []string{"2024-01-01 11:00 UTC", "2024-01-01 12:00 UTC"}},
+		{"@weekly", []string{"2024-01-07 00:00 UTC", "2024-01-14 00:00 UTC"}},
+		{"@monthly", []string{"2024-02-01 00:00 UTC", "2024-03-01 00:00 UTC"}},
+		{"30 2 * * 1-5", []string{"2024-01-02 02:30 UTC", "2024-01-03 02:30 UTC", "2024-01-04 02:30 UTC", "2024-01-05 02:30 UTC", "2024-01-08 02:30 UTC"}},
+		// Restricted day of month and day of week: either matches
+		{"0 0 13 * 5", []string{"2024-01-05 00:00 UTC", "2024-01-12 00:00 UTC", "2024-01-13 00:00 UTC", "2024-01-19 00:00 UTC"}},
+		// Only the day of week restricted
+		{"0 0 * * 5", []string{"2024-01-05 00:00 UTC", "2024-01-12 00:00 UTC"}},
+		{"0 12 29 2 *", []string{"2024-02-29 12:00 UTC", "2028-02-29 12:00 UTC"}},
+	} {
+		if got := cronTimes(t, tc.expr, start, len(tc.want)); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q fires at %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+
+	cs, _ := parseCron("0 0 30 2 *")
+	if _, ok := cs.next(start); ok {
+		t.Fatal("February 30th fired")
+	}
+}
+
+func TestCronNextAcrossDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clocks go from 02:00 EST to 03:00 EDT on March 10th 2024, and from
+	// 02:00 EDT back to 01:00 EST on November 3rd
+	spring := time.Date(2024, 3, 9, 23, 0, 0, 0, ny)
+	fall := time.Date(2024, 11, 2, 23, 0, 0, 0, ny)
+
+	for _, tc := range []struct {
+		name  string
+		expr  string
+		start time.Time
+		want  []string
+	}{
+		{"fixed time in the gap runs as it ends", "30 2 * * *", spring,
+			[]string{"2024-03-10 03:00 EDT", "2024-03-11 02:30 EDT"}},
+		{"fixed times in the gap run once", "0,30 2 * * *", spring.Add(2 * time.Hour),
+			[]string{"2024-03-10 03:00 EDT", "2024-03-11 02:00 EDT"}},
+		{"wildcard minute skips the gap", "*/20 2 * * *", spring.Add(2 * time.Hour),
+			[]string{"2024-03-11 02:00 EDT", "2024-03-11 02:20 EDT"}},
+		{"fixed time after the gap", "30 3 * * *", spring,
+			[]string{"2024-03-10 03:30 EDT", "2024-03-11 03:30 EDT"}},
+		{"wildcard skips the gap", "0 * * * *", spring.Add(2 * time.Hour),
+			[]string{"2024-03-10 03:00 EDT", "2024-03-10 04:00 EDT"}},
+		{"fixed time in the repeated hour runs once", "30 1 * * *", fall,
+			[]string{"2024-11-03 01:30 EDT", "2024-11-04 01:30 EST"}},
+		{"wildcard runs in both passes", "30 * * * *", fall.Add(2 * time.Hour),
+			[]string{"2024-11-03 01:30 EDT", "2024-11-03 01:30 EST", "2024-11-03 02:30 EST"}},
+		{"fixed time after the repeated hour", "0 2 * * *", fall,
+			[]string{"2024-11-03 02:00 EST", "2024-11-04 02:00 EST"}},
+		{"daily across both changes", "@daily", time.Date(2024, 3, 9, 12, 0, 0, 0, ny),
+			[]string{"2024-03-10 00:00 EST", "2024-03-11 00:00 EDT"}},
+		{"zone not a whole hour off UTC", "15 */6 * * *", time.Date(2024, 1, 1, 0, 20, 0, 0, kolkata),
+			[]string{"2024-01-01 06:15 IST", "2024-01-01 12:15 IST"}},
+	} {
+		if got := cronTimes(t, tc.expr, tc.start, len(tc.want)); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: %q fires at %v, want %v", tc.name, tc.expr, got, tc.want)
+		}
+	}
+
+	// A server restarting in the second pass of the hour does not run a
+	// fixed-time schedule again
+	cs, _ := parseCron("30 1 * * *")
+	secondPass := time.Date(2024, 11, 3, 6, 10, 0, 0, time.UTC).In(ny)
+	if next, _ := cs.next(secondPass); next.Format("2006-01-02 15:04 MST") != "2024-11-04 01:30 EST" {
+		t.Fatalf("next after %v = %v", secondPass, next)
+	}
+}
+
+func TestScheduleNextDue(t *testing.T) {
+	prev := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		sch  Schedule
+		now  time.Time
+		want time.Time
+	}{
+		{"interval", Schedule{Interval: "10m"}, prev.Add(time.Minute), prev.Add(10 * time.Minute)},
+		{"interval skips missed runs", Schedule{Interval: "10m"}, prev.Add(35 * time.Minute), prev.Add(40 * time.Minute)},
+		{"interval due exactly now", Schedule{Interval: "10m"}, prev.Add(10 * time.Minute), prev.Add(10 * time.Minute)},
+		{"cron", Schedule{Cron: "0 * * * *"}, prev.Add(time.Minute), prev.Add(time.Hour)},
+		{"cron skips missed runs", Schedule{Cron: "0 * * * *"}, prev.Add(150 * time.Minute), prev.Add(3 * time.Hour)},
+		{"cron in a timezone", Schedule{Cron: "0 12 * * *", Timezone: "Europe/Berlin"}, prev, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+	} {
+		sch := tc.sch
+		sch.Name, sch.Command, sch.Selector = "test", "true", "role=web"
+		if err := sch.compile(); err != nil {
+			t.Fatalf("%s: compile: %v", tc.name, err)
+		}
+		got, err := sch.nextDue(prev, tc.now)
+		if err != nil || !got.Equal(tc.want) {
+			t.Errorf("%s: nextDue = %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestSchedulePlanJitter(t *testing.T) {
+	sch := Schedule{Name: "test", Command: "true", Selector: "role=web", Cron: "0 * * * *", Jitter: "5m"}
+	if err := sch.compile(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	spread := false
+	for i := 0; i < 100; i++ {
+		if err := sch.plan(now, now); err != nil {
+			t.Fatal(err)
+		}
+		due, start := *sch.NextDueAt, *sch.NextRunAt
+		if !due.Equal(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)) {
+			t.Fatalf("due at %v", due)
+		}
+		if start.Before(due) || !start.Before(due.Add(5*time.Minute)) {
+			t.Fatalf("start %v outside the jitter after %v", start, due)
+		}
+		spread = spread || !start.Equal(due)
+	}
+	if !spread {
+		t.Fatal("jitter never delayed a run")
+	}
+}
+
+func TestScheduleCompile(t *testing.T) {
+	valid := Schedule{Name: "n", Command: "true", Selector: "role=web", Interval: "1h"}
+	for name, change := range map[string]func(*Schedule){
+		"no name":             func(s *Schedule) { s.Name = "" },
+		"cron and interval":   func(s *Schedule) { s.Cron = "@daily" },
+		"neither":             func(s *Schedule) { s.Interval = "" },
+		"short interval":      func(s *Schedule) { s.Interval = "1s" },
+		"bad cron":            func(s *Schedule) { s.Interval, s.Cron = "", "* * *" },
+		"bad timezone":        func(s *Schedule) { s.Timezone = "Mars/Olympus" },
+		"negative jitter":     func(s *Schedule) { s.Jitter = "-1m" },
+		"bad selector":        func(s *Schedule) { s.Selector = "=" },
+		"bad offline":         func(s *Schedule) { s.Offline = "sometimes" },
+		"bad rollout timeout": func(s *Schedule) { s.Rollout = &Rollout{BatchTimeout: "x"} },
+	} {
+		sch := valid
+		change(&sch)
+		if err := sch.compile(); err == nil {
+			t.Errorf("schedule with %s compiled", name)
+		}
+	}
+	sch := valid
+	if err := sch.compile(); err != nil || sch.Offline != offlineQueue {
+		t.Fatalf("valid schedule: %v, offline %q", err, sch.Offline)
+	}
+}
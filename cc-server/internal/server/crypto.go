@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// sealer encrypts values stored by the server with AES-256-GCM. Sealed
+// values are base64 of the nonce followed by the ciphertext.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealerFromEnv reads a base64 encoded 32-byte key from an environment
+// variable
+func newSealerFromEnv(name string) (*sealer, error) {
+	encoded := os.Getenv(name)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is not set", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes, base64 encoded", name)
+	}
+	return newSealer(key)
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts plaintext
+func (s *sealer) seal(plaintext []byte) (string, error) {
+	return s.sealFor(plaintext, nil)
+}
+
+// sealFor encrypts plaintext bound to aad, which openFor must be given to
+// decrypt it
+func (s *sealer) sealFor(plaintext, aad []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, aad)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value made by seal
+func (s *sealer) open(value string) ([]byte, error) {
+	return s.openFor(value, nil)
+}
+
+// openFor decrypts a value made by sealFor with the same aad
+func (s *sealer) openFor(value string, aad []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("sealed value too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
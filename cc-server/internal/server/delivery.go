@@ -0,0 +1,405 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// Command statuses
+const (
+	statusAwaitingApproval = "awaiting_approval" // waiting for a second operator
+	statusHeld             = "held"              // waiting for its rollout batch
+	statusPending          = "pending"           // stored, not yet sent
+	statusDelivered        = "delivered"         // written to the agent socket
+	statusQueued           = "queued"            // agent accepted it, waiting for a worker
+	statusReceived         = "received"          // agent acknowledged receipt
+	statusCompleted        = "completed"         // agent reported success
+	statusFailed           = "failed"            // agent reported an error
+	statusLimited          = "limit_exceeded"    // stopped by a resource limit
+	statusUndelivered      = "undelivered"       // gave up after MaxAttempts
+	statusCancelled        = "cancelled"         // stopped by an operator or its job
+	statusRejected         = "rejected"          // a second operator refused it
+	statusExpired          = "expired"           // nobody approved it in time
+)
+
+// unfinishedStatuses are the statuses a command can still leave
+var unfinishedStatuses = []string{statusAwaitingApproval, statusHeld, statusPending, statusDelivered, statusQueued, statusReceived, statusUndelivered}
+
+// pendingDelivery is a command sent to an agent that has not acknowledged it
+type pendingDelivery struct {
+	cmd         Command
+	attempts    int
+	nextAttempt time.Time
+}
+
+// deliveryTracker retries commands until the agent acknowledges receipt
+type deliveryTracker struct {
+	mu      sync.Mutex
+	pending map[string]*pendingDelivery
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{pending: make(map[string]*pendingDelivery)}
+}
+
+func (t *deliveryTracker) track(cmd Command, nextAttempt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[cmd.ID]; ok {
+		p.attempts++
+		p.nextAttempt = nextAttempt
+		return
+	}
+	t.pending[cmd.ID] = &pendingDelivery{cmd: cmd, attempts: 1, nextAttempt: nextAttempt}
+}
+
+// ack stops retrying a command and reports whether it was being tracked
+func (t *deliveryTracker) ack(commandID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.pending[commandID]
+	delete(t.pending, commandID)
+	return ok
+}
+
+// postpone pushes back the next attempt of a tracked command
+func (t *deliveryTracker) postpone(commandID string, nextAttempt time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[commandID]
+	if ok {
+		p.nextAttempt = nextAttempt
+	}
+	return ok
+}
+
+// due returns the deliveries whose retry time has passed
+func (t *deliveryTracker) due(now time.Time) []pendingDelivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var due []pendingDelivery
+	for _, p := range t.pending {
+		if !now.Before(p.nextAttempt) {
+			due = append(due, *p)
+		}
+	}
+	return due
+}
+
+// commandMessage is a command as sent to an agent, with the values of the
+// secrets it uses. It is never stored.
+type commandMessage struct {
+	Command
+	SecretEnv   map[string]string `json:"secret_env,omitempty"`
+	SecretStdin string            `json:"secret_stdin,omitempty"`
+}
+
+// deliver sends a command to its agent if it is connected, here or on
+// another node of the cluster
+func (s *Server) deliver(cmd Command) bool {
+	if _, ok := s.hub.get(cmd.ClientID); !ok && s.cluster != nil {
+		return s.cluster.forward(cmd)
+	}
+	return s.deliverLocal(cmd)
+}
+
+// deliverLocal sends a command to its agent if it is connected to this node.
+// Agents that acknowledge commands get it re-sent until they do.
+func (s *Server) deliverLocal(cmd Command) bool {
+	ac, ok := s.hub.get(cmd.ClientID)
+	if !ok {
+		log.Printf("Client %s is not connected, command %s queued", cmd.ClientID, cmd.ID)
+		return false
+	}
+	if ac.paused.Load() {
+		log.Printf("Client %s is paused by its owner, command %s held", cmd.ClientID, cmd.ID)
+		return false
+	}
+
+	// Limits must never be silently dropped by an agent that cannot apply them
+	if cmd.Limits != nil && !cmd.Limits.IsZero() && !ac.session.Has(protocol.FeatureLimits) {
+		log.Printf("Client %s cannot enforce resource limits, failing command %s", cmd.ClientID, cmd.ID)
+		s.failCommand(cmd.ID, "agent does not support resource limits")
+		return false
+	}
+
+	// Shell lines were checked and stored as typed. Agents that wrap them
+	// get the line and its directory, so their policy sees it as typed too;
+	// older ones get the script that carries the directory over.
+	msg := commandMessage{Command: cmd}
+	if cmd.Task == protocol.ShellTask && !ac.session.Has(protocol.FeatureShell) {
+		msg.Command.Command = protocol.WrapShellLine(cmd.Command, cmd.Cwd)
+		msg.Command.Cwd = ""
+	}
+	if len(cmd.Secrets) > 0 {
+		if !ac.session.Has(protocol.FeatureSecrets) {
+			log.Printf("Client %s cannot receive secrets, failing command %s", cmd.ClientID, cmd.ID)
+			s.failCommand(cmd.ID, "agent does not support secrets")
+			return false
+		}
+		var err error
+		if msg.SecretEnv, msg.SecretStdin, err = s.resolveSecrets(cmd); err != nil {
+			log.Printf("Failing command %s: %v", cmd.ID, err)
+			s.failCommand(cmd.ID, err.Error())
+			return false
+		}
+	}
+
+	if err := ac.send(msg); err != nil {
+		log.Printf("Failed to send command %s to client %s: %v", cmd.ID, cmd.ClientID, err)
+		return false
+	}
+
+	if ac.session.Has(protocol.FeatureAck) {
+		s.deliveries.track(cmd, time.Now().Add(s.retryDelay(cmd.ID)))
+	}
+	s.updateCommandStatus(cmd.ID, statusDelivered, statusPending, statusUndelivered)
+	return true
+}
+
+// retryDelay doubles the ack timeout with every attempt, up to MaxBackoff
+func (s *Server) retryDelay(commandID string) time.Duration {
+	attempts := 0
+	s.deliveries.mu.Lock()
+	if p, ok := s.deliveries.pending[commandID]; ok {
+		attempts = p.attempts
+	}
+	s.deliveries.mu.Unlock()
+
+	delay := s.cfg.Delivery.AckTimeout
+	for i := 0; i < attempts && delay < s.cfg.Delivery.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.cfg.Delivery.MaxBackoff {
+		delay = s.cfg.Delivery.MaxBackoff
+	}
+	return delay
+}
+
+// retryDeliveries re-sends unacknowledged commands until the server stops.
+// Every node of a cluster runs it, for the commands it sent to the agents
+// connected to it.
+func (s *Server) retryDeliveries() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, p := range s.deliveries.due(time.Now()) {
+			if _, ok := s.hub.get(p.cmd.ClientID); !ok {
+				// Offline agents get their commands again when they reconnect
+				s.deliveries.ack(p.cmd.ID)
+				continue
+			}
+			if p.attempts >= s.cfg.Delivery.MaxAttempts {
+				log.Printf("Giving up on command %s after %d attempts", p.cmd.ID, p.attempts)
+				s.deliveries.ack(p.cmd.ID)
+				s.updateCommandStatus(p.cmd.ID, statusUndelivered, statusDelivered)
+				continue
+			}
+			log.Printf("No ack for command %s from client %s, re-sending (attempt %d)", p.cmd.ID, p.cmd.ClientID, p.attempts+1)
+			s.deliver(p.cmd)
+		}
+	}
+}
+
+// redeliver sends every unfinished command of an agent that just connected.
+// Commands it already received are sent again too: the agent's journal
+// reports them instead of running them twice.
+func (s *Server) redeliver(clientID string) {
+	var commands []Command
+	resp, err := s.db.From("commands").Select("*", false, "", "", "").
+		Eq("client_id", clientID).
+		In("status", []string{statusPending, statusDelivered, statusQueued, statusReceived}).
+		Order("created_at", true).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to load unfinished commands for client %s: %v", clientID, err)
+		return
+	}
+	if err := s.db.ParseJSON(resp.Body, &commands); err != nil {
+		log.Printf("Failed to parse unfinished commands for client %s: %v", clientID, err)
+		return
+	}
+
+	for _, cmd := range commands {
+		if err := s.openCommand(&cmd); err != nil {
+			log.Printf("Not re-sending undecryptable %v", err)
+			continue
+		}
+		s.deliver(cmd)
+	}
+}
+
+// handleAck records that an agent has a command
+func (s *Server) handleAck(clientID string, message []byte) {
+	var ack protocol.Ack
+	if err := json.Unmarshal(message, &ack); err != nil {
+		log.Printf("Invalid ack from client %s: %v", clientID, err)
+		return
+	}
+	switch ack.Stage {
+	case protocol.AckQueued:
+		s.deliveries.ack(ack.CommandID)
+		s.updateCommandStatus(ack.CommandID, statusQueued, statusPending, statusDelivered, statusUndelivered)
+	case protocol.AckReceived:
+		s.deliveries.ack(ack.CommandID)
+		s.updateCommandStatus(ack.CommandID, statusReceived, statusPending, statusDelivered, statusQueued, statusUndelivered)
+	}
+}
+
+// handleResult stores the outcome of a command
+func (s *Server) handleResult(clientID string, message []byte) {
+	var res protocol.Result
+	if err := json.Unmarshal(message, &res); err != nil {
+		log.Printf("Invalid result from client %s: %v", clientID, err)
+		return
+	}
+
+	// A busy agent refused the command; keep it tracked and try again later
+	if res.Status == protocol.StatusBusy {
+		log.Printf("Client %s is busy, will re-send command %s", clientID, res.CommandID)
+		s.deliveries.postpone(res.CommandID, time.Now().Add(s.retryDelay(res.CommandID)))
+		return
+	}
+	s.deliveries.ack(res.CommandID)
+
+	// A paused agent refused the command; hold it until the agent resumes
+	if res.Status == protocol.StatusPaused {
+		log.Printf("Client %s is paused, holding command %s", clientID, res.CommandID)
+		s.updateCommandStatus(res.CommandID, statusPending, statusDelivered, statusUndelivered)
+		return
+	}
+
+	// The end of the streamed output goes out before the final status
+	s.flushOutput(clientID, res.CommandID)
+
+	update := map[string]interface{}{
+		"result":       res.Result,
+		"error":        res.Error,
+		"completed_at": time.Now(),
+	}
+	if res.ExitCode != nil {
+		update["exit_code"] = *res.ExitCode
+	}
+
+	switch res.Status {
+	case protocol.StatusSuccess:
+		update["status"] = statusCompleted
+	case protocol.StatusDuplicate:
+		log.Printf("Client %s reported command %s as already run (%s)", clientID, res.CommandID, res.Original)
+		update["status"] = statusFailed
+		if res.Original == protocol.StatusSuccess {
+			update["status"] = statusCompleted
+		}
+	case protocol.StatusLimitExceeded:
+		update["status"] = statusLimited
+		update["limit_exceeded"] = res.LimitExceeded
+	case protocol.StatusCancelled:
+		update["status"] = statusCancelled
+	case protocol.StatusInterrupted:
+		update["status"] = statusFailed
+		if res.Error == "" {
+			update["error"] = "agent restarted while the command was running"
+		}
+	default:
+		update["status"] = statusFailed
+	}
+
+	s.cfg.Redaction.redactResult(res.CommandID, update)
+	if err := s.sealUpdate(res.CommandID, update); err != nil {
+		log.Printf("Failed to encrypt result of command %s: %v", res.CommandID, err)
+		return
+	}
+
+	query := s.db.From("commands").Update(update, "representation", "").Eq("id", res.CommandID).Eq("client_id", clientID)
+	if res.Status == protocol.StatusDuplicate || res.Status == protocol.StatusInterrupted {
+		// Never let a replayed outcome overwrite a result already stored
+		query = query.In("status", unfinishedStatuses)
+	}
+	resp, err := query.Execute()
+	if err != nil {
+		log.Printf("Failed to store result of command %s: %v", res.CommandID, err)
+		return
+	}
+	s.publishUpdatedCommands(resp.Body)
+}
+
+// Mark a command failed before it reached the agent
+func (s *Server) failCommand(commandID, reason string) {
+	update := map[string]interface{}{
+		"status":       statusFailed,
+		"error":        reason,
+		"completed_at": time.Now(),
+	}
+	if err := s.sealUpdate(commandID, update); err != nil {
+		log.Printf("Failed to encrypt error of command %s: %v", commandID, err)
+		return
+	}
+	resp, err := s.db.From("commands").Update(update, "representation", "").
+		Eq("id", commandID).
+		In("status", unfinishedStatuses).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to fail command %s: %v", commandID, err)
+		return
+	}
+	s.publishUpdatedCommands(resp.Body)
+}
+
+// Move a command to status, but only from one of the given statuses, so a
+// late delivery update never overwrites a newer state
+func (s *Server) updateCommandStatus(commandID, status string, from ...string) {
+	resp, err := s.db.From("commands").Update(map[string]interface{}{"status": status}, "representation", "").
+		Eq("id", commandID).
+		In("status", from).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to update status of command %s: %v", commandID, err)
+		return
+	}
+	s.publishUpdatedCommands(resp.Body)
+}
+
+// handleAgentStatus records a change of the agent's local state
+func (s *Server) handleAgentStatus(clientID string, message []byte) {
+	var st protocol.AgentStatus
+	if err := json.Unmarshal(message, &st); err != nil {
+		log.Printf("Invalid status from client %s: %v", clientID, err)
+		return
+	}
+	ac, ok := s.hub.get(clientID)
+	if !ok {
+		return
+	}
+
+	wasPaused := ac.paused.Swap(st.Paused)
+	if wasPaused == st.Paused {
+		return
+	}
+	if st.Paused {
+		log.Printf("Client %s was paused by its owner", clientID)
+		s.audit(AuditEvent{Type: auditAgentPaused, ClientID: clientID})
+	} else {
+		log.Printf("Client %s was resumed by its owner", clientID)
+		s.audit(AuditEvent{Type: auditAgentResumed, ClientID: clientID})
+		go s.redeliver(clientID)
+	}
+	s.updateClientStatus(clientID, agentStatus(ac))
+	s.live.publish(liveEvent{
+		Type:     eventAgentStatus,
+		ClientID: clientID,
+		Data:     eventData(map[string]interface{}{"status": agentStatus(ac)}),
+	})
+}
+
+// agentStatus is the client status stored for a connected agent
+func agentStatus(ac *agentConn) string {
+	if ac.paused.Load() {
+		return "paused"
+	}
+	return "connected"
+}
@@ -0,0 +1,516 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// envelopePrefix marks an encrypted value. The rest is the ID of the master
+// key, the wrapped data key and the sealed value, separated by colons:
+//
+//	enc2:<key id>:<wrapped data key>:<nonce and ciphertext>
+//
+// The ciphertext is bound to the column and record holding it (see
+// fieldContext), so a value copied to another row does not decrypt. Values
+// with legacyEnvelopePrefix were sealed without that binding and are moved
+// to the current format by -reencrypt. Values without either prefix were
+// stored before encryption was enabled and are read as they are.
+const (
+	envelopePrefix       = "enc2:"
+	legacyEnvelopePrefix = "enc1:"
+)
+
+// encryptedCommandFields are the columns of commands stored encrypted
+var encryptedCommandFields = []string{"command", "result", "error"}
+
+// KeyWrapper protects data keys with master keys the store never sees. A
+// KMS can be used by implementing it; LoadMasterKeyFile reads local keys.
+type KeyWrapper interface {
+	// Wrap encrypts a data key with the current master key and returns the
+	// ID of that key along with the wrapped data key
+	Wrap(dataKey []byte) (keyID, wrapped string, err error)
+
+	// Unwrap decrypts a data key wrapped by the master key keyID
+	Unwrap(keyID, wrapped string) ([]byte, error)
+
+	// Current is the ID of the master key new data keys are wrapped with
+	Current() string
+}
+
+// masterKeyFile lists the master keys by ID. Old keys stay in the file
+// until -reencrypt has moved every value to the current one.
+type masterKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"` // base64 encoded 32-byte keys
+}
+
+// fileKeyring wraps data keys with master keys read from a local file
+type fileKeyring struct {
+	current string
+	keys    map[string]*sealer
+}
+
+// LoadMasterKeyFile reads the master keys that wrap the data keys of
+// encrypted command fields
+func LoadMasterKeyFile(file string) (KeyWrapper, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %v", err)
+	}
+
+	var mf masterKeyFile
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, fmt.Errorf("failed to parse master key file: %v", err)
+	}
+
+	kr := &fileKeyring{current: mf.Current, keys: make(map[string]*sealer)}
+	for id, encoded := range mf.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid master key ID %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes, base64 encoded", id)
+		}
+		if kr.keys[id], err = newSealer(key); err != nil {
+			return nil, err
+		}
+	}
+	if kr.keys[kr.current] == nil {
+		return nil, fmt.Errorf("current master key %q is not in the file", kr.current)
+	}
+	return kr, nil
+}
+
+func (kr *fileKeyring) Current() string { return kr.current }
+
+func (kr *fileKeyring) Wrap(dataKey []byte) (string, string, error) {
+	wrapped, err := kr.keys[kr.current].seal(dataKey)
+	return kr.current, wrapped, err
+}
+
+func (kr *fileKeyring) Unwrap(keyID, wrapped string) ([]byte, error) {
+	key := kr.keys[keyID]
+	if key == nil {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	return key.open(wrapped)
+}
+
+// fieldContext names where a sealed value is stored, such as
+// "commands.result:cmd_1". It is the associated data of the value.
+func fieldContext(table, column, id string) string {
+	return table + "." + column + ":" + id
+}
+
+// isSealed reports whether v is an encrypted value
+func isSealed(v string) bool {
+	return strings.HasPrefix(v, envelopePrefix) || strings.HasPrefix(v, legacyEnvelopePrefix)
+}
+
+// sealValue encrypts v, to be stored at context, with a new data key
+// wrapped by the current master key. Empty values and values of a server
+// without keys are kept as is.
+func sealValue(keys KeyWrapper, context, v string) (string, error) {
+	if keys == nil || v == "" {
+		return v, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	ds, err := newSealer(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := ds.sealFor([]byte(v), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	keyID, wrapped, err := keys.Wrap(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return envelopePrefix + keyID + ":" + wrapped + ":" + sealed, nil
+}
+
+// openValue decrypts a value sealValue made for context. Plaintext values
+// are returned as they are.
+func openValue(keys KeyWrapper, context, v string) (string, error) {
+	if !isSealed(v) {
+		return v, nil
+	}
+	if keys == nil {
+		return "", fmt.Errorf("value is encrypted but no master key is configured")
+	}
+	var aad []byte
+	if strings.HasPrefix(v, envelopePrefix) {
+		aad = []byte(context)
+	}
+	parts := strings.SplitN(v[strings.Index(v, ":")+1:], ":", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	dataKey, err := keys.Unwrap(parts[0], parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	ds, err := newSealer(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := ds.openFor(parts[2], aad)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", context, err)
+	}
+	return string(plain), nil
+}
+
+// needsSealing reports whether a stored value is plaintext, sealed in the
+// legacy format or wrapped by a master key other than the current one
+func needsSealing(keys KeyWrapper, v string) bool {
+	if v == "" {
+		return false
+	}
+	return !strings.HasPrefix(v, envelopePrefix+keys.Current()+":")
+}
+
+// sealCommand returns a copy of cmd with its encrypted fields sealed, ready
+// to be inserted
+func (s *Server) sealCommand(cmd Command) (Command, error) {
+	keys := s.cfg.Encryption
+	var err error
+	if cmd.Command, err = sealValue(keys, fieldContext("commands", "command", cmd.ID), cmd.Command); err != nil {
+		return cmd, err
+	}
+	if cmd.Result, err = sealValue(keys, fieldContext("commands", "result", cmd.ID), cmd.Result); err != nil {
+		return cmd, err
+	}
+	if cmd.Error, err = sealValue(keys, fieldContext("commands", "error", cmd.ID), cmd.Error); err != nil {
+		return cmd, err
+	}
+	return cmd, nil
+}
+
+// sealUpdate seals the encrypted fields set by an update of a command
+func (s *Server) sealUpdate(commandID string, update map[string]interface{}) error {
+	for _, field := range encryptedCommandFields {
+		v, ok := update[field].(string)
+		if !ok {
+			continue
+		}
+		sealed, err := sealValue(s.cfg.Encryption, fieldContext("commands", field, commandID), v)
+		if err != nil {
+			return err
+		}
+		update[field] = sealed
+	}
+	return nil
+}
+
+// openCommand decrypts the encrypted fields of a command read from the
+// store. A command that fails to decrypt must not be sent to an agent.
+func (s *Server) openCommand(cmd *Command) error {
+	keys := s.cfg.Encryption
+	var err error
+	if cmd.Command, err = openValue(keys, fieldContext("commands", "command", cmd.ID), cmd.Command); err != nil {
+		return fmt.Errorf("command %s: %v", cmd.ID, err)
+	}
+	if cmd.Result, err = openValue(keys, fieldContext("commands", "result", cmd.ID), cmd.Result); err != nil {
+		return fmt.Errorf("command %s: %v", cmd.ID, err)
+	}
+	if cmd.Error, err = openValue(keys, fieldContext("commands", "error", cmd.ID), cmd.Error); err != nil {
+		return fmt.Errorf("command %s: %v", cmd.ID, err)
+	}
+	return nil
+}
+
+// openCommandRows decrypts the encrypted fields of listed commands. Values
+// that fail to decrypt are logged and left as stored.
+func (s *Server) openCommandRows(rows []map[string]interface{}) {
+	for _, row := range rows {
+		id, _ := row["id"].(string)
+		for _, field := range encryptedCommandFields {
+			v, ok := row[field].(string)
+			if !ok {
+				continue
+			}
+			plain, err := openValue(s.cfg.Encryption, fieldContext("commands", field, id), v)
+			if err != nil {
+				log.Printf("Failed to decrypt %s of command %s: %v", field, id, err)
+				continue
+			}
+			row[field] = plain
+		}
+	}
+}
+
+// openStored decrypts the command of a job, approval or schedule read from
+// its table. A value that fails to decrypt is logged and returned as stored.
+func (s *Server) openStored(table, id, v string) string {
+	plain, err := openValue(s.cfg.Encryption, fieldContext(table, "command", id), v)
+	if err != nil {
+		log.Printf("Failed to decrypt command of %s %s: %v", table, id, err)
+		return v
+	}
+	return plain
+}
+
+// sealPayload seals the payload of dead letter id, which may quote a
+// command. The sealed payload is stored as a JSON string.
+func sealPayload(keys KeyWrapper, id string, payload json.RawMessage) (json.RawMessage, error) {
+	if keys == nil {
+		return payload, nil
+	}
+	sealed, err := sealValue(keys, fieldContext("webhook_dead_letters", "payload", id), string(payload))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// openPayload decrypts a payload made by sealPayload. Payloads stored before
+// encryption was enabled are returned as they are.
+func openPayload(keys KeyWrapper, id string, payload json.RawMessage) (json.RawMessage, error) {
+	var sealed string
+	if json.Unmarshal(payload, &sealed) != nil || !isSealed(sealed) {
+		return payload, nil
+	}
+	plain, err := openValue(keys, fieldContext("webhook_dead_letters", "payload", id), sealed)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(plain), nil
+}
+
+// reencryptRow is a command as -reencrypt reads it
+type reencryptRow struct {
+	ID       string  `json:"id"`
+	Status   string  `json:"status"`
+	PrunedAt *string `json:"pruned_at"`
+	Command  string  `json:"command"`
+	Result   string  `json:"result"`
+	Error    string  `json:"error"`
+}
+
+// reencryptStore is what -reencrypt reads and writes. It is the database
+// unless a test says otherwise.
+type reencryptStore interface {
+	// commands returns up to limit commands with IDs after last, by ID
+	commands(last string, limit int) ([]reencryptRow, error)
+
+	// rewrite stores update on a command unless its status or pruned_at
+	// changed since it was read, and reports whether it did
+	rewrite(row reencryptRow, update map[string]interface{}) (bool, error)
+
+	// values returns the IDs and values of a column after last, by ID. A
+	// value that is not a JSON string is returned as its JSON.
+	values(table, column, last string, limit int) (ids, values []string, err error)
+
+	// store writes one value of a column
+	store(table, column, id, v string) error
+}
+
+// dbReencryptStore is the reencryptStore of the database
+type dbReencryptStore struct {
+	s *Server
+}
+
+func (st dbReencryptStore) commands(last string, limit int) ([]reencryptRow, error) {
+	var rows []reencryptRow
+	resp, err := st.s.db.From("commands").Select("id,status,pruned_at,command,result,error", false, "", "", "").
+		Gt("id", last).
+		Order("id", true).
+		Limit(limit).
+		Execute()
+	if err == nil {
+		err = st.s.db.ParseJSON(resp.Body, &rows)
+	}
+	return rows, err
+}
+
+func (st dbReencryptStore) rewrite(row reencryptRow, update map[string]interface{}) (bool, error) {
+	// Only write over what was read: a result or prune in between changes
+	// the status or pruned_at
+	query := st.s.db.From("commands").Update(update, "representation", "").
+		Eq("id", row.ID).
+		Eq("status", row.Status)
+	if row.PrunedAt == nil {
+		query = query.Is("pruned_at", "null")
+	}
+	resp, err := query.Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	if err != nil {
+		return false, err
+	}
+	var written []map[string]interface{}
+	if err := st.s.db.ParseJSON(resp.Body, &written); err != nil || len(written) == 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (st dbReencryptStore) values(table, column, last string, limit int) ([]string, []string, error) {
+	var rows []map[string]json.RawMessage
+	resp, err := st.s.db.From(table).Select("id,"+column, false, "", "", "").
+		Gt("id", last).
+		Order("id", true).
+		Limit(limit).
+		Execute()
+	if err == nil {
+		err = st.s.db.ParseJSON(resp.Body, &rows)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, len(rows))
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		json.Unmarshal(row["id"], &ids[i])
+		if json.Unmarshal(row[column], &values[i]) != nil {
+			values[i] = string(row[column])
+		}
+	}
+	return ids, values, nil
+}
+
+func (st dbReencryptStore) store(table, column, id, v string) error {
+	resp, err := st.s.db.From(table).Update(map[string]interface{}{column: v}, "", "").Eq("id", id).Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	return err
+}
+
+// reencryptBatchSize is how many commands -reencrypt reads at a time
+const reencryptBatchSize = 500
+
+// Reencrypt seals the command fields and sealedColumns still stored in
+// plaintext or in the legacy format and moves the ones wrapped by an old
+// master key to the current one. It is safe to run while servers are up: a
+// command that changes in the meantime is skipped and picked up by the next
+// run.
+func Reencrypt(supabaseURL, supabaseKey string, keys KeyWrapper) error {
+	s := &Server{db: newDBClient(supabaseURL, supabaseKey), cfg: Config{Encryption: keys}}
+	st := dbReencryptStore{s}
+
+	updated, skipped, err := s.reencryptCommands(st)
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-encrypted %d command(s) with master key %s", updated, keys.Current())
+	if skipped > 0 {
+		log.Printf("Skipped %d command(s) that changed while running; run -reencrypt again", skipped)
+	}
+
+	for _, col := range sealedColumns {
+		n, err := s.reencryptColumn(st, col.table, col.column)
+		if err != nil {
+			return err
+		}
+		log.Printf("Re-encrypted %d %s.%s value(s)", n, col.table, col.column)
+	}
+	return nil
+}
+
+// reencryptCommands seals the fields of commands that need it and returns
+// how many commands were rewritten and how many changed under it
+func (s *Server) reencryptCommands(st reencryptStore) (updated, skipped int, err error) {
+	keys := s.cfg.Encryption
+	last := ""
+	for {
+		rows, err := st.commands(last, reencryptBatchSize)
+		if err != nil {
+			return updated, skipped, fmt.Errorf("failed to load commands after %q: %v", last, err)
+		}
+
+		for _, row := range rows {
+			last = row.ID
+			update := make(map[string]interface{})
+			for field, v := range map[string]string{"command": row.Command, "result": row.Result, "error": row.Error} {
+				if !needsSealing(keys, v) {
+					continue
+				}
+				plain, err := openValue(keys, fieldContext("commands", field, row.ID), v)
+				if err != nil {
+					return updated, skipped, fmt.Errorf("command %s: %v", row.ID, err)
+				}
+				update[field] = plain
+			}
+			if len(update) == 0 {
+				continue
+			}
+			if err := s.sealUpdate(row.ID, update); err != nil {
+				return updated, skipped, fmt.Errorf("command %s: %v", row.ID, err)
+			}
+			written, err := st.rewrite(row, update)
+			if err != nil {
+				return updated, skipped, fmt.Errorf("failed to store command %s: %v", row.ID, err)
+			}
+			if !written {
+				skipped++
+				continue
+			}
+			updated++
+		}
+
+		if len(rows) < reencryptBatchSize {
+			return updated, skipped, nil
+		}
+	}
+}
+
+// sealedColumns are the columns besides those of commands that are stored
+// encrypted. They quote commands, which may hold secrets.
+var sealedColumns = []struct{ table, column string }{
+	{"jobs", "command"},
+	{"approvals", "command"},
+	{"schedules", "command"},
+	{"webhook_dead_letters", "payload"},
+}
+
+// reencryptColumn seals the values of a column that are still plaintext or
+// need sealing again. These values are never changed once stored, so the
+// write is not guarded. A JSON object, a payload stored before encryption
+// was enabled, is sealed into a JSON string.
+func (s *Server) reencryptColumn(st reencryptStore, table, column string) (int, error) {
+	keys := s.cfg.Encryption
+	updated, last := 0, ""
+	for {
+		ids, values, err := st.values(table, column, last, reencryptBatchSize)
+		if err != nil {
+			return updated, fmt.Errorf("failed to load %s after %q: %v", table, last, err)
+		}
+
+		for i, id := range ids {
+			last = id
+			if !needsSealing(keys, values[i]) {
+				continue
+			}
+			context := fieldContext(table, column, id)
+			plain, err := openValue(keys, context, values[i])
+			if err != nil {
+				return updated, fmt.Errorf("%s %s: %v", table, id, err)
+			}
+			sealed, err := sealValue(keys, context, plain)
+			if err != nil {
+				return updated, fmt.Errorf("%s %s: %v", table, id, err)
+			}
+			if err := st.store(table, column, id, sealed); err != nil {
+				return updated, fmt.Errorf("failed to store %s %s: %v", table, id, err)
+			}
+			updated++
+		}
+
+		if len(ids) < reencryptBatchSize {
+			return updated, nil
+		}
+	}
+}
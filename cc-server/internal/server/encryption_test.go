@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) KeyWrapper {
+	t.Helper()
+	return rotatedKeyring(t, "k1", "k1")
+}
+
+// rotatedKeyring holds test master keys by ID, wrapping with current
+func rotatedKeyring(t *testing.T, current string, ids ...string) *fileKeyring {
+	t.Helper()
+	kr := &fileKeyring{current: current, keys: make(map[string]*sealer)}
+	for i, id := range ids {
+		key, err := newSealer(bytes.Repeat([]byte{byte(7 + i)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kr.keys[id] = key
+	}
+	return kr
+}
+
+func TestSealValue(t *testing.T) {
+	keys := testKeyring(t)
+	ctx := fieldContext("commands", "result", "cmd_1")
+	if ctx != "commands.result:cmd_1" {
+		t.Fatalf("fieldContext = %q", ctx)
+	}
+
+	sealed, err := sealValue(keys, ctx, "password=hunter2")
+	if err != nil || !strings.HasPrefix(sealed, envelopePrefix+"k1:") || strings.Contains(sealed, "hunter2") {
+		t.Fatalf("sealValue = %q, %v", sealed, err)
+	}
+	if again, _ := sealValue(keys, ctx, "password=hunter2"); again == sealed {
+		t.Fatal("two seals of a value are the same")
+	}
+	if plain, err := openValue(keys, ctx, sealed); err != nil || plain != "password=hunter2" {
+		t.Fatalf("openValue = %q, %v", plain, err)
+	}
+
+	// A value moved to another record or column does not open
+	for _, other := range []string{
+		fieldContext("commands", "result", "cmd_2"),
+		fieldContext("commands", "error", "cmd_1"),
+		fieldContext("jobs", "result", "cmd_1"),
+	} {
+		if _, err := openValue(keys, other, sealed); err == nil {
+			t.Errorf("value sealed for %s opened as %s", ctx, other)
+		}
+	}
+
+	// Plaintext, empty values and servers without keys pass through
+	if plain, err := openValue(keys, ctx, "ls -la"); err != nil || plain != "ls -la" {
+		t.Fatalf("openValue of plaintext = %q, %v", plain, err)
+	}
+	if v, _ := sealValue(keys, ctx, ""); v != "" {
+		t.Fatalf("empty value sealed as %q", v)
+	}
+	if v, _ := sealValue(nil, ctx, "ls"); v != "ls" {
+		t.Fatalf("value sealed without keys: %q", v)
+	}
+	if _, err := openValue(nil, ctx, sealed); err == nil {
+		t.Fatal("sealed value opened without keys")
+	}
+	for _, bad := range []string{envelopePrefix + "k1:only", envelopePrefix + "k9:x:y"} {
+		if _, err := openValue(keys, ctx, bad); err == nil {
+			t.Errorf("openValue(%q) succeeded", bad)
+		}
+	}
+}
+
+// legacySeal seals v the way enc1 values were, without associated data
+func legacySeal(t *testing.T, keys KeyWrapper, v string) string {
+	t.Helper()
+	dataKey := bytes.Repeat([]byte{3}, 32)
+	ds, _ := newSealer(dataKey)
+	sealed, err := ds.seal([]byte(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err := keys.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return legacyEnvelopePrefix + keyID + ":" + wrapped + ":" + sealed
+}
+
+func TestOpenLegacyValue(t *testing.T) {
+	keys := testKeyring(t)
+	legacy := legacySeal(t, keys, "uptime")
+	if plain, err := openValue(keys, fieldContext("commands", "command", "cmd_1"), legacy); err != nil || plain != "uptime" {
+		t.Fatalf("openValue of enc1 = %q, %v", plain, err)
+	}
+	if !isSealed(legacy) || !needsSealing(keys, legacy) {
+		t.Fatal("enc1 value not taken for a sealed value that needs sealing again")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := rotatedKeyring(t, "k1", "k1")
+	ctx := fieldContext("jobs", "command", "job_1")
+	sealed, err := sealValue(old, ctx, "systemctl restart app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotatedKeyring(t, "k2", "k1", "k2")
+	if !needsSealing(rotated, sealed) {
+		t.Fatal("value wrapped by a retired key does not need sealing")
+	}
+	// The retired key still unwraps what it wrapped
+	if plain, err := openValue(rotated, ctx, sealed); err != nil || plain != "systemctl restart app" {
+		t.Fatalf("openValue with a retired key = %q, %v", plain, err)
+	}
+	resealed, err := sealValue(rotated, ctx, "systemctl restart app")
+	if err != nil || !strings.HasPrefix(resealed, envelopePrefix+"k2:") || needsSealing(rotated, resealed) {
+		t.Fatalf("sealed with the new key: %q, %v", resealed, err)
+	}
+	if !needsSealing(rotated, "plaintext") || needsSealing(rotated, "") {
+		t.Fatal("needsSealing of plaintext or an empty value")
+	}
+
+	// Once the old key is removed its values no longer open
+	delete(rotated.keys, "k1")
+	if _, err := rotated.Unwrap("k1", "anything"); err == nil || !strings.Contains(err.Error(), "unknown master key") {
+		t.Fatalf("Unwrap of a removed key: %v", err)
+	}
+	if _, err := openValue(rotated, ctx, sealed); err == nil {
+		t.Fatal("value opened after its master key was removed")
+	}
+}
+
+// memReencryptStore is a reencryptStore in memory. Commands listed in
+// changed are taken to have changed since they were read.
+type memReencryptStore struct {
+	commandRows []reencryptRow
+	changed     map[string]bool
+	columns     map[string]map[string]string // table.column -> id -> value
+}
+
+func (st *memReencryptStore) commands(last string, limit int) ([]reencryptRow, error) {
+	var rows []reencryptRow
+	for _, row := range st.commandRows {
+		if row.ID > last && len(rows) < limit {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (st *memReencryptStore) rewrite(row reencryptRow, update map[string]interface{}) (bool, error) {
+	if st.changed[row.ID] {
+		return false, nil
+	}
+	for i := range st.commandRows {
+		if st.commandRows[i].ID != row.ID {
+			continue
+		}
+		for field, v := range update {
+			switch field {
+			case "command":
+				st.commandRows[i].Command = v.(string)
+			case "result":
+				st.commandRows[i].Result = v.(string)
+			case "error":
+				st.commandRows[i].Error = v.(string)
+			}
+		}
+	}
+	return true, nil
+}
+
+func (st *memReencryptStore) values(table, column, last string, limit int) ([]string, []string, error) {
+	col := st.columns[table+"."+column]
+	var ids []string
+	for id := range col {
+		if id > last {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = col[id]
+	}
+	return ids, values, nil
+}
+
+func (st *memReencryptStore) store(table, column, id, v string) error {
+	st.columns[table+"."+column][id] = v
+	return nil
+}
+
+func TestReencryptCommands(t *testing.T) {
+	old := rotatedKeyring(t, "k1", "k1")
+	oldResult, _ := sealValue(old, fieldContext("commands", "result", "cmd_2"), "old output")
+	st := &memReencryptStore{
+		commandRows: []reencryptRow{
+			{ID: "cmd_1", Status: statusCompleted, Command: "uptime", Result: "up 3 days"},
+			{ID: "cmd_2", Status: statusCompleted, Command: legacySeal(t, old, "df -h"), Result: oldResult},
+			{ID: "cmd_3", Status: statusReceived, Command: "sleep 60"},
+			{ID: "cmd_4", Status: statusPending},
+		},
+		// cmd_3 finished while the migration ran
+		changed: map[string]bool{"cmd_3": true},
+	}
+	s := &Server{cfg: Config{Encryption: rotatedKeyring(t, "k2", "k1", "k2")}}
+
+	updated, skipped, err := s.reencryptCommands(st)
+	if err != nil || updated != 2 || skipped != 1 {
+		t.Fatalf("reencryptCommands = %d updated, %d skipped, %v", updated, skipped, err)
+	}
+	for _, row := range st.commandRows[:2] {
+		cmd := Command{ID: row.ID, Command: row.Command, Result: row.Result}
+		for _, v := range []string{row.Command, row.Result} {
+			if !strings.HasPrefix(v, envelopePrefix+"k2:") {
+				t.Errorf("command %s holds %q", row.ID, v)
+			}
+		}
+		if err := s.openCommand(&cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.commandRows[2].Command != "sleep 60" {
+		t.Fatal("a command that changed was written over")
+	}
+
+	// A second run only picks up what was skipped
+	delete(st.changed, "cmd_3")
+	if updated, skipped, _ := s.reencryptCommands(st); updated != 1 || skipped != 0 {
+		t.Fatalf("second run: %d updated, %d skipped", updated, skipped)
+	}
+}
+
+func TestReencryptColumn(t *testing.T) {
+	old := rotatedKeyring(t, "k1", "k1")
+	oldPayload, _ := sealPayload(old, "dl_2", json.RawMessage(`{"b":2}`))
+	var oldSealed string
+	json.Unmarshal(oldPayload, &oldSealed)
+	st := &memReencryptStore{columns: map[string]map[string]string{
+		"webhook_dead_letters.payload": {"dl_1": `{"a":1}`, "dl_2": oldSealed},
+	}}
+	s := &Server{cfg: Config{Encryption: rotatedKeyring(t, "k2", "k1", "k2")}}
+
+	n, err := s.reencryptColumn(st, "webhook_dead_letters", "payload")
+	if err != nil || n != 2 {
+		t.Fatalf("reencryptColumn = %d, %v", n, err)
+	}
+	for id, want := range map[string]string{"dl_1": `{"a":1}`, "dl_2": `{"b":2}`} {
+		stored, _ := json.Marshal(st.columns["webhook_dead_letters.payload"][id])
+		payload, err := openPayload(s.cfg.Encryption, id, stored)
+		if err != nil || string(payload) != want || needsSealing(s.cfg.Encryption, st.columns["webhook_dead_letters.payload"][id]) {
+			t.Errorf("payload of %s = %s, %v", id, payload, err)
+		}
+	}
+	if n, _ := s.reencryptColumn(st, "webhook_dead_letters", "payload"); n != 0 {
+		t.Fatalf("second run sealed %d values again", n)
+	}
+}
+
+func TestSealPayload(t *testing.T) {
+	keys := testKeyring(t)
+	payload := json.RawMessage(`{"type":"command_status","data":{"command":"mysql -psecret"}}`)
+
+	sealed, err := sealPayload(keys, "dl_1", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := json.Unmarshal(sealed, &stored); err != nil || !strings.HasPrefix(stored, envelopePrefix+"k1:") {
+		t.Fatalf("sealed payload = %s, want a JSON string holding an envelope", sealed)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("sealed payload holds the plaintext")
+	}
+
+	opened, err := openPayload(keys, "dl_1", sealed)
+	if err != nil || string(opened) != string(payload) {
+		t.Fatalf("openPayload = %s, %v", opened, err)
+	}
+
+	// Payloads stored before encryption was enabled are read as they are
+	if opened, err := openPayload(keys, "dl_1", payload); err != nil || string(opened) != string(payload) {
+		t.Fatalf("openPayload of plaintext = %s, %v", opened, err)
+	}
+	if kept, _ := sealPayload(nil, "dl_1", payload); string(kept) != string(payload) {
+		t.Fatal("payload sealed without keys")
+	}
+	// The payload of one dead letter does not open as another's
+	if _, err := openPayload(keys, "dl_2", sealed); err == nil {
+		t.Fatal("payload opened for another dead letter")
+	}
+}
+
+func TestCommandDigest(t *testing.T) {
+	d := commandDigest("mysql -psecret")
+	if len(d) != 64 || strings.Contains(d, "secret") {
+		t.Fatalf("commandDigest = %q", d)
+	}
+	if d != commandDigest("mysql -psecret") || d == commandDigest("mysql -pother") {
+		t.Fatal("commandDigest does not identify the command")
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// Live event types
+const (
+	eventAgentConnected    = "agent_connected"
+	eventAgentDisconnected = "agent_disconnected"
+	eventAgentStatus       = "agent_status"  // paused or resumed by the host owner
+	eventAgentMessage      = "agent_message" // raw message, only sent when asked for
+	eventCommandStatus     = "command_status"
+	eventCommandOutput     = "command_output"
+	eventJobStatus         = "job_status"
+	eventLost              = "events_lost" // events were dropped for a slow subscriber or are no longer kept
+)
+
+// eventKeepAlive is how often an idle event stream gets a comment, so
+// proxies do not close it
+const eventKeepAlive = 15 * time.Second
+
+// eventSelectorRefresh is how often the clients matching a label filter are
+// looked up again
+const eventSelectorRefresh = 30 * time.Second
+
+// eventFilter selects the events an operator asked for. All conditions that
+// are set must hold.
+type eventFilter struct {
+	types   map[string]bool
+	clients map[string]bool
+
+	selector labelSelector
+	matched  map[string]bool // clients the selector matched at the last lookup
+
+	jobID       string
+	jobCommands map[string]bool
+}
+
+// parseEventFilter reads the client, selector, job and type query parameters.
+// client and type take comma-separated lists.
+func (s *Server) parseEventFilter(c *gin.Context) (*eventFilter, int, error) {
+	f := &eventFilter{
+		types:   splitSet(c.Query("type")),
+		clients: splitSet(c.Query("client")),
+		jobID:   c.Query("job"),
+	}
+
+	if sel := c.Query("selector"); sel != "" {
+		parsed, err := parseSelector(sel)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		f.selector = parsed
+		if err := s.refreshEventFilter(f); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Database query failed")
+		}
+	}
+
+	if f.jobID != "" {
+		job, err := s.loadJob(f.jobID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Database query failed")
+		}
+		if job == nil {
+			return nil, http.StatusNotFound, fmt.Errorf("Job not found")
+		}
+		// Output chunks only name their command, so the job's commands are
+		// looked up once; a job never gains commands
+		commands, err := s.jobCommands(f.jobID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Database query failed")
+		}
+		f.jobCommands = make(map[string]bool, len(commands))
+		for _, cmd := range commands {
+			f.jobCommands[cmd.ID] = true
+		}
+	}
+	return f, 0, nil
+}
+
+// refreshEventFilter looks up the clients matching the filter's selector
+func (s *Server) refreshEventFilter(f *eventFilter) error {
+	clients, err := s.matchClients(f.selector)
+	if err != nil {
+		return err
+	}
+	f.matched = make(map[string]bool, len(clients))
+	for _, cl := range clients {
+		f.matched[cl.ID] = true
+	}
+	return nil
+}
+
+// matches reports whether ev passes the filter
+func (f *eventFilter) matches(ev liveEvent) bool {
+	if ev.Type == eventLost {
+		return true
+	}
+	if f.types != nil {
+		if !f.types[ev.Type] {
+			return false
+		}
+	} else if ev.Type == eventAgentMessage {
+		return false
+	}
+	if f.clients != nil && !f.clients[ev.ClientID] {
+		return false
+	}
+	if f.selector != nil && !f.matched[ev.ClientID] {
+		return false
+	}
+	if f.jobID != "" && ev.JobID != f.jobID && !f.jobCommands[ev.CommandID] {
+		return false
+	}
+	return true
+}
+
+// stale reports whether the clients matching the selector must be looked
+// up again before ev is matched: a newly connected agent may have
+// registered after the last lookup
+func (f *eventFilter) stale(ev liveEvent) bool {
+	return f.selector != nil && ev.Type == eventAgentConnected && !f.matched[ev.ClientID]
+}
+
+// splitSet turns a comma-separated list into a set, or nil if it is empty
+func splitSet(list string) map[string]bool {
+	var set map[string]bool
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// handleEvents streams live events to an operator as server-sent events.
+// A client reconnecting with Last-Event-ID first gets the kept events it
+// missed; if some are gone it gets an events_lost event instead.
+func (s *Server) handleEvents(c *gin.Context) {
+	filter, status, err := s.parseEventFilter(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastIDHeader := c.GetHeader("Last-Event-ID")
+	if lastIDHeader == "" {
+		lastIDHeader = c.Query("last_event_id")
+	}
+	events, backlog, complete := s.live.subscribeSince(lastIDHeader)
+	defer s.live.unsubscribe(events)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	if !complete {
+		writeEvent(w, liveEvent{Type: eventLost, Timestamp: time.Now()})
+	}
+	for _, ev := range backlog {
+		if filter.matches(ev) {
+			writeEvent(w, ev)
+		}
+	}
+	w.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	refresh := time.NewTicker(eventSelectorRefresh)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case ev := <-events:
+			if filter.stale(ev) {
+				if err := s.refreshEventFilter(filter); err != nil {
+					log.Printf("Failed to refresh event filter: %v", err)
+				}
+			}
+			if !filter.matches(ev) {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+			w.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		case <-refresh.C:
+			if filter.selector != nil {
+				if err := s.refreshEventFilter(filter); err != nil {
+					log.Printf("Failed to refresh event filter: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// writeEvent writes ev in server-sent events format
+func writeEvent(w io.Writer, ev liveEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if ev.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", ev.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// eventData marshals the data of an event, which is always a small map
+func eventData(v map[string]interface{}) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// publishCommand announces the current status of a command
+func (s *Server) publishCommand(cmd Command) {
+	data := map[string]interface{}{"status": cmd.Status}
+	if cmd.ExitCode != nil {
+		data["exit_code"] = *cmd.ExitCode
+	}
+	if cmd.Error != "" {
+		data["error"] = cmd.Error
+	}
+	s.live.publish(liveEvent{
+		Type:      eventCommandStatus,
+		ClientID:  cmd.ClientID,
+		JobID:     cmd.JobID,
+		CommandID: cmd.ID,
+		Data:      eventData(data),
+	})
+}
+
+// publishUpdatedCommands announces the commands an update returned, so only
+// changes that were actually made are published
+func (s *Server) publishUpdatedCommands(body []byte) {
+	var commands []Command
+	if err := s.db.ParseJSON(body, &commands); err != nil {
+		log.Printf("Failed to parse updated commands: %v", err)
+		return
+	}
+	for _, cmd := range commands {
+		if err := s.openCommand(&cmd); err != nil {
+			log.Printf("Failed to decrypt updated %v", err)
+			continue
+		}
+		s.publishCommand(cmd)
+	}
+}
+
+// handleOutput publishes a chunk of output streamed by an agent. Chunks are
+// not stored; the result carries the whole output.
+func (s *Server) handleOutput(clientID string, message []byte) {
+	var out protocol.Output
+	if err := json.Unmarshal(message, &out); err != nil {
+		log.Printf("Invalid output from client %s: %v", clientID, err)
+		return
+	}
+	data, seq := s.outputs.take(clientID, out.CommandID, out.Seq, out.Data, false)
+	s.publishOutput(clientID, out.CommandID, data, seq)
+}
+
+// flushOutput publishes the streamed output still held back for a command
+// that finished
+func (s *Server) flushOutput(clientID, commandID string) {
+	data, seq := s.outputs.take(clientID, commandID, 0, "", true)
+	s.publishOutput(clientID, commandID, data, seq)
+}
+
+func (s *Server) publishOutput(clientID, commandID, data string, seq int) {
+	if data == "" {
+		return
+	}
+	data, _ = s.cfg.Redaction.redact(data)
+	s.live.publish(liveEvent{
+		Type:      eventCommandOutput,
+		ClientID:  clientID,
+		CommandID: commandID,
+		Data:      eventData(map[string]interface{}{"seq": seq, "data": data}),
+	})
+}
+
+// maxOutputTail bounds the output held back for one command
+const maxOutputTail = 16 << 10
+
+// outputTailIdle is how long the output held back for a command that stopped
+// streaming is kept
+const outputTailIdle = 10 * time.Minute
+
+// outputTails holds back the end of each command's streamed output, where a
+// secret could still continue in the next chunk. Agents cut chunks at
+// arbitrary points, so a chunk is only redacted together with what was held
+// back from the ones before.
+type outputTails struct {
+	mu        sync.Mutex
+	tails     map[string]*outputTail
+	lastSweep time.Time
+}
+
+type outputTail struct {
+	raw     string // held back output, not redacted yet
+	in      int    // seq of the last chunk the agent sent
+	out     int    // seq of the last chunk published
+	touched time.Time
+}
+
+// take adds a chunk of a command's output and returns the part that can be
+// redacted and published, with the seq to publish it as. final returns all
+// that is held and forgets the command.
+func (t *outputTails) take(clientID, commandID string, seq int, data string, final bool) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.tails == nil {
+		t.tails = make(map[string]*outputTail)
+	}
+	if now.Sub(t.lastSweep) > outputTailIdle {
+		for key, tail := range t.tails {
+			if now.Sub(tail.touched) > outputTailIdle {
+				delete(t.tails, key)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	key := clientID + "/" + commandID
+	tail := t.tails[key]
+	if tail == nil {
+		if final {
+			return "", 0
+		}
+		tail = &outputTail{}
+		t.tails[key] = tail
+	}
+	tail.touched = now
+	if !final {
+		// Chunks the agent failed to send leave a gap subscribers can see
+		if seq > tail.in+1 {
+			tail.out++
+		}
+		tail.in = seq
+	}
+
+	text := tail.raw + data
+	cut := len(text)
+	if !final {
+		cut = streamCut(text)
+	} else {
+		delete(t.tails, key)
+	}
+	tail.raw = text[cut:]
+	if cut == 0 {
+		return "", 0
+	}
+	tail.out++
+	return text[:cut], tail.out
+}
+
+// streamCut returns how much of a command's output can be redacted now:
+// every complete line, except from the start of a PEM block that has not
+// ended yet. The built-in rules match within a line or a PEM block, so a
+// secret is never cut in two. More than maxOutputTail is not held back.
+func streamCut(s string) int {
+	cut := strings.LastIndexByte(s, '\n') + 1
+	if begin := strings.LastIndex(s[:cut], "-----BEGIN "); begin >= 0 && !strings.Contains(s[begin:cut], "-----END ") {
+		cut = strings.LastIndexByte(s[:begin], '\n') + 1
+	}
+	if len(s)-cut > maxOutputTail {
+		cut = len(s) - maxOutputTail
+		for cut < len(s) && !utf8.RuneStart(s[cut]) {
+			cut++
+		}
+	}
+	return cut
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/user/cc-server/internal/protocol"
+	"github.com/user/cc-server/internal/version"
+)
+
+// serverFeatures lists the optional protocol features this server implements
+var serverFeatures = []string{protocol.FeatureAck, protocol.FeatureQueue, protocol.FeatureLimits, protocol.FeaturePause, protocol.FeatureStreaming, protocol.FeatureSecrets, protocol.FeatureCancel, protocol.FeatureShell}
+
+// helloTimeout bounds how long an agent may take to send its hello
+const helloTimeout = 10 * time.Second
+
+// handshake waits for the agent's hello and answers with the negotiated
+// session. Agents older than the handshake protocol get a legacy session
+// with no optional features.
+func (s *Server) handshake(conn *websocket.Conn, agentProtocol int) (protocol.Welcome, protocol.Hello, error) {
+	limits := s.agentLimits()
+	conn.SetReadLimit(limits.MaxMessageBytes)
+
+	if agentProtocol < protocol.HandshakeProtocol {
+		legacy := protocol.Hello{Protocol: agentProtocol}
+		return protocol.Negotiate(legacy, serverFeatures, limits), legacy, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Welcome{}, protocol.Hello{}, fmt.Errorf("failed to read hello: %v", err)
+	}
+
+	var hello protocol.Hello
+	if err := json.Unmarshal(message, &hello); err != nil || hello.Type != protocol.TypeHello {
+		return protocol.Welcome{}, protocol.Hello{}, fmt.Errorf("expected hello message")
+	}
+	if hello.Protocol < version.MinProtocol {
+		return protocol.Welcome{}, hello, fmt.Errorf("agent protocol %d too old", hello.Protocol)
+	}
+
+	welcome := protocol.Negotiate(hello, serverFeatures, limits)
+	if err := conn.WriteJSON(welcome); err != nil {
+		return protocol.Welcome{}, hello, fmt.Errorf("failed to send welcome: %v", err)
+	}
+	return welcome, hello, nil
+}
+
+// agentLimits converts the configured agent limits to their wire form
+func (s *Server) agentLimits() protocol.Limits {
+	return protocol.Limits{
+		MaxMessageBytes:   s.cfg.Agent.MaxMessageBytes,
+		MaxOutputBytes:    s.cfg.Agent.MaxOutputBytes,
+		HeartbeatInterval: int(s.cfg.Agent.HeartbeatInterval / time.Second),
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/cc-server/internal/version"
+)
+
+// readinessTimeout bounds each dependency check done by /readyz
+const readinessTimeout = 2 * time.Second
+
+// Liveness probe: the process is up and serving HTTP
+func (s *Server) handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness probe: the storage backend and the agent hub are usable
+func (s *Server) handleReadyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	if err := s.pingStorage(readinessTimeout); err != nil {
+		checks["storage"] = err.Error()
+		ready = false
+	} else {
+		checks["storage"] = "ok"
+	}
+
+	if !s.hub.ping(readinessTimeout) {
+		checks["hub"] = "unresponsive"
+		ready = false
+	} else {
+		checks["hub"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	body := gin.H{
+		"ready":  ready,
+		"checks": checks,
+		"agents": s.hub.count(),
+	}
+	if s.cluster != nil {
+		body["node"] = s.cfg.Cluster.NodeID
+	}
+	c.JSON(status, body)
+}
+
+// Build metadata of the running server
+func (s *Server) handleVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
+}
+
+// pingStorage runs a cheap query against the storage backend
+func (s *Server) pingStorage(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := s.db.From("clients").Select("id", false, "", "", "").Limit(1).Execute()
+		if err == nil && resp.Error != nil {
+			err = resp.Error
+		}
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
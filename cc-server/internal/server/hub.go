@@ -0,0 +1,92 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// agentConn is the socket of one connected agent together with the session
+// negotiated during the handshake
+type agentConn struct {
+	clientID string
+	conn     *websocket.Conn
+	session  protocol.Welcome
+
+	// paused is set while the host owner has paused the agent
+	paused atomic.Bool
+
+	// gorilla/websocket allows a single concurrent writer
+	writeMu sync.Mutex
+}
+
+// send writes a JSON message to the agent
+func (a *agentConn) send(v interface{}) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return a.conn.WriteJSON(v)
+}
+
+// hub tracks the websocket connections of agents attached to this server
+type hub struct {
+	mu    sync.RWMutex
+	conns map[string]*agentConn
+}
+
+func newHub() *hub {
+	return &hub{
+		conns: make(map[string]*agentConn),
+	}
+}
+
+// add registers the connection for an agent, replacing any previous one
+func (h *hub) add(ac *agentConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[ac.clientID] = ac
+}
+
+// remove drops the agent's connection if it is still the registered one
+func (h *hub) remove(ac *agentConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[ac.clientID] == ac {
+		delete(h.conns, ac.clientID)
+	}
+}
+
+// get returns the live connection for an agent, if any
+func (h *hub) get(clientID string) (*agentConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ac, ok := h.conns[clientID]
+	return ac, ok
+}
+
+// count returns the number of connected agents
+func (h *hub) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// ping reports whether the hub lock can be taken within timeout. A hub that
+// is stuck holding its lock cannot route commands, so the server is not ready.
+func (h *hub) ping(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		h.mu.RLock()
+		h.mu.RUnlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
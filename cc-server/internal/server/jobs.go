@@ -0,0 +1,256 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job groups the commands created for every agent matching a selector
+type Job struct {
+	ID         string     `json:"id"`
+	Command    string     `json:"command"`
+	Selector   string     `json:"selector"`
+	Operator   string     `json:"operator,omitempty"`
+	Targets    int        `json:"targets"` // number of child commands
+	Status     string     `json:"status"`  // running, paused, completed, failed, aborted
+	StopReason string     `json:"stop_reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Rollout optionally releases the commands in batches
+	Rollout      *Rollout `json:"rollout,omitempty"`
+	Batches      int      `json:"batches"`
+	CurrentBatch int      `json:"current_batch"`
+	// BatchStartedAt is when the current batch was released
+	BatchStartedAt *time.Time `json:"batch_started_at,omitempty"`
+
+	// Commands are the child commands, one per matching agent, and Progress
+	// counts them per batch. Neither is stored with the job.
+	Commands []Command       `json:"commands,omitempty"`
+	Progress []BatchProgress `json:"progress,omitempty"`
+}
+
+// SendCommandRequest is the body of POST /command. It names either a single
+// client_id or a label selector, optionally with a rollout.
+type SendCommandRequest struct {
+	Command
+	Selector string   `json:"selector,omitempty"`
+	Rollout  *Rollout `json:"rollout,omitempty"`
+}
+
+// errNoMatchingClients is returned when a selector matches no client
+var errNoMatchingClients = errors.New("No clients match the selector")
+
+// resolveTargets returns the clients a command request is for: the client
+// named by client_id, or every client matching the selector. On error it also
+// returns the HTTP status to answer with.
+func (s *Server) resolveTargets(req SendCommandRequest) ([]ClientInfo, int, error) {
+	switch {
+	case req.Selector != "" && req.ClientID != "":
+		return nil, http.StatusBadRequest, errors.New("client_id and selector are mutually exclusive")
+	case req.Selector == "" && req.ClientID == "":
+		return nil, http.StatusBadRequest, errors.New("client_id or selector is required")
+	case req.Selector == "":
+		target, err := s.loadClient(req.ClientID)
+		if err != nil {
+			log.Printf("Failed to load client %s: %v", req.ClientID, err)
+			return nil, http.StatusInternalServerError, errors.New("Database query failed")
+		}
+		if target == nil {
+			return nil, http.StatusNotFound, errors.New("Client not found")
+		}
+		return []ClientInfo{*target}, 0, nil
+	}
+
+	sel, err := parseSelector(req.Selector)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	targets, err := s.matchClients(sel)
+	if err != nil {
+		log.Printf("Failed to match clients for selector %q: %v", req.Selector, err)
+		return nil, http.StatusInternalServerError, errors.New("Database query failed")
+	}
+	if len(targets) == 0 {
+		return nil, http.StatusNotFound, errNoMatchingClients
+	}
+	return targets, 0, nil
+}
+
+// sendJob creates a job for the targets of a request and answers with it
+func (s *Server) sendJob(c *gin.Context, req SendCommandRequest, targets []ClientInfo) {
+	job, err := s.createJob(req, targets, operatorName(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if job.Status == jobAwaitingApproval {
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// createJob stores a job with one child command per target and delivers the
+// children to the connected agents. A job matching an approval rule holds
+// every command until a second operator decides.
+func (s *Server) createJob(req SendCommandRequest, targets []ClientInfo, operator string) (*Job, error) {
+	batches, batchCount := req.Rollout.plan(len(targets))
+	now := time.Now()
+	job := Job{
+		ID:           generateJobID(),
+		Command:      req.Command.Command,
+		Selector:     req.Selector,
+		Operator:     operator,
+		Targets:      len(targets),
+		Status:       jobRunning,
+		CreatedAt:    now,
+		Rollout:      req.Rollout,
+		Batches:      batchCount,
+		CurrentBatch: 1,
+	}
+
+	rule := s.cfg.CommandPolicy.approvalRuleFor(req.Command, targets)
+	if rule != nil {
+		job.Status = jobAwaitingApproval
+	} else {
+		job.BatchStartedAt = &now
+	}
+
+	stored := job
+	var err error
+	if stored.Command, err = sealValue(s.cfg.Encryption, fieldContext("jobs", "command", job.ID), job.Command); err != nil {
+		log.Printf("Failed to encrypt command of job %s: %v", job.ID, err)
+		return nil, errors.New("Failed to store job")
+	}
+	resp, err := s.db.From("jobs").Insert(stored, false, "", "", "").Execute()
+	if err != nil || resp.Error != nil {
+		return nil, errors.New("Failed to store job")
+	}
+
+	baseID := generateCommandID()
+	children := make([]Command, len(targets))
+	for i, target := range targets {
+		child := req.Command
+		child.ID = fmt.Sprintf("%s_%d", baseID, i+1)
+		child.ClientID = target.ID
+		child.JobID = job.ID
+		child.Batch = batches[i]
+		child.Status = statusPending
+		if child.Batch > job.CurrentBatch || rule != nil {
+			child.Status = statusHeld
+		}
+		child.CreatedAt = now
+		child.Operator = job.Operator
+		children[i] = child
+	}
+	sealed := make([]Command, len(children))
+	for i, child := range children {
+		if sealed[i], err = s.sealCommand(child); err != nil {
+			log.Printf("Failed to encrypt command %s: %v", child.ID, err)
+			s.stopJob(job.ID, jobFailed, "failed to encrypt commands")
+			return nil, errors.New("Failed to encrypt commands")
+		}
+	}
+	resp, err = s.db.From("commands").Insert(sealed, false, "", "", "").Execute()
+	if err != nil || resp.Error != nil {
+		// Do not leave a running job without commands behind
+		log.Printf("Failed to store commands of job %s", job.ID)
+		s.stopJob(job.ID, jobFailed, "failed to store commands")
+		return nil, errors.New("Failed to store commands")
+	}
+	log.Printf("Job %s: %d command(s) in %d batch(es) for selector %q", job.ID, len(children), job.Batches, job.Selector)
+	s.live.publish(liveEvent{Type: eventJobStatus, JobID: job.ID, Data: eventData(map[string]interface{}{"status": job.Status})})
+	for _, child := range children {
+		s.publishCommand(child)
+	}
+
+	if rule != nil {
+		if _, err := s.requestApproval(approvalKindJob, job.ID, job.Command, job.Targets, rule, job.Operator); err != nil {
+			log.Printf("Failed to store approval request for job %s: %v", job.ID, err)
+			s.stopJob(job.ID, jobFailed, "failed to request approval")
+			return nil, errors.New("Failed to request approval")
+		}
+	} else {
+		// Agents that are not connected get their command when they reconnect
+		for i := range children {
+			if children[i].Status == statusPending && s.deliver(children[i]) {
+				children[i].Status = statusDelivered
+			}
+		}
+	}
+
+	job.Commands = children
+	job.Progress = jobProgress(job, children)
+	return &job, nil
+}
+
+// Get a job together with its child commands
+func (s *Server) handleGetJob(c *gin.Context) {
+	job, err := s.loadJob(c.Param("job_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	job.Commands, err = s.jobCommands(job.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	job.Progress = jobProgress(*job, job.Commands)
+
+	c.JSON(http.StatusOK, job)
+}
+
+// loadJob returns a job, or nil if there is none
+func (s *Server) loadJob(jobID string) (*Job, error) {
+	var jobs []Job
+	resp, err := s.db.From("jobs").Select("*", false, "", "", "").Eq("id", jobID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &jobs); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	jobs[0].Command = s.openStored("jobs", jobID, jobs[0].Command)
+	return &jobs[0], nil
+}
+
+// jobCommands returns the child commands of a job ordered by batch
+func (s *Server) jobCommands(jobID string) ([]Command, error) {
+	var commands []Command
+	resp, err := s.db.From("commands").Select("*", false, "", "", "").
+		Eq("job_id", jobID).
+		Order("batch", true).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &commands); err != nil {
+		return nil, err
+	}
+	for i := range commands {
+		if err := s.openCommand(&commands[i]); err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+// generateJobID is a placeholder for job ID generation
+func generateJobID() string {
+	return fmt.Sprintf("job_%d", time.Now().UnixNano())
+}
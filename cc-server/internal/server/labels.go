@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Label keys start with an alphanumeric and may contain dots, dashes,
+// underscores and slashes, e.g. "team/role". Values may be empty.
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{0,63}$`)
+)
+
+// validateLabels checks that every key and value is well formed
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("invalid value %q for label %s", v, k)
+		}
+	}
+	return nil
+}
+
+// Selector operators
+const (
+	selectEquals    = "="
+	selectNotEquals = "!="
+	selectExists    = "exists"
+	selectAbsent    = "!exists"
+)
+
+// labelRequirement is one comma-separated term of a selector
+type labelRequirement struct {
+	key   string
+	op    string
+	value string
+}
+
+// labelSelector matches agents whose labels meet every requirement
+type labelSelector []labelRequirement
+
+// parseSelector parses a selector such as "role=build,env!=prod,gpu,!legacy".
+// "key=value" and "key!=value" compare values (a missing label is never
+// equal), "key" requires the label and "!key" requires it to be missing.
+func parseSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			k, v, _ := strings.Cut(term, "!=")
+			req = labelRequirement{key: k, op: selectNotEquals, value: v}
+		case strings.Contains(term, "="):
+			k, v, _ := strings.Cut(term, "=")
+			req = labelRequirement{key: k, op: selectEquals, value: strings.TrimPrefix(v, "=")}
+		case strings.HasPrefix(term, "!"):
+			req = labelRequirement{key: term[1:], op: selectAbsent}
+		default:
+			req = labelRequirement{key: term, op: selectExists}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+
+		if !labelKeyPattern.MatchString(req.key) {
+			return nil, fmt.Errorf("invalid label key %q in selector", req.key)
+		}
+		if !labelValuePattern.MatchString(req.value) {
+			return nil, fmt.Errorf("invalid label value %q in selector", req.value)
+		}
+		sel = append(sel, req)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return sel, nil
+}
+
+// matches reports whether labels meet every requirement of the selector
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		v, ok := labels[req.key]
+		switch req.op {
+		case selectEquals:
+			if !ok || v != req.value {
+				return false
+			}
+		case selectNotEquals:
+			if ok && v == req.value {
+				return false
+			}
+		case selectExists:
+			if !ok {
+				return false
+			}
+		case selectAbsent:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchClients returns the registered clients the selector matches,
+// connected or not, ordered by ID. Only their IDs and labels are loaded.
+func (s *Server) matchClients(sel labelSelector) ([]ClientInfo, error) {
+	var clients []ClientInfo
+	resp, err := s.db.From("clients").Select("id,labels,assigned_labels", false, "", "", "").Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &clients); err != nil {
+		return nil, err
+	}
+
+	var matched []ClientInfo
+	for _, cl := range clients {
+		if sel.matches(cl.Labels) {
+			matched = append(matched, cl)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+	return matched, nil
+}
+
+// loadClient returns the ID and labels of a client, or nil if there is none
+func (s *Server) loadClient(clientID string) (*ClientInfo, error) {
+	var clients []ClientInfo
+	resp, err := s.db.From("clients").Select("id,labels,assigned_labels", false, "", "", "").Eq("id", clientID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &clients); err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, nil
+	}
+	return &clients[0], nil
+}
+
+// handleSetLabels changes the labels of a client. The body maps keys to new
+// values; a null value removes the label. Labels not named are kept. Labels
+// set here are also recorded as assigned, which secret selectors match.
+func (s *Server) handleSetLabels(c *gin.Context) {
+	clientID := c.Param("client_id")
+
+	var changes map[string]*string
+	if err := c.ShouldBindJSON(&changes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid labels"})
+		return
+	}
+
+	client, err := s.loadClient(clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if client == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+
+	labels := client.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	assigned := client.AssignedLabels
+	if assigned == nil {
+		assigned = make(map[string]string)
+	}
+	var changed []string
+	for k, v := range changes {
+		if v == nil {
+			delete(labels, k)
+			delete(assigned, k)
+			changed = append(changed, "-"+k)
+			continue
+		}
+		labels[k] = *v
+		assigned[k] = *v
+		changed = append(changed, k+"="+*v)
+	}
+	if err := validateLabels(labels); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = s.db.From("clients").Update(map[string]interface{}{
+		"labels":          labels,
+		"assigned_labels": assigned,
+	}, "", "").Eq("id", clientID).Execute()
+	if err != nil {
+		log.Printf("Failed to update labels of client %s: %v", clientID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update labels"})
+		return
+	}
+
+	sort.Strings(changed)
+	s.audit(AuditEvent{
+		Type:     auditLabelsChanged,
+		Actor:    operatorName(c),
+		ClientID: clientID,
+		Detail:   strings.Join(changed, ","),
+	})
+	c.JSON(http.StatusOK, gin.H{"client_id": clientID, "labels": labels, "assigned_labels": assigned})
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supabase/postgrest-go"
+)
+
+// Page sizes of list endpoints
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	// maxScanPages is how many pages are read to fill one when post drops
+	// rows
+	maxScanPages = 10
+)
+
+// nextCursorHeader carries the cursor of the next page. The body stays a
+// plain array, so callers that ignore paging keep working.
+const nextCursorHeader = "X-Next-Cursor"
+
+// listSpec describes what a list endpoint lets callers select and sort by
+type listSpec struct {
+	fields      []string // columns that may be selected
+	sortable    []string // columns that may be sorted by; never null
+	defaultSort string   // "-" prefix for descending
+	timeField   string   // column since and until apply to
+}
+
+var clientListSpec = listSpec{
+	fields: []string{"id", "hostname", "ip", "last_seen", "status", "agent_version", "agent_protocol",
+		"os", "arch", "outdated", "labels", "assigned_labels", "node_id", "created_at"},
+	sortable:    []string{"id", "hostname", "last_seen", "created_at"},
+	defaultSort: "id",
+	timeField:   "last_seen",
+}
+
+var commandListSpec = listSpec{
+	fields: []string{"id", "client_id", "job_id", "batch", "command", "task", "cwd", "operator", "concurrency",
+		"serial_key", "status", "result", "error", "limits", "limit_exceeded", "exit_code", "created_at", "completed_at",
+		"pruned_at", "archive", "redactions", "secrets"},
+	sortable:    []string{"id", "created_at", "status"},
+	defaultSort: "-created_at",
+	timeField:   "created_at",
+}
+
+// pageCursor is where the previous page ended: the sort order, and the sort
+// value and ID of its last row
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	ID    string `json:"id"`
+}
+
+// listQuery holds the paging, sorting, field and time range parameters
+// shared by list endpoints:
+//
+//	limit   rows per page, up to maxPageSize
+//	cursor  the X-Next-Cursor of the previous page
+//	sort    a sortable column, "-" prefixed for descending
+//	fields  comma-separated columns to return
+//	since   RFC 3339 time or a duration such as 24h before now
+//	until   likewise
+type listQuery struct {
+	columns   string
+	sortField string
+	desc      bool
+	limit     int
+	cursor    *pageCursor
+	timeField string
+	since     time.Time
+	until     time.Time
+
+	// post works on a page after its cursor is taken, for what the store
+	// cannot do, such as decrypting or filtering encrypted columns. When it
+	// drops rows, the pages after it are read too, up to maxScanPages, so a
+	// page may still hold fewer rows than the limit and have a next one.
+	post func(rows []map[string]interface{}) []map[string]interface{}
+}
+
+// parseListQuery reads the shared list parameters
+func parseListQuery(c *gin.Context, spec listSpec) (*listQuery, error) {
+	q := &listQuery{limit: defaultPageSize, timeField: spec.timeField}
+
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid limit %q", v)
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		q.limit = n
+	}
+
+	sort := c.DefaultQuery("sort", spec.defaultSort)
+	q.desc = strings.HasPrefix(sort, "-")
+	q.sortField = strings.TrimPrefix(sort, "-")
+	if !contains(spec.sortable, q.sortField) {
+		return nil, fmt.Errorf("Cannot sort by %q, use one of %s", q.sortField, strings.Join(spec.sortable, ", "))
+	}
+
+	// Columns not listed, such as encrypted copies, are never returned
+	q.columns = strings.Join(spec.fields, ",")
+	if v := c.Query("fields"); v != "" {
+		// The cursor needs the ID and the sort value of every row
+		columns := []string{"id"}
+		if q.sortField != "id" {
+			columns = append(columns, q.sortField)
+		}
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if !contains(spec.fields, f) {
+				return nil, fmt.Errorf("Unknown field %q", f)
+			}
+			if !contains(columns, f) {
+				columns = append(columns, f)
+			}
+		}
+		q.columns = strings.Join(columns, ",")
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeCursor(v)
+		if err != nil || cur.Sort != sort {
+			return nil, fmt.Errorf("Invalid cursor")
+		}
+		q.cursor = cur
+	}
+
+	var err error
+	if q.since, err = parseListTime(c.Query("since")); err != nil {
+		return nil, err
+	}
+	if q.until, err = parseListTime(c.Query("until")); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// parseListTime accepts an RFC 3339 time or a duration before now
+func parseListTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q, use RFC 3339 or a duration such as 24h", v)
+}
+
+// splitList splits a comma-separated list, or returns nil if it is empty
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeCursor(cur pageCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+	if cur.ID == "" {
+		return nil, fmt.Errorf("cursor without id")
+	}
+	return &cur, nil
+}
+
+// quoteFilterValue quotes a value inside a PostgREST logic filter, where
+// commas and parentheses would otherwise end it
+func quoteFilterValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// containsPattern returns an ilike pattern matching values that contain v.
+// The LIKE wildcards % and _ in v are escaped. PostgREST turns every * into
+// %, so a * in v becomes _, which matches it among other characters; callers
+// check the rows again with strings.Contains.
+func containsPattern(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `_`).Replace(v)
+	return "*" + v + "*"
+}
+
+// page adds the time range, the cursor position, the order and the limit to
+// a query. One row more than the limit is asked for, to tell whether another
+// page follows.
+func (q *listQuery) page(f *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+	if !q.since.IsZero() {
+		f = f.Gte(q.timeField, q.since.Format(time.RFC3339))
+	}
+	if !q.until.IsZero() {
+		f = f.Lt(q.timeField, q.until.Format(time.RFC3339))
+	}
+
+	if q.cursor != nil {
+		op := "gt"
+		if q.desc {
+			op = "lt"
+		}
+		if q.sortField == "id" {
+			f = f.Or(fmt.Sprintf("id.%s.%s", op, quoteFilterValue(q.cursor.ID)))
+		} else {
+			// Rows sharing the sort value are ordered by ID
+			f = f.Or(fmt.Sprintf("%[1]s.%[2]s.%[3]s,and(%[1]s.eq.%[3]s,id.%[2]s.%[4]s)",
+				q.sortField, op, quoteFilterValue(q.cursor.Value), quoteFilterValue(q.cursor.ID)))
+		}
+	}
+
+	f = f.Order(q.sortField, !q.desc)
+	if q.sortField != "id" {
+		f = f.Order("id", !q.desc)
+	}
+	return f.Limit(q.limit + 1)
+}
+
+// sort returns the sort parameter the query was made with
+func (q *listQuery) sort() string {
+	if q.desc {
+		return "-" + q.sortField
+	}
+	return q.sortField
+}
+
+// next trims the extra row off a page and returns the cursor of the page
+// after it, or nil if this is the last one
+func (q *listQuery) next(rows []map[string]interface{}) ([]map[string]interface{}, *pageCursor) {
+	if len(rows) <= q.limit {
+		return rows, nil
+	}
+	rows = rows[:q.limit]
+	return rows, q.cursorAfter(rows[len(rows)-1])
+}
+
+// cursorAfter returns the cursor of the rows after row
+func (q *listQuery) cursorAfter(row map[string]interface{}) *pageCursor {
+	cur := &pageCursor{Sort: q.sort(), ID: fmt.Sprint(row["id"])}
+	if q.sortField != "id" {
+		cur.Value = fmt.Sprint(row[q.sortField])
+	}
+	return cur
+}
+
+// scan reads pages with fetch, which runs the query from q.cursor, and
+// passes them through post until limit rows are kept, the rows run out or
+// maxScanPages were read. It returns the kept rows and the cursor of the
+// rows after them, or nil if there are none.
+func (q *listQuery) scan(fetch func() ([]map[string]interface{}, error)) ([]map[string]interface{}, *pageCursor, error) {
+	var kept []map[string]interface{}
+	for pages := 1; ; pages++ {
+		rows, err := fetch()
+		if err != nil {
+			return nil, nil, err
+		}
+		rows, next := q.next(rows)
+		if q.post != nil {
+			rows = q.post(rows)
+		}
+		kept = append(kept, rows...)
+
+		// Rows kept beyond the limit are read again with the next page
+		if len(kept) > q.limit {
+			kept = kept[:q.limit]
+			return kept, q.cursorAfter(kept[len(kept)-1]), nil
+		}
+		if next == nil || len(kept) == q.limit || pages == maxScanPages {
+			return kept, next, nil
+		}
+		q.cursor = next
+	}
+}
+
+// respond sends a page of rows, with the cursor of the next page if there is
+// one
+func (q *listQuery) respond(c *gin.Context, s *Server, resp *postgrest.Response) {
+	var rows []map[string]interface{}
+	if err := s.db.ParseJSON(resp.Body, &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+		return
+	}
+
+	rows, next := q.next(rows)
+	if q.post != nil {
+		rows = q.post(rows)
+	}
+	q.send(c, rows, next)
+}
+
+// respondScanning sends a page like respond, reading more pages while post
+// drops rows. query builds the filtered query, without paging, each time.
+func (q *listQuery) respondScanning(c *gin.Context, s *Server, query func() *postgrest.FilterBuilder) {
+	var parseFailed bool
+	rows, next, err := q.scan(func() ([]map[string]interface{}, error) {
+		resp, err := q.page(query()).Execute()
+		if err != nil {
+			return nil, err
+		}
+		var rows []map[string]interface{}
+		if err := s.db.ParseJSON(resp.Body, &rows); err != nil {
+			parseFailed = true
+			return nil, err
+		}
+		return rows, nil
+	})
+	if parseFailed {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	q.send(c, rows, next)
+}
+
+// send writes a page and the cursor of the next one
+func (q *listQuery) send(c *gin.Context, rows []map[string]interface{}, next *pageCursor) {
+	if next != nil {
+		c.Header(nextCursorHeader, encodeCursor(*next))
+	}
+	if rows == nil {
+		rows = []map[string]interface{}{}
+	}
+	c.JSON(http.StatusOK, rows)
+}
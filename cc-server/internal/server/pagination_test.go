@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestContainsPattern(t *testing.T) {
+	for v, want := range map[string]string{
+		"uptime":       "*uptime*",
+		"100%":         `*100\%*`,
+		"my_file":      `*my\_file*`,
+		"rm -rf *.log": "*rm -rf _.log*",
+		`C:\tmp`:       `*C:\\tmp*`,
+	} {
+		if got := containsPattern(v); got != want {
+			t.Errorf("containsPattern(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, cur := range []pageCursor{
+		{Sort: "id", ID: "cmd_1"},
+		{Sort: "-created_at", Value: "2024-01-01T10:00:00Z", ID: `cmd_"2",(x)`},
+	} {
+		got, err := decodeCursor(encodeCursor(cur))
+		if err != nil || *got != cur {
+			t.Errorf("cursor %+v decoded as %+v, %v", cur, got, err)
+		}
+	}
+	for _, bad := range []string{"not base64!", encodeCursor(pageCursor{Sort: "id"}), "bm90IGpzb24"} {
+		if _, err := decodeCursor(bad); err == nil {
+			t.Errorf("decodeCursor(%q) accepted", bad)
+		}
+	}
+}
+
+// listContext is a request context with the given query string
+func listContext(query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/v1/commands/client_1?"+query, nil)
+	return c
+}
+
+func TestParseListQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string // substring, "" if valid
+	}{
+		{"limit=0", "Invalid limit"},
+		{"limit=ten", "Invalid limit"},
+		{"sort=result", "Cannot sort by"},
+		{"sort=-hostname", "Cannot sort by"},
+		{"fields=id,password", "Unknown field"},
+		{"cursor=garbage", "Invalid cursor"},
+		// A cursor only continues the order it was made for
+		{"sort=id&cursor=" + encodeCursor(pageCursor{Sort: "-created_at", ID: "cmd_1"}), "Invalid cursor"},
+		{"since=yesterday", "Invalid time"},
+		{"until=-1h", "Invalid time"},
+		{"sort=-id&cursor=" + encodeCursor(pageCursor{Sort: "-id", ID: "cmd_1"}), ""},
+		{"since=2024-01-01T00:00:00Z&until=24h", ""},
+	} {
+		_, err := parseListQuery(listContext(tc.query), commandListSpec)
+		if (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("parseListQuery(%q) = %v, want %q", tc.query, err, tc.err)
+		}
+	}
+
+	q, err := parseListQuery(listContext(""), commandListSpec)
+	if err != nil || q.limit != defaultPageSize || q.sortField != "created_at" || !q.desc || q.columns != strings.Join(commandListSpec.fields, ",") {
+		t.Fatalf("defaults: %+v, %v", q, err)
+	}
+	if q, _ := parseListQuery(listContext("limit=5000"), commandListSpec); q.limit != maxPageSize {
+		t.Fatalf("limit above the maximum gives %d", q.limit)
+	}
+	// The cursor needs the ID and the sort value of every row
+	if q, _ := parseListQuery(listContext("fields=status,command,status&sort=created_at"), commandListSpec); q.columns != "id,created_at,status,command" {
+		t.Fatalf("columns = %q", q.columns)
+	}
+	q, _ = parseListQuery(listContext("since=2h"), commandListSpec)
+	if since := time.Since(q.since); since < 2*time.Hour || since > 2*time.Hour+time.Minute {
+		t.Fatalf("since=2h is %v ago", since)
+	}
+}
+
+// testRows are rows with IDs row_00 to row_<n-1>, every third created at the
+// same time as the one before
+func testRows(n int) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for i := 0; i < n; i++ {
+		rows = append(rows, map[string]interface{}{"id": fmt.Sprintf("row_%02d", i), "created_at": fmt.Sprintf("t%02d", i-i%3)})
+	}
+	return rows
+}
+
+// fakeStore serves rows as the store would for q: sorted, after q.cursor and
+// one more than the limit
+func fakeStore(q *listQuery, rows []map[string]interface{}, reads *int) func() ([]map[string]interface{}, error) {
+	return func() ([]map[string]interface{}, error) {
+		*reads++
+		key := func(row map[string]interface{}) string {
+			return fmt.Sprint(row[q.sortField]) + "/" + fmt.Sprint(row["id"])
+		}
+		sorted := append([]map[string]interface{}(nil), rows...)
+		sort.Slice(sorted, func(i, j int) bool { return (key(sorted[i]) < key(sorted[j])) != q.desc })
+
+		var page []map[string]interface{}
+		for _, row := range sorted {
+			if q.cursor != nil {
+				after := q.cursor.Value + "/" + q.cursor.ID
+				if q.sortField == "id" {
+					after = q.cursor.ID + "/" + q.cursor.ID
+				}
+				if (key(row) <= after) != q.desc || key(row) == after {
+					continue
+				}
+			}
+			if len(page) == q.limit+1 {
+				break
+			}
+			page = append(page, row)
+		}
+		return page, nil
+	}
+}
+
+func TestListQueryNext(t *testing.T) {
+	q := &listQuery{limit: 3, sortField: "created_at", desc: true}
+	rows := testRows(4)
+	page, cur := q.next(rows)
+	if len(page) != 3 || cur == nil || *cur != (pageCursor{Sort: "-created_at", Value: "t00", ID: "row_02"}) {
+		t.Fatalf("next = %d rows, %+v", len(page), cur)
+	}
+	if page, cur := q.next(rows[:3]); len(page) != 3 || cur != nil {
+		t.Fatalf("last page: %d rows, %+v", len(page), cur)
+	}
+	q.sortField = "id"
+	if _, cur := q.next(rows); cur.Value != "" || cur.ID != "row_02" || cur.Sort != "-id" {
+		t.Fatalf("cursor by id: %+v", cur)
+	}
+}
+
+func TestListQueryScan(t *testing.T) {
+	// Every page is read in full, in order and without repeats
+	for _, sortField := range []string{"id", "created_at"} {
+		for _, desc := range []bool{false, true} {
+			q := &listQuery{limit: 4, sortField: sortField, desc: desc}
+			store := fakeStore(q, testRows(10), new(int))
+			var seen []string
+			for {
+				rows, next, err := q.scan(store)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, row := range rows {
+					seen = append(seen, row["id"].(string))
+				}
+				if next == nil {
+					break
+				}
+				q.cursor = next
+			}
+			if len(seen) != 10 || sort.StringsAreSorted(seen) == desc {
+				t.Errorf("sort %s desc %v: read %v", sortField, desc, seen)
+			}
+		}
+	}
+
+	// A filter matching every fourth row still fills the page
+	keep := func(rows []map[string]interface{}) []map[string]interface{} {
+		var kept []map[string]interface{}
+		for _, row := range rows {
+			var n int
+			fmt.Sscanf(row["id"].(string), "row_%d", &n)
+			if n%4 == 0 {
+				kept = append(kept, row)
+			}
+		}
+		return kept
+	}
+	q := &listQuery{limit: 3, sortField: "created_at", post: keep}
+	reads := 0
+	rows, next, err := q.scan(fakeStore(q, testRows(40), &reads))
+	if err != nil || len(rows) != 3 || rows[2]["id"] != "row_08" || next == nil || next.ID != "row_08" || reads != 3 {
+		t.Fatalf("filtered scan: %v, next %+v, %d reads, %v", rows, next, reads, err)
+	}
+	// The next page starts after the last row returned, not the last read
+	q.cursor = next
+	if rows, _, _ := q.scan(fakeStore(q, testRows(40), &reads)); len(rows) != 3 || rows[0]["id"] != "row_12" {
+		t.Fatalf("page after a filtered scan: %v", rows)
+	}
+
+	// Reading stops after maxScanPages, with a cursor to go on from
+	none := func([]map[string]interface{}) []map[string]interface{} { return nil }
+	q = &listQuery{limit: 2, sortField: "id", post: none}
+	reads = 0
+	rows, next, _ = q.scan(fakeStore(q, testRows(100), &reads))
+	if len(rows) != 0 || reads != maxScanPages || next == nil || next.ID != fmt.Sprintf("row_%02d", 2*maxScanPages-1) {
+		t.Fatalf("scan without matches: %d rows, %d reads, next %+v", len(rows), reads, next)
+	}
+}
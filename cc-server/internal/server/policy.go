@@ -0,0 +1,386 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultApprovalExpiry is how long a command waits for approval when the
+// policy does not say
+const defaultApprovalExpiry = time.Hour
+
+// RuleMatch selects commands. Every condition that is set must hold; a match
+// with no conditions matches every command.
+type RuleMatch struct {
+	// Command is a regular expression matched against the command line
+	Command string `json:"command,omitempty"`
+
+	// CommandGlob is a shell-style pattern the whole command line must
+	// match; "*" matches any text, including slashes and line breaks
+	CommandGlob string `json:"command_glob,omitempty"`
+
+	// Task is a glob matched against the task name of the command
+	Task string `json:"task,omitempty"`
+
+	// Labels matches when any target client carries all of these labels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// MinTargets matches commands sent to at least this many clients
+	MinTargets int `json:"min_targets,omitempty"`
+
+	re   *regexp.Regexp
+	glob *regexp.Regexp
+}
+
+// compile prepares the match for use and checks its patterns
+func (m *RuleMatch) compile() error {
+	if m.Command != "" {
+		re, err := regexp.Compile(m.Command)
+		if err != nil {
+			return fmt.Errorf("invalid command pattern: %v", err)
+		}
+		m.re = re
+	}
+	if m.CommandGlob != "" {
+		m.glob = globToRegexp(m.CommandGlob)
+	}
+	if m.Task != "" {
+		if _, err := path.Match(m.Task, ""); err != nil {
+			return fmt.Errorf("invalid task pattern: %v", err)
+		}
+	}
+	return validateLabels(m.Labels)
+}
+
+// matches reports whether cmd, sent to targets, meets every condition
+func (m *RuleMatch) matches(cmd Command, targets []ClientInfo) bool {
+	if m.re != nil && !matchCommand(m.re, cmd.Command) {
+		return false
+	}
+	if m.glob != nil && !matchCommand(m.glob, cmd.Command) {
+		return false
+	}
+	if m.Task != "" {
+		if ok, _ := path.Match(m.Task, cmd.Task); !ok {
+			return false
+		}
+	}
+	if m.MinTargets > 0 && len(targets) < m.MinTargets {
+		return false
+	}
+	if len(m.Labels) > 0 {
+		found := false
+		for _, t := range targets {
+			if hasLabels(t.Labels, m.Labels) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCommand reports whether re matches the whole command or any one of
+// its lines, so a rule cannot be bypassed by putting a harmless line first
+func matchCommand(re *regexp.Regexp, command string) bool {
+	if re.MatchString(command) {
+		return true
+	}
+	if !strings.ContainsAny(command, "\r\n") {
+		return false
+	}
+	for _, line := range strings.FieldsFunc(command, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp turns a shell-style pattern into an anchored regular
+// expression where "*" matches any text, line breaks included, and "?" any
+// single character
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// hasLabels reports whether labels contains every key/value of want
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ApprovalRule makes matching commands wait for a second operator
+type ApprovalRule struct {
+	Name string `json:"name"`
+	RuleMatch
+}
+
+// weekdays maps the day names used in time windows
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// TimeWindow is a recurring period of the week, e.g. a maintenance blackout.
+// A window whose end is before its start runs past midnight.
+type TimeWindow struct {
+	// Days lists the days the window starts on ("mon" to "sun"); empty
+	// means every day
+	Days []string `json:"days,omitempty"`
+
+	// Start and End are "15:04" times of day; empty means the whole day
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// Timezone is an IANA zone name; it defaults to UTC
+	Timezone string `json:"timezone,omitempty"`
+
+	loc        *time.Location
+	days       map[time.Weekday]bool
+	start, end time.Duration
+}
+
+// compile checks the window and prepares it for use
+func (w *TimeWindow) compile() error {
+	w.loc = time.UTC
+	if w.Timezone != "" {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q", w.Timezone)
+		}
+		w.loc = loc
+	}
+
+	if len(w.Days) > 0 {
+		w.days = make(map[time.Weekday]bool)
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("invalid day %q", d)
+			}
+			w.days[wd] = true
+		}
+	}
+
+	w.end = 24 * time.Hour
+	for _, t := range []struct {
+		s   string
+		dst *time.Duration
+	}{{w.Start, &w.start}, {w.End, &w.end}} {
+		if t.s == "" {
+			continue
+		}
+		tod, err := time.Parse("15:04", t.s)
+		if err != nil {
+			return fmt.Errorf("invalid time of day %q", t.s)
+		}
+		*t.dst = time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute
+	}
+	return nil
+}
+
+// contains reports whether t falls inside the window
+func (w *TimeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+
+	if w.start <= w.end {
+		return (w.days == nil || w.days[day]) && tod >= w.start && tod < w.end
+	}
+	// Past midnight: the early hours belong to the window started the day before
+	if tod >= w.start {
+		return w.days == nil || w.days[day]
+	}
+	return tod < w.end && (w.days == nil || w.days[(day+6)%7])
+}
+
+// DenyRule refuses matching commands. Roles limits the rule to operators with
+// one of the roles and Window to a period of the week, e.g. a blackout.
+type DenyRule struct {
+	Name   string      `json:"name"`
+	Roles  []string    `json:"roles,omitempty"`
+	Window *TimeWindow `json:"window,omitempty"`
+	RuleMatch
+}
+
+// appliesTo reports whether the rule is in force for role at time now
+func (r *DenyRule) appliesTo(role string, now time.Time) bool {
+	if len(r.Roles) > 0 {
+		found := false
+		for _, rr := range r.Roles {
+			if rr == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.Window == nil || r.Window.contains(now)
+}
+
+// maxTargetsRule is the rule name reported when MaxTargets is exceeded
+const maxTargetsRule = "max_targets"
+
+// CommandPolicy holds the server-side rules every command is checked against
+type CommandPolicy struct {
+	// MaxTargets caps the number of clients a single command may target.
+	// Zero means no cap.
+	MaxTargets int `json:"max_targets,omitempty"`
+
+	// Deny rules; the first rule in force that matches refuses the command
+	Deny []DenyRule `json:"deny"`
+
+	// Approval rules; the first matching rule makes a command wait for
+	// approval by a different operator
+	Approval []ApprovalRule `json:"approval"`
+
+	// ApprovalExpiry is how long a command may wait for approval, e.g.
+	// "30m". It defaults to one hour.
+	ApprovalExpiry string `json:"approval_expiry,omitempty"`
+
+	approvalExpiry time.Duration
+}
+
+// LoadCommandPolicy reads a command policy from a JSON file
+func LoadCommandPolicy(file string) (*CommandPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command policy: %v", err)
+	}
+
+	var p CommandPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse command policy: %v", err)
+	}
+	if p.MaxTargets < 0 {
+		return nil, fmt.Errorf("max_targets must not be negative")
+	}
+	for i := range p.Deny {
+		r := &p.Deny[i]
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("deny rule %q: %v", r.Name, err)
+		}
+		if r.Window != nil {
+			if err := r.Window.compile(); err != nil {
+				return nil, fmt.Errorf("deny rule %q: %v", r.Name, err)
+			}
+		}
+	}
+	for i := range p.Approval {
+		if err := p.Approval[i].compile(); err != nil {
+			return nil, fmt.Errorf("approval rule %q: %v", p.Approval[i].Name, err)
+		}
+	}
+
+	p.approvalExpiry = defaultApprovalExpiry
+	if p.ApprovalExpiry != "" {
+		d, err := time.ParseDuration(p.ApprovalExpiry)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid approval_expiry %q", p.ApprovalExpiry)
+		}
+		p.approvalExpiry = d
+	}
+	return &p, nil
+}
+
+// deniedBy returns the name of the rule refusing cmd sent to targets by an
+// operator with role at time now, or "" if the command is allowed
+func (p *CommandPolicy) deniedBy(cmd Command, targets []ClientInfo, role string, now time.Time) string {
+	if p == nil {
+		return ""
+	}
+	if p.MaxTargets > 0 && len(targets) > p.MaxTargets {
+		return maxTargetsRule
+	}
+	for i := range p.Deny {
+		r := &p.Deny[i]
+		if r.appliesTo(role, now) && r.matches(cmd, targets) {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// approvalRuleFor returns the first approval rule matching cmd sent to
+// targets, or nil if the command may run right away
+func (p *CommandPolicy) approvalRuleFor(cmd Command, targets []ClientInfo) *ApprovalRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Approval {
+		if p.Approval[i].matches(cmd, targets) {
+			return &p.Approval[i]
+		}
+	}
+	return nil
+}
+
+// PolicyTestResult reports what the command policy would do with a command
+type PolicyTestResult struct {
+	Targets      []string `json:"targets"`
+	Allowed      bool     `json:"allowed"`
+	DeniedBy     string   `json:"denied_by,omitempty"`
+	ApprovalRule string   `json:"approval_rule,omitempty"`
+}
+
+// handlePolicyTest checks a command against the policy as the calling
+// operator, without storing or sending anything
+func (s *Server) handlePolicyTest(c *gin.Context) {
+	var req SendCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command"})
+		return
+	}
+
+	targets, status, err := s.resolveTargets(req)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	res := PolicyTestResult{Targets: make([]string, len(targets))}
+	for i, t := range targets {
+		res.Targets[i] = t.ID
+	}
+	res.DeniedBy = s.cfg.CommandPolicy.deniedBy(req.Command, targets, operatorRole(c), time.Now())
+	res.Allowed = res.DeniedBy == ""
+	if res.Allowed {
+		if rule := s.cfg.CommandPolicy.approvalRuleFor(req.Command, targets); rule != nil {
+			res.ApprovalRule = rule.Name
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
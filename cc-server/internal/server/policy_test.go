@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestRuleMatchMultiLineCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		match   RuleMatch
+		command string
+		want    bool
+	}{
+		{"glob single line", RuleMatch{CommandGlob: "rm -rf *"}, "rm -rf /", true},
+		{"glob across lines", RuleMatch{CommandGlob: "rm -rf *"}, "rm -rf /tmp/a\n/", true},
+		{"glob on a later line", RuleMatch{CommandGlob: "rm -rf *"}, "echo hello\nrm -rf /", true},
+		{"glob after a carriage return", RuleMatch{CommandGlob: "rm -rf *"}, "true\r\nrm -rf /", true},
+		{"glob no match", RuleMatch{CommandGlob: "rm -rf *"}, "echo rm -rf /\nls", false},
+		{"regexp on a later line", RuleMatch{Command: "^shutdown\\b"}, "uptime\nshutdown -h now", true},
+		{"regexp no match", RuleMatch{Command: "^shutdown\\b"}, "uptime\necho shutdown", false},
+	}
+	for _, tt := range tests {
+		m := tt.match
+		if err := m.compile(); err != nil {
+			t.Fatalf("%s: compile: %v", tt.name, err)
+		}
+		if got := m.matches(Command{Command: tt.command}, nil); got != tt.want {
+			t.Errorf("%s: matches(%q) = %v, want %v", tt.name, tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clock abstracts time so limiters can be driven by a fake clock
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// tokenBucket is a classic token bucket refilled continuously at rate tokens
+// per second up to burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow takes one token if available. When it is not, it returns how long
+// until the next token is due.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Minute
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// full reports whether the bucket has refilled completely, i.e. it carries
+// no state worth keeping
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Reasons a registration attempt is rejected before the token is checked
+const (
+	rejectGlobalRate = "global_rate_limit"
+	rejectIPRate     = "ip_rate_limit"
+	rejectLockedOut  = "locked_out"
+)
+
+type ipState struct {
+	bucket       *tokenBucket
+	failures     int
+	firstFailure time.Time
+	lockedUntil  time.Time
+}
+
+// registrationLimiter guards /register with per-IP and global token buckets
+// and locks out IPs that keep presenting invalid tokens
+type registrationLimiter struct {
+	mu        sync.Mutex
+	cfg       RegistrationLimits
+	clock     clock
+	global    *tokenBucket
+	ips       map[string]*ipState
+	lastSweep time.Time
+}
+
+func newRegistrationLimiter(cfg RegistrationLimits, clk clock) *registrationLimiter {
+	now := clk.Now()
+	return &registrationLimiter{
+		cfg:       cfg,
+		clock:     clk,
+		global:    newTokenBucket(cfg.GlobalRate, cfg.GlobalBurst, now),
+		ips:       make(map[string]*ipState),
+		lastSweep: now,
+	}
+}
+
+// allow decides whether a registration attempt from ip may proceed. When it
+// may not, it returns the reason and how long the caller should wait.
+func (l *registrationLimiter) allow(ip string) (bool, string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.sweep(now)
+
+	st := l.state(ip, now)
+	if now.Before(st.lockedUntil) {
+		return false, rejectLockedOut, st.lockedUntil.Sub(now)
+	}
+	if ok, wait := st.bucket.allow(now); !ok {
+		return false, rejectIPRate, wait
+	}
+	if ok, wait := l.global.allow(now); !ok {
+		return false, rejectGlobalRate, wait
+	}
+	return true, "", 0
+}
+
+// recordFailure counts an invalid token from ip and reports whether the IP
+// has just been locked out
+func (l *registrationLimiter) recordFailure(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	st := l.state(ip, now)
+	if st.failures == 0 || now.Sub(st.firstFailure) > l.cfg.FailureWindow {
+		st.failures = 0
+		st.firstFailure = now
+	}
+	st.failures++
+
+	if l.cfg.MaxFailures > 0 && st.failures >= l.cfg.MaxFailures {
+		st.lockedUntil = now.Add(l.cfg.LockoutDuration)
+		st.failures = 0
+		return true
+	}
+	return false
+}
+
+// recordSuccess clears the failure count of ip after a valid registration
+func (l *registrationLimiter) recordSuccess(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if st, ok := l.ips[ip]; ok {
+		st.failures = 0
+	}
+}
+
+func (l *registrationLimiter) state(ip string, now time.Time) *ipState {
+	st, ok := l.ips[ip]
+	if !ok {
+		st = &ipState{bucket: newTokenBucket(l.cfg.PerIPRate, l.cfg.PerIPBurst, now)}
+		l.ips[ip] = st
+	}
+	return st
+}
+
+// sweep forgets IPs that are neither locked out, failing nor rate limited,
+// so the map does not grow with every address that ever registered
+func (l *registrationLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, st := range l.ips {
+		idle := st.failures == 0 || now.Sub(st.firstFailure) > l.cfg.FailureWindow
+		if idle && !now.Before(st.lockedUntil) && st.bucket.full(now) {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+// Middleware guarding the public registration endpoint
+func (s *Server) registrationGuard(c *gin.Context) {
+	ip := c.ClientIP()
+
+	if ok, reason, wait := s.regLimiter.allow(ip); !ok {
+		s.audit(AuditEvent{
+			Type:   auditRegistrationRejected,
+			IP:     ip,
+			Detail: reason,
+		})
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many registration attempts"})
+		return
+	}
+
+	if max := s.cfg.Registration.MaxBodyBytes; max > 0 {
+		if c.Request.ContentLength > max {
+			s.audit(AuditEvent{
+				Type:   auditRegistrationRejected,
+				IP:     ip,
+				Detail: fmt.Sprintf("body_too_large: %d bytes", c.Request.ContentLength),
+			})
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+	}
+
+	c.Next()
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock the test moves by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	clk := newFakeClock()
+	b := newTokenBucket(2, 3, clk.Now())
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(clk.Now()); !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := b.allow(clk.Now())
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("wait = %v, want 500ms", wait)
+	}
+
+	clk.advance(499 * time.Millisecond)
+	if ok, _ := b.allow(clk.Now()); ok {
+		t.Fatal("token was available before it was due")
+	}
+	clk.advance(time.Millisecond)
+	if ok, _ := b.allow(clk.Now()); !ok {
+		t.Fatal("token was not refilled when due")
+	}
+
+	// A long idle period refills no more than the burst
+	clk.advance(time.Hour)
+	if !b.full(clk.Now()) {
+		t.Fatal("bucket is not full after an hour")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(clk.Now()); !ok {
+			t.Fatalf("request %d after refilling was refused", i+1)
+		}
+	}
+	if ok, _ := b.allow(clk.Now()); ok {
+		t.Fatal("bucket refilled past its burst")
+	}
+}
+
+func testLimits() RegistrationLimits {
+	return RegistrationLimits{
+		PerIPRate:       1,
+		PerIPBurst:      10,
+		GlobalRate:      100,
+		GlobalBurst:     100,
+		MaxFailures:     3,
+		FailureWindow:   time.Minute,
+		LockoutDuration: 10 * time.Minute,
+	}
+}
+
+func TestRegistrationLimiterPerIPRate(t *testing.T) {
+	clk := newFakeClock()
+	cfg := testLimits()
+	cfg.PerIPBurst = 2
+	l := newRegistrationLimiter(cfg, clk)
+
+	for i := 0; i < 2; i++ {
+		if ok, reason, _ := l.allow("10.0.0.1"); !ok {
+			t.Fatalf("attempt %d refused: %s", i+1, reason)
+		}
+	}
+	ok, reason, wait := l.allow("10.0.0.1")
+	if ok || reason != rejectIPRate || wait != time.Second {
+		t.Fatalf("allow = %v %q %v, want false %q 1s", ok, reason, wait, rejectIPRate)
+	}
+	if ok, _, _ := l.allow("10.0.0.2"); !ok {
+		t.Fatal("another IP was limited by the first one's bucket")
+	}
+
+	clk.advance(time.Second)
+	if ok, reason, _ := l.allow("10.0.0.1"); !ok {
+		t.Fatalf("attempt after refill refused: %s", reason)
+	}
+}
+
+func TestRegistrationLimiterLockoutExpiry(t *testing.T) {
+	clk := newFakeClock()
+	l := newRegistrationLimiter(testLimits(), clk)
+	const ip = "10.0.0.1"
+
+	for i := 1; i <= 3; i++ {
+		if ok, reason, _ := l.allow(ip); !ok {
+			t.Fatalf("attempt %d refused: %s", i, reason)
+		}
+		if locked := l.recordFailure(ip); locked != (i == 3) {
+			t.Fatalf("failure %d: locked = %v", i, locked)
+		}
+		clk.advance(time.Second)
+	}
+
+	ok, reason, wait := l.allow(ip)
+	if ok || reason != rejectLockedOut {
+		t.Fatalf("allow = %v %q, want locked out", ok, reason)
+	}
+	if want := 10*time.Minute - time.Second; wait != want {
+		t.Fatalf("wait = %v, want %v", wait, want)
+	}
+
+	clk.advance(wait - time.Millisecond)
+	if ok, reason, _ := l.allow(ip); ok || reason != rejectLockedOut {
+		t.Fatalf("allow = %v %q just before the lockout ends", ok, reason)
+	}
+	clk.advance(time.Millisecond)
+	if ok, reason, _ := l.allow(ip); !ok {
+		t.Fatalf("attempt after the lockout refused: %s", reason)
+	}
+
+	// The failure count started over with the lockout
+	if l.recordFailure(ip) || l.recordFailure(ip) {
+		t.Fatal("locked out again before reaching the failure limit")
+	}
+}
+
+func TestRegistrationLimiterFailureWindow(t *testing.T) {
+	clk := newFakeClock()
+	l := newRegistrationLimiter(testLimits(), clk)
+	const ip = "10.0.0.1"
+
+	l.recordFailure(ip)
+	l.recordFailure(ip)
+	clk.advance(time.Minute + time.Second)
+	if l.recordFailure(ip) {
+		t.Fatal("failures outside the window caused a lockout")
+	}
+	if ok, reason, _ := l.allow(ip); !ok {
+		t.Fatalf("attempt refused: %s", reason)
+	}
+
+	l.recordSuccess(ip)
+	l.recordFailure(ip)
+	if l.recordFailure(ip) {
+		t.Fatal("a success did not clear the failure count")
+	}
+}
+
+func TestRegistrationLimiterSweep(t *testing.T) {
+	clk := newFakeClock()
+	l := newRegistrationLimiter(testLimits(), clk)
+
+	l.allow("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		l.recordFailure("10.0.0.2")
+	}
+
+	// The idle IP is forgotten, the locked out one kept
+	clk.advance(2 * time.Minute)
+	l.allow("10.0.0.3")
+	if _, ok := l.ips["10.0.0.1"]; ok {
+		t.Fatal("idle IP was not swept")
+	}
+	if _, ok := l.ips["10.0.0.2"]; !ok {
+		t.Fatal("locked out IP was swept")
+	}
+}
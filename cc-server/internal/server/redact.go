@@ -0,0 +1,371 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRawKeyEnv holds the key raw output copies are encrypted with
+const defaultRawKeyEnv = "CC_RAW_OUTPUT_KEY"
+
+// Entropy detection defaults
+const (
+	defaultEntropyMinLength = 24
+	defaultEntropyThreshold = 4.3 // bits per character; hex tops out at 4
+)
+
+// RedactionRule replaces what its pattern matches. If the pattern has a
+// capture group, only the first group is replaced, so "password=(\S+)" keeps
+// the "password=" part.
+type RedactionRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// builtinRedactionRules detect well known secret formats
+var builtinRedactionRules = []RedactionRule{
+	{Name: "private_key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{Name: "aws_access_key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "github_token", Pattern: `\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`},
+	{Name: "slack_token", Pattern: `\bxox[abprs]-[A-Za-z0-9-]{10,}`},
+	{Name: "jwt", Pattern: `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`},
+	{Name: "bearer_token", Pattern: `(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`},
+	{Name: "url_credentials", Pattern: `\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`},
+	{Name: "password_assignment", Pattern: `(?i)\b(?:password|passwd|pwd|secret|token|api[_-]?key)\b["']?\s*[:=]\s*["']?([^\s"',;]+)`},
+}
+
+func init() {
+	for i := range builtinRedactionRules {
+		builtinRedactionRules[i].re = regexp.MustCompile(builtinRedactionRules[i].Pattern)
+	}
+}
+
+// EntropyDetection redacts long tokens that look random
+type EntropyDetection struct {
+	MinLength int     `json:"min_length,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// entropyCandidate matches the tokens entropy detection looks at
+var entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_-]+`)
+
+// redactionMarkers matches the markers left by redaction rules
+var redactionMarkers = regexp.MustCompile(`\[REDACTED:[^\]]*\]`)
+
+// RedactionConfig lists what is removed from command output before it is
+// stored or sent to operators
+type RedactionConfig struct {
+	// Builtin enables the rules for well known secret formats. Default on.
+	Builtin *bool `json:"builtin,omitempty"`
+
+	Rules []RedactionRule `json:"rules,omitempty"`
+
+	// Entropy enables detection of random looking tokens. Nil disables it.
+	Entropy *EntropyDetection `json:"entropy,omitempty"`
+
+	// KeepRaw stores an encrypted copy of redacted output that admins can
+	// read. The key is read from RawKeyEnv.
+	KeepRaw   bool   `json:"keep_raw,omitempty"`
+	RawKeyEnv string `json:"raw_key_env,omitempty"`
+
+	rules []RedactionRule
+	raw   *sealer
+}
+
+// DefaultRedactionConfig redacts the built-in secret formats only
+func DefaultRedactionConfig() *RedactionConfig {
+	return &RedactionConfig{rules: builtinRedactionRules}
+}
+
+// LoadRedactionConfig reads redaction rules from a JSON file
+func LoadRedactionConfig(file string) (*RedactionConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redaction config: %v", err)
+	}
+
+	var rc RedactionConfig
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, fmt.Errorf("failed to parse redaction config: %v", err)
+	}
+
+	if rc.Builtin == nil || *rc.Builtin {
+		rc.rules = append(rc.rules, builtinRedactionRules...)
+	}
+	for i, r := range rc.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("redaction rule %d has no name", i+1)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %q: %v", r.Name, err)
+		}
+		r.re = re
+		rc.rules = append(rc.rules, r)
+	}
+
+	if e := rc.Entropy; e != nil {
+		if e.MinLength == 0 {
+			e.MinLength = defaultEntropyMinLength
+		}
+		if e.Threshold == 0 {
+			e.Threshold = defaultEntropyThreshold
+		}
+	}
+
+	if rc.KeepRaw {
+		if rc.RawKeyEnv == "" {
+			rc.RawKeyEnv = defaultRawKeyEnv
+		}
+		if rc.raw, err = newSealerFromEnv(rc.RawKeyEnv); err != nil {
+			return nil, fmt.Errorf("keep_raw: %v", err)
+		}
+	}
+	return &rc, nil
+}
+
+// redactionMarker replaces a redacted secret
+func redactionMarker(rule string) string {
+	return "[REDACTED:" + rule + "]"
+}
+
+// redact returns s with every secret replaced by a marker naming the rule
+// that found it, and the names of those rules
+func (rc *RedactionConfig) redact(s string) (string, []string) {
+	if rc == nil || s == "" {
+		return s, nil
+	}
+
+	hits := make(map[string]bool)
+	for _, r := range rc.rules {
+		s = redactRule(s, r, hits)
+	}
+	if rc.Entropy != nil {
+		s = rc.redactEntropy(s, hits)
+	}
+
+	if len(hits) == 0 {
+		return s, nil
+	}
+	names := make([]string, 0, len(hits))
+	for name := range hits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return s, names
+}
+
+// redactEntropy replaces random looking tokens, leaving the markers of
+// earlier rules alone
+func (rc *RedactionConfig) redactEntropy(s string, hits map[string]bool) string {
+	replace := func(part string) string {
+		return entropyCandidate.ReplaceAllStringFunc(part, func(tok string) string {
+			if len(tok) < rc.Entropy.MinLength || shannonEntropy(tok) < rc.Entropy.Threshold {
+				return tok
+			}
+			hits["entropy"] = true
+			return redactionMarker("entropy")
+		})
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range redactionMarkers.FindAllStringIndex(s, -1) {
+		b.WriteString(replace(s[last:m[0]]))
+		b.WriteString(s[m[0]:m[1]])
+		last = m[1]
+	}
+	b.WriteString(replace(s[last:]))
+	return b.String()
+}
+
+// redactRule replaces the matches of one rule, or only their first capture
+// group when the pattern has one
+func redactRule(s string, r RedactionRule, hits map[string]bool) string {
+	matches := r.re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if start < last || start == end {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(redactionMarker(r.Name))
+		last = end
+		hits[r.Name] = true
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// shannonEntropy returns the entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	var h float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// redactJSON redacts every string value of a JSON message, so the result is
+// still valid JSON. Messages that do not parse are returned as they are.
+func (rc *RedactionConfig) redactJSON(message []byte) []byte {
+	if rc == nil {
+		return message
+	}
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return message
+	}
+	redacted := false
+	v = rc.redactValue(v, &redacted)
+	if !redacted {
+		return message
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return message
+	}
+	return data
+}
+
+func (rc *RedactionConfig) redactValue(v interface{}, redacted *bool) interface{} {
+	switch v := v.(type) {
+	case string:
+		s, hits := rc.redact(v)
+		if hits != nil {
+			*redacted = true
+		}
+		return s
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = rc.redactValue(item, redacted)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = rc.redactValue(item, redacted)
+		}
+	}
+	return v
+}
+
+// rawOutput is the encrypted copy of output before redaction
+type rawOutput struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// redactResult redacts the output and error of a result in update. When
+// configured, an encrypted copy of the original is added as raw_output.
+func (rc *RedactionConfig) redactResult(commandID string, update map[string]interface{}) {
+	result, _ := update["result"].(string)
+	errText, _ := update["error"].(string)
+
+	redResult, resultHits := rc.redact(result)
+	redError, errorHits := rc.redact(errText)
+	if resultHits == nil && errorHits == nil {
+		return
+	}
+	update["result"] = redResult
+	update["error"] = redError
+
+	names := append(resultHits, errorHits...)
+	sort.Strings(names)
+	update["redactions"] = uniqueStrings(names)
+
+	if rc.raw != nil {
+		data, _ := json.Marshal(rawOutput{Result: result, Error: errText})
+		sealed, err := rc.raw.seal(data)
+		if err != nil {
+			log.Printf("Failed to encrypt raw output of command %s: %v", commandID, err)
+			return
+		}
+		update["raw_output"] = sealed
+	}
+}
+
+// uniqueStrings drops repeated entries of a sorted list
+func uniqueStrings(list []string) []string {
+	out := list[:0]
+	for i, s := range list {
+		if i == 0 || s != list[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// handleRawOutput returns the output of a command as the agent sent it,
+// before redaction. Only admins may read it, and every read is audited.
+func (s *Server) handleRawOutput(c *gin.Context) {
+	rc := s.cfg.Redaction
+	if rc == nil || rc.raw == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Raw output is not kept"})
+		return
+	}
+
+	var rows []struct {
+		RawOutput string `json:"raw_output"`
+	}
+	resp, err := s.db.From("commands").Select("raw_output", false, "", "", "").
+		Eq("id", c.Param("command_id")).
+		Eq("client_id", c.Param("client_id")).
+		Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &rows)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	}
+	if rows[0].RawOutput == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No raw output: nothing was redacted, or it was pruned"})
+		return
+	}
+
+	data, err := rc.raw.open(rows[0].RawOutput)
+	if err != nil {
+		log.Printf("Failed to decrypt raw output of command %s: %v", c.Param("command_id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt raw output"})
+		return
+	}
+	var raw rawOutput
+	if err := json.Unmarshal(data, &raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt raw output"})
+		return
+	}
+
+	s.audit(AuditEvent{Type: auditRawOutputRead, Actor: operatorName(c), ClientID: c.Param("client_id"),
+		IP: c.ClientIP(), Detail: c.Param("command_id")})
+	c.JSON(http.StatusOK, raw)
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retentionBatchSize is how many commands are archived per archive file
+const retentionBatchSize = 500
+
+// exportPageSize is how many commands an export reads at a time
+const exportPageSize = 1000
+
+// finishedStatuses are the statuses a command never leaves. Only finished
+// commands are pruned.
+var finishedStatuses = []string{statusCompleted, statusFailed, statusLimited, statusCancelled, statusRejected, statusExpired}
+
+// exportColumns are the CSV columns of an export, in order
+var exportColumns = []string{"id", "client_id", "job_id", "batch", "command", "task", "operator", "status",
+	"exit_code", "error", "limit_exceeded", "created_at", "completed_at", "pruned_at", "archive", "redactions", "secrets", "result"}
+
+// retentionStore is what retention reads and changes in the store. It is
+// the database unless a test says otherwise.
+type retentionStore interface {
+	// expired returns up to limit finished commands not pruned yet that
+	// were created before cutoff, oldest first
+	expired(cutoff time.Time, limit int) ([]Command, error)
+	// clientIDs returns the IDs of all clients
+	clientIDs() ([]string, error)
+	// newest returns up to limit finished commands of a client not pruned
+	// yet, newest first, after skipping the newest skip
+	newest(clientID string, skip, limit int) ([]Command, error)
+	// prune drops the output of commands and records the archive holding it
+	prune(ids []string, archive string, now time.Time) error
+}
+
+// dbRetentionStore is the retentionStore of the database
+type dbRetentionStore struct {
+	s *Server
+}
+
+func (st dbRetentionStore) expired(cutoff time.Time, limit int) ([]Command, error) {
+	var commands []Command
+	resp, err := st.s.db.From("commands").Select("*", false, "", "", "").
+		In("status", finishedStatuses).
+		Is("pruned_at", "null").
+		Lt("created_at", cutoff.Format(time.RFC3339)).
+		Order("created_at", true).
+		Limit(limit).
+		Execute()
+	if err == nil {
+		err = st.s.db.ParseJSON(resp.Body, &commands)
+	}
+	return commands, err
+}
+
+func (st dbRetentionStore) clientIDs() ([]string, error) {
+	var clients []ClientInfo
+	resp, err := st.s.db.From("clients").Select("id", false, "", "", "").Execute()
+	if err == nil {
+		err = st.s.db.ParseJSON(resp.Body, &clients)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(clients))
+	for i, cl := range clients {
+		ids[i] = cl.ID
+	}
+	return ids, nil
+}
+
+func (st dbRetentionStore) newest(clientID string, skip, limit int) ([]Command, error) {
+	var commands []Command
+	resp, err := st.s.db.From("commands").Select("*", false, "", "", "").
+		Eq("client_id", clientID).
+		In("status", finishedStatuses).
+		Is("pruned_at", "null").
+		Order("created_at", false).
+		Range(skip, skip+limit-1).
+		Execute()
+	if err == nil {
+		err = st.s.db.ParseJSON(resp.Body, &commands)
+	}
+	return commands, err
+}
+
+func (st dbRetentionStore) prune(ids []string, archive string, now time.Time) error {
+	resp, err := st.s.db.From("commands").Update(map[string]interface{}{
+		"result":     nil,
+		"raw_output": nil,
+		"pruned_at":  now,
+		"archive":    archive,
+	}, "", "").In("id", ids).Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	return err
+}
+
+// runRetention prunes the output of old commands until the server stops
+func (s *Server) runRetention() {
+	cfg := s.cfg.Retention
+	if !cfg.Enabled() {
+		return
+	}
+	log.Printf("Command retention: max age %s, keep %d per client, archiving to %s", cfg.MaxAge, cfg.KeepPerClient, cfg.ArchiveDir)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if s.leads() {
+			s.applyRetention(time.Now())
+		}
+		<-ticker.C
+	}
+}
+
+// applyRetention archives and prunes the commands the retention policy no
+// longer keeps
+func (s *Server) applyRetention(now time.Time) {
+	cfg := s.cfg.Retention
+	pruned := 0
+
+	if cfg.MaxAge > 0 {
+		for {
+			commands, err := s.retention.expired(now.Add(-cfg.MaxAge), retentionBatchSize)
+			if err != nil {
+				log.Printf("Failed to load commands past retention: %v", err)
+				break
+			}
+			if len(commands) == 0 {
+				break
+			}
+			if err := s.pruneCommands(commands, now); err != nil {
+				log.Printf("Failed to prune commands: %v", err)
+				break
+			}
+			pruned += len(commands)
+			if len(commands) < retentionBatchSize {
+				break
+			}
+		}
+	}
+
+	if cfg.KeepPerClient > 0 {
+		n, err := s.pruneBeyondCount(cfg.KeepPerClient, now)
+		if err != nil {
+			log.Printf("Failed to prune commands beyond the per-client count: %v", err)
+		}
+		pruned += n
+	}
+
+	if pruned > 0 {
+		log.Printf("Retention pruned the output of %d command(s)", pruned)
+		s.audit(AuditEvent{Type: auditCommandsPruned, Actor: "retention", Detail: fmt.Sprintf("%d commands archived to %s", pruned, cfg.ArchiveDir)})
+	}
+}
+
+// pruneBeyondCount prunes the finished commands of each client beyond the
+// newest keep. Pruning always takes the oldest commands first, so the ones
+// not pruned yet are the newest and the offset can skip pruned ones.
+func (s *Server) pruneBeyondCount(keep int, now time.Time) (int, error) {
+	clients, err := s.retention.clientIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, clientID := range clients {
+		for {
+			commands, err := s.retention.newest(clientID, keep, retentionBatchSize)
+			if err != nil {
+				return pruned, err
+			}
+			if len(commands) == 0 {
+				break
+			}
+			if err := s.pruneCommands(commands, now); err != nil {
+				return pruned, err
+			}
+			pruned += len(commands)
+			if len(commands) < retentionBatchSize {
+				break
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// pruneCommands writes the commands to a new archive file and then drops
+// their output from the store. Everything else about them is kept for the
+// audit trail, along with the name of the archive holding the output.
+func (s *Server) pruneCommands(commands []Command, now time.Time) error {
+	name, err := s.writeArchive(commands, now)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, len(commands))
+	for i, cmd := range commands {
+		ids[i] = cmd.ID
+	}
+	if err := s.retention.prune(ids, name, now); err != nil {
+		// The archive stays; pruning again writes the commands to a new one
+		return fmt.Errorf("archived to %s but failed to prune: %v", name, err)
+	}
+	return nil
+}
+
+// writeArchive stores commands as gzip-compressed JSON Lines in a new file
+// of the archive directory and returns its name. The file is complete on
+// disk before the name is returned. Encrypted fields are archived sealed as
+// they are stored, and still need the master key to be read.
+func (s *Server) writeArchive(commands []Command, now time.Time) (string, error) {
+	dir := s.cfg.Retention.ArchiveDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("commands-%s-%s.jsonl.gz", now.UTC().Format("20060102T150405Z"), commands[0].ID)
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, cmd := range commands {
+		if err = enc.Encode(cmd); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return name, nil
+}
+
+// handleExport streams commands as JSON Lines or CSV, oldest first. It takes
+// since and until (RFC 3339 or a duration before now), client, status
+// (comma-separated) and format (jsonl, the default, or csv). Pruned commands
+// are included without their output.
+func (s *Server) handleExport(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be jsonl or csv"})
+		return
+	}
+	q := &listQuery{columns: strings.Join(commandListSpec.fields, ","), sortField: "created_at", limit: exportPageSize, timeField: "created_at"}
+	var err error
+	if q.since, err = parseListTime(c.Query("since")); err == nil {
+		q.until, err = parseListTime(c.Query("until"))
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client := c.Query("client")
+	statuses := splitList(c.Query("status"))
+
+	// Headers go out with the first page, so a failing query can still be
+	// reported as an error
+	var w rowWriter
+	exported := 0
+	for {
+		f := s.db.From("commands").Select(q.columns, false, "", "", "")
+		if client != "" {
+			f = f.Eq("client_id", client)
+		}
+		if statuses != nil {
+			f = f.In("status", statuses)
+		}
+		var rows []map[string]interface{}
+		resp, err := q.page(f).Execute()
+		if err == nil {
+			err = s.db.ParseJSON(resp.Body, &rows)
+		}
+		if err != nil {
+			if w == nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+			} else {
+				// Too late for a status; the truncated export is logged
+				log.Printf("Export failed after %d command(s): %v", exported, err)
+			}
+			return
+		}
+
+		if w == nil {
+			w = newRowWriter(c, format)
+		}
+		rows, next := q.next(rows)
+		s.openCommandRows(rows)
+		for _, row := range rows {
+			if err := w.write(row); err != nil {
+				log.Printf("Export aborted after %d command(s): %v", exported, err)
+				return
+			}
+			exported++
+		}
+		if next == nil {
+			break
+		}
+		q.cursor = next
+	}
+	if err := w.close(); err != nil {
+		log.Printf("Export aborted after %d command(s): %v", exported, err)
+	}
+	s.audit(AuditEvent{Type: auditCommandsExported, Actor: operatorName(c), IP: c.ClientIP(),
+		Detail: fmt.Sprintf("%d commands as %s, %s", exported, format, c.Request.URL.RawQuery)})
+}
+
+// rowWriter writes exported rows in one format
+type rowWriter interface {
+	write(row map[string]interface{}) error
+	close() error
+}
+
+func newRowWriter(c *gin.Context, format string) rowWriter {
+	name := "commands-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		w := &csvRowWriter{w: csv.NewWriter(c.Writer)}
+		w.w.Write(exportColumns)
+		return w
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	return &jsonlRowWriter{enc: json.NewEncoder(c.Writer)}
+}
+
+type jsonlRowWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlRowWriter) write(row map[string]interface{}) error { return w.enc.Encode(row) }
+func (w *jsonlRowWriter) close() error                           { return nil }
+
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvRowWriter) write(row map[string]interface{}) error {
+	record := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		record[i] = csvValue(row[col])
+	}
+	return w.w.Write(record)
+}
+
+func (w *csvRowWriter) close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// csvValue renders a JSON value as a CSV field. Text that a spreadsheet
+// would read as a formula gets a leading quote, so opening an export cannot
+// run what an agent or operator wrote.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
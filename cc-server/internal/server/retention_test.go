@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// memRetentionStore keeps commands in memory the way the database does for
+// retention
+type memRetentionStore struct {
+	mu       sync.Mutex
+	commands []Command
+	pruneErr error
+}
+
+// unpruned returns the finished commands not pruned yet that keep says
+// to, oldest first
+func (st *memRetentionStore) unpruned(keep func(Command) bool) []Command {
+	var list []Command
+	for _, cmd := range st.commands {
+		if contains(finishedStatuses, cmd.Status) && cmd.PrunedAt == nil && keep(cmd) {
+			list = append(list, cmd)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (st *memRetentionStore) expired(cutoff time.Time, limit int) ([]Command, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	list := st.unpruned(func(cmd Command) bool { return cmd.CreatedAt.Before(cutoff) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (st *memRetentionStore) clientIDs() ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	seen := map[string]bool{}
+	var ids []string
+	for _, cmd := range st.commands {
+		if !seen[cmd.ClientID] {
+			seen[cmd.ClientID] = true
+			ids = append(ids, cmd.ClientID)
+		}
+	}
+	return ids, nil
+}
+
+func (st *memRetentionStore) newest(clientID string, skip, limit int) ([]Command, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	list := st.unpruned(func(cmd Command) bool { return cmd.ClientID == clientID })
+	var page []Command
+	for i := len(list) - 1 - skip; i >= 0 && len(page) < limit; i-- {
+		page = append(page, list[i])
+	}
+	return page, nil
+}
+
+func (st *memRetentionStore) prune(ids []string, archive string, now time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pruneErr != nil {
+		return st.pruneErr
+	}
+	for i := range st.commands {
+		if contains(ids, st.commands[i].ID) {
+			st.commands[i].Result = ""
+			st.commands[i].PrunedAt = &now
+			st.commands[i].Archive = archive
+		}
+	}
+	return nil
+}
+
+// pruned returns the IDs of the pruned commands, sorted
+func (st *memRetentionStore) pruned() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var ids []string
+	for _, cmd := range st.commands {
+		if cmd.PrunedAt != nil {
+			ids = append(ids, cmd.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newRetentionServer(t *testing.T, cfg RetentionConfig, commands []Command) (*Server, *memRetentionStore) {
+	t.Helper()
+	cfg.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+	st := &memRetentionStore{commands: commands}
+	s := &Server{cfg: Config{Retention: cfg}, retention: st}
+	s.auditor = &auditor{s: s, events: make(chan AuditEvent, 16)}
+	return s, st
+}
+
+// readArchive returns the commands in an archive file
+func readArchive(t *testing.T, path string) []Command {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []Command
+	for dec := json.NewDecoder(zr); dec.More(); {
+		var cmd Command
+		if err := dec.Decode(&cmd); err != nil {
+			t.Fatalf("archive %s: %v", path, err)
+		}
+		commands = append(commands, cmd)
+	}
+	return commands
+}
+
+// ageCommand is a finished command of a client created age ago
+func ageCommand(id, clientID string, now time.Time, age time.Duration) Command {
+	return Command{ID: id, ClientID: clientID, Command: "uptime", Status: statusCompleted, Result: "output of " + id, CreatedAt: now.Add(-age)}
+}
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	commands := []Command{
+		ageCommand("a_1", "client_a", now, 1*day),
+		ageCommand("a_2", "client_a", now, 2*day),
+		ageCommand("a_3", "client_a", now, 3*day-time.Hour),
+		ageCommand("a_4", "client_a", now, 4*day),
+		ageCommand("a_5", "client_a", now, 5*day),
+		ageCommand("b_1", "client_b", now, 1*day),
+		ageCommand("b_2", "client_b", now, 2*day),
+	}
+	// Commands that may still change are never pruned
+	running := ageCommand("a_old_running", "client_a", now, 10*day)
+	running.Status = statusDelivered
+	commands = append(commands, running)
+
+	s, st := newRetentionServer(t, RetentionConfig{MaxAge: 3 * day, KeepPerClient: 2}, commands)
+	s.applyRetention(now)
+
+	// a_4 and a_5 are too old, a_3 is beyond the newest two of client_a
+	if got := fmt.Sprint(st.pruned()); got != "[a_3 a_4 a_5]" {
+		t.Fatalf("pruned %s", got)
+	}
+	archived := map[string]Command{}
+	for _, cmd := range st.commands {
+		if cmd.PrunedAt == nil {
+			if cmd.Archive != "" || cmd.Result == "" && cmd.Status == statusCompleted {
+				t.Fatalf("kept command %s changed: %+v", cmd.ID, cmd)
+			}
+			continue
+		}
+		if cmd.Result != "" || !cmd.PrunedAt.Equal(now) {
+			t.Fatalf("pruned command %s: %+v", cmd.ID, cmd)
+		}
+		for _, a := range readArchive(t, filepath.Join(s.cfg.Retention.ArchiveDir, cmd.Archive)) {
+			archived[a.ID] = a
+		}
+	}
+	for _, id := range []string{"a_3", "a_4", "a_5"} {
+		if archived[id].Result != "output of "+id {
+			t.Fatalf("archive holds %+v for %s", archived[id], id)
+		}
+	}
+
+	select {
+	case ev := <-s.auditor.events:
+		if ev.Type != auditCommandsPruned || !strings.HasPrefix(ev.Detail, "3 commands") {
+			t.Fatalf("audit event %+v", ev)
+		}
+	default:
+		t.Fatal("pruning was not audited")
+	}
+
+	// Applying it again finds nothing more to do
+	s.applyRetention(now)
+	if got := fmt.Sprint(st.pruned()); got != "[a_3 a_4 a_5]" {
+		t.Fatalf("second run pruned %s", got)
+	}
+	if len(s.auditor.events) != 0 {
+		t.Fatal("a run that pruned nothing was audited")
+	}
+}
+
+func TestPruneBeyondCountInBatches(t *testing.T) {
+	now := time.Now()
+	var commands []Command
+	for i := 0; i < retentionBatchSize+5; i++ {
+		commands = append(commands, ageCommand(fmt.Sprintf("cmd_%04d", i), "client_a", now, time.Duration(i)*time.Minute))
+	}
+	s, st := newRetentionServer(t, RetentionConfig{}, commands)
+
+	n, err := s.pruneBeyondCount(3, now)
+	if err != nil || n != retentionBatchSize+2 {
+		t.Fatalf("pruned %d, %v; want %d", n, err, retentionBatchSize+2)
+	}
+	for _, cmd := range st.commands[:3] {
+		if cmd.PrunedAt != nil {
+			t.Fatalf("one of the newest three, %s, was pruned", cmd.ID)
+		}
+	}
+	files, _ := os.ReadDir(s.cfg.Retention.ArchiveDir)
+	if len(files) != 2 {
+		t.Fatalf("%d archive files for two batches", len(files))
+	}
+}
+
+func TestPruneKeepsArchiveWhenStoreFails(t *testing.T) {
+	now := time.Now()
+	s, st := newRetentionServer(t, RetentionConfig{}, []Command{ageCommand("cmd_1", "client_a", now, time.Hour)})
+	st.pruneErr = errors.New("store unavailable")
+
+	if err := s.pruneCommands(st.commands, now); err == nil || !strings.Contains(err.Error(), "failed to prune") {
+		t.Fatalf("pruneCommands = %v", err)
+	}
+	files, _ := os.ReadDir(s.cfg.Retention.ArchiveDir)
+	if len(files) != 1 {
+		t.Fatalf("%d archive files after a failed prune, want the one written", len(files))
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	exit := 2
+	commands := []Command{
+		{ID: "cmd_1", ClientID: "client_a", Command: "ls /", Status: statusCompleted, Result: "bin\netc\n", CreatedAt: now.Add(-time.Hour)},
+		{ID: "cmd_2", ClientID: "client_a", Command: "false", Status: statusFailed, ExitCode: &exit, Error: "exit status 2", CreatedAt: now},
+	}
+	s, _ := newRetentionServer(t, RetentionConfig{}, nil)
+
+	name, err := s.writeArchive(commands, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "commands-20240601T120000Z-cmd_1.jsonl.gz" {
+		t.Fatalf("archive named %q", name)
+	}
+	path := filepath.Join(s.cfg.Retention.ArchiveDir, name)
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("archive file: %v, %v", info, err)
+	}
+	got := readArchive(t, path)
+	if len(got) != 2 || got[0].Result != commands[0].Result || got[1].Error != commands[1].Error ||
+		got[1].ExitCode == nil || *got[1].ExitCode != 2 || !got[0].CreatedAt.Equal(commands[0].CreatedAt) {
+		t.Fatalf("archive holds %+v", got)
+	}
+
+	// An archive is never overwritten
+	if _, err := s.writeArchive(commands, now); err == nil {
+		t.Fatal("second archive of the same name written")
+	}
+	if again := readArchive(t, path); len(again) != 2 {
+		t.Fatal("existing archive damaged")
+	}
+
+	// Encrypted fields are archived as stored
+	s.cfg.Encryption = testKeyring(t)
+	sealed, err := s.sealCommand(commands[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err = s.writeArchive([]Command{sealed}, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readArchive(t, filepath.Join(s.cfg.Retention.ArchiveDir, name))
+	if len(got) != 1 || got[0].Result != sealed.Result || got[0].Command != sealed.Command {
+		t.Fatalf("sealed archive holds %+v", got)
+	}
+	if err := s.openCommand(&got[0]); err != nil || got[0].Result != commands[0].Result {
+		t.Fatalf("archived command opens as %+v, %v", got[0], err)
+	}
+}
+
+// exportRows writes rows with the writer of format and returns the body
+func exportRows(t *testing.T, format string, rows ...map[string]interface{}) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	w := newRowWriter(c, format)
+	for _, row := range rows {
+		if err := w.write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "."+format+`"`) {
+		t.Fatalf("Content-Disposition = %q", cd)
+	}
+	return rec.Body.String()
+}
+
+func TestExportWriters(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"id": "cmd_1", "client_id": "client_a", "batch": float64(2), "exit_code": float64(-1), "limit_exceeded": true,
+			"redactions": map[string]interface{}{"password": float64(1)}, "command": "echo \"a, b\"\nls", "unknown": "dropped"},
+		{"id": "cmd_2", "command": "=HYPERLINK(\"http://evil\")", "operator": "@admin", "error": "-exit", "result": "+1",
+			"task": "\tcmd", "status": "completed"},
+	}
+
+	body := exportRows(t, "csv", rows...)
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("csv: %v\n%s", err, body)
+	}
+	if len(records) != 3 || fmt.Sprint(records[0]) != fmt.Sprint(exportColumns) {
+		t.Fatalf("csv records %q", records)
+	}
+	cell := func(record []string, col string) string {
+		for i, c := range exportColumns {
+			if c == col {
+				return record[i]
+			}
+		}
+		t.Fatalf("no column %s", col)
+		return ""
+	}
+	for col, want := range map[string]string{
+		"id": "cmd_1", "batch": "2", "exit_code": "-1", "limit_exceeded": "true", "redactions": `{"password":1}`,
+		"command": "echo \"a, b\"\nls", "job_id": "",
+	} {
+		if got := cell(records[1], col); got != want {
+			t.Errorf("csv %s = %q, want %q", col, got, want)
+		}
+	}
+	// Text a spreadsheet would run is quoted
+	for col, want := range map[string]string{
+		"command": `'=HYPERLINK("http://evil")`, "operator": "'@admin", "error": "'-exit", "result": "'+1", "task": "'\tcmd",
+		"status": "completed",
+	} {
+		if got := cell(records[2], col); got != want {
+			t.Errorf("csv %s = %q, want %q", col, got, want)
+		}
+	}
+
+	// JSON Lines keep the rows as they are, one per line
+	body = exportRows(t, "jsonl", rows...)
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for i := 0; scanner.Scan(); i++ {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil || row["id"] != rows[i]["id"] || row["command"] != rows[i]["command"] {
+			t.Fatalf("jsonl line %d: %s", i+1, scanner.Text())
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supabase/postgrest-go"
+)
+
+// Job statuses
+const (
+	jobAwaitingApproval = "awaiting_approval" // waiting for a second operator
+	jobRunning          = "running"           // releasing batches as earlier ones finish
+	jobPaused           = "paused"            // an operator stopped releasing batches
+	jobCompleted        = "completed"         // every batch finished
+	jobFailed           = "failed"            // stopped by a failure threshold
+	jobAborted          = "aborted"           // stopped by an operator
+	jobRejected         = "rejected"          // a second operator refused it
+	jobExpired          = "expired"           // nobody approved it in time
+)
+
+// jobTickInterval is how often running jobs are checked for finished batches
+const jobTickInterval = 2 * time.Second
+
+// Rollout spreads a job over batches. The first Canary agents form their own
+// batch; the rest are split into batches of BatchSize agents or BatchPercent
+// percent of all targets. A batch is only released once every command of the
+// previous one has finished, or BatchTimeout after it was released.
+type Rollout struct {
+	Canary       int `json:"canary,omitempty"`
+	BatchSize    int `json:"batch_size,omitempty"`
+	BatchPercent int `json:"batch_percent,omitempty"`
+
+	// The job stops once FailureThreshold commands failed, or once failed
+	// commands make up FailurePercent percent of the finished ones. Zero
+	// disables a check. A failed canary always stops the job.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	FailurePercent   int `json:"failure_percent,omitempty"`
+
+	// BatchTimeout is a duration such as "30m". Commands of a batch still
+	// unfinished that long after its release are failed, so offline agents
+	// cannot hold up the job. Empty waits for them.
+	BatchTimeout string `json:"batch_timeout,omitempty"`
+}
+
+// validate checks that the rollout settings make sense
+func (r *Rollout) validate() error {
+	switch {
+	case r.Canary < 0, r.BatchSize < 0, r.FailureThreshold < 0:
+		return fmt.Errorf("rollout counts must not be negative")
+	case r.BatchPercent < 0 || r.BatchPercent > 100, r.FailurePercent < 0 || r.FailurePercent > 100:
+		return fmt.Errorf("rollout percentages must be between 0 and 100")
+	case r.BatchSize > 0 && r.BatchPercent > 0:
+		return fmt.Errorf("batch_size and batch_percent are mutually exclusive")
+	}
+	if r.BatchTimeout != "" {
+		if d, err := time.ParseDuration(r.BatchTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("batch_timeout must be a positive duration such as 30m")
+		}
+	}
+	return nil
+}
+
+// batchTimeout returns how long a batch may run, or zero for no limit
+func (r *Rollout) batchTimeout() time.Duration {
+	if r == nil || r.BatchTimeout == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(r.BatchTimeout)
+	return d
+}
+
+// plan assigns each of n targets a batch number, starting at 1, and returns
+// the assignment with the number of batches. Without a rollout every target
+// is in batch 1.
+func (r *Rollout) plan(n int) ([]int, int) {
+	batches := make([]int, n)
+	if r == nil {
+		for i := range batches {
+			batches[i] = 1
+		}
+		return batches, 1
+	}
+
+	size := n
+	switch {
+	case r.BatchSize > 0:
+		size = r.BatchSize
+	case r.BatchPercent > 0:
+		size = (n*r.BatchPercent + 99) / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	batch, inBatch := 1, 0
+	for i := range batches {
+		limit := size
+		if batch == 1 && r.Canary > 0 {
+			limit = r.Canary
+		}
+		if inBatch == limit {
+			batch++
+			inBatch = 0
+		}
+		batches[i] = batch
+		inBatch++
+	}
+	if n == 0 {
+		return batches, 0
+	}
+	return batches, batch
+}
+
+// BatchProgress counts the commands of one batch by state
+type BatchProgress struct {
+	Batch     int  `json:"batch"`
+	Canary    bool `json:"canary,omitempty"`
+	Total     int  `json:"total"`
+	Held      int  `json:"held"`   // waiting for the batch to be released
+	Active    int  `json:"active"` // released but not finished
+	Completed int  `json:"completed"`
+	Failed    int  `json:"failed"`
+	Cancelled int  `json:"cancelled"`
+}
+
+// finished reports whether no command of the batch can still change
+func (b BatchProgress) finished() bool {
+	return b.Held == 0 && b.Active == 0
+}
+
+// jobProgress summarizes the commands of a job per batch
+func jobProgress(job Job, commands []Command) []BatchProgress {
+	progress := make([]BatchProgress, job.Batches)
+	for i := range progress {
+		progress[i].Batch = i + 1
+	}
+	if job.Rollout != nil && job.Rollout.Canary > 0 && len(progress) > 0 {
+		progress[0].Canary = true
+	}
+
+	for _, cmd := range commands {
+		if cmd.Batch < 1 || cmd.Batch > len(progress) {
+			continue
+		}
+		b := &progress[cmd.Batch-1]
+		b.Total++
+		switch cmd.Status {
+		case statusHeld:
+			b.Held++
+		case statusCompleted:
+			b.Completed++
+		case statusFailed, statusLimited, statusUndelivered:
+			b.Failed++
+		case statusCancelled, statusRejected, statusExpired:
+			// Final without having run
+			b.Cancelled++
+		default:
+			b.Active++
+		}
+	}
+	return progress
+}
+
+// thresholdExceeded returns why a job must stop, or "" if it may go on
+func (r *Rollout) thresholdExceeded(progress []BatchProgress) string {
+	if r == nil {
+		return ""
+	}
+
+	failed, finished := 0, 0
+	for _, b := range progress {
+		if b.Canary && b.Failed > 0 {
+			return fmt.Sprintf("%d canary command(s) failed", b.Failed)
+		}
+		failed += b.Failed
+		finished += b.Completed + b.Failed
+	}
+	if r.FailureThreshold > 0 && failed >= r.FailureThreshold {
+		return fmt.Sprintf("%d command(s) failed, threshold is %d", failed, r.FailureThreshold)
+	}
+	if r.FailurePercent > 0 && finished > 0 && failed*100 >= r.FailurePercent*finished {
+		return fmt.Sprintf("%d of %d finished command(s) failed, threshold is %d%%", failed, finished, r.FailurePercent)
+	}
+	return ""
+}
+
+// batchOverdue reports whether the current batch of a job has run longer than
+// its rollout allows
+func (j Job) batchOverdue(now time.Time) bool {
+	timeout := j.Rollout.batchTimeout()
+	return timeout > 0 && j.BatchStartedAt != nil && now.Sub(*j.BatchStartedAt) >= timeout
+}
+
+// runJobs advances running jobs until the server stops
+func (s *Server) runJobs() {
+	ticker := time.NewTicker(jobTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.leads() {
+			continue
+		}
+		var jobs []Job
+		resp, err := s.db.From("jobs").Select("*", false, "", "", "").Eq("status", jobRunning).Execute()
+		if err != nil {
+			log.Printf("Failed to load running jobs: %v", err)
+			continue
+		}
+		if err := s.db.ParseJSON(resp.Body, &jobs); err != nil {
+			log.Printf("Failed to parse running jobs: %v", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			s.jobMu.Lock()
+			s.advanceJob(job)
+			s.jobMu.Unlock()
+		}
+	}
+}
+
+// advanceJob stops a job that passed a failure threshold, releases its next
+// batch once the current one has finished, and completes it after the last.
+// The caller holds jobMu.
+func (s *Server) advanceJob(job Job) {
+	commands, err := s.jobCommands(job.ID)
+	if err != nil {
+		log.Printf("Failed to load commands of job %s: %v", job.ID, err)
+		return
+	}
+	progress := jobProgress(job, commands)
+
+	if reason := job.Rollout.thresholdExceeded(progress); reason != "" {
+		log.Printf("Job %s stopped: %s", job.ID, reason)
+		s.stopJob(job.ID, jobFailed, reason)
+		return
+	}
+
+	if job.CurrentBatch < 1 || job.CurrentBatch > len(progress) {
+		return
+	}
+	if !progress[job.CurrentBatch-1].finished() {
+		// Failed commands count against the thresholds on the next tick
+		if job.batchOverdue(time.Now()) {
+			s.timeOutBatch(job)
+		}
+		return
+	}
+	if job.CurrentBatch == job.Batches {
+		log.Printf("Job %s completed", job.ID)
+		s.updateJob(job.ID, map[string]interface{}{"status": jobCompleted, "finished_at": time.Now()})
+		return
+	}
+
+	// Moving current_batch on claims the release, so a node that loaded the
+	// job before it moved does not release the batch again
+	next := job.CurrentBatch + 1
+	resp, err := s.db.From("jobs").Update(map[string]interface{}{"current_batch": next, "batch_started_at": time.Now()}, "representation", "").
+		Eq("id", job.ID).
+		Eq("status", jobRunning).
+		Eq("current_batch", job.CurrentBatch).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to update job %s: %v", job.ID, err)
+		return
+	}
+	var moved []Job
+	if err := s.db.ParseJSON(resp.Body, &moved); err != nil || len(moved) == 0 {
+		return
+	}
+	log.Printf("Job %s: releasing batch %d of %d", job.ID, next, job.Batches)
+	s.releaseBatch(job.ID, next, commands)
+}
+
+// timeOutBatch fails the commands of the current batch of a job that are
+// still unfinished, and asks the agents running any of them to kill them.
+// Their results no longer change the stored status.
+func (s *Server) timeOutBatch(job Job) {
+	reason := fmt.Sprintf("batch %d did not finish within %s", job.CurrentBatch, job.Rollout.BatchTimeout)
+	failed := 0
+	for _, statuses := range [][]string{{statusPending, statusUndelivered}, sentStatuses} {
+		timedOut, err := s.finishCommands(statusFailed, reason, func(q *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+			return q.Eq("job_id", job.ID).Eq("batch", job.CurrentBatch).In("status", statuses)
+		})
+		if err != nil {
+			log.Printf("Failed to time out batch %d of job %s: %v", job.CurrentBatch, job.ID, err)
+			return
+		}
+		for _, cmd := range timedOut {
+			s.deliveries.ack(cmd.ID)
+			if contains(sentStatuses, statuses[0]) {
+				s.sendCancel(cmd.ClientID, cmd.ID)
+			}
+		}
+		failed += len(timedOut)
+	}
+	if failed > 0 {
+		log.Printf("Job %s: %s, %d command(s) failed", job.ID, reason, failed)
+	}
+}
+
+// releaseBatch makes the held commands of a batch pending and delivers them
+func (s *Server) releaseBatch(jobID string, batch int, commands []Command) {
+	resp, err := s.db.From("commands").Update(map[string]interface{}{"status": statusPending}, "representation", "").
+		Eq("job_id", jobID).
+		Eq("batch", batch).
+		Eq("status", statusHeld).
+		Execute()
+	if err != nil {
+		log.Printf("Failed to release batch %d of job %s: %v", batch, jobID, err)
+		return
+	}
+	s.publishUpdatedCommands(resp.Body)
+
+	for _, cmd := range commands {
+		if cmd.Batch == batch && cmd.Status == statusHeld {
+			cmd.Status = statusPending
+			s.deliver(cmd)
+		}
+	}
+}
+
+// stopJob ends a job and cancels its commands that were not sent yet.
+// Commands already on their way to an agent are not recalled.
+func (s *Server) stopJob(jobID, status, reason string) {
+	s.updateJob(jobID, map[string]interface{}{
+		"status":      status,
+		"stop_reason": reason,
+		"finished_at": time.Now(),
+	})
+
+	_, err := s.finishCommands(statusCancelled, "job "+status+": "+reason, func(q *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+		return q.Eq("job_id", jobID).In("status", []string{statusHeld, statusPending})
+	})
+	if err != nil {
+		log.Printf("Failed to cancel commands of job %s: %v", jobID, err)
+	}
+}
+
+// finishCommands ends the commands filter matches with status and reason
+// and publishes them. A sealed reason is bound to its command, so with
+// encryption on it is written to each command after the status changed.
+func (s *Server) finishCommands(status, reason string, filter func(*postgrest.FilterBuilder) *postgrest.FilterBuilder) ([]Command, error) {
+	update := map[string]interface{}{
+		"status":       status,
+		"completed_at": time.Now(),
+	}
+	if s.cfg.Encryption == nil {
+		update["error"] = reason
+	}
+	resp, err := filter(s.db.From("commands").Update(update, "representation", "")).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var finished []Command
+	if err := s.db.ParseJSON(resp.Body, &finished); err != nil {
+		return nil, err
+	}
+	if s.cfg.Encryption == nil {
+		s.publishUpdatedCommands(resp.Body)
+		return finished, nil
+	}
+
+	for _, cmd := range finished {
+		update := map[string]interface{}{"error": reason}
+		if err := s.sealUpdate(cmd.ID, update); err != nil {
+			log.Printf("Failed to encrypt error of command %s: %v", cmd.ID, err)
+			continue
+		}
+		_, err := s.db.From("commands").Update(update, "", "").Eq("id", cmd.ID).Eq("status", status).Execute()
+		if err != nil {
+			log.Printf("Failed to store error of command %s: %v", cmd.ID, err)
+			continue
+		}
+		if err := s.openCommand(&cmd); err != nil {
+			log.Printf("Failed to decrypt updated %v", err)
+			continue
+		}
+		cmd.Error = reason
+		s.publishCommand(cmd)
+	}
+	return finished, nil
+}
+
+// updateJob changes fields of a job and announces status changes
+func (s *Server) updateJob(jobID string, update map[string]interface{}) {
+	_, err := s.db.From("jobs").Update(update, "", "").Eq("id", jobID).Execute()
+	if err != nil {
+		log.Printf("Failed to update job %s: %v", jobID, err)
+		return
+	}
+	if status, ok := update["status"]; ok {
+		data := map[string]interface{}{"status": status}
+		if reason, ok := update["stop_reason"]; ok {
+			data["reason"] = reason
+		}
+		s.live.publish(liveEvent{Type: eventJobStatus, JobID: jobID, Data: eventData(data)})
+	}
+}
+
+// handleJobAction lets an operator pause, resume or abort a job
+func (s *Server) handleJobAction(c *gin.Context) {
+	jobID := c.Param("job_id")
+	action := c.Param("action")
+
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	job, err := s.loadJob(jobID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	var auditType string
+	switch {
+	case action == "pause" && job.Status == jobRunning:
+		s.updateJob(jobID, map[string]interface{}{"status": jobPaused})
+		job.Status = jobPaused
+		auditType = auditJobPaused
+	case action == "resume" && job.Status == jobPaused:
+		s.updateJob(jobID, map[string]interface{}{"status": jobRunning})
+		job.Status = jobRunning
+		auditType = auditJobResumed
+	case action == "abort" && (job.Status == jobRunning || job.Status == jobPaused):
+		reason := "aborted by " + operatorName(c)
+		s.stopJob(jobID, jobAborted, reason)
+		job.Status = jobAborted
+		job.StopReason = reason
+		auditType = auditJobAborted
+	case action != "pause" && action != "resume" && action != "abort":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown job action"})
+		return
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot %s a job that is %s", action, job.Status)})
+		return
+	}
+
+	log.Printf("Job %s %s by %s", jobID, job.Status, operatorName(c))
+	s.audit(AuditEvent{Type: auditType, Actor: operatorName(c), Detail: jobID})
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRolloutPlan(t *testing.T) {
+	for _, tc := range []struct {
+		rollout *Rollout
+		n       int
+		want    string
+		batches int
+	}{
+		{nil, 3, "[1 1 1]", 1},
+		{&Rollout{}, 3, "[1 1 1]", 1},
+		{&Rollout{BatchSize: 2}, 5, "[1 1 2 2 3]", 3},
+		{&Rollout{Canary: 1, BatchSize: 2}, 5, "[1 2 2 3 3]", 3},
+		{&Rollout{Canary: 2}, 5, "[1 1 2 2 2]", 2},
+		// 25% of 10 rounds up to 3
+		{&Rollout{BatchPercent: 25}, 10, "[1 1 1 2 2 2 3 3 3 4]", 4},
+		{&Rollout{BatchPercent: 1}, 3, "[1 2 3]", 3},
+		{&Rollout{Canary: 5, BatchSize: 2}, 3, "[1 1 1]", 1},
+		{&Rollout{BatchSize: 2}, 0, "[]", 0},
+	} {
+		got, batches := tc.rollout.plan(tc.n)
+		if fmt.Sprint(got) != tc.want || batches != tc.batches {
+			t.Errorf("plan(%d) with %+v = %v, %d batches; want %s, %d", tc.n, tc.rollout, got, batches, tc.want, tc.batches)
+		}
+	}
+}
+
+func TestRolloutValidate(t *testing.T) {
+	for _, r := range []Rollout{
+		{Canary: -1},
+		{BatchPercent: 101},
+		{FailurePercent: -5},
+		{BatchSize: 2, BatchPercent: 50},
+		{BatchTimeout: "soon"},
+		{BatchTimeout: "-1m"},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("rollout %+v accepted", r)
+		}
+	}
+	r := Rollout{Canary: 1, BatchPercent: 50, FailurePercent: 10, BatchTimeout: "30m"}
+	if err := r.validate(); err != nil || r.batchTimeout() != 30*time.Minute {
+		t.Fatalf("rollout %+v: %v, timeout %v", r, err, r.batchTimeout())
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	job := Job{Batches: 3, Rollout: &Rollout{Canary: 1}}
+	statuses := [][]string{
+		{statusCompleted},
+		{statusFailed, statusLimited, statusUndelivered, statusCancelled, statusRejected, statusExpired},
+		{statusHeld, statusPending, statusDelivered, statusQueued, statusReceived},
+	}
+	var commands []Command
+	for batch, list := range statuses {
+		for _, status := range list {
+			commands = append(commands, Command{Batch: batch + 1, Status: status})
+		}
+	}
+	// Commands outside the job's batches are ignored
+	commands = append(commands, Command{Batch: 4, Status: statusPending}, Command{Status: statusPending})
+
+	progress := jobProgress(job, commands)
+	want := []BatchProgress{
+		{Batch: 1, Canary: true, Total: 1, Completed: 1},
+		{Batch: 2, Total: 6, Failed: 3, Cancelled: 3},
+		{Batch: 3, Total: 5, Held: 1, Active: 4},
+	}
+	if fmt.Sprint(progress) != fmt.Sprint(want) {
+		t.Fatalf("progress = %+v\nwant %+v", progress, want)
+	}
+	for i, finished := range []bool{true, true, false} {
+		if progress[i].finished() != finished {
+			t.Errorf("batch %d finished = %v", i+1, !finished)
+		}
+	}
+}
+
+func TestRolloutThresholdExceeded(t *testing.T) {
+	for _, tc := range []struct {
+		rollout  *Rollout
+		progress []BatchProgress
+		reason   string // substring, "" if the job goes on
+	}{
+		{nil, []BatchProgress{{Failed: 10}}, ""},
+		{&Rollout{}, []BatchProgress{{Failed: 10, Completed: 1}}, ""},
+		{&Rollout{Canary: 1}, []BatchProgress{{Canary: true, Failed: 1}}, "canary"},
+		{&Rollout{FailureThreshold: 3}, []BatchProgress{{Failed: 1}, {Failed: 1, Active: 4}}, ""},
+		{&Rollout{FailureThreshold: 3}, []BatchProgress{{Failed: 1}, {Failed: 2}}, "3 command(s) failed"},
+		{&Rollout{FailurePercent: 50}, []BatchProgress{{Completed: 3, Failed: 2, Active: 10}}, ""},
+		{&Rollout{FailurePercent: 50}, []BatchProgress{{Completed: 2, Failed: 2, Active: 10}}, "2 of 4"},
+		// Commands that never ran do not count as finished
+		{&Rollout{FailurePercent: 50}, []BatchProgress{{Completed: 1, Failed: 1, Cancelled: 5}}, "1 of 2"},
+		{&Rollout{FailurePercent: 50}, []BatchProgress{{Cancelled: 5, Held: 3}}, ""},
+	} {
+		got := tc.rollout.thresholdExceeded(tc.progress)
+		if (got == "") != (tc.reason == "") || !strings.Contains(got, tc.reason) {
+			t.Errorf("thresholdExceeded(%+v) with %+v = %q, want %q", tc.progress, tc.rollout, got, tc.reason)
+		}
+	}
+}
+
+func TestJobBatchOverdue(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-10 * time.Minute)
+	for _, tc := range []struct {
+		job     Job
+		overdue bool
+	}{
+		{Job{BatchStartedAt: &started}, false},
+		{Job{Rollout: &Rollout{}, BatchStartedAt: &started}, false},
+		{Job{Rollout: &Rollout{BatchTimeout: "15m"}, BatchStartedAt: &started}, false},
+		{Job{Rollout: &Rollout{BatchTimeout: "10m"}, BatchStartedAt: &started}, true},
+		{Job{Rollout: &Rollout{BatchTimeout: "5m"}, BatchStartedAt: &started}, true},
+		// Jobs stored before batches had a start time
+		{Job{Rollout: &Rollout{BatchTimeout: "5m"}}, false},
+	} {
+		if got := tc.job.batchOverdue(now); got != tc.overdue {
+			t.Errorf("batchOverdue with %+v = %v", tc.job.Rollout, got)
+		}
+	}
+}
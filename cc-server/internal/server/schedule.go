@@ -0,0 +1,582 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/cc-server/internal/protocol"
+)
+
+// What a scheduled run does with targets that are not connected
+const (
+	offlineQueue = "queue" // create their commands; they run on reconnect
+	offlineSkip  = "skip"  // leave them out of the run
+)
+
+// Schedule run statuses
+const (
+	runStarted = "started" // a job was created
+	runSkipped = "skipped" // no target was left to run on
+	runDenied  = "denied"  // the command policy refused the command
+	runFailed  = "failed"  // the job could not be created
+)
+
+// scheduleTickInterval is how often schedules are checked for due runs
+const scheduleTickInterval = 15 * time.Second
+
+// minScheduleInterval is the shortest interval a schedule may repeat at
+const minScheduleInterval = time.Minute
+
+// Schedule creates a job for the clients matching Selector whenever it is
+// due, either by a cron expression or every Interval. Runs missed while the
+// server was down are not caught up.
+type Schedule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Cron is a five-field cron expression evaluated in Timezone; Interval
+	// is a duration such as "1h". Exactly one must be set.
+	Cron     string `json:"cron,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timezone string `json:"timezone,omitempty"` // IANA zone name, defaults to UTC
+
+	// Jitter delays each run by a random duration up to this long, e.g.
+	// "5m", so schedules due at the same time do not all start at once
+	Jitter string `json:"jitter,omitempty"`
+
+	Selector    string   `json:"selector"`
+	Command     string   `json:"command"`
+	Task        string   `json:"task,omitempty"`
+	Concurrency string   `json:"concurrency,omitempty"`
+	Rollout     *Rollout `json:"rollout,omitempty"`
+
+	// Secrets are checked against Role on every run
+	Secrets []SecretRef `json:"secrets,omitempty"`
+
+	// Offline is queue (default) or skip
+	Offline string `json:"offline,omitempty"`
+	Enabled bool   `json:"enabled"`
+
+	// Operator created the schedule; deny rules are checked against Role
+	// on every run
+	Operator string `json:"operator,omitempty"`
+	Role     string `json:"role,omitempty"`
+
+	// NextDueAt is when the next run is due and NextRunAt when it starts,
+	// after jitter
+	NextDueAt *time.Time `json:"next_due_at,omitempty"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Runs are the most recent runs; they are not stored with the schedule
+	Runs []ScheduleRun `json:"runs,omitempty"`
+
+	cron     *cronSchedule
+	interval time.Duration
+	jitter   time.Duration
+	loc      *time.Location
+}
+
+// ScheduleRun records one time a schedule was due
+type ScheduleRun struct {
+	ID         string    `json:"id"`
+	ScheduleID string    `json:"schedule_id"`
+	DueAt      time.Time `json:"due_at"`
+	StartedAt  time.Time `json:"started_at"`
+	Status     string    `json:"status"` // started, skipped, denied, failed
+	JobID      string    `json:"job_id,omitempty"`
+	Targets    int       `json:"targets"`
+	Offline    int       `json:"offline"` // targets left out because they were not connected
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// compile checks the schedule and prepares it for use
+func (sch *Schedule) compile() error {
+	switch {
+	case sch.Name == "":
+		return errors.New("name is required")
+	case sch.Command == "":
+		return errors.New("command is required")
+	case sch.Selector == "":
+		return errors.New("selector is required")
+	case (sch.Cron == "") == (sch.Interval == ""):
+		return errors.New("exactly one of cron and interval is required")
+	}
+	if _, err := parseSelector(sch.Selector); err != nil {
+		return err
+	}
+	switch sch.Concurrency {
+	case "", protocol.ConcurrencyParallel, protocol.ConcurrencySerial:
+	default:
+		return errors.New("concurrency must be parallel or serial")
+	}
+	switch sch.Offline {
+	case "":
+		sch.Offline = offlineQueue
+	case offlineQueue, offlineSkip:
+	default:
+		return errors.New("offline must be queue or skip")
+	}
+	if sch.Rollout != nil {
+		if err := sch.Rollout.validate(); err != nil {
+			return err
+		}
+	}
+
+	sch.loc = time.UTC
+	if sch.Timezone != "" {
+		loc, err := time.LoadLocation(sch.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q", sch.Timezone)
+		}
+		sch.loc = loc
+	}
+
+	if sch.Cron != "" {
+		cs, err := parseCron(sch.Cron)
+		if err != nil {
+			return err
+		}
+		sch.cron = cs
+	} else {
+		d, err := time.ParseDuration(sch.Interval)
+		if err != nil || d < minScheduleInterval {
+			return fmt.Errorf("interval must be a duration of at least %s", minScheduleInterval)
+		}
+		sch.interval = d
+	}
+
+	if sch.Jitter != "" {
+		d, err := time.ParseDuration(sch.Jitter)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid jitter %q", sch.Jitter)
+		}
+		sch.jitter = d
+	}
+	return nil
+}
+
+// nextDue returns when the schedule is due next after it was last due at
+// prev. Runs that would already be in the past at now are skipped.
+func (sch *Schedule) nextDue(prev, now time.Time) (time.Time, error) {
+	if sch.cron == nil {
+		next := prev.Add(sch.interval)
+		if next.Before(now) {
+			next = prev.Add((now.Sub(prev)/sch.interval + 1) * sch.interval)
+		}
+		return next, nil
+	}
+
+	if prev.Before(now) {
+		prev = now
+	}
+	next, ok := sch.cron.next(prev.In(sch.loc))
+	if !ok {
+		return time.Time{}, fmt.Errorf("cron expression %q never fires", sch.Cron)
+	}
+	return next, nil
+}
+
+// plan sets the next due and start times after prev
+func (sch *Schedule) plan(prev, now time.Time) error {
+	due, err := sch.nextDue(prev, now)
+	if err != nil {
+		return err
+	}
+	start := due
+	if sch.jitter > 0 {
+		start = due.Add(time.Duration(rand.Int63n(int64(sch.jitter))))
+	}
+	sch.NextDueAt, sch.NextRunAt = &due, &start
+	return nil
+}
+
+// request returns the command request a run of the schedule sends
+func (sch *Schedule) request() SendCommandRequest {
+	return SendCommandRequest{
+		Command: Command{
+			Command:     sch.Command,
+			Task:        sch.Task,
+			Concurrency: sch.Concurrency,
+			Secrets:     sch.Secrets,
+		},
+		Selector: sch.Selector,
+		Rollout:  sch.Rollout,
+	}
+}
+
+// Create a schedule. The command is checked against the deny rules for the
+// clients matching the selector now, at the time of the first run; every run
+// is checked again.
+func (s *Server) handleCreateSchedule(c *gin.Context) {
+	var sch Schedule
+	if err := c.ShouldBindJSON(&sch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule"})
+		return
+	}
+	if err := sch.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	sch.ID = generateScheduleID()
+	sch.Enabled = true
+	sch.Operator = operatorName(c)
+	sch.Role = operatorRole(c)
+	sch.CreatedAt = now
+	if err := sch.plan(now, now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sel, _ := parseSelector(sch.Selector)
+	targets, err := s.matchClients(sel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	req := sch.request()
+	if status, err := s.authorizeSecrets(sch.Secrets, sch.Role, targets); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if rule := s.cfg.CommandPolicy.deniedBy(req.Command, targets, sch.Role, *sch.NextRunAt); rule != "" {
+		s.audit(AuditEvent{
+			Type:   auditCommandDenied,
+			Actor:  operatorName(c),
+			Detail: fmt.Sprintf("rule=%q schedule=%q command_sha256=%s", rule, sch.Name, commandDigest(sch.Command)),
+		})
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("Command denied by policy rule %q", rule),
+			"rule":  rule,
+		})
+		return
+	}
+
+	stored := sch
+	if stored.Command, err = sealValue(s.cfg.Encryption, fieldContext("schedules", "command", sch.ID), sch.Command); err != nil {
+		log.Printf("Failed to encrypt command of schedule %s: %v", sch.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store schedule"})
+		return
+	}
+	resp, err := s.db.From("schedules").Insert(stored, false, "", "", "").Execute()
+	if err != nil || resp.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store schedule"})
+		return
+	}
+
+	log.Printf("Schedule %s (%s) created by %s, next run at %s", sch.ID, sch.Name, sch.Operator, sch.NextRunAt.Format(time.RFC3339))
+	s.audit(AuditEvent{
+		Type:   auditScheduleCreated,
+		Actor:  sch.Operator,
+		Detail: fmt.Sprintf("%s %q selector=%q command_sha256=%s", sch.ID, sch.Name, sch.Selector, commandDigest(sch.Command)),
+	})
+	c.JSON(http.StatusCreated, sch)
+}
+
+// List all schedules
+func (s *Server) handleListSchedules(c *gin.Context) {
+	var schedules []Schedule
+	resp, err := s.db.From("schedules").Select("*", false, "", "", "").Order("name", true).Execute()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if err := s.db.ParseJSON(resp.Body, &schedules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+		return
+	}
+	for i := range schedules {
+		schedules[i].Command = s.openStored("schedules", schedules[i].ID, schedules[i].Command)
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+// scheduleRunHistory is how many recent runs are shown with a schedule
+const scheduleRunHistory = 20
+
+// Get a schedule together with its most recent runs
+func (s *Server) handleGetSchedule(c *gin.Context) {
+	sch, err := s.loadSchedule(c.Param("schedule_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if sch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+
+	resp, err := s.db.From("schedule_runs").Select("*", false, "", "", "").
+		Eq("schedule_id", sch.ID).
+		Order("due_at", false).
+		Limit(scheduleRunHistory).
+		Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &sch.Runs)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sch)
+}
+
+// Enable or disable a schedule. Enabling plans the next run from now.
+func (s *Server) handleScheduleAction(c *gin.Context) {
+	action := c.Param("action")
+	if action != "enable" && action != "disable" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown schedule action"})
+		return
+	}
+
+	sch, err := s.loadSchedule(c.Param("schedule_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if sch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+
+	update := map[string]interface{}{"enabled": action == "enable"}
+	auditType := auditScheduleDisabled
+	if action == "enable" {
+		now := time.Now()
+		if err := sch.plan(now, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		update["next_due_at"] = sch.NextDueAt
+		update["next_run_at"] = sch.NextRunAt
+		auditType = auditScheduleEnabled
+	}
+	sch.Enabled = action == "enable"
+
+	if _, err := s.db.From("schedules").Update(update, "", "").Eq("id", sch.ID).Execute(); err != nil {
+		log.Printf("Failed to %s schedule %s: %v", action, sch.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update schedule"})
+		return
+	}
+
+	s.audit(AuditEvent{Type: auditType, Actor: operatorName(c), Detail: fmt.Sprintf("%s %q", sch.ID, sch.Name)})
+	c.JSON(http.StatusOK, sch)
+}
+
+// Delete a schedule together with its run history. Jobs it created are kept.
+func (s *Server) handleDeleteSchedule(c *gin.Context) {
+	sch, err := s.loadSchedule(c.Param("schedule_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if sch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+
+	if _, err := s.db.From("schedules").Delete("", "").Eq("id", sch.ID).Execute(); err != nil {
+		log.Printf("Failed to delete schedule %s: %v", sch.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+
+	s.audit(AuditEvent{Type: auditScheduleDeleted, Actor: operatorName(c), Detail: fmt.Sprintf("%s %q", sch.ID, sch.Name)})
+	c.JSON(http.StatusOK, gin.H{"id": sch.ID, "deleted": true})
+}
+
+// loadSchedule returns a schedule, or nil if there is none
+func (s *Server) loadSchedule(id string) (*Schedule, error) {
+	var schedules []Schedule
+	resp, err := s.db.From("schedules").Select("*", false, "", "", "").Eq("id", id).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &schedules); err != nil {
+		return nil, err
+	}
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+	sch := &schedules[0]
+	if err := sch.compile(); err != nil {
+		return nil, fmt.Errorf("stored schedule %s is invalid: %v", id, err)
+	}
+	sch.Command = s.openStored("schedules", id, sch.Command)
+	return sch, nil
+}
+
+// runSchedules starts due schedule runs until the server stops
+func (s *Server) runSchedules() {
+	ticker := time.NewTicker(scheduleTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.leads() {
+			continue
+		}
+		var schedules []Schedule
+		resp, err := s.db.From("schedules").Select("*", false, "", "", "").
+			Eq("enabled", "true").
+			Lte("next_run_at", time.Now().Format(time.RFC3339)).
+			Execute()
+		if err != nil {
+			log.Printf("Failed to load due schedules: %v", err)
+			continue
+		}
+		if err := s.db.ParseJSON(resp.Body, &schedules); err != nil {
+			log.Printf("Failed to parse due schedules: %v", err)
+			continue
+		}
+
+		for i := range schedules {
+			sch := &schedules[i]
+			if err := sch.compile(); err != nil {
+				log.Printf("Skipping invalid schedule %s: %v", sch.ID, err)
+				continue
+			}
+			command, err := openValue(s.cfg.Encryption, fieldContext("schedules", "command", sch.ID), sch.Command)
+			if err != nil {
+				log.Printf("Skipping schedule %s: %v", sch.ID, err)
+				continue
+			}
+			sch.Command = command
+			s.runSchedule(sch)
+		}
+	}
+}
+
+// runSchedule plans the next run of a due schedule, then creates the job of
+// this one and records it. Planning first claims the run: a node that loaded
+// the schedule before the plan was stored finds it changed and leaves the
+// run alone.
+func (s *Server) runSchedule(sch *Schedule) {
+	now := time.Now()
+	run := ScheduleRun{
+		ID:         generateScheduleRunID(),
+		ScheduleID: sch.ID,
+		DueAt:      now,
+		StartedAt:  now,
+	}
+	if sch.NextDueAt != nil {
+		run.DueAt = *sch.NextDueAt
+	}
+	claimed := sch.NextRunAt
+
+	update := map[string]interface{}{"last_run_at": now}
+	if err := sch.plan(run.DueAt, now); err != nil {
+		log.Printf("Disabling schedule %s: %v", sch.ID, err)
+		update["enabled"] = false
+	} else {
+		update["next_due_at"] = sch.NextDueAt
+		update["next_run_at"] = sch.NextRunAt
+	}
+	query := s.db.From("schedules").Update(update, "representation", "").Eq("id", sch.ID)
+	if claimed != nil {
+		query = query.Eq("next_run_at", claimed.Format(time.RFC3339Nano))
+	} else {
+		query = query.Is("next_run_at", "null")
+	}
+	resp, err := query.Execute()
+	if err != nil {
+		log.Printf("Failed to plan next run of schedule %s: %v", sch.ID, err)
+		return
+	}
+	var planned []Schedule
+	if err := s.db.ParseJSON(resp.Body, &planned); err != nil || len(planned) == 0 {
+		return
+	}
+
+	s.startRun(sch, &run)
+
+	resp, err = s.db.From("schedule_runs").Insert(run, false, "", "", "").Execute()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	if err != nil {
+		log.Printf("Failed to record run of schedule %s: %v", sch.ID, err)
+	}
+}
+
+// startRun resolves the targets of a run, applies the offline setting and
+// the command policy, and creates the job. The outcome is recorded in run.
+func (s *Server) startRun(sch *Schedule, run *ScheduleRun) {
+	req := sch.request()
+	targets, _, err := s.resolveTargets(req)
+	if err != nil {
+		run.Status = runSkipped
+		if !errors.Is(err, errNoMatchingClients) {
+			run.Status = runFailed
+		}
+		run.Detail = err.Error()
+		return
+	}
+
+	if sch.Offline == offlineSkip {
+		var connected []ClientInfo
+		for _, t := range targets {
+			if s.isConnected(t) {
+				connected = append(connected, t)
+			}
+		}
+		run.Offline = len(targets) - len(connected)
+		targets = connected
+		if len(targets) == 0 {
+			run.Status = runSkipped
+			run.Detail = "no matching client is connected"
+			return
+		}
+	}
+	run.Targets = len(targets)
+
+	if rule := s.cfg.CommandPolicy.deniedBy(req.Command, targets, sch.Role, time.Now()); rule != "" {
+		run.Status = runDenied
+		run.Detail = fmt.Sprintf("denied by policy rule %q", rule)
+		s.audit(AuditEvent{
+			Type:   auditCommandDenied,
+			Actor:  sch.Operator,
+			Detail: fmt.Sprintf("rule=%q schedule=%s targets=%d command_sha256=%s", rule, sch.ID, len(targets), commandDigest(sch.Command)),
+		})
+		return
+	}
+
+	if _, err := s.authorizeSecrets(sch.Secrets, sch.Role, targets); err != nil {
+		run.Status = runDenied
+		run.Detail = err.Error()
+		return
+	}
+
+	job, err := s.createJob(req, targets, sch.Operator)
+	if err != nil {
+		run.Status = runFailed
+		run.Detail = err.Error()
+		return
+	}
+	run.Status = runStarted
+	run.JobID = job.ID
+	if job.Status == jobAwaitingApproval {
+		run.Detail = "awaiting approval"
+	}
+	log.Printf("Schedule %s (%s) started job %s on %d client(s), %d offline skipped",
+		sch.ID, sch.Name, job.ID, run.Targets, run.Offline)
+}
+
+// generateScheduleID is a placeholder for schedule ID generation
+func generateScheduleID() string {
+	return fmt.Sprintf("sched_%d", time.Now().UnixNano())
+}
+
+// generateScheduleRunID is a placeholder for schedule run ID generation
+func generateScheduleRunID() string {
+	return fmt.Sprintf("run_%d", time.Now().UnixNano())
+}
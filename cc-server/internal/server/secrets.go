@@ -0,0 +1,280 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Secret is a value kept by the server for commands to use by name. The
+// value is stored encrypted and never returned by the API; it only leaves
+// the server in the command message to an agent allowed to receive it.
+type Secret struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"` // write-only
+	Description string `json:"description,omitempty"`
+
+	// Roles lists the operator roles that may use the secret. Admins always
+	// may.
+	Roles []string `json:"roles,omitempty"`
+
+	// Selector limits the clients the secret is sent to. Empty allows every
+	// client.
+	Selector string `json:"selector,omitempty"`
+
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SecretRef names a secret a command uses and how the agent hands it to the
+// process: as the environment variable Env, or on standard input
+type SecretRef struct {
+	Name  string `json:"name"`
+	Env   string `json:"env,omitempty"`
+	Stdin bool   `json:"stdin,omitempty"`
+}
+
+// secretColumns are the columns of secrets returned by the API
+const secretColumns = "name,description,roles,selector,updated_by,updated_at"
+
+var (
+	secretNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+	envNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// errSecretsDisabled is returned when secrets are used without a master key
+var errSecretsDisabled = errors.New("The secret store needs the server to run with -master-key-file")
+
+// validateSecretRefs checks how a command uses its secrets
+func validateSecretRefs(refs []SecretRef) error {
+	envs := make(map[string]bool)
+	stdin := false
+	for _, ref := range refs {
+		switch {
+		case !secretNamePattern.MatchString(ref.Name):
+			return fmt.Errorf("Invalid secret name %q", ref.Name)
+		case (ref.Env == "") == !ref.Stdin:
+			return fmt.Errorf("Secret %q needs exactly one of env and stdin", ref.Name)
+		case ref.Stdin && stdin:
+			return errors.New("Only one secret can be passed on stdin")
+		case ref.Env != "" && !envNamePattern.MatchString(ref.Env):
+			return fmt.Errorf("Invalid environment variable %q", ref.Env)
+		case envs[ref.Env]:
+			return fmt.Errorf("Environment variable %q is set twice", ref.Env)
+		}
+		stdin = stdin || ref.Stdin
+		if ref.Env != "" {
+			envs[ref.Env] = true
+		}
+	}
+	return nil
+}
+
+// loadSecrets returns the named secrets by name. The values are included,
+// still sealed, when withValues is set.
+func (s *Server) loadSecrets(names []string, withValues bool) (map[string]Secret, error) {
+	columns := secretColumns
+	if withValues {
+		columns += ",value"
+	}
+	var secrets []Secret
+	resp, err := s.db.From("secrets").Select(columns, false, "", "", "").In("name", names).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ParseJSON(resp.Body, &secrets); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]Secret, len(secrets))
+	for _, sec := range secrets {
+		byName[sec.Name] = sec
+	}
+	return byName, nil
+}
+
+// secretNames returns the names of the secrets refs use
+func secretNames(refs []SecretRef) []string {
+	names := make([]string, len(refs))
+	for i, ref := range refs {
+		names[i] = ref.Name
+	}
+	return names
+}
+
+// allowsClient reports whether a secret may be sent to client. Only the
+// labels operators assigned count: the agent reports the others itself.
+func (sec Secret) allowsClient(client ClientInfo) bool {
+	if sec.Selector == "" {
+		return true
+	}
+	sel, err := parseSelector(sec.Selector)
+	return err == nil && sel.matches(client.AssignedLabels)
+}
+
+// authorizeSecrets checks that role may use every secret refs name, on every
+// target. On error it also returns the HTTP status to answer with.
+func (s *Server) authorizeSecrets(refs []SecretRef, role string, targets []ClientInfo) (int, error) {
+	if len(refs) == 0 {
+		return http.StatusOK, nil
+	}
+	if s.cfg.Encryption == nil {
+		return http.StatusServiceUnavailable, errSecretsDisabled
+	}
+	if err := validateSecretRefs(refs); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	secrets, err := s.secretStore(secretNames(refs), false)
+	if err != nil {
+		log.Printf("Failed to load secrets: %v", err)
+		return http.StatusInternalServerError, errors.New("Database query failed")
+	}
+	for _, ref := range refs {
+		sec, ok := secrets[ref.Name]
+		if !ok {
+			return http.StatusBadRequest, fmt.Errorf("Unknown secret %q", ref.Name)
+		}
+		if role != roleAdmin && !contains(sec.Roles, role) {
+			return http.StatusForbidden, fmt.Errorf("Role %s may not use secret %q", role, ref.Name)
+		}
+		for _, t := range targets {
+			if !sec.allowsClient(t) {
+				return http.StatusForbidden, fmt.Errorf("Secret %q may not be sent to client %s", ref.Name, t.ID)
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// resolveSecrets decrypts the secrets of a command for its delivery. The
+// client is checked again, as its labels may have changed since the command
+// was sent. Errors name secrets, never values.
+func (s *Server) resolveSecrets(cmd Command) (map[string]string, string, error) {
+	if s.cfg.Encryption == nil {
+		return nil, "", errors.New("secret store disabled on this server")
+	}
+	client, err := s.loadClient(cmd.ClientID)
+	if err != nil || client == nil {
+		return nil, "", fmt.Errorf("failed to load client: %v", err)
+	}
+	secrets, err := s.secretStore(secretNames(cmd.Secrets), true)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load secrets: %v", err)
+	}
+
+	env := make(map[string]string)
+	stdin := ""
+	for _, ref := range cmd.Secrets {
+		sec, ok := secrets[ref.Name]
+		if !ok {
+			return nil, "", fmt.Errorf("secret %q no longer exists", ref.Name)
+		}
+		if !sec.allowsClient(*client) {
+			return nil, "", fmt.Errorf("secret %q may not be sent to this client", ref.Name)
+		}
+		value, err := openValue(s.cfg.Encryption, fieldContext("secrets", "value", sec.Name), sec.Value)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decrypt secret %q", ref.Name)
+		}
+		if ref.Stdin {
+			stdin = value
+		} else {
+			env[ref.Env] = value
+		}
+	}
+	return env, stdin, nil
+}
+
+// List the secrets, without their values
+func (s *Server) handleListSecrets(c *gin.Context) {
+	var secrets []Secret
+	resp, err := s.db.From("secrets").Select(secretColumns, false, "", "", "").Order("name", true).Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &secrets)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if secrets == nil {
+		secrets = []Secret{}
+	}
+	c.JSON(http.StatusOK, secrets)
+}
+
+// Create or replace a secret. Only admins manage secrets.
+func (s *Server) handlePutSecret(c *gin.Context) {
+	if s.cfg.Encryption == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errSecretsDisabled.Error()})
+		return
+	}
+
+	var sec Secret
+	if err := c.ShouldBindJSON(&sec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid secret"})
+		return
+	}
+	sec.Name = c.Param("name")
+	switch {
+	case !secretNamePattern.MatchString(sec.Name):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid secret name %q", sec.Name)})
+		return
+	case sec.Value == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+		return
+	}
+	if sec.Selector != "" {
+		if _, err := parseSelector(sec.Selector); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	sealed, err := sealValue(s.cfg.Encryption, fieldContext("secrets", "value", sec.Name), sec.Value)
+	if err != nil {
+		log.Printf("Failed to encrypt secret %s: %v", sec.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt secret"})
+		return
+	}
+	sec.Value = sealed
+	sec.UpdatedBy = operatorName(c)
+	sec.UpdatedAt = time.Now()
+
+	resp, err := s.db.From("secrets").Insert(sec, true, "name", "", "").Execute()
+	if err != nil || resp.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store secret"})
+		return
+	}
+
+	s.audit(AuditEvent{Type: auditSecretSet, Actor: sec.UpdatedBy, IP: c.ClientIP(),
+		Detail: fmt.Sprintf("%s roles=%v selector=%q", sec.Name, sec.Roles, sec.Selector)})
+	sec.Value = ""
+	c.JSON(http.StatusOK, sec)
+}
+
+// Delete a secret. Commands still using it fail when they are delivered.
+func (s *Server) handleDeleteSecret(c *gin.Context) {
+	name := c.Param("name")
+
+	var deleted []Secret
+	resp, err := s.db.From("secrets").Delete("representation", "").Eq("name", name).Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &deleted)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete secret"})
+		return
+	}
+	if len(deleted) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Secret not found"})
+		return
+	}
+
+	s.audit(AuditEvent{Type: auditSecretDeleted, Actor: operatorName(c), IP: c.ClientIP(), Detail: name})
+	c.JSON(http.StatusOK, gin.H{"message": "Secret deleted"})
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSecretSelectorMatchesAssignedLabels(t *testing.T) {
+	sec := Secret{Name: "db_password", Selector: "env=prod"}
+
+	reported := ClientInfo{ID: "client_1", Labels: map[string]string{"env": "prod"}}
+	if sec.allowsClient(reported) {
+		t.Fatal("secret allowed on a label the agent reported itself")
+	}
+
+	assigned := ClientInfo{
+		ID:             "client_2",
+		Labels:         map[string]string{"env": "prod"},
+		AssignedLabels: map[string]string{"env": "prod"},
+	}
+	if !sec.allowsClient(assigned) {
+		t.Fatal("secret refused on a label an operator assigned")
+	}
+
+	if !(Secret{Name: "shared"}).allowsClient(reported) {
+		t.Fatal("secret without a selector refused")
+	}
+}
+
+func TestValidateSecretRefs(t *testing.T) {
+	for _, tc := range []struct {
+		refs []SecretRef
+		err  string // substring, "" if valid
+	}{
+		{nil, ""},
+		{[]SecretRef{{Name: "db_password", Env: "DB_PASS"}, {Name: "tls.key", Stdin: true}}, ""},
+		{[]SecretRef{{Name: "bad name", Env: "X"}}, "Invalid secret name"},
+		{[]SecretRef{{Name: "-leading", Env: "X"}}, "Invalid secret name"},
+		{[]SecretRef{{Name: "db_password"}}, "exactly one of env and stdin"},
+		{[]SecretRef{{Name: "db_password", Env: "DB_PASS", Stdin: true}}, "exactly one of env and stdin"},
+		{[]SecretRef{{Name: "a", Stdin: true}, {Name: "b", Stdin: true}}, "Only one secret"},
+		{[]SecretRef{{Name: "a", Env: "1PASS"}}, "Invalid environment variable"},
+		{[]SecretRef{{Name: "a", Env: "PASS"}, {Name: "b", Env: "PASS"}}, "set twice"},
+	} {
+		err := validateSecretRefs(tc.refs)
+		if (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("validateSecretRefs(%+v) = %v, want %q", tc.refs, err, tc.err)
+		}
+	}
+}
+
+func TestAuthorizeSecrets(t *testing.T) {
+	stored := map[string]Secret{
+		"db_password": {Name: "db_password", Roles: []string{roleOperator}, Selector: "env=prod"},
+		"admin_token": {Name: "admin_token"},
+	}
+	s := &Server{cfg: Config{Encryption: testKeyring(t)}}
+	s.secretStore = func(names []string, withValues bool) (map[string]Secret, error) {
+		if withValues {
+			t.Error("values loaded to authorize")
+		}
+		found := make(map[string]Secret)
+		for _, name := range names {
+			if sec, ok := stored[name]; ok {
+				found[name] = sec
+			}
+		}
+		return found, nil
+	}
+	prod := ClientInfo{ID: "client_1", AssignedLabels: map[string]string{"env": "prod"}}
+	dev := ClientInfo{ID: "client_2", AssignedLabels: map[string]string{"env": "dev"}}
+	dbPassword := []SecretRef{{Name: "db_password", Env: "DB_PASS"}}
+
+	for _, tc := range []struct {
+		refs    []SecretRef
+		role    string
+		targets []ClientInfo
+		status  int
+	}{
+		{nil, roleViewer, []ClientInfo{dev}, http.StatusOK},
+		{dbPassword, roleOperator, []ClientInfo{prod}, http.StatusOK},
+		{dbPassword, roleAdmin, []ClientInfo{prod}, http.StatusOK},
+		// Admins may use every secret, but only on the clients it allows
+		{dbPassword, roleAdmin, []ClientInfo{prod, dev}, http.StatusForbidden},
+		{[]SecretRef{{Name: "admin_token", Env: "TOKEN"}}, roleOperator, []ClientInfo{prod}, http.StatusForbidden},
+		{[]SecretRef{{Name: "admin_token", Env: "TOKEN"}}, roleAdmin, []ClientInfo{prod, dev}, http.StatusOK},
+		{[]SecretRef{{Name: "missing", Env: "X"}}, roleAdmin, []ClientInfo{prod}, http.StatusBadRequest},
+		{[]SecretRef{{Name: "db_password"}}, roleAdmin, []ClientInfo{prod}, http.StatusBadRequest},
+	} {
+		if status, err := s.authorizeSecrets(tc.refs, tc.role, tc.targets); status != tc.status {
+			t.Errorf("authorizeSecrets(%+v, %s) = %d %v, want %d", tc.refs, tc.role, status, err, tc.status)
+		}
+	}
+
+	s.secretStore = func([]string, bool) (map[string]Secret, error) { return nil, errors.New("down") }
+	if status, _ := s.authorizeSecrets(dbPassword, roleAdmin, []ClientInfo{prod}); status != http.StatusInternalServerError {
+		t.Fatalf("store failure gave %d", status)
+	}
+
+	// Secrets need a master key
+	s.cfg.Encryption = nil
+	if status, err := s.authorizeSecrets(dbPassword, roleAdmin, []ClientInfo{prod}); status != http.StatusServiceUnavailable || err != errSecretsDisabled {
+		t.Fatalf("without a master key: %d %v", status, err)
+	}
+}
@@ -1,41 +1,119 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/supabase/postgrest-go"
+	"github.com/user/cc-server/internal/protocol"
+	"github.com/user/cc-server/internal/version"
 )
 
 type Server struct {
 	router   *gin.Engine
-	upgrader websocket.Upgrader
 	db       *postgrest.Client
 	addr     string
-	clients  map[string]*websocket.Conn
+	hub      *hub
+	cfg      Config
+
+	regLimiter *registrationLimiter
+	auditor    *auditor
+
+	agentUpgrader    websocket.Upgrader
+	operatorUpgrader websocket.Upgrader
+	upgrades         *upgradeLimiter
+	live             *liveView
+	deliveries       *deliveryTracker
+	operators        *operatorCache
+	webhooks         *webhookDispatcher
+	cluster          *cluster
+	retention        retentionStore
+	started          time.Time
+
+	// secretStore loads secrets by name. It is loadSecrets unless a test
+	// says otherwise.
+	secretStore func(names []string, withValues bool) (map[string]Secret, error)
+
+	// jobMu serializes changes of job state between the rollout loop and
+	// operator actions
+	jobMu sync.Mutex
+
+	// approvalMu serializes decisions on and expiry of approvals
+	approvalMu sync.Mutex
+
+	// outputs holds back streamed output until it can be redacted whole
+	outputs outputTails
 }
 
 type ClientInfo struct {
-	ID       string    `json:"id"`
-	Hostname string    `json:"hostname"`
-	IP       string    `json:"ip"`
-	LastSeen time.Time `json:"last_seen"`
-	Status   string    `json:"status"`
+	ID            string    `json:"id"`
+	Hostname      string    `json:"hostname"`
+	IP            string    `json:"ip"`
+	LastSeen      time.Time `json:"last_seen"`
+	Status        string    `json:"status"`
+	AgentVersion  string    `json:"agent_version,omitempty"`
+	AgentProtocol int       `json:"agent_protocol,omitempty"`
+	OS            string    `json:"os,omitempty"`
+	Arch          string    `json:"arch,omitempty"`
+	Outdated      bool      `json:"outdated"`
+
+	// NodeID is the server the agent is connected to when several share
+	// the store
+	NodeID string `json:"node_id,omitempty"`
+
+	// Labels come from the agent's config at registration and can be
+	// changed by operators with PATCH /clients/:client_id/labels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// AssignedLabels are the labels set by operators, kept apart from the
+	// ones the agent reported. Secret selectors only match these, so an
+	// agent cannot claim a label to be given a secret.
+	AssignedLabels map[string]string `json:"assigned_labels,omitempty"`
 }
 
 // Command represents a command to be executed on a client
 type Command struct {
 	ID          string    `json:"id"`
 	ClientID    string    `json:"client_id"`
+	JobID       string    `json:"job_id,omitempty"` // set on commands created for a selector
+	Batch       int       `json:"batch,omitempty"`  // rollout batch within the job
 	Command     string    `json:"command"`
-	Status      string    `json:"status"` // pending, executing, completed, failed
+	Task        string    `json:"task,omitempty"` // optional task name matched by policy rules
+	Cwd         string    `json:"cwd,omitempty"`  // directory a shell line runs in
+	Operator    string    `json:"operator,omitempty"` // who sent it, shown to the host owner
+	Concurrency string    `json:"concurrency,omitempty"` // parallel (default) or serial
+	SerialKey   string    `json:"serial_key,omitempty"`  // serial commands sharing a key never overlap
+	Status      string    `json:"status"` // held, pending, delivered, queued, received, completed, failed, limit_exceeded, undelivered, cancelled
 	Result      string    `json:"result,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ExitCode    *int      `json:"exit_code,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	CompletedAt time.Time `json:"completed_at,omitempty"`
+
+	// PrunedAt is set once retention moved the result to the Archive file;
+	// everything else about the command is kept
+	PrunedAt *time.Time `json:"pruned_at,omitempty"`
+	Archive  string     `json:"archive,omitempty"`
+
+	// Redactions names the rules that removed secrets from the result
+	Redactions []string `json:"redactions,omitempty"`
+
+	// Secrets names the server-managed secrets the agent passes to the
+	// command; their values are never stored with it
+	Secrets []SecretRef `json:"secrets,omitempty"`
+
+	// Limits optionally bound the resources the command may use on the agent
+	Limits        *protocol.ResourceLimits `json:"limits,omitempty"`
+	LimitExceeded string                   `json:"limit_exceeded,omitempty"`
 }
 
 // RegistrationRequest represents the initial client registration
@@ -43,77 +121,181 @@ type RegistrationRequest struct {
 	Token    string `json:"token"`
 	Hostname string `json:"hostname"`
 	IP       string `json:"ip"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // NewServer creates a new C&C server instance
-func NewServer(addr, supabaseURL, supabaseKey string) *Server {
-	// Initialize Supabase client
-	db := postgrest.NewClient(supabaseURL, &postgrest.ClientOptions{
-		Headers: map[string]string{
-			"apikey": supabaseKey,
-			"Authorization": "Bearer " + supabaseKey,
-		},
-	})
+func NewServer(addr, supabaseURL, supabaseKey string, cfg Config) *Server {
+	db := newDBClient(supabaseURL, supabaseKey)
 
 	router := gin.Default()
-	
-	// Setup secure websocket upgrader
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// In production, check origin properly
-			return true
-		},
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Printf("Invalid trusted proxies, trusting none: %v", err)
+		router.SetTrustedProxies(nil)
 	}
 
 	s := &Server{
 		router:   router,
-		upgrader: upgrader,
 		db:       db,
 		addr:     addr,
-		clients:  make(map[string]*websocket.Conn),
+		hub:      newHub(),
+		cfg:      cfg,
+
+		regLimiter: newRegistrationLimiter(cfg.Registration, realClock{}),
+		upgrades:   newUpgradeLimiter(cfg.WebSocket.MaxConcurrentUpgrades),
+		live:       newLiveView(),
+		deliveries: newDeliveryTracker(),
+		operators:  newOperatorCache(),
+		started:    time.Now(),
 	}
+	s.auditor = newAuditor(s)
+	s.retention = dbRetentionStore{s}
+	s.secretStore = s.loadSecrets
+	s.webhooks = newWebhookDispatcher(s, cfg.Webhooks)
+	s.cluster = newCluster(s, cfg.Cluster)
+	s.setupUpgraders()
+	go s.retryDeliveries()
+	go s.runJobs()
+	go s.expireApprovals()
+	go s.runSchedules()
+	go s.runRetention()
 
 	s.setupRoutes()
 	return s
 }
 
+// newDBClient connects to the Supabase REST API
+func newDBClient(supabaseURL, supabaseKey string) *postgrest.Client {
+	return postgrest.NewClient(supabaseURL, &postgrest.ClientOptions{
+		Headers: map[string]string{
+			"apikey": supabaseKey,
+			"Authorization": "Bearer " + supabaseKey,
+		},
+	})
+}
+
 func (s *Server) setupRoutes() {
+	// Public probe endpoints for orchestrators
+	s.router.GET("/healthz", s.handleHealthz)
+	s.router.GET("/readyz", s.handleReadyz)
+	s.router.GET("/version", s.handleVersion)
+
 	// Public registration endpoint
-	s.router.POST("/register", s.handleRegistration)
+	s.router.POST("/register", s.registrationGuard, s.handleRegistration)
+
+	// Agent sockets authenticate with their own token. /ws is kept for
+	// agents built before the endpoints were split.
+	s.router.GET("/ws/agent", s.upgradeGuard, s.handleAgentSocket)
+	s.router.GET("/ws", s.upgradeGuard, s.handleAgentSocket)
 
-	// Authenticated endpoints for CLI
+	// Messages between the nodes of a cluster
+	if s.cluster != nil {
+		s.router.POST(clusterPath, s.clusterAuth, s.handleBusMessage)
+	}
+
+	// Authenticated endpoints for CLI. Viewers may only read; changing
+	// anything takes an operator or an admin.
 	protected := s.router.Group("/")
 	protected.Use(s.authMiddleware)
+	operate := requireRole(roleOperator, roleAdmin)
+	admin := requireRole(roleAdmin)
 	{
 		protected.GET("/clients", s.handleListClients)
-		protected.POST("/command", s.handleSendCommand)
+		protected.PATCH("/clients/:client_id/labels", operate, s.handleSetLabels)
+		protected.POST("/command", operate, s.handleSendCommand)
 		protected.GET("/commands/:client_id", s.handleGetCommands)
-		protected.GET("/ws", s.handleWebSocket)
+		protected.GET("/commands/:client_id/:command_id", s.handleGetCommand)
+		protected.GET("/commands/:client_id/:command_id/raw", admin, s.handleRawOutput)
+		protected.POST("/commands/:client_id/:command_id/cancel", operate, s.handleCancelCommand)
+		protected.GET("/export/commands", s.handleExport)
+		protected.GET("/jobs/:job_id", s.handleGetJob)
+		protected.POST("/jobs/:job_id/:action", operate, s.handleJobAction)
+		protected.GET("/approvals", s.handleListApprovals)
+		protected.POST("/policy/test", s.handlePolicyTest)
+		protected.POST("/approvals/:id/:decision", s.handleDecideApproval)
+		protected.GET("/schedules", s.handleListSchedules)
+		protected.POST("/schedules", operate, s.handleCreateSchedule)
+		protected.GET("/schedules/:schedule_id", s.handleGetSchedule)
+		protected.DELETE("/schedules/:schedule_id", operate, s.handleDeleteSchedule)
+		protected.POST("/schedules/:schedule_id/:action", operate, s.handleScheduleAction)
+		protected.GET("/secrets", s.handleListSecrets)
+		protected.PUT("/secrets/:name", admin, s.handlePutSecret)
+		protected.DELETE("/secrets/:name", admin, s.handleDeleteSecret)
+		protected.GET("/webhooks", s.handleListWebhooks)
+		protected.GET("/webhooks/dead-letters", s.handleListDeadLetters)
+		protected.POST("/webhooks/dead-letters/:id/replay", operate, s.handleReplayDeadLetter)
+		protected.GET("/ws/operator", s.upgradeGuard, s.handleOperatorSocket)
+		protected.GET("/v1/events", s.handleEvents)
 	}
 }
 
 // Register new client
 func (s *Server) handleRegistration(c *gin.Context) {
+	ip := c.ClientIP()
+
 	var req RegistrationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.audit(AuditEvent{Type: auditRegistrationRejected, IP: ip, Detail: "body_too_large"})
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	if err := validateLabels(req.Labels); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Refuse agents that cannot speak the current protocol
+	if req.Protocol < version.MinProtocol {
+		c.JSON(http.StatusUpgradeRequired, gin.H{
+			"error":        "Agent protocol too old",
+			"min_protocol": version.MinProtocol,
+		})
+		return
+	}
 
 	// Validate registration token against database
 	tokenValid, err := s.validateRegistrationToken(req.Token)
-	if err != nil || !tokenValid {
+	if err != nil {
+		log.Printf("Failed to validate registration token: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Registration temporarily unavailable"})
+		return
+	}
+	if !tokenValid {
+		s.audit(AuditEvent{Type: auditRegistrationRejected, IP: ip, Detail: "invalid_token"})
+		if s.regLimiter.recordFailure(ip) {
+			s.audit(AuditEvent{
+				Type:   auditRegistrationLockout,
+				IP:     ip,
+				Detail: fmt.Sprintf("locked out for %s", s.cfg.Registration.LockoutDuration),
+			})
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid registration token"})
 		return
 	}
+	s.regLimiter.recordSuccess(ip)
 
 	// Create client entry in database
 	clientInfo := ClientInfo{
-		ID:       generateClientID(), // This would be a proper ID generation function
-		Hostname: req.Hostname,
-		IP:       req.IP,
-		LastSeen: time.Now(),
-		Status:   "connected",
+		ID:            generateClientID(), // This would be a proper ID generation function
+		Hostname:      req.Hostname,
+		IP:            req.IP,
+		LastSeen:      time.Now(),
+		Status:        "connected",
+		AgentVersion:  req.Version,
+		AgentProtocol: req.Protocol,
+		Outdated:      isOutdatedAgent(req.Version),
+		Labels:        req.Labels,
+	}
+	if clientInfo.Outdated {
+		log.Printf("Agent %s registered with outdated version %s (server %s)", req.Hostname, req.Version, version.Version)
 	}
 
 	// Insert client into Supabase
@@ -177,45 +359,84 @@ func (s *Server) generateClientJWT(clientID string) (string, error) {
 	return fmt.Sprintf("jwt_for_%s", clientID), nil
 }
 
-// WebSocket handler for client communication
-func (s *Server) handleWebSocket(c *gin.Context) {
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Authenticate client using JWT from query param or header
+// WebSocket handler for agent communication
+func (s *Server) handleAgentSocket(c *gin.Context) {
+	// Authenticate the agent before upgrading, so unauthenticated callers
+	// never get a socket
 	clientID := c.Query("client_id")
 	authToken := c.GetHeader("Authorization")
 	if clientID == "" || authToken == "" {
-		conn.WriteMessage(websocket.CloseMessage, []byte("Authentication required"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 		return
 	}
 
 	// Validate the token against Supabase
 	valid, err := s.validateClientToken(clientID, authToken)
 	if err != nil || !valid {
-		conn.WriteMessage(websocket.CloseMessage, []byte("Invalid token"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	// Agents announce their build on every connect, so upgrades in place are noticed
+	agentVersion := c.GetHeader("X-Agent-Version")
+	agentProtocol, _ := strconv.Atoi(c.GetHeader("X-Agent-Protocol"))
+	if agentProtocol < version.MinProtocol {
+		c.JSON(http.StatusUpgradeRequired, gin.H{
+			"error":        "Agent protocol too old",
+			"min_protocol": version.MinProtocol,
+		})
 		return
 	}
 
+	conn, err := s.agentUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	releaseUpgrade(c)
+	defer conn.Close()
+
+	// Agree on protocol version and features before anything else is sent
+	session, hello, err := s.handshake(conn, agentProtocol)
+	if err != nil {
+		log.Printf("Handshake with client %s failed: %v", clientID, err)
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error()))
+		return
+	}
+	if hello.AgentVersion == "" {
+		hello.AgentVersion = agentVersion
+	}
+	log.Printf("Client %s connected: agent %s (%s/%s), protocol %d, features %v",
+		clientID, hello.AgentVersion, hello.OS, hello.Arch, session.Protocol, session.Features)
+
 	// Add client to active connections
-	s.clients[clientID] = conn
-	defer func() {
-		delete(s.clients, clientID)
-	}()
+	ac := &agentConn{clientID: clientID, conn: conn, session: session}
+	s.hub.add(ac)
+	defer s.hub.remove(ac)
 
 	// Update client status in database
+	s.updateClientVersion(clientID, hello)
 	s.updateClientStatus(clientID, "connected")
+	if s.cluster != nil {
+		s.cluster.claim(clientID)
+	}
+	s.live.publish(liveEvent{Type: eventAgentConnected, ClientID: clientID})
+
+	// Catch up on commands queued or unacknowledged while the agent was away
+	go s.redeliver(clientID)
 
 	// Handle incoming messages from client
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("WebSocket read error: %v", err)
-			s.updateClientStatus(clientID, "disconnected")
+			if s.cluster != nil {
+				s.cluster.disconnected(clientID)
+			} else {
+				s.updateClientStatus(clientID, "disconnected")
+			}
+			s.live.publish(liveEvent{Type: eventAgentDisconnected, ClientID: clientID})
 			break
 		}
 
@@ -247,85 +468,288 @@ func (s *Server) updateClientStatus(clientID, status string) {
 	}
 }
 
+// Record the version and platform an agent reported when it connected
+func (s *Server) updateClientVersion(clientID string, hello protocol.Hello) {
+	outdated := isOutdatedAgent(hello.AgentVersion)
+	if outdated {
+		log.Printf("Client %s is running outdated agent %s (server %s)", clientID, hello.AgentVersion, version.Version)
+	}
+
+	update := map[string]interface{}{
+		"agent_version":  hello.AgentVersion,
+		"agent_protocol": hello.Protocol,
+		"outdated":       outdated,
+	}
+	if hello.OS != "" {
+		update["os"] = hello.OS
+		update["arch"] = hello.Arch
+	}
+	_, err := s.db.From("clients").Update(update, "", "").Eq("id", clientID).Execute()
+	if err != nil {
+		log.Printf("Failed to update client version: %v", err)
+	}
+}
+
+// isOutdatedAgent reports whether an agent build is older than this server
+func isOutdatedAgent(agentVersion string) bool {
+	return agentVersion == "" || version.Compare(agentVersion, version.Version) < 0
+}
+
 // Handle messages from client (heartbeats, command results, etc.)
 func (s *Server) handleClientMessage(clientID string, message []byte) {
-	// Process different types of messages from the client
-	// For example, command execution results, heartbeats, etc.
-	log.Printf("Received message from client %s: %s", clientID, string(message))
-}
+	s.live.publish(liveEvent{Type: eventAgentMessage, ClientID: clientID, Data: s.cfg.Redaction.redactJSON(message)})
 
-// Middleware to authenticate CLI requests
-func (s *Server) authMiddleware(c *gin.Context) {
-	// In a real implementation, validate the admin token
-	// For now, we'll skip this for development
-	c.Next()
+	var env protocol.Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		log.Printf("Invalid message from client %s: %v", clientID, err)
+		return
+	}
+
+	switch env.Type {
+	case protocol.TypeHeartbeat:
+		if ac, ok := s.hub.get(clientID); ok {
+			s.updateClientStatus(clientID, agentStatus(ac))
+		}
+	case protocol.TypeStatus:
+		s.handleAgentStatus(clientID, message)
+	case protocol.TypeAck:
+		s.handleAck(clientID, message)
+	case protocol.TypeOutput:
+		s.handleOutput(clientID, message)
+	case protocol.TypeResult, "":
+		// Results from protocol 1 agents carry no type
+		s.handleResult(clientID, message)
+	default:
+		log.Printf("Ignoring %q message from client %s", env.Type, clientID)
+	}
 }
 
-// List all registered clients
+// List registered clients a page at a time. Besides the list parameters
+// (see listQuery) it takes status (comma-separated) and selector.
 func (s *Server) handleListClients(c *gin.Context) {
-	var clients []ClientInfo
-	resp, err := s.db.From("clients").Select("*", false, "", "", "").Execute()
+	q, err := parseListQuery(c, clientListSpec)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := s.db.ParseJSON(resp.Body, &clients); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
-		return
+	f := s.db.From("clients").Select(q.columns, false, "", "", "")
+	if statuses := splitList(c.Query("status")); statuses != nil {
+		f = f.In("status", statuses)
+	}
+	if v := c.Query("selector"); v != "" {
+		sel, err := parseSelector(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Labels are matched here, so the page is limited to the matches
+		matched, err := s.matchClients(sel)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+			return
+		}
+		ids := make([]string, 0, len(matched))
+		for _, cl := range matched {
+			ids = append(ids, cl.ID)
+		}
+		f = f.In("id", ids)
 	}
 
-	c.JSON(http.StatusOK, clients)
+	resp, err := q.page(f).Execute()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	q.respond(c, s, resp)
 }
 
-// Send command to a client
+// Send command to a client, or to every client matching a label selector
 func (s *Server) handleSendCommand(c *gin.Context) {
-	var cmd Command
-	if err := c.ShouldBindJSON(&cmd); err != nil {
+	var req SendCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command"})
 		return
 	}
+	cmd := req.Command
+	if cmd.Cwd != "" && cmd.Task != protocol.ShellTask {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cwd is only used by shell lines"})
+		return
+	}
+	switch cmd.Concurrency {
+	case "", protocol.ConcurrencyParallel, protocol.ConcurrencySerial:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "concurrency must be parallel or serial"})
+		return
+	}
+	if req.Rollout != nil {
+		if req.Selector == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rollout requires a selector"})
+			return
+		}
+		if err := req.Rollout.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	targets, status, err := s.resolveTargets(req)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := s.authorizeSecrets(cmd.Secrets, operatorRole(c), targets); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Central policy is checked before anything is stored
+	if rule := s.cfg.CommandPolicy.deniedBy(cmd, targets, operatorRole(c), time.Now()); rule != "" {
+		s.audit(AuditEvent{
+			Type:   auditCommandDenied,
+			Actor:  operatorName(c),
+			Detail: fmt.Sprintf("rule=%q targets=%d command_sha256=%s", rule, len(targets), commandDigest(cmd.Command)),
+		})
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("Command denied by policy rule %q", rule),
+			"rule":  rule,
+		})
+		return
+	}
+
+	if req.Selector != "" {
+		s.sendJob(c, req, targets)
+		return
+	}
 
 	// Insert command into database
 	cmd.ID = generateCommandID() // This would be a proper ID generation function
-	cmd.Status = "pending"
+	cmd.Status = statusPending
 	cmd.CreatedAt = time.Now()
+	cmd.Operator = operatorName(c)
 
-	resp, err := s.db.From("commands").Insert(cmd, false, "", "", "").Execute()
+	rule := s.cfg.CommandPolicy.approvalRuleFor(cmd, targets)
+	if rule != nil {
+		cmd.Status = statusAwaitingApproval
+	}
+
+	sealed, err := s.sealCommand(cmd)
+	if err != nil {
+		log.Printf("Failed to encrypt command %s: %v", cmd.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt command"})
+		return
+	}
+	resp, err := s.db.From("commands").Insert(sealed, false, "", "", "").Execute()
 	if err != nil || resp.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store command"})
 		return
 	}
-
-	// Send command to client if connected
-	if clientConn, ok := s.clients[cmd.ClientID]; ok {
-		if err := clientConn.WriteJSON(cmd); err != nil {
-			log.Printf("Failed to send command to client %s: %v", cmd.ClientID, err)
+	s.publishCommand(cmd)
+
+	// Commands needing approval wait until a second operator decides
+	if rule != nil {
+		if _, err := s.requestApproval(approvalKindCommand, cmd.ID, cmd.Command, 1, rule, cmd.Operator); err != nil {
+			log.Printf("Failed to store approval request for command %s: %v", cmd.ID, err)
+			s.failCommand(cmd.ID, "failed to request approval")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request approval"})
+			return
 		}
-	} else {
-		log.Printf("Client %s is not connected, command queued", cmd.ClientID)
+		c.JSON(http.StatusAccepted, cmd)
+		return
+	}
+
+	// Send command to client if connected, otherwise it waits for the reconnect
+	if s.deliver(cmd) {
+		cmd.Status = statusDelivered
 	}
 
 	c.JSON(http.StatusOK, cmd)
 }
 
-// Get command history for a client
+// Get command history for a client a page at a time, newest first. Besides
+// the list parameters (see listQuery) it takes status (comma-separated), job,
+// command (a case-insensitive substring) and exit_code.
 func (s *Server) handleGetCommands(c *gin.Context) {
-	clientID := c.Param("client_id")
-	var commands []Command
-	
-	resp, err := s.db.From("commands").Select("*", false, "", "", "").Eq("client_id", clientID).Execute()
+	q, err := parseListQuery(c, commandListSpec)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	grep := c.Query("command")
+	if grep != "" && s.cfg.Encryption != nil && !contains(strings.Split(q.columns, ","), "command") {
+		q.columns += ",command"
+	}
+
+	exitCode := c.Query("exit_code")
+	code, err := strconv.Atoi(exitCode)
+	if exitCode != "" && err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid exit code %q", exitCode)})
 		return
 	}
 
-	if err := s.db.ParseJSON(resp.Body, &commands); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+	query := func() *postgrest.FilterBuilder {
+		f := s.db.From("commands").Select(q.columns, false, "", "", "").Eq("client_id", c.Param("client_id"))
+		if statuses := splitList(c.Query("status")); statuses != nil {
+			f = f.In("status", statuses)
+		}
+		if v := c.Query("job"); v != "" {
+			f = f.Eq("job_id", v)
+		}
+		if grep != "" && s.cfg.Encryption == nil {
+			f = f.Ilike("command", containsPattern(grep))
+		}
+		if exitCode != "" {
+			f = f.Eq("exit_code", code)
+		}
+		return f
+	}
+
+	// Encrypted commands can only be searched once decrypted, and the
+	// pattern can match more than the substring, so pages are read until
+	// enough rows match
+	q.post = func(rows []map[string]interface{}) []map[string]interface{} {
+		s.openCommandRows(rows)
+		if grep == "" {
+			return rows
+		}
+		kept := rows[:0]
+		for _, row := range rows {
+			if text, _ := row["command"].(string); strings.Contains(strings.ToLower(text), strings.ToLower(grep)) {
+				kept = append(kept, row)
+			}
+		}
+		return kept
+	}
+	q.respondScanning(c, s, query)
+}
+
+// Get one command of a client. fields selects columns as for the list.
+func (s *Server) handleGetCommand(c *gin.Context) {
+	q, err := parseListQuery(c, commandListSpec)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, commands)
+	var rows []map[string]interface{}
+	resp, err := s.db.From("commands").Select(q.columns, false, "", "", "").
+		Eq("id", c.Param("command_id")).
+		Eq("client_id", c.Param("client_id")).
+		Execute()
+	if err == nil {
+		err = s.db.ParseJSON(resp.Body, &rows)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database query failed"})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	}
+	s.openCommandRows(rows)
+	c.JSON(http.StatusOK, rows[0])
 }
 
 // Start the C&C server
@@ -340,5 +764,5 @@ func generateClientID() string {
 
 // generateCommandID is a placeholder for command ID generation
 func generateCommandID() string {
-	return fmt.Sprintf("cmd_%d", time.Now().Unix())
+	return fmt.Sprintf("cmd_%d", time.Now().UnixNano())
 }
\ No newline at end of file
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testWebhookSecret = "s3cret"
+
+// webhookReceiver is an endpoint that records the deliveries it gets and
+// answers with the statuses it is given, then 200
+type webhookReceiver struct {
+	*httptest.Server
+	t *testing.T
+
+	mu       sync.Mutex
+	statuses []int
+	got      []receivedDelivery
+	arrived  chan struct{}
+	hold     chan struct{} // when set, requests wait until it is closed
+}
+
+type receivedDelivery struct {
+	at        time.Time
+	event     string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{t: t, statuses: statuses, arrived: make(chan struct{}, 4096)}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) serve(w http.ResponseWriter, req *http.Request) {
+	if r.hold != nil {
+		<-r.hold
+	}
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.got = append(r.got, receivedDelivery{
+		at:        time.Now(),
+		event:     req.Header.Get("X-CC-Event"),
+		timestamp: req.Header.Get("X-CC-Timestamp"),
+		signature: req.Header.Get("X-CC-Signature"),
+		body:      body,
+	})
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.mu.Unlock()
+	w.WriteHeader(status)
+	r.arrived <- struct{}{}
+}
+
+// wait returns once n deliveries arrived in total
+func (r *webhookReceiver) wait(n int) []receivedDelivery {
+	r.t.Helper()
+	for {
+		r.mu.Lock()
+		got := append([]receivedDelivery(nil), r.got...)
+		r.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		select {
+		case <-r.arrived:
+		case <-time.After(5 * time.Second):
+			r.t.Fatalf("got %d deliveries, want %d", len(got), n)
+		}
+	}
+}
+
+// newTestDispatcher starts a dispatcher posting every command_status event to
+// url, and returns it with the channel its dead letters go to
+func newTestDispatcher(t *testing.T, url string, attempts int) (*Server, *webhookDispatcher, chan WebhookDeadLetter) {
+	cfg := &WebhookConfig{
+		Endpoints: []WebhookEndpoint{{
+			Name:   "tickets",
+			URL:    url,
+			Secret: testWebhookSecret,
+			events: map[string]bool{eventCommandStatus: true},
+		}},
+		MaxAttempts: attempts,
+		backoff:     20 * time.Millisecond,
+		maxBackoff:  50 * time.Millisecond,
+		timeout:     time.Second,
+	}
+	s := &Server{live: newLiveView()}
+	letters := make(chan WebhookDeadLetter, 16)
+	d := newWebhookDispatcher(s, cfg)
+	d.store = func(dl WebhookDeadLetter) error {
+		letters <- dl
+		return nil
+	}
+	s.webhooks = d
+	return s, d, letters
+}
+
+func publishStatus(s *Server, commandID, status string) {
+	s.live.publish(liveEvent{
+		Type:      eventCommandStatus,
+		ClientID:  "client_1",
+		CommandID: commandID,
+		Data:      eventData(map[string]interface{}{"status": status}),
+	})
+}
+
+func TestWebhookSignature(t *testing.T) {
+	recv := newWebhookReceiver(t)
+	s, _, _ := newTestDispatcher(t, recv.URL, 1)
+
+	publishStatus(s, "cmd_1", "failed")
+	got := recv.wait(1)[0]
+
+	if got.event != eventCommandStatus {
+		t.Fatalf("X-CC-Event = %q", got.event)
+	}
+	ts, err := strconv.ParseInt(got.timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Fatalf("X-CC-Timestamp = %q", got.timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(got.timestamp + "."))
+	mac.Write(got.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(got.signature), []byte(want)) {
+		t.Fatalf("X-CC-Signature = %q, want %q", got.signature, want)
+	}
+
+	var ev liveEvent
+	if err := json.Unmarshal(got.body, &ev); err != nil || ev.CommandID != "cmd_1" || ev.Type != eventCommandStatus {
+		t.Fatalf("body = %s", got.body)
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	recv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusBadGateway)
+	s, _, letters := newTestDispatcher(t, recv.URL, 4)
+
+	publishStatus(s, "cmd_1", "failed")
+	got := recv.wait(4)
+
+	// Waits of 20ms, 40ms, then capped at 50ms
+	for i, min := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+		if wait := got[i+1].at.Sub(got[i].at); wait < min {
+			t.Errorf("wait before attempt %d = %v, want at least %v", i+2, wait, min)
+		}
+	}
+	for i := 1; i < len(got); i++ {
+		if string(got[i].body) != string(got[0].body) {
+			t.Fatalf("attempt %d sent a different body", i+1)
+		}
+	}
+	select {
+	case dl := <-letters:
+		t.Fatalf("delivered event was dead-lettered: %+v", dl)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := &webhookDispatcher{cfg: &WebhookConfig{backoff: time.Second, maxBackoff: 10 * time.Second}}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 20: 10 * time.Second} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookDeadLetterAndReplay(t *testing.T) {
+	recv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	s, d, letters := newTestDispatcher(t, recv.URL, 2)
+
+	publishStatus(s, "cmd_1", "failed")
+	var dl WebhookDeadLetter
+	select {
+	case dl = <-letters:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed delivery was not dead-lettered")
+	}
+	if dl.Endpoint != "tickets" || dl.EventType != eventCommandStatus || dl.Attempts != 2 ||
+		dl.Status != deadLetterFailed || dl.LastError != "endpoint answered 503" {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+	failed := recv.wait(2)
+	if string(dl.Payload) != string(failed[0].body) {
+		t.Fatalf("dead letter payload %s, sent %s", dl.Payload, failed[0].body)
+	}
+
+	// The endpoint recovered; a replay sends the same event, freshly signed
+	if err := d.replay(dl); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	got := recv.wait(3)[2]
+	if string(got.body) != string(dl.Payload) {
+		t.Fatalf("replay sent %s, want %s", got.body, dl.Payload)
+	}
+	if got.signature != "sha256="+signWebhook(testWebhookSecret, got.timestamp, got.body) {
+		t.Fatal("replay is not signed")
+	}
+
+	dl.Endpoint = "removed"
+	if err := d.replay(dl); err == nil {
+		t.Fatal("replay to an endpoint no longer configured succeeded")
+	}
+}
+
+func TestWebhookPermanentErrorIsNotRetried(t *testing.T) {
+	recv := newWebhookReceiver(t, http.StatusBadRequest)
+	s, _, letters := newTestDispatcher(t, recv.URL, 5)
+
+	publishStatus(s, "cmd_1", "failed")
+	select {
+	case dl := <-letters:
+		if dl.Attempts != 1 {
+			t.Fatalf("dead letter after %d attempts, want 1", dl.Attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refused delivery was not dead-lettered")
+	}
+}
+
+func TestWebhookKeepsEventsWhileEndpointIsSlow(t *testing.T) {
+	recv := newWebhookReceiver(t)
+	recv.hold = make(chan struct{})
+	s, _, letters := newTestDispatcher(t, recv.URL, 1)
+
+	// More events than an operator subscription buffers
+	const n = 2 * liveBufferSize
+	for i := 0; i < n; i++ {
+		publishStatus(s, "cmd_"+strconv.Itoa(i), "completed")
+	}
+	close(recv.hold)
+
+	got := recv.wait(n)
+	seen := make(map[string]bool, n)
+	for _, d := range got {
+		var ev liveEvent
+		json.Unmarshal(d.body, &ev)
+		seen[ev.CommandID] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("%d distinct events delivered, want %d", len(seen), n)
+	}
+	select {
+	case dl := <-letters:
+		t.Fatalf("event was dead-lettered: %+v", dl)
+	default:
+	}
+}
+
+func TestListWebhooksHidesURLPaths(t *testing.T) {
+	s, _, _ := newTestDispatcher(t, "https://hooks.example.com:8443/services/T000/B000/XXXX?token=abc", 1)
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	s.handleListWebhooks(c)
+
+	var endpoints []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &endpoints); err != nil || len(endpoints) != 1 {
+		t.Fatalf("body = %s", w.Body)
+	}
+	if url := endpoints[0]["url"]; url != "https://hooks.example.com:8443" {
+		t.Fatalf("url = %v", url)
+	}
+	if strings.Contains(w.Body.String(), "XXXX") || strings.Contains(w.Body.String(), testWebhookSecret) {
+		t.Fatalf("endpoint list leaks secrets: %s", w.Body)
+	}
+}
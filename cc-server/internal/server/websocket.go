@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// setupUpgraders builds the websocket upgraders for agents and operators
+func (s *Server) setupUpgraders() {
+	allowed := make(map[string]bool, len(s.cfg.WebSocket.AllowedOrigins))
+	for _, origin := range s.cfg.WebSocket.AllowedOrigins {
+		allowed[strings.ToLower(strings.TrimRight(origin, "/"))] = true
+	}
+
+	// Agents are never browsers, and browsers always send Origin on a
+	// websocket upgrade. Refusing any Origin keeps web pages from riding on
+	// an agent's credentials.
+	s.agentUpgrader = websocket.Upgrader{
+		HandshakeTimeout: s.cfg.WebSocket.HandshakeTimeout,
+		CheckOrigin: func(r *http.Request) bool {
+			if r.Header.Get("Origin") != "" {
+				log.Printf("Rejected browser-originated agent upgrade from %s (origin %q)", r.RemoteAddr, r.Header.Get("Origin"))
+				return false
+			}
+			return true
+		},
+	}
+
+	// Operator live views are opened from the dashboard, so the origin must
+	// be allow-listed. Without an allow-list only same-origin pages may connect.
+	s.operatorUpgrader = websocket.Upgrader{
+		HandshakeTimeout: s.cfg.WebSocket.HandshakeTimeout,
+	}
+	if len(allowed) > 0 {
+		s.operatorUpgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := strings.ToLower(r.Header.Get("Origin"))
+			if origin == "" || allowed[origin] {
+				return true
+			}
+			log.Printf("Rejected operator upgrade from disallowed origin %q", origin)
+			return false
+		}
+	}
+}
+
+// upgradeLimiter bounds the number of websocket handshakes in flight
+type upgradeLimiter struct {
+	slots chan struct{}
+}
+
+func newUpgradeLimiter(max int) *upgradeLimiter {
+	if max <= 0 {
+		return &upgradeLimiter{}
+	}
+	return &upgradeLimiter{slots: make(chan struct{}, max)}
+}
+
+func (l *upgradeLimiter) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *upgradeLimiter) release() {
+	if l.slots == nil {
+		return
+	}
+	select {
+	case <-l.slots:
+	default:
+	}
+}
+
+// Middleware holding an upgrade slot while the handshake is processed.
+// Handlers release the slot as soon as the socket is established; the
+// deferred release covers handshakes that fail before that point.
+func (s *Server) upgradeGuard(c *gin.Context) {
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Websocket upgrade required"})
+		return
+	}
+	if !s.upgrades.acquire() {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Too many concurrent upgrades"})
+		return
+	}
+
+	released := false
+	c.Set("releaseUpgrade", func() {
+		if !released {
+			released = true
+			s.upgrades.release()
+		}
+	})
+	defer func() {
+		if !released {
+			s.upgrades.release()
+		}
+	}()
+
+	c.Next()
+}
+
+// releaseUpgrade frees the upgrade slot held by upgradeGuard
+func releaseUpgrade(c *gin.Context) {
+	if release, ok := c.Get("releaseUpgrade"); ok {
+		release.(func())()
+	}
+}
+
+// liveEvent is pushed to operator live views and the event stream. ID is
+// given by the node that published the event and kept when it is relayed, so
+// a stream can be resumed on any node. It is "node:seq" in a cluster and
+// just the sequence number otherwise.
+type liveEvent struct {
+	ID        string          `json:"id,omitempty"`
+	Type      string          `json:"type"`
+	ClientID  string          `json:"client_id,omitempty"`
+	JobID     string          `json:"job_id,omitempty"`
+	CommandID string          `json:"command_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+
+	// seq is the event's position on this node, relayed events included
+	seq uint64
+}
+
+// liveBufferSize is how many events a slow operator may lag behind before
+// events are dropped for it
+const liveBufferSize = 256
+
+// liveHistorySize is how many recent events are kept for operators resuming
+// the event stream
+const liveHistorySize = 1024
+
+// liveView fans agent activity out to connected operators
+type liveView struct {
+	mu   sync.Mutex
+	subs map[chan liveEvent]*liveSubscriber
+	// sinks get every event, in order, and must not block
+	sinks []func(liveEvent)
+
+	// node prefixes the IDs of events published here; empty outside a
+	// cluster
+	node string
+	// seq is the position of the last event. It starts at the current time
+	// in microseconds, so IDs handed out before a restart stay lower.
+	seq     uint64
+	history []liveEvent
+	dropped uint64 // position of the newest event no longer in the history
+}
+
+// liveSubscriber tracks what was delivered to one subscription
+type liveSubscriber struct {
+	// lastSent is the ID of the last event delivered
+	lastSent string
+	// lossy is set once an event had to be dropped because the subscriber
+	// fell behind. It is told so before the next event it gets.
+	lossy bool
+}
+
+func newLiveView() *liveView {
+	l := &liveView{
+		subs: make(map[chan liveEvent]*liveSubscriber),
+		seq:  uint64(time.Now().UnixMicro()),
+	}
+	l.dropped = l.seq
+	return l
+}
+
+// setNode makes the IDs of events published from now on name node
+func (l *liveView) setNode(node string) {
+	l.mu.Lock()
+	l.node = node
+	l.mu.Unlock()
+}
+
+// eventID is the ID of the event published here at position seq
+func (l *liveView) eventID(seq uint64) string {
+	id := strconv.FormatUint(seq, 10)
+	if l.node == "" {
+		return id
+	}
+	return l.node + ":" + id
+}
+
+// position finds where the event with the given ID is in this node's
+// sequence. Events relayed from other nodes are found only while they are
+// in the history; events published here also when they were dropped or not
+// kept. ok is false for an ID that cannot be placed.
+func (l *liveView) position(id string) (seq uint64, ok bool) {
+	for i := len(l.history) - 1; i >= 0; i-- {
+		if l.history[i].ID == id {
+			return l.history[i].seq, true
+		}
+	}
+	local := id
+	if l.node != "" {
+		var found bool
+		if local, found = strings.CutPrefix(id, l.node+":"); !found {
+			return 0, false
+		}
+	}
+	seq, err := strconv.ParseUint(local, 10, 64)
+	if err != nil || seq > l.seq {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (l *liveView) subscribe() chan liveEvent {
+	ch, _, _ := l.subscribeSince("")
+	return ch
+}
+
+// subscribeSince subscribes to new events and returns the kept events after
+// lastID, oldest first. complete is false when events after lastID were
+// already dropped from the history, or when lastID is not known here: then
+// nothing is replayed, since which events came after it cannot be told. An
+// empty lastID replays nothing.
+func (l *liveView) subscribeSince(lastID string) (ch chan liveEvent, backlog []liveEvent, complete bool) {
+	ch = make(chan liveEvent, liveBufferSize)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subs[ch] = &liveSubscriber{lastSent: l.eventID(l.seq)}
+
+	if lastID == "" {
+		return ch, nil, true
+	}
+	seq, ok := l.position(lastID)
+	if !ok {
+		return ch, nil, false
+	}
+	complete = seq >= l.dropped
+	for _, ev := range l.history {
+		if ev.seq > seq {
+			backlog = append(backlog, ev)
+		}
+	}
+	return ch, backlog, complete
+}
+
+// addSink passes every event published from now on to sink, which must
+// not block. Unlike a subscription it is never skipped.
+func (l *liveView) addSink(sink func(liveEvent)) {
+	l.mu.Lock()
+	l.sinks = append(l.sinks, sink)
+	l.mu.Unlock()
+}
+
+func (l *liveView) unsubscribe(ch chan liveEvent) {
+	l.mu.Lock()
+	delete(l.subs, ch)
+	l.mu.Unlock()
+}
+
+// publish delivers ev to every subscriber without blocking on slow ones. A
+// subscriber that missed events gets an events_lost event naming the last
+// one it did get, so it can resume from there, before anything new.
+func (l *liveView) publish(ev liveEvent) {
+	ev.Timestamp = time.Now()
+	l.fanOut(ev, true)
+}
+
+// relay delivers an event another node published. It keeps its timestamp
+// and ID, but skips the sinks, which that node already ran.
+func (l *liveView) relay(ev liveEvent) {
+	l.fanOut(ev, false)
+}
+
+func (l *liveView) fanOut(ev liveEvent, sinks bool) {
+	if ev.Data != nil && !json.Valid(ev.Data) {
+		ev.Data = nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	ev.seq = l.seq
+	if sinks || ev.ID == "" {
+		ev.ID = l.eventID(l.seq)
+	}
+
+	// Raw agent messages are mostly heartbeats; keeping them would push
+	// everything else out of the history
+	if ev.Type != eventAgentMessage {
+		l.history = append(l.history, ev)
+		if len(l.history) > 2*liveHistorySize {
+			cut := len(l.history) - liveHistorySize
+			l.dropped = l.history[cut-1].seq
+			l.history = append([]liveEvent(nil), l.history[cut:]...)
+		}
+	}
+
+	if sinks {
+		for _, sink := range l.sinks {
+			sink(ev)
+		}
+	}
+
+	// Only publish sends on the channels, under l.mu, so the room seen
+	// here cannot shrink before the sends
+	for ch, sub := range l.subs {
+		if sub.lossy {
+			if cap(ch)-len(ch) < 2 {
+				continue
+			}
+			ch <- liveEvent{
+				Type:      eventLost,
+				Data:      eventData(map[string]interface{}{"last_event_id": sub.lastSent}),
+				Timestamp: ev.Timestamp,
+			}
+			sub.lossy = false
+		}
+		select {
+		case ch <- ev:
+			sub.lastSent = ev.ID
+		default:
+			sub.lossy = true
+		}
+	}
+}
+
+// WebSocket handler for operator live views
+func (s *Server) handleOperatorSocket(c *gin.Context) {
+	conn, err := s.operatorUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Operator WebSocket upgrade error: %v", err)
+		return
+	}
+	releaseUpgrade(c)
+	defer conn.Close()
+
+	events := s.live.subscribe()
+	defer s.live.unsubscribe(events)
+
+	// Operators only listen; the read loop just notices when they leave
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case ev := <-events:
+			if err := conn.WriteJSON(ev); err != nil {
+				log.Printf("Failed to send live event to operator: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newUpgradeServer serves the agent and operator upgraders of a server with
+// cfg on /agent and /operator
+func newUpgradeServer(t *testing.T, cfg WebSocketConfig) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	s := &Server{cfg: Config{WebSocket: cfg}}
+	s.setupUpgraders()
+
+	upgrade := func(u *websocket.Upgrader) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			conn, err := u.Upgrade(c.Writer, c.Request, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}
+	router := gin.New()
+	router.GET("/agent", upgrade(&s.agentUpgrader))
+	router.GET("/operator", upgrade(&s.operatorUpgrader))
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialStatus opens a websocket to path with the given Origin, if any, and
+// returns the HTTP status of the handshake
+func dialStatus(t *testing.T, srv *httptest.Server, path, origin string) int {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAgentUpgradeRejectsBrowsers(t *testing.T) {
+	srv := newUpgradeServer(t, WebSocketConfig{AllowedOrigins: []string{"https://dash.example.com"}})
+
+	if got := dialStatus(t, srv, "/agent", ""); got != http.StatusSwitchingProtocols {
+		t.Fatalf("agent upgrade without Origin: %d", got)
+	}
+	// Not even an origin allowed for operators may open an agent socket
+	for _, origin := range []string{"https://dash.example.com", srv.URL} {
+		if got := dialStatus(t, srv, "/agent", origin); got != http.StatusForbidden {
+			t.Errorf("agent upgrade from %s: %d, want %d", origin, got, http.StatusForbidden)
+		}
+	}
+}
+
+func TestOperatorUpgradeOrigins(t *testing.T) {
+	srv := newUpgradeServer(t, WebSocketConfig{AllowedOrigins: []string{"https://Dash.example.com/"}})
+	for origin, want := range map[string]int{
+		"":                         http.StatusSwitchingProtocols,
+		"https://dash.example.com": http.StatusSwitchingProtocols,
+		"https://DASH.example.com": http.StatusSwitchingProtocols,
+		"http://dash.example.com":  http.StatusForbidden,
+		"https://evil.example.com": http.StatusForbidden,
+		srv.URL:                    http.StatusForbidden,
+	} {
+		if got := dialStatus(t, srv, "/operator", origin); got != want {
+			t.Errorf("operator upgrade from %q: %d, want %d", origin, got, want)
+		}
+	}
+
+	// Without an allow-list only the server's own origin may connect
+	srv = newUpgradeServer(t, WebSocketConfig{})
+	for origin, want := range map[string]int{
+		"":                         http.StatusSwitchingProtocols,
+		srv.URL:                    http.StatusSwitchingProtocols,
+		"https://dash.example.com": http.StatusForbidden,
+	} {
+		if got := dialStatus(t, srv, "/operator", origin); got != want {
+			t.Errorf("same-origin operator upgrade from %q: %d, want %d", origin, got, want)
+		}
+	}
+}
+
+func TestUpgradeLimiter(t *testing.T) {
+	l := newUpgradeLimiter(2)
+	if !l.acquire() || !l.acquire() {
+		t.Fatal("limiter refused a free slot")
+	}
+	if l.acquire() {
+		t.Fatal("limiter handed out a third slot")
+	}
+	l.release()
+	if !l.acquire() {
+		t.Fatal("released slot was not handed out again")
+	}
+
+	// Releasing more than was acquired does not block or add slots
+	l.release()
+	l.release()
+	l.release()
+	if !l.acquire() || !l.acquire() || l.acquire() {
+		t.Fatal("extra releases changed the number of slots")
+	}
+
+	unlimited := newUpgradeLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.acquire() {
+			t.Fatal("limiter without a maximum refused an upgrade")
+		}
+	}
+	unlimited.release()
+}
+
+func TestUpgradeGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &Server{upgrades: newUpgradeLimiter(1)}
+	entered, release, released, finish := make(chan struct{}), make(chan struct{}), make(chan struct{}), make(chan struct{})
+
+	router := gin.New()
+	// A handshake that frees its slot once the socket would be established
+	router.GET("/hold", s.upgradeGuard, func(c *gin.Context) {
+		close(entered)
+		<-release
+		releaseUpgrade(c)
+		releaseUpgrade(c)
+		close(released)
+		<-finish
+		c.Status(http.StatusOK)
+	})
+	// A handshake that fails without releasing its slot
+	router.GET("/fail", s.upgradeGuard, func(c *gin.Context) {
+		c.Status(http.StatusInternalServerError)
+	})
+
+	get := func(path string, upgrade bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/fail", false); w.Code != http.StatusBadRequest {
+		t.Fatalf("plain request: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	held := make(chan int)
+	go func() { held <- get("/hold", true).Code }()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake never started")
+	}
+
+	w := get("/fail", true)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("upgrade beyond the limit: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The slot is free once released, while the socket is still open
+	close(release)
+	<-released
+	for i := 0; i < 3; i++ {
+		if w := get("/fail", true); w.Code != http.StatusInternalServerError {
+			t.Fatalf("upgrade %d after release: %d, want the handler's %d", i+1, w.Code, http.StatusInternalServerError)
+		}
+	}
+
+	close(finish)
+	if code := <-held; code != http.StatusOK {
+		t.Fatalf("held handshake: %d", code)
+	}
+	if !s.upgrades.acquire() {
+		t.Fatal("slot released twice by one handshake was lost")
+	}
+}
+
+func TestLiveViewMarksSlowSubscriberLossy(t *testing.T) {
+	l := newLiveView()
+	ch := l.subscribe()
+	defer l.unsubscribe(ch)
+
+	// Fill the buffer, then drop two events
+	for i := 0; i < liveBufferSize+2; i++ {
+		l.publish(liveEvent{Type: eventCommandStatus})
+	}
+	var lastSent string
+	for i := 0; i < liveBufferSize; i++ {
+		lastSent = (<-ch).ID
+	}
+
+	l.publish(liveEvent{Type: eventJobStatus})
+	lost := <-ch
+	if lost.Type != eventLost {
+		t.Fatalf("first event after the gap is %q, want %q", lost.Type, eventLost)
+	}
+	var data struct {
+		LastEventID string `json:"last_event_id"`
+	}
+	if err := json.Unmarshal(lost.Data, &data); err != nil || data.LastEventID != lastSent {
+		t.Fatalf("events_lost data = %s, want last_event_id %s", lost.Data, lastSent)
+	}
+	if ev := <-ch; ev.Type != eventJobStatus {
+		t.Fatalf("event after events_lost is %q, want %q", ev.Type, eventJobStatus)
+	}
+
+	// Once caught up nothing more is reported lost
+	l.publish(liveEvent{Type: eventCommandStatus})
+	if ev := <-ch; ev.Type != eventCommandStatus {
+		t.Fatalf("got %q, want %q", ev.Type, eventCommandStatus)
+	}
+
+	// The missed events can be fetched from the history
+	_, backlog, complete := l.subscribeSince(data.LastEventID)
+	last, _ := strconv.ParseUint(data.LastEventID, 10, 64)
+	if !complete || len(backlog) != 4 || backlog[0].ID != strconv.FormatUint(last+1, 10) {
+		t.Fatalf("backlog after %s: %d events, complete %v", data.LastEventID, len(backlog), complete)
+	}
+}
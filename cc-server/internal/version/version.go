@@ -0,0 +1,82 @@
+package version
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Build metadata. These are overwritten at link time by build.sh, e.g.
+// -ldflags "-X github.com/user/cc-server/internal/version.Version=v1.2.0"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Protocol is the wire protocol version spoken by this build. It is bumped
+// whenever the server and agent message formats change incompatibly.
+const Protocol = 2
+
+// MinProtocol is the oldest agent protocol the server still accepts.
+const MinProtocol = 1
+
+// Info describes the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	Protocol  int    `json:"protocol"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build metadata of the running binary
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		Protocol:  Protocol,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String returns a one-line human readable version string
+func (i Info) String() string {
+	return i.Version + " (commit " + i.Commit + ", built " + i.BuildDate + ", protocol " + strconv.Itoa(i.Protocol) + ")"
+}
+
+// Compare compares two dotted version strings such as "v1.4.2".
+// It returns -1, 0 or 1. Non-numeric parts (including "dev") compare as 0,
+// so development builds are never considered older than a release.
+func Compare(a, b string) int {
+	if a == "dev" || b == "dev" {
+		return 0
+	}
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		na, nb := versionPart(pa, i), versionPart(pb, i)
+		if na < nb {
+			return -1
+		}
+		if na > nb {
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionPart returns the numeric value of the i-th component, ignoring any
+// pre-release suffix ("3-rc1" -> 3)
+func versionPart(parts []string, i int) int {
+	if i >= len(parts) {
+		return 0
+	}
+	p := parts[i]
+	if idx := strings.IndexAny(p, "-+"); idx >= 0 {
+		p = p[:idx]
+	}
+	n, _ := strconv.Atoi(p)
+	return n
+}